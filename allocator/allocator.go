@@ -0,0 +1,657 @@
+// Package allocator allocates ranges of IP addresses from a pool.
+//
+// Ranges of IP addresses are represented using CIDR notation and are managed
+// like a buddy memory allocator: allocating splits the smallest big-enough free
+// range in halves until it has the requested size, and deallocating
+// aggressively merges free ranges with their buddy (see cidr.CIDR.Other).
+package allocator
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+// Allocator allocates ranges of IP addresses from a single pool.
+// An Allocator is safe for concurrent use.
+type Allocator struct {
+	logger      zerolog.Logger
+	now         func() time.Time
+	observer    Observer
+	poolID      int
+	retryPolicy RetryPolicy
+	s           storage.Storage
+	tracer      trace.Tracer
+}
+
+// Option configures an Allocator.
+type Option func(a *Allocator)
+
+// WithClock sets the function that returns the current time, which is used for leases. Defaults to time.Now.
+func WithClock(now func() time.Time) Option {
+	return func(a *Allocator) {
+		a.now = now
+	}
+}
+
+// WithLogger sets the logger. Defaults to the global zerolog logger.
+func WithLogger(logger zerolog.Logger) Option {
+	return func(a *Allocator) {
+		a.logger = logger
+	}
+}
+
+// WithPoolID sets the identifier of the pool to allocate from. Defaults to 1.
+func WithPoolID(poolID int) Option {
+	return func(a *Allocator) {
+		a.poolID = poolID
+	}
+}
+
+// WithRetryPolicy sets the policy for retrying transactions. Defaults to DefaultRetryPolicy().
+func WithRetryPolicy(retryPolicy RetryPolicy) Option {
+	return func(a *Allocator) {
+		a.retryPolicy = retryPolicy
+	}
+}
+
+type allocateOptions struct {
+	labels map[string]string
+	ttl    time.Duration
+}
+
+// AllocateOption is an option of Allocate, AllocateDualStack and AllocateSpecific.
+type AllocateOption func(*allocateOptions)
+
+func newAllocateOptions(opts []AllocateOption) (o allocateOptions, err error) {
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.ttl < 0 {
+		err = fmt.Errorf(`lease ttl must be positive but got %v`, o.ttl)
+		return
+	}
+	err = checkLabels(o.labels)
+	return
+}
+
+// claim allocates record to requestID, with the labels of o and a lease if o has a TTL.
+func (o allocateOptions) claim(record *storage.Record, requestID string, now time.Time) {
+	record.RequestID = requestID
+	record.Labels = o.labels
+	record.ExpiresAt = nil
+	if o.ttl > 0 {
+		expiresAt := now.Add(o.ttl).UTC()
+		record.ExpiresAt = &expiresAt
+	}
+}
+
+// New returns an Allocator that stores ranges of IP addresses in s.
+func New(s storage.Storage, opts ...Option) *Allocator {
+	a := &Allocator{
+		logger:      log.Logger,
+		now:         time.Now,
+		poolID:      1,
+		retryPolicy: DefaultRetryPolicy(),
+		s:           s,
+		tracer:      otel.GetTracerProvider().Tracer(tracerName),
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+	return a
+}
+
+// PoolID returns the identifier of the pool a allocates from.
+func (a *Allocator) PoolID() int {
+	return a.poolID
+}
+
+// Allocate allocates a range of IP addresses of address family family to the object identified as requestID.
+// The size of the range is specified as prefixBits (the number to the right of the
+// slash in CIDR notation).
+// The smallest big-enough free range is found, split if needed, and allocated in a single transaction.
+//
+// requestID identifies the request and is needed to reliably allocate in case of transient errors.
+// Calls to Allocate with the same requestID and family are idempotent.
+// A requestID can be allocated at most one range per address family.
+//
+// The range is allocated without a lease, unless the option WithLease is given.
+//
+// Returns ErrPoolExhausted if there is no big-enough free range, ErrPoolNotFound if the pool does not exist,
+// and a *RequestConflictError if requestID was previously allocated a range of a different size.
+func (a *Allocator) Allocate(ctx context.Context, family cidr.Family, prefixBits int, requestID string,
+	opts ...AllocateOption) (c cidr.CIDR, err error) {
+	ctx, end := a.measure(ctx, &err, attributePoolID.Int(a.poolID), attributeRequestID.String(requestID),
+		attributeFamily.Int(int(family)), attributePrefixLength.Int(prefixBits))
+	defer end()
+	if err = checkPrefixBits(family, prefixBits); err != nil {
+		return
+	}
+	o, err := newAllocateOptions(opts)
+	if err != nil {
+		return
+	}
+	err = a.retry(ctx, func(ctx context.Context) (err error) {
+		c, err = a.allocate(ctx, family, prefixBits, requestID, o)
+		return
+	})
+	return
+}
+
+func (a *Allocator) allocate(ctx context.Context, family cidr.Family, prefixBits int, requestID string,
+	o allocateOptions) (c cidr.CIDR, err error) {
+	records, err := a.lookup(ctx, requestID)
+	if err != nil {
+		return
+	}
+	if record := findFamily(records, family); record != nil {
+		return checkPrevious(*record, prefixBits)
+	}
+	err = a.doTransaction(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	}, func(tx storage.Transaction) (err error) {
+		c, err = a.allocateInTx(ctx, tx, family, prefixBits, requestID, o)
+		return
+	})
+	return
+}
+
+// allocateInTx allocates a range of IP addresses to requestID using tx. See Allocate.
+func (a *Allocator) allocateInTx(ctx context.Context, tx storage.Transaction, family cidr.Family, prefixBits int,
+	requestID string, o allocateOptions) (c cidr.CIDR, err error) {
+	record, err := tx.FindSmallestFree(ctx, a.poolID, family, prefixBits)
+	if err != nil {
+		return
+	}
+	if record == nil {
+		err = a.checkPoolExists(ctx, tx, fmt.Errorf(`%w: no free %v range of prefixBits=%d or larger`, ErrPoolExhausted, family,
+			prefixBits))
+		return
+	}
+	if record.C.PrefixBits > prefixBits || record.C.Family() != family {
+		err = errors.New("bug in code: FindSmallestFree returned record with a range of IP addresses that is smaller than the requested " +
+			"minimal size, or of the wrong address family")
+		return
+	}
+	recordOldPrefixBits := record.C.PrefixBits
+	var events []storage.Event
+	if record.C.PrefixBits < prefixBits {
+		events = append(events, a.event(ctx, storage.EventSplit, *record))
+	}
+	var newRecords []storage.Record
+	for record.C.PrefixBits < prefixBits {
+		// Split the range of IP addresses into two.
+
+		// Add a new record for the upper half.
+		newRecords = append(newRecords, storage.Record{
+			C:      record.C.Split(),
+			PoolID: a.poolID,
+		})
+
+		// Update record to be the lower half.
+		record.C.PrefixBits++
+	}
+	o.claim(record, requestID, a.now())
+	if recordOldPrefixBits != record.C.PrefixBits {
+		recordOldC := record.C
+		recordOldC.PrefixBits = recordOldPrefixBits
+		err = tx.Delete(ctx, record.PoolID, recordOldC)
+		if err != nil {
+			return
+		}
+		newRecords = append(newRecords, *record)
+	} else {
+		err = tx.Update(ctx, *record)
+		if err != nil {
+			return
+		}
+	}
+	err = tx.InsertMany(ctx, newRecords)
+	if err != nil {
+		return
+	}
+	err = tx.InsertEvents(ctx, append(events, a.event(ctx, storage.EventAllocate, *record)))
+	if err != nil {
+		return
+	}
+	c = record.C
+	return
+}
+
+// AllocateDualStack allocates an IPv4 range of IP addresses of size v4PrefixBits and an IPv6 range of IP addresses
+// of size v6PrefixBits to the object identified as requestID, atomically in a single transaction.
+//
+// Calls to AllocateDualStack with the same requestID are idempotent. If requestID was previously allocated a range
+// of only one address family (see Allocate) then only a range of the other address family is allocated.
+//
+// Returns the same errors as Allocate.
+func (a *Allocator) AllocateDualStack(ctx context.Context, v4PrefixBits, v6PrefixBits int, requestID string,
+	opts ...AllocateOption) (v4, v6 cidr.CIDR, err error) {
+	ctx, end := a.measure(ctx, &err, attributePoolID.Int(a.poolID), attributeRequestID.String(requestID),
+		attributeIPv4PrefixLength.Int(v4PrefixBits), attributeIPv6PrefixLength.Int(v6PrefixBits))
+	defer end()
+	if err = checkPrefixBits(cidr.IPv4, v4PrefixBits); err != nil {
+		return
+	}
+	if err = checkPrefixBits(cidr.IPv6, v6PrefixBits); err != nil {
+		return
+	}
+	o, err := newAllocateOptions(opts)
+	if err != nil {
+		return
+	}
+	err = a.retry(ctx, func(ctx context.Context) (err error) {
+		v4, v6, err = a.allocateDualStack(ctx, v4PrefixBits, v6PrefixBits, requestID, o)
+		return
+	})
+	return
+}
+
+func (a *Allocator) allocateDualStack(ctx context.Context, v4PrefixBits, v6PrefixBits int, requestID string,
+	o allocateOptions) (v4, v6 cidr.CIDR, err error) {
+	records, err := a.lookup(ctx, requestID)
+	if err != nil {
+		return
+	}
+	v4Record := findFamily(records, cidr.IPv4)
+	if v4Record != nil {
+		v4, err = checkPrevious(*v4Record, v4PrefixBits)
+		if err != nil {
+			return
+		}
+	}
+	v6Record := findFamily(records, cidr.IPv6)
+	if v6Record != nil {
+		v6, err = checkPrevious(*v6Record, v6PrefixBits)
+		if err != nil {
+			return
+		}
+	}
+	if v4Record != nil && v6Record != nil {
+		return
+	}
+	err = a.doTransaction(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	}, func(tx storage.Transaction) (err error) {
+		if v4Record == nil {
+			v4, err = a.allocateInTx(ctx, tx, cidr.IPv4, v4PrefixBits, requestID, o)
+			if err != nil {
+				return
+			}
+		}
+		if v6Record == nil {
+			v6, err = a.allocateInTx(ctx, tx, cidr.IPv6, v6PrefixBits, requestID, o)
+		}
+		return
+	})
+	return
+}
+
+// checkPrefixBits returns an error if prefixBits is not a valid prefix length for family.
+func checkPrefixBits(family cidr.Family, prefixBits int) error {
+	if family.Bits() == 0 {
+		return fmt.Errorf(`invalid address family %v`, family)
+	}
+	if prefixBits < 0 || prefixBits > family.Bits() {
+		return fmt.Errorf(`prefixBits=%d is invalid for %v`, prefixBits, family)
+	}
+	return nil
+}
+
+// checkPrevious returns the range of IP addresses of record, which was previously allocated,
+// or a *RequestConflictError if it does not have size prefixBits.
+func checkPrevious(record storage.Record, prefixBits int) (cidr.CIDR, error) {
+	if record.C.PrefixBits != prefixBits {
+		return cidr.CIDR{}, &RequestConflictError{
+			RequestID:           record.RequestID,
+			Previous:            record.C,
+			PreviousPrefixBits:  record.C.PrefixBits,
+			RequestedPrefixBits: prefixBits,
+		}
+	}
+	return record.C, nil
+}
+
+// findFamily returns the record of address family family, or nil if there is no such record.
+// Records that are being moved to (see ApplyDefrag) are ignored.
+func findFamily(records []storage.Record, family cidr.Family) *storage.Record {
+	for i := range records {
+		if records[i].C.Family() == family && records[i].MovedFrom == nil {
+			return &records[i]
+		}
+	}
+	return nil
+}
+
+// AllocateSpecific allocates the range of IP addresses c to the object identified as requestID.
+// The free range that contains c is found, split along the path down to c, and c is allocated, in a single transaction.
+//
+// Calls to AllocateSpecific with the same requestID are idempotent.
+//
+// Returns ErrRangeUnavailable if c overlaps a range allocated to another object, ErrRangeNotInPool if c is not
+// contained in a single range of the pool, ErrPoolNotFound if the pool does not exist, and a *RequestConflictError if
+// requestID was previously allocated a different range.
+func (a *Allocator) AllocateSpecific(ctx context.Context, c cidr.CIDR, requestID string, opts ...AllocateOption) (err error) {
+	ctx, end := a.measure(ctx, &err, attributePoolID.Int(a.poolID), attributeRequestID.String(requestID),
+		attributeCIDR.String(c.String()), attributePrefixLength.Int(c.PrefixBits))
+	defer end()
+	if !c.IsValid() {
+		return fmt.Errorf(`AllocateSpecific: invalid CIDR %s`, c)
+	}
+	o, err := newAllocateOptions(opts)
+	if err != nil {
+		return
+	}
+	return a.retry(ctx, func(ctx context.Context) error {
+		return a.allocateSpecific(ctx, c, requestID, o)
+	})
+}
+
+func (a *Allocator) allocateSpecific(ctx context.Context, c cidr.CIDR, requestID string, o allocateOptions) (err error) {
+	records, err := a.lookup(ctx, requestID)
+	if err != nil {
+		return
+	}
+	if record := findFamily(records, c.Family()); record != nil {
+		if !record.C.Equal(c) {
+			err = &RequestConflictError{
+				RequestID:           requestID,
+				Previous:            record.C,
+				PreviousPrefixBits:  record.C.PrefixBits,
+				Requested:           &c,
+				RequestedPrefixBits: c.PrefixBits,
+			}
+		}
+		return
+	}
+	return a.doTransaction(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	}, func(tx storage.Transaction) error {
+		return a.allocateSpecificInTx(ctx, tx, c, func(record *storage.Record) {
+			o.claim(record, requestID, a.now())
+		})
+	})
+}
+
+// allocateSpecificInTx allocates the range of IP addresses c using tx, calling claim to set the fields of the record
+// of c that make it allocated. See AllocateSpecific.
+func (a *Allocator) allocateSpecificInTx(ctx context.Context, tx storage.Transaction, c cidr.CIDR,
+	claim func(record *storage.Record)) (err error) {
+	records, err := tx.FindOverlapping(ctx, a.poolID, c)
+	if err != nil {
+		return
+	}
+	for _, overlapping := range records {
+		if overlapping.RequestID != "" {
+			return fmt.Errorf(`%w: %s is allocated to requestID=%#v`, ErrRangeUnavailable, overlapping.C, overlapping.RequestID)
+		}
+		if overlapping.Retired {
+			return fmt.Errorf(`%w: %s is retired`, ErrRangeUnavailable, overlapping.C)
+		}
+	}
+	if len(records) != 1 || !records[0].C.Contains(c) {
+		return a.checkPoolExists(ctx, tx, fmt.Errorf(`%w: %s`, ErrRangeNotInPool, c))
+	}
+	record := records[0]
+	if record.C.Equal(c) {
+		claim(&record)
+		if err = tx.Update(ctx, record); err != nil {
+			return
+		}
+		return tx.InsertEvents(ctx, []storage.Event{a.event(ctx, storage.EventAllocate, record)})
+	}
+	err = tx.Delete(ctx, record.PoolID, record.C)
+	if err != nil {
+		return
+	}
+	events := []storage.Event{a.event(ctx, storage.EventSplit, record)}
+	newRecords := splitDown(&record, c)
+	claim(&record)
+	newRecords = append(newRecords, record)
+	if err = tx.InsertMany(ctx, newRecords); err != nil {
+		return
+	}
+	return tx.InsertEvents(ctx, append(events, a.event(ctx, storage.EventAllocate, record)))
+}
+
+// splitDown splits the range of IP addresses of record along the path down to c, which record.C must contain.
+// Sets record.C to c, and returns records for the halves split off along the way, which do not contain c.
+// The returned records are free, and are retired if and only if record is retired.
+func splitDown(record *storage.Record, c cidr.CIDR) (newRecords []storage.Record) {
+	for record.C.PrefixBits < c.PrefixBits {
+		// Split the range of IP addresses into two, add a new record for the half that does not contain c,
+		// and continue with the half that contains c.
+		upper := record.C.Split()
+		lower := cidr.CIDR{IP: record.C.IP, PrefixBits: upper.PrefixBits}
+		other := upper
+		if upper.Contains(c) {
+			other = lower
+			record.C = upper
+		} else {
+			record.C = lower
+		}
+		newRecords = append(newRecords, storage.Record{C: other, PoolID: record.PoolID, Retired: record.Retired})
+	}
+	return
+}
+
+// Deallocate deallocates the ranges of IP addresses allocated to the object identified as requestID
+// (at most one per address family), and returns the deallocated ranges.
+// The ranges are aggressively merged with free ranges, in a single transaction.
+// If no range is allocated to requestID then returns ErrNotFound, or ErrPoolNotFound if the pool does not exist.
+func (a *Allocator) Deallocate(ctx context.Context, requestID string) (cs []cidr.CIDR, err error) {
+	ctx, end := a.measure(ctx, &err, attributePoolID.Int(a.poolID), attributeRequestID.String(requestID))
+	defer end()
+	err = a.retry(ctx, func(ctx context.Context) (err error) {
+		cs, err = a.deallocate(ctx, requestID)
+		return
+	})
+	return
+}
+
+func (a *Allocator) deallocate(ctx context.Context, requestID string) (cs []cidr.CIDR, err error) {
+	records, err := a.lookup(ctx, requestID)
+	if err != nil {
+		return
+	}
+	if len(records) == 0 {
+		err = a.notFound(ctx)
+		return
+	}
+	err = a.doTransaction(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	}, func(tx storage.Transaction) (err error) {
+		for _, record := range records {
+			err = a.release(ctx, tx, record)
+			if err != nil {
+				return
+			}
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	for _, record := range records {
+		cs = append(cs, record.C)
+	}
+	return
+}
+
+// release deallocates the allocated record and its host addresses, and aggressively merges it with free records (see
+// insertFree).
+func (a *Allocator) release(ctx context.Context, tx storage.Transaction, record storage.Record) error {
+	events, err := a.hostReleaseEvents(ctx, tx, record.PoolID, record.C)
+	if err != nil {
+		return err
+	}
+	if err := tx.Delete(ctx, record.PoolID, record.C); err != nil {
+		return err
+	}
+	if err := tx.InsertEvents(ctx, append(events, a.event(ctx, storage.EventRelease, record))); err != nil {
+		return err
+	}
+	record.RequestID = ""
+	record.ExpiresAt = nil
+	record.Labels = nil
+	return a.insertFree(ctx, tx, record)
+}
+
+// insertFree inserts a free record, after aggressively merging it with free records.
+// The record is merged with the record for the CIDR paired with it (see cidr.CIDR.Other)
+// if that record exists, is free, and is retired if and only if the record is retired.
+// This repeats for the merged record until no more merging is possible.
+// If the record was merged then a merge event of the resulting range is inserted.
+func (a *Allocator) insertFree(ctx context.Context, tx storage.Transaction, record storage.Record) error {
+	prefixBits := record.C.PrefixBits
+	for record.C.PrefixBits > 0 {
+		record2, err := tx.Get(ctx, record.PoolID, record.C.Other())
+		if err != nil {
+			return err
+		}
+		if record2 == nil {
+			// The CIDR that we can merge with has been subdivided.
+			break
+		}
+		if record2.RequestID != "" {
+			// The CIDR that we can merge has been allocated to an object.
+			break
+		}
+		if record2.Retired != record.Retired {
+			break
+		}
+		if err := tx.Delete(ctx, record2.PoolID, record2.C); err != nil {
+			return err
+		}
+		record.C = record.C.Supernet(record.C.PrefixBits - 1)
+	}
+	records := [...]storage.Record{record}
+	if err := tx.InsertMany(ctx, records[:]); err != nil {
+		return err
+	}
+	if record.C.PrefixBits == prefixBits {
+		return nil
+	}
+	return tx.InsertEvents(ctx, []storage.Event{a.event(ctx, storage.EventMerge, record)})
+}
+
+// Lookup finds the records allocated to the object identified as requestID (at most one per address family, except
+// while a range is being moved, see ApplyDefrag), ordered by address family (IPv4 first).
+// If no such records exist then returns ErrNotFound, or ErrPoolNotFound if the pool does not exist.
+func (a *Allocator) Lookup(ctx context.Context, requestID string) (records []storage.Record, err error) {
+	ctx, end := a.measure(ctx, &err, attributePoolID.Int(a.poolID), attributeRequestID.String(requestID))
+	defer end()
+	err = a.retry(ctx, func(ctx context.Context) (err error) {
+		records, err = a.lookup(ctx, requestID)
+		if err == nil && len(records) == 0 {
+			err = a.notFound(ctx)
+		}
+		return
+	})
+	return
+}
+
+func (a *Allocator) lookup(ctx context.Context, requestID string) (records []storage.Record, err error) {
+	err = a.doTransaction(ctx, &sql.TxOptions{
+		ReadOnly:  true,
+		Isolation: sql.LevelReadUncommitted,
+	}, func(tx storage.Transaction) (err error) {
+		records, err = tx.FindAllocated(ctx, a.poolID, requestID)
+		return
+	})
+	return
+}
+
+// checkPoolExists returns ErrPoolNotFound if the pool does not exist, and errIfExists otherwise.
+func (a *Allocator) checkPoolExists(ctx context.Context, tx storage.Transaction, errIfExists error) error {
+	pool, err := tx.GetPool(ctx, a.poolID)
+	if err != nil {
+		return err
+	}
+	if pool == nil {
+		return ErrPoolNotFound
+	}
+	return errIfExists
+}
+
+// notFound returns ErrPoolNotFound if the pool does not exist, and ErrNotFound otherwise.
+func (a *Allocator) notFound(ctx context.Context) (err error) {
+	err = a.doTransaction(ctx, &sql.TxOptions{
+		ReadOnly:  true,
+		Isolation: sql.LevelReadUncommitted,
+	}, func(tx storage.Transaction) error {
+		return a.checkPoolExists(ctx, tx, nil)
+	})
+	if err == nil {
+		err = ErrNotFound
+	}
+	return
+}
+
+// doTransaction calls f in a transaction. The transaction is committed if f returns nil,
+// and rolled back otherwise.
+func (a *Allocator) doTransaction(ctx context.Context, txOpts *sql.TxOptions, f func(tx storage.Transaction) error) (err error) {
+	ctx, end := startSpan(ctx, a.tracer, "storage.Transaction", &err, transactionAttributes(txOpts)...)
+	defer end()
+	tx, err := a.s.BeginTransaction(ctx, txOpts)
+	if err != nil {
+		return
+	}
+	tx = &tracedTransaction{ctx: ctx, tracer: a.tracer, tx: tx}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				a.logger.Error().Err(rollbackErr).Msg("error rolling back tx")
+			}
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	err = f(tx)
+	return
+}
+
+// measure starts a span for the calling method with attributes attrs, and returns the context of the span and
+// a function that ends the span, logs the duration of the method and reports it to the observer, along with *err.
+// Usage:
+//
+//	ctx, end := a.measure(ctx, &err, attrs...)
+//	defer end()
+func (a *Allocator) measure(ctx context.Context, err *error, attrs ...attribute.KeyValue) (context.Context, func()) {
+	var funcName string
+	if pc, _, _, ok := runtime.Caller(1); ok {
+		if funcInfo := runtime.FuncForPC(pc); funcInfo != nil {
+			funcName = funcInfo.Name()
+		}
+	}
+	// funcName is of the form ".../allocator.(*Allocator).Allocate".
+	operation := funcName[strings.LastIndexByte(funcName, '.')+1:]
+	start := time.Now()
+	ctx, endSpan := startSpan(ctx, a.tracer, "allocator."+operation, err, attrs...)
+	return ctx, func() {
+		endSpan()
+		elapsed := time.Since(start)
+		a.logger.Debug().Dur("t", elapsed).Msgf("%s", funcName)
+		if a.observer != nil {
+			a.observer.ObserveOperation(operation, elapsed, *err)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package allocator
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+	"github.com/jbrekelmans/go-sql-ip-management/storage/memory"
+)
+
+// testAllocator returns an Allocator for pool 1, which initially has the free ranges roots.
+func testAllocator(t *testing.T, roots ...string) (*Allocator, *memory.MemoryStorage) {
+	t.Helper()
+	s := memory.NewMemoryStorage(storage.Pool{ID: 1, Name: "pool1"})
+	var records []storage.Record
+	for _, root := range roots {
+		records = append(records, storage.Record{PoolID: 1, C: cidr.MustParseCIDR(root)})
+	}
+	tx, err := s.BeginTransaction(context.Background(), nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.InsertMany(context.Background(), records))
+	require.NoError(t, tx.Commit())
+	retryPolicy := DefaultRetryPolicy()
+	retryPolicy.MaxAttempts = 1000
+	retryPolicy.InitialBackoff = 0
+	return New(s, WithLogger(zerolog.Nop()), WithRetryPolicy(retryPolicy)), s
+}
+
+// testGet gets the record identified by c from s.
+func testGet(t *testing.T, s storage.Storage, c string) *storage.Record {
+	t.Helper()
+	tx, err := s.BeginTransaction(context.Background(), nil)
+	require.NoError(t, err)
+	defer func() {
+		require.NoError(t, tx.Rollback())
+	}()
+	record, err := tx.Get(context.Background(), 1, cidr.MustParseCIDR(c))
+	require.NoError(t, err)
+	return record
+}
+
+func Test_Allocator(t *testing.T) {
+	ctx := context.Background()
+	t.Run("Allocate", func(t *testing.T) {
+		a, s := testAllocator(t, "10.0.0.0/16")
+		c, err := a.Allocate(ctx, cidr.IPv4, 18, "a")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.0/18", c.String())
+		c, err = a.Allocate(ctx, cidr.IPv4, 17, "b")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.128.0/17", c.String())
+		c, err = a.Allocate(ctx, cidr.IPv4, 18, "c")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.64.0/18", c.String())
+		assert.Equal(t, &storage.Record{PoolID: 1, C: cidr.MustParseCIDR("10.0.64.0/18"), RequestID: "c"}, testGet(t, s, "10.0.64.0/18"))
+	})
+	t.Run("AllocateIdempotent", func(t *testing.T) {
+		a, _ := testAllocator(t, "10.0.0.0/16")
+		c1, err := a.Allocate(ctx, cidr.IPv4, 24, "a")
+		require.NoError(t, err)
+		c2, err := a.Allocate(ctx, cidr.IPv4, 24, "a")
+		require.NoError(t, err)
+		assert.Equal(t, c1, c2)
+	})
+	t.Run("AllocateErrors", func(t *testing.T) {
+		a, _ := testAllocator(t, "10.0.0.0/24")
+		_, err := a.Allocate(ctx, cidr.IPv4, 25, "a")
+		require.NoError(t, err)
+		_, err = a.Allocate(ctx, cidr.IPv4, 26, "a")
+		assert.ErrorIs(t, err, ErrRequestConflict)
+		var conflictErr *RequestConflictError
+		if assert.ErrorAs(t, err, &conflictErr) {
+			assert.Equal(t, RequestConflictError{
+				RequestID:           "a",
+				Previous:            cidr.MustParseCIDR("10.0.0.0/25"),
+				PreviousPrefixBits:  25,
+				RequestedPrefixBits: 26,
+			}, *conflictErr)
+		}
+		_, err = a.Allocate(ctx, cidr.IPv4, 24, "b")
+		assert.ErrorIs(t, err, ErrPoolExhausted)
+		_, err = New(a.s, WithLogger(zerolog.Nop()), WithPoolID(2)).Allocate(ctx, cidr.IPv4, 24, "b")
+		assert.ErrorIs(t, err, ErrPoolNotFound)
+	})
+	t.Run("AllocateDualStack", func(t *testing.T) {
+		a, s := testAllocator(t, "10.0.0.0/16", "fd00::/48")
+		v4, v6, err := a.AllocateDualStack(ctx, 24, 64, "a")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.0/24", v4.String())
+		assert.Equal(t, "fd00::/64", v6.String())
+		v4Again, v6Again, err := a.AllocateDualStack(ctx, 24, 64, "a")
+		require.NoError(t, err)
+		assert.Equal(t, v4, v4Again)
+		assert.Equal(t, v6, v6Again)
+		_, _, err = a.AllocateDualStack(ctx, 24, 56, "a")
+		assert.ErrorIs(t, err, ErrRequestConflict)
+
+		// Only the missing family is allocated.
+		c, err := a.Allocate(ctx, cidr.IPv6, 64, "b")
+		require.NoError(t, err)
+		v4, v6, err = a.AllocateDualStack(ctx, 24, 64, "b")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.1.0/24", v4.String())
+		assert.Equal(t, c, v6)
+
+		// Allocation is atomic: an exhausted IPv6 space leaves IPv4 unallocated.
+		_, _, err = a.AllocateDualStack(ctx, 24, 40, "c")
+		assert.ErrorIs(t, err, ErrPoolExhausted)
+		_, err = a.Lookup(ctx, "c")
+		assert.ErrorIs(t, err, ErrNotFound)
+
+		cs, err := a.Deallocate(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, []cidr.CIDR{cidr.MustParseCIDR("10.0.0.0/24"), cidr.MustParseCIDR("fd00::/64")}, cs)
+		_, err = a.Deallocate(ctx, "b")
+		require.NoError(t, err)
+		assert.Equal(t, &storage.Record{PoolID: 1, C: cidr.MustParseCIDR("10.0.0.0/16")}, testGet(t, s, "10.0.0.0/16"))
+		assert.Equal(t, &storage.Record{PoolID: 1, C: cidr.MustParseCIDR("fd00::/48")}, testGet(t, s, "fd00::/48"))
+	})
+	t.Run("AllocateFamily", func(t *testing.T) {
+		a, _ := testAllocator(t, "fd00::/48")
+		_, err := a.Allocate(ctx, cidr.IPv4, 24, "a")
+		assert.ErrorIs(t, err, ErrPoolExhausted)
+		_, err = a.Allocate(ctx, cidr.IPv6, 129, "a")
+		assert.Error(t, err)
+		c, err := a.Allocate(ctx, cidr.IPv6, 64, "a")
+		require.NoError(t, err)
+		assert.Equal(t, "fd00::/64", c.String())
+	})
+	t.Run("AllocateSpecific", func(t *testing.T) {
+		a, s := testAllocator(t, "10.0.0.0/16")
+		require.NoError(t, a.AllocateSpecific(ctx, cidr.MustParseCIDR("10.0.20.0/24"), "a"))
+		require.NoError(t, a.AllocateSpecific(ctx, cidr.MustParseCIDR("10.0.20.0/24"), "a"))
+		assert.Equal(t, &storage.Record{PoolID: 1, C: cidr.MustParseCIDR("10.0.20.0/24"), RequestID: "a"}, testGet(t, s, "10.0.20.0/24"))
+		for _, c := range []string{"10.0.128.0/17", "10.0.0.0/20", "10.0.24.0/21", "10.0.16.0/22", "10.0.22.0/23", "10.0.21.0/24"} {
+			assert.Equal(t, &storage.Record{PoolID: 1, C: cidr.MustParseCIDR(c)}, testGet(t, s, c))
+		}
+		c, err := a.Allocate(ctx, cidr.IPv4, 24, "b")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.21.0/24", c.String())
+		require.NoError(t, a.AllocateSpecific(ctx, cidr.MustParseCIDR("10.0.128.0/17"), "c"))
+		_, err = a.Deallocate(ctx, "a")
+		require.NoError(t, err)
+		_, err = a.Deallocate(ctx, "b")
+		require.NoError(t, err)
+		_, err = a.Deallocate(ctx, "c")
+		require.NoError(t, err)
+		assert.Equal(t, &storage.Record{PoolID: 1, C: cidr.MustParseCIDR("10.0.0.0/16")}, testGet(t, s, "10.0.0.0/16"))
+	})
+	t.Run("AllocateSpecificErrors", func(t *testing.T) {
+		a, _ := testAllocator(t, "10.0.0.0/16")
+		require.NoError(t, a.AllocateSpecific(ctx, cidr.MustParseCIDR("10.0.20.0/24"), "a"))
+		err := a.AllocateSpecific(ctx, cidr.MustParseCIDR("10.0.21.0/24"), "a")
+		assert.ErrorIs(t, err, ErrRequestConflict)
+		err = a.AllocateSpecific(ctx, cidr.MustParseCIDR("10.0.0.0/19"), "b")
+		assert.ErrorIs(t, err, ErrRangeUnavailable)
+		err = a.AllocateSpecific(ctx, cidr.MustParseCIDR("10.0.20.128/25"), "b")
+		assert.ErrorIs(t, err, ErrRangeUnavailable)
+		err = a.AllocateSpecific(ctx, cidr.MustParseCIDR("10.1.0.0/24"), "b")
+		assert.ErrorIs(t, err, ErrRangeNotInPool)
+		err = a.AllocateSpecific(ctx, cidr.MustParseCIDR("10.0.0.0/15"), "b")
+		assert.ErrorIs(t, err, ErrRangeUnavailable)
+		a2, _ := testAllocator(t, "10.0.0.0/16")
+		err = a2.AllocateSpecific(ctx, cidr.MustParseCIDR("10.0.0.0/15"), "b")
+		assert.ErrorIs(t, err, ErrRangeNotInPool)
+		err = New(a.s, WithLogger(zerolog.Nop()), WithPoolID(2)).AllocateSpecific(ctx, cidr.MustParseCIDR("10.0.0.0/24"), "b")
+		assert.ErrorIs(t, err, ErrPoolNotFound)
+	})
+	t.Run("Deallocate", func(t *testing.T) {
+		a, s := testAllocator(t, "10.0.0.0/16")
+		for i := 0; i < 4; i++ {
+			_, err := a.Allocate(ctx, cidr.IPv4, 18, fmt.Sprint(i))
+			require.NoError(t, err)
+		}
+		for _, i := range []int{2, 0, 3, 1} {
+			_, err := a.Deallocate(ctx, fmt.Sprint(i))
+			require.NoError(t, err)
+		}
+		assert.Equal(t, &storage.Record{PoolID: 1, C: cidr.MustParseCIDR("10.0.0.0/16")}, testGet(t, s, "10.0.0.0/16"))
+		_, err := a.Deallocate(ctx, "0")
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = New(a.s, WithLogger(zerolog.Nop()), WithPoolID(2)).Deallocate(ctx, "0")
+		assert.ErrorIs(t, err, ErrPoolNotFound)
+	})
+	t.Run("Lookup", func(t *testing.T) {
+		a, _ := testAllocator(t, "10.0.0.0/16")
+		c, err := a.Allocate(ctx, cidr.IPv4, 20, "a")
+		require.NoError(t, err)
+		records, err := a.Lookup(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, []storage.Record{{PoolID: 1, C: c, RequestID: "a"}}, records)
+		_, err = a.Lookup(ctx, "b")
+		assert.ErrorIs(t, err, ErrNotFound)
+	})
+	t.Run("Concurrent", func(t *testing.T) {
+		a, s := testAllocator(t, "10.0.0.0/16")
+		const parallelism = 8
+		const allocationsPerWorker = 8
+		var waitGroup sync.WaitGroup
+		var mu sync.Mutex
+		allocated := map[string]string{}
+		for i := 1; i <= parallelism; i++ {
+			workerID := i
+			waitGroup.Add(1)
+			go func() {
+				defer waitGroup.Done()
+				for i := 1; i <= allocationsPerWorker; i++ {
+					requestID := fmt.Sprintf("worker%d_user%d", workerID, i)
+					c, err := a.Allocate(ctx, cidr.IPv4, 22, requestID)
+					if !assert.NoError(t, err) {
+						return
+					}
+					mu.Lock()
+					allocated[c.String()] = requestID
+					mu.Unlock()
+				}
+			}()
+		}
+		waitGroup.Wait()
+		assert.Len(t, allocated, parallelism*allocationsPerWorker)
+		for _, requestID := range allocated {
+			_, err := a.Deallocate(ctx, requestID)
+			require.NoError(t, err)
+		}
+		assert.Equal(t, &storage.Record{PoolID: 1, C: cidr.MustParseCIDR("10.0.0.0/16")}, testGet(t, s, "10.0.0.0/16"))
+	})
+}
@@ -0,0 +1,342 @@
+package allocator
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"sort"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+// ViolationType is the type of a Violation.
+type ViolationType string
+
+const (
+	// ViolationHostBits is the violation of a record that is not a valid CIDR, for example because bits of its IP
+	// address after the prefix (the host bits) are set. Such records are ignored by the other checks.
+	ViolationHostBits ViolationType = "host_bits"
+	// ViolationOverlap is the violation of two records that have IP addresses in common.
+	ViolationOverlap ViolationType = "overlap"
+	// ViolationMisaligned is the violation of a record that is not contained in a single root of the pool, so that it
+	// is not a block of the buddy allocation of a root. This includes records outside the roots of the pool.
+	ViolationMisaligned ViolationType = "misaligned"
+	// ViolationGap is the violation of a range of IP addresses of a root of the pool that is not covered by records.
+	ViolationGap ViolationType = "gap"
+	// ViolationUnmergedBuddies is the violation of two free records that are each other's buddy (see cidr.CIDR.Other)
+	// and are both retired or both not retired, which should have been merged into one record.
+	ViolationUnmergedBuddies ViolationType = "unmerged_buddies"
+	// ViolationHostBitmap is the violation of a host subnet (see EnableHosts) whose bitmap of used addresses does not
+	// match its reserved addresses and the host addresses allocated from it.
+	ViolationHostBitmap ViolationType = "host_bitmap"
+)
+
+// Violation is a violation of the invariants of the records of a pool, found by Check.
+type Violation struct {
+	Type ViolationType
+	// C is the invalid record, the first of two overlapping records, the misaligned record, the range of IP addresses
+	// of the gap, the lower of two unmerged buddies, or the host subnet whose bitmap does not match.
+	C cidr.CIDR
+	// Other is the second of two overlapping records, or the upper of two unmerged buddies. Nil otherwise.
+	Other *cidr.CIDR
+	// Repaired is true if Repair fixed the violation.
+	Repaired bool
+}
+
+// Check checks the invariants of the records of the pool identified by poolID that allocation relies on, in one
+// read-only transaction, and returns the violations (see ViolationType), ordered by type and then by address.
+// The records of a pool must not overlap, must exactly tile the roots of the pool (the ranges of IP addresses added by
+// CreatePool and AddRange, minus the ranges removed by RetireRange), and free buddies must be merged. The bitmap of
+// each host subnet must mark exactly its reserved addresses and its allocated host addresses as used.
+// Returns ErrPoolNotFound if the pool does not exist.
+func (m *PoolManager) Check(ctx context.Context, poolID int) (violations []Violation, err error) {
+	ctx, end := m.a.measure(ctx, &err, attributePoolID.Int(poolID))
+	defer end()
+	err = m.a.retry(ctx, func(ctx context.Context) error {
+		return m.a.doTransaction(ctx, &sql.TxOptions{
+			ReadOnly:  true,
+			Isolation: sql.LevelRepeatableRead,
+		}, func(tx storage.Transaction) (err error) {
+			violations, err = m.check(ctx, tx, poolID)
+			return
+		})
+	})
+	if err != nil {
+		violations = nil
+	}
+	return
+}
+
+// Repair checks the pool identified by poolID like Check, merges unmerged buddies, and recomputes the bitmaps of host
+// subnets from their reserved and allocated host addresses, in one transaction.
+// Returns the violations found before repairing, of which those that were fixed have Repaired set. Other violations
+// cannot be repaired safely and must be investigated. Unmerged buddies that overlap other records, and host subnets
+// whose host addresses are invalid or the same, are not repaired.
+// Returns ErrPoolNotFound if the pool does not exist.
+func (m *PoolManager) Repair(ctx context.Context, poolID int) (violations []Violation, err error) {
+	ctx, end := m.a.measure(ctx, &err, attributePoolID.Int(poolID))
+	defer end()
+	err = m.a.retry(ctx, func(ctx context.Context) error {
+		return m.a.doTransaction(ctx, &sql.TxOptions{
+			Isolation: sql.LevelSerializable,
+			ReadOnly:  false,
+		}, func(tx storage.Transaction) (err error) {
+			violations, err = m.check(ctx, tx, poolID)
+			if err != nil {
+				return
+			}
+			overlapping := map[string]bool{}
+			for _, violation := range violations {
+				if violation.Type == ViolationOverlap {
+					overlapping[violation.C.String()] = true
+					overlapping[violation.Other.String()] = true
+				}
+			}
+			for i := range violations {
+				violation := &violations[i]
+				if violation.Type == ViolationHostBitmap {
+					if violation.Repaired, err = m.repairHostBitmap(ctx, tx, poolID, violation.C); err != nil {
+						return err
+					}
+					continue
+				}
+				if violation.Type != ViolationUnmergedBuddies || overlapping[violation.C.String()] ||
+					overlapping[violation.Other.String()] {
+					continue
+				}
+				lower, err := tx.Get(ctx, poolID, violation.C)
+				if err != nil {
+					return err
+				}
+				upper, err := tx.Get(ctx, poolID, *violation.Other)
+				if err != nil {
+					return err
+				}
+				if lower == nil || upper == nil {
+					// Merged by repairing another violation.
+					continue
+				}
+				if err := tx.Delete(ctx, poolID, lower.C); err != nil {
+					return err
+				}
+				// Merges lower with the upper buddy, and the result with its free buddies.
+				if err := m.a.insertFree(ctx, tx, storage.Record{PoolID: poolID, C: lower.C, Retired: lower.Retired}); err != nil {
+					return err
+				}
+				violation.Repaired = true
+			}
+			return
+		})
+	})
+	if err != nil {
+		violations = nil
+	}
+	return
+}
+
+func (m *PoolManager) check(ctx context.Context, tx storage.Transaction, poolID int) ([]Violation, error) {
+	pool, err := tx.GetPool(ctx, poolID)
+	if err != nil {
+		return nil, err
+	}
+	if pool == nil {
+		return nil, ErrPoolNotFound
+	}
+	records, err := tx.ListRecords(ctx, poolID)
+	if err != nil {
+		return nil, err
+	}
+	roots, err := m.a.poolRoots(ctx, tx, poolID, records)
+	if err != nil {
+		return nil, err
+	}
+	violations := check(records, roots)
+	hostSubnets, err := tx.ListHostSubnets(ctx, poolID)
+	if err != nil {
+		return nil, err
+	}
+	for _, hostSubnet := range hostSubnets {
+		used, err := m.a.expectedHostBitmap(ctx, tx, hostSubnet)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(used, hostSubnet.Used) {
+			violations = append(violations, Violation{Type: ViolationHostBitmap, C: hostSubnet.C})
+		}
+	}
+	return violations, nil
+}
+
+// repairHostBitmap recomputes the bitmap of the host subnet of the pool identified by poolID and c, and returns true,
+// or returns false if the bitmap cannot be computed (see expectedHostBitmap).
+func (m *PoolManager) repairHostBitmap(ctx context.Context, tx storage.Transaction, poolID int, c cidr.CIDR) (
+	bool, error) {
+	hostSubnet, err := tx.GetHostSubnet(ctx, poolID, c)
+	if err != nil || hostSubnet == nil {
+		return false, err
+	}
+	used, err := m.a.expectedHostBitmap(ctx, tx, *hostSubnet)
+	if err != nil || used == nil {
+		return false, err
+	}
+	hostSubnet.Used = used
+	return true, tx.UpdateHostSubnet(ctx, *hostSubnet)
+}
+
+// poolRoots returns the roots of the pool identified by poolID as blocks (see mergeBlocks).
+// Pools without roots, such as pools whose records were inserted directly into the storage, are assumed to have the
+// records of the pool as roots. records are the records of the pool, or nil to list them if needed.
+func (a *Allocator) poolRoots(ctx context.Context, tx storage.Transaction, poolID int,
+	records []storage.Record) ([]cidr.CIDR, error) {
+	roots, err := tx.ListRoots(ctx, poolID)
+	if err != nil || len(roots) > 0 {
+		return mergeBlocks(roots), err
+	}
+	if records == nil {
+		if records, err = tx.ListRecords(ctx, poolID); err != nil {
+			return nil, err
+		}
+	}
+	for _, record := range records {
+		if record.C.IsValid() {
+			roots = append(roots, record.C)
+		}
+	}
+	return mergeBlocks(roots), nil
+}
+
+// mergeBlocks returns the fewest CIDRs that cover the same IP addresses as cs, ordered by address. That is, CIDRs
+// contained in other CIDRs are dropped, and buddies (see cidr.CIDR.Other) are merged repeatedly.
+// cs must be valid.
+func mergeBlocks(cs []cidr.CIDR) []cidr.CIDR {
+	sorted := append([]cidr.CIDR(nil), cs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return storage.CompareAddress(sorted[i], sorted[j]) < 0
+	})
+	var blocks []cidr.CIDR
+	for _, c := range sorted {
+		if n := len(blocks); n > 0 && blocks[n-1].Contains(c) {
+			continue
+		}
+		blocks = append(blocks, c)
+		// Because blocks are ordered by address, a lower buddy is merged before its upper buddy is appended.
+		for n := len(blocks); n >= 2 && blocks[n-1].PrefixBits > 0 && blocks[n-2].Equal(blocks[n-1].Other()); n-- {
+			blocks = append(blocks[:n-2], blocks[n-2].Supernet(blocks[n-2].PrefixBits-1))
+		}
+	}
+	return blocks
+}
+
+// subtractBlock returns the blocks (see mergeBlocks) that cover the IP addresses of blocks that are not in c.
+func subtractBlock(blocks []cidr.CIDR, c cidr.CIDR) []cidr.CIDR {
+	var result []cidr.CIDR
+	for _, block := range blocks {
+		switch {
+		case c.Contains(block):
+		case block.Contains(c):
+			record := storage.Record{C: block}
+			for _, newRecord := range splitDown(&record, c) {
+				result = append(result, newRecord.C)
+			}
+		default:
+			result = append(result, block)
+		}
+	}
+	return mergeBlocks(result)
+}
+
+// check returns the violations of records given the roots of their pool (see Check).
+// roots must be blocks (see mergeBlocks).
+func check(records []storage.Record, roots []cidr.CIDR) (violations []Violation) {
+	var valid []storage.Record
+	for _, record := range records {
+		if record.C.IsValid() {
+			valid = append(valid, record)
+		} else {
+			violations = append(violations, Violation{Type: ViolationHostBits, C: record.C})
+		}
+	}
+	sort.Slice(valid, func(i, j int) bool {
+		return storage.CompareAddress(valid[i].C, valid[j].C) < 0
+	})
+
+	// CIDRs either contain one another or are disjoint. Ordered by address, a record overlaps a preceding record if and
+	// only if it overlaps the preceding record that ends last.
+	var last *cidr.CIDR
+	for i := range valid {
+		c := valid[i].C
+		if last != nil && last.Contains(c) {
+			violations = append(violations, Violation{Type: ViolationOverlap, C: *last, Other: &valid[i].C})
+			continue
+		}
+		last = &valid[i].C
+	}
+
+	for _, record := range valid {
+		if !containedInOne(roots, record.C) {
+			violations = append(violations, Violation{Type: ViolationMisaligned, C: record.C})
+		}
+	}
+
+	for _, root := range roots {
+		var overlapping []cidr.CIDR
+		for _, record := range valid {
+			if record.C.Overlaps(root) {
+				overlapping = append(overlapping, record.C)
+			}
+		}
+		for _, gap := range gaps(root, overlapping) {
+			violations = append(violations, Violation{Type: ViolationGap, C: gap})
+		}
+	}
+
+	free := map[string]storage.Record{}
+	for _, record := range valid {
+		if record.RequestID == "" {
+			free[record.C.String()] = record
+		}
+	}
+	for _, record := range valid {
+		if record.RequestID != "" || !record.C.IsLower() {
+			continue
+		}
+		if upper, ok := free[record.C.Other().String()]; ok && upper.Retired == record.Retired {
+			violations = append(violations, Violation{Type: ViolationUnmergedBuddies, C: record.C, Other: &upper.C})
+		}
+	}
+	return
+}
+
+// containedInOne returns true if one of blocks contains c.
+func containedInOne(blocks []cidr.CIDR, c cidr.CIDR) bool {
+	for _, block := range blocks {
+		if block.Contains(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// gaps returns the largest CIDRs within block that do not overlap cs, ordered by address.
+// cs must overlap block.
+func gaps(block cidr.CIDR, cs []cidr.CIDR) []cidr.CIDR {
+	if len(cs) == 0 {
+		return []cidr.CIDR{block}
+	}
+	if containedInOne(cs, block) {
+		return nil
+	}
+	// No CIDR contains block, so each CIDR is contained in one of the halves of block.
+	upper := block.Split()
+	lower := cidr.CIDR{IP: block.IP, PrefixBits: upper.PrefixBits}
+	var lowerCs, upperCs []cidr.CIDR
+	for _, c := range cs {
+		if bytes.Compare(c.IP, upper.IP) < 0 {
+			lowerCs = append(lowerCs, c)
+		} else {
+			upperCs = append(upperCs, c)
+		}
+	}
+	return append(gaps(lower, lowerCs), gaps(upper, upperCs)...)
+}
@@ -0,0 +1,187 @@
+package allocator
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+	"github.com/jbrekelmans/go-sql-ip-management/storage/memory"
+)
+
+// violationStrings formats violations as "<type> <cidr> [<other>] [repaired]" for readable assertions.
+func violationStrings(violations []Violation) []string {
+	var result []string
+	for _, violation := range violations {
+		s := string(violation.Type) + " " + violation.C.String()
+		if violation.Other != nil {
+			s += " " + violation.Other.String()
+		}
+		if violation.Repaired {
+			s += " repaired"
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+func cidrStrings(cs []cidr.CIDR) []string {
+	var result []string
+	for _, c := range cs {
+		result = append(result, c.String())
+	}
+	return result
+}
+
+func parseCIDRs(ss ...string) []cidr.CIDR {
+	var result []cidr.CIDR
+	for _, s := range ss {
+		result = append(result, cidr.MustParseCIDR(s))
+	}
+	return result
+}
+
+func Test_Check(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewMemoryStorage()
+	m := NewPoolManager(s, WithLogger(zerolog.Nop()))
+	pool, err := m.CreatePool(ctx, "pool1", cidr.MustParseCIDR("10.0.0.0/24"))
+	require.NoError(t, err)
+	a := New(s, WithLogger(zerolog.Nop()), WithPoolID(pool.ID))
+	_, err = a.Allocate(ctx, cidr.IPv4, 26, "a")
+	require.NoError(t, err)
+	violations, err := m.Check(ctx, pool.ID)
+	require.NoError(t, err)
+	assert.Empty(t, violations)
+
+	tx, err := s.BeginTransaction(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.Delete(ctx, pool.ID, cidr.MustParseCIDR("10.0.0.64/26")))
+	require.NoError(t, tx.Delete(ctx, pool.ID, cidr.MustParseCIDR("10.0.0.128/25")))
+	require.NoError(t, tx.InsertMany(ctx, []storage.Record{
+		{PoolID: pool.ID, C: cidr.MustParseCIDR("10.0.0.128/26")},
+		{PoolID: pool.ID, C: cidr.MustParseCIDR("10.0.0.192/26")},
+		{PoolID: pool.ID, C: cidr.MustParseCIDR("10.0.0.0/27")},
+		{PoolID: pool.ID, C: cidr.MustParseCIDR("10.1.0.0/24")},
+		{PoolID: pool.ID, C: cidr.CIDR{IP: cidr.MustParseCIDR("10.2.0.1/32").IP, PrefixBits: 24}},
+	}))
+	require.NoError(t, tx.Commit())
+
+	expected := []string{
+		"host_bits 10.2.0.1/24",
+		"overlap 10.0.0.0/26 10.0.0.0/27",
+		"misaligned 10.1.0.0/24",
+		"gap 10.0.0.64/26",
+		"unmerged_buddies 10.0.0.128/26 10.0.0.192/26",
+	}
+	violations, err = m.Check(ctx, pool.ID)
+	require.NoError(t, err)
+	assert.Equal(t, expected, violationStrings(violations))
+
+	violations, err = m.Repair(ContextWithActor(ctx, "fsck"), pool.ID)
+	require.NoError(t, err)
+	expected[4] += " repaired"
+	assert.Equal(t, expected, violationStrings(violations))
+	violations, err = m.Check(ctx, pool.ID)
+	require.NoError(t, err)
+	assert.Equal(t, expected[:4], violationStrings(violations))
+	assert.NotNil(t, testGet(t, s, "10.0.0.128/25"))
+	events, err := a.History(ctx, cidr.MustParseCIDR("10.0.0.128/25"))
+	require.NoError(t, err)
+	assert.Equal(t, "merge 10.0.0.128/25  fsck", eventStrings(events)[len(events)-1])
+
+	_, err = m.Check(ctx, 2)
+	assert.ErrorIs(t, err, ErrPoolNotFound)
+	_, err = m.Repair(ctx, 2)
+	assert.ErrorIs(t, err, ErrPoolNotFound)
+}
+
+func Test_Check_Roots(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewMemoryStorage()
+	m := NewPoolManager(s, WithLogger(zerolog.Nop()))
+	pool, err := m.CreatePool(ctx, "pool1", cidr.MustParseCIDR("10.0.0.0/24"))
+	require.NoError(t, err)
+	roots := func() []string {
+		tx, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		defer func() {
+			require.NoError(t, tx.Rollback())
+		}()
+		roots, err := tx.ListRoots(ctx, pool.ID)
+		require.NoError(t, err)
+		violations, err := m.Check(ctx, pool.ID)
+		require.NoError(t, err)
+		assert.Empty(t, violations)
+		return cidrStrings(roots)
+	}
+	assert.Equal(t, []string{"10.0.0.0/24"}, roots())
+	require.NoError(t, m.AddRange(ctx, pool.ID, cidr.MustParseCIDR("10.0.1.0/24")))
+	assert.Equal(t, []string{"10.0.0.0/23"}, roots())
+	_, err = m.RetireRange(ctx, pool.ID, cidr.MustParseCIDR("10.0.0.0/25"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.128/25", "10.0.1.0/24"}, roots())
+
+	// Pools without roots are assumed to have their records as roots.
+	_, s2 := testAllocator(t, "10.0.0.0/25", "10.0.0.128/26")
+	violations, err := NewPoolManager(s2, WithLogger(zerolog.Nop())).Check(ctx, 1)
+	require.NoError(t, err)
+	assert.Empty(t, violations)
+}
+
+func Test_Check_Hosts(t *testing.T) {
+	ctx := context.Background()
+	a, s := testAllocator(t, "10.0.0.0/24")
+	m := NewPoolManager(s, WithLogger(zerolog.Nop()))
+	subnet, err := a.Allocate(ctx, cidr.IPv4, 29, "subnet")
+	require.NoError(t, err)
+	require.NoError(t, a.EnableHosts(ctx, subnet))
+	for _, requestID := range []string{"vm1", "vm2"} {
+		_, err := a.AllocateHost(ctx, subnet, requestID)
+		require.NoError(t, err)
+	}
+	violations, err := m.Check(ctx, 1)
+	require.NoError(t, err)
+	assert.Empty(t, violations)
+
+	// The bitmap marks 10.0.0.3 as free although it is allocated to vm2, and 10.0.0.5 as used.
+	tx, err := s.BeginTransaction(ctx, nil)
+	require.NoError(t, err)
+	hostSubnet, err := tx.GetHostSubnet(ctx, 1, subnet)
+	require.NoError(t, err)
+	hostSubnet.Used = []byte{0xe5}
+	require.NoError(t, tx.UpdateHostSubnet(ctx, *hostSubnet))
+	require.NoError(t, tx.Commit())
+	violations, err = m.Check(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"host_bitmap 10.0.0.0/29"}, violationStrings(violations))
+	violations, err = m.Repair(ctx, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"host_bitmap 10.0.0.0/29 repaired"}, violationStrings(violations))
+	violations, err = m.Check(ctx, 1)
+	require.NoError(t, err)
+	assert.Empty(t, violations)
+	ip, err := a.AllocateHost(ctx, subnet, "vm3")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.4", ip.String())
+}
+
+func Test_mergeBlocks(t *testing.T) {
+	assert.Equal(t, []string{"10.0.0.0/24", "fd00::/64"}, cidrStrings(mergeBlocks(parseCIDRs(
+		"fd00:0:0:0:8000::/65", "10.0.0.128/26", "10.0.0.0/25", "10.0.0.192/26", "10.0.0.0/27", "fd00::/65"))))
+	assert.Equal(t, []string{"10.0.0.0/25", "10.0.1.0/24"}, cidrStrings(mergeBlocks(parseCIDRs(
+		"10.0.1.0/24", "10.0.0.0/25"))))
+	assert.Empty(t, mergeBlocks(nil))
+}
+
+func Test_subtractBlock(t *testing.T) {
+	assert.Equal(t, []string{"10.0.0.0/26", "10.0.0.128/25"}, cidrStrings(subtractBlock(parseCIDRs("10.0.0.0/24"),
+		cidr.MustParseCIDR("10.0.0.64/26"))))
+	assert.Equal(t, []string{"10.0.1.0/24"}, cidrStrings(subtractBlock(parseCIDRs("10.0.0.0/24", "10.0.1.0/24"),
+		cidr.MustParseCIDR("10.0.0.0/24"))))
+	assert.Empty(t, subtractBlock(parseCIDRs("10.0.0.0/25", "10.0.0.128/25"), cidr.MustParseCIDR("10.0.0.0/24")))
+}
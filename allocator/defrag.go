@@ -0,0 +1,333 @@
+package allocator
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+// DefragMove is the move of the range of IP addresses From, allocated to RequestID, to the free range To of the same
+// size.
+type DefragMove struct {
+	RequestID string
+	From      cidr.CIDR
+	To        cidr.CIDR
+}
+
+// DefragPlan is a plan to free the range of IP addresses Block by moving allocations out of it (see PlanDefrag).
+type DefragPlan struct {
+	// Block is the range of IP addresses that is free once the moves have been applied.
+	Block cidr.CIDR
+	// Moves are the moves of the allocations within Block to free ranges outside Block, ordered by From.
+	// Empty if Block is already free.
+	Moves []DefragMove
+}
+
+type defragOptions struct {
+	migrate func(ctx context.Context, move DefragMove) error
+}
+
+// DefragOption is an option of ApplyDefrag.
+type DefragOption func(*defragOptions)
+
+// WithMigrateFunc sets the function that ApplyDefrag calls for each move while both ranges of the move are allocated
+// to the request, for example to renumber the object identified by the request ID from move.From to move.To.
+// If migrate returns an error then ApplyDefrag stops and returns the error, leaving both ranges allocated, so that
+// applying the plan again resumes with the move.
+func WithMigrateFunc(migrate func(ctx context.Context, move DefragMove) error) DefragOption {
+	return func(o *defragOptions) {
+		o.migrate = migrate
+	}
+}
+
+// PlanDefrag plans to free a range of IP addresses of address family family and size prefixBits, for pools whose
+// free ranges are too fragmented to allocate such a range. The plan moves the fewest allocations, and among those the
+// fewest IP addresses. Allocations are moved to free ranges outside the range to free, chosen like Allocate does.
+// The plan is computed in one read-only transaction and does not change the pool; apply it with ApplyDefrag.
+//
+// If a big-enough free range exists then the returned plan has no moves.
+// Returns ErrMoveInProgress if a move of a previous plan is unfinished, ErrPoolExhausted if no range of size prefixBits
+// can be freed by moving allocations, and ErrPoolNotFound if the pool does not exist.
+func (a *Allocator) PlanDefrag(ctx context.Context, family cidr.Family, prefixBits int) (plan *DefragPlan, err error) {
+	ctx, end := a.measure(ctx, &err, attributePoolID.Int(a.poolID), attributeFamily.Int(int(family)),
+		attributePrefixLength.Int(prefixBits))
+	defer end()
+	if err = checkPrefixBits(family, prefixBits); err != nil {
+		return
+	}
+	err = a.retry(ctx, func(ctx context.Context) error {
+		return a.doTransaction(ctx, &sql.TxOptions{
+			ReadOnly:  true,
+			Isolation: sql.LevelRepeatableRead,
+		}, func(tx storage.Transaction) (err error) {
+			if err = a.checkPoolExists(ctx, tx, nil); err != nil {
+				return
+			}
+			records, err := tx.ListRecords(ctx, a.poolID)
+			if err != nil {
+				return
+			}
+			for _, record := range records {
+				if record.MovedFrom != nil {
+					// Planning the ranges of the move again would leave the request allocated more than one range.
+					return fmt.Errorf(`%w: %s of requestID=%#v is moving to %s, apply the plan of the move again`,
+						ErrMoveInProgress, *record.MovedFrom, record.RequestID, record.C)
+				}
+			}
+			roots, err := a.poolRoots(ctx, tx, a.poolID, records)
+			if err != nil {
+				return
+			}
+			plan = planDefrag(records, roots, family, prefixBits)
+			if plan == nil {
+				err = fmt.Errorf(`%w: no %v range of prefixBits=%d can be freed by moving allocations`, ErrPoolExhausted, family,
+					prefixBits)
+			}
+			return
+		})
+	})
+	if err != nil {
+		plan = nil
+	}
+	return
+}
+
+// ApplyDefrag applies the moves of plan one at a time, and returns the moves that were applied.
+// Each move is applied in two transactions, with a temporary dual allocation in between: the first transaction
+// allocates move.To to the request, with the labels and lease of move.From and with MovedFrom set to move.From, and
+// the second deallocates move.From and clears MovedFrom. Between the two, the function given with WithMigrateFunc (if
+// any) is called, and the request is allocated both ranges: Lookup returns both ranges and Deallocate deallocates
+// both, while Allocate and AllocateSpecific consider move.From to be the range of the request.
+// The host addresses allocated from move.From (see EnableHosts) are copied to the same offsets in move.To by the
+// first transaction, and deallocated with move.From by the second. In between, host addresses of move.From cannot be
+// allocated or deallocated.
+//
+// Moves of ranges that are no longer allocated to their request are skipped. Applying a plan again resumes it:
+// moves whose range To is already allocated to the request are completed.
+// Returns ErrRangeUnavailable if the range To of a move is no longer free, in which case the plan is stale and
+// should be computed again, and ErrPoolNotFound if the pool does not exist.
+func (a *Allocator) ApplyDefrag(ctx context.Context, plan *DefragPlan, opts ...DefragOption) (applied []DefragMove,
+	err error) {
+	if plan == nil {
+		return nil, fmt.Errorf(`ApplyDefrag: plan must not be nil`)
+	}
+	ctx, end := a.measure(ctx, &err, attributePoolID.Int(a.poolID), attributeCIDR.String(plan.Block.String()))
+	defer end()
+	var o defragOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	for _, move := range plan.Moves {
+		if !move.From.IsValid() || !move.To.IsValid() || move.From.PrefixBits != move.To.PrefixBits ||
+			move.From.Family() != move.To.Family() {
+			return applied, fmt.Errorf(`invalid move of %s to %s`, move.From, move.To)
+		}
+	}
+	for _, move := range plan.Moves {
+		var skipped bool
+		err = a.retry(ctx, func(ctx context.Context) (err error) {
+			skipped, err = a.beginMove(ctx, move)
+			return
+		})
+		if err != nil {
+			return
+		}
+		if skipped {
+			a.logger.Info().Str("requestID", move.RequestID).Str("from", move.From.String()).
+				Msg("skipping move of range that is no longer allocated to the request")
+			continue
+		}
+		if o.migrate != nil {
+			if err = o.migrate(ctx, move); err != nil {
+				return
+			}
+		}
+		err = a.retry(ctx, func(ctx context.Context) error {
+			return a.endMove(ctx, move)
+		})
+		if err != nil {
+			return
+		}
+		a.logger.Info().Str("requestID", move.RequestID).Str("from", move.From.String()).Str("to", move.To.String()).
+			Msg("moved range")
+		applied = append(applied, move)
+	}
+	return
+}
+
+// beginMove allocates move.To to move.RequestID, with the labels and lease of move.From, and MovedFrom set, and copies
+// the host addresses of move.From (see EnableHosts).
+// Returns true if the move should be skipped because move.From is no longer allocated to move.RequestID.
+func (a *Allocator) beginMove(ctx context.Context, move DefragMove) (skipped bool, err error) {
+	err = a.doTransaction(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	}, func(tx storage.Transaction) (err error) {
+		skipped = false
+		to, err := tx.Get(ctx, a.poolID, move.To)
+		if err != nil {
+			return
+		}
+		if to != nil && to.RequestID == move.RequestID {
+			// The move was begun before.
+			return
+		}
+		from, err := tx.Get(ctx, a.poolID, move.From)
+		if err != nil {
+			return
+		}
+		if from == nil || from.RequestID != move.RequestID {
+			skipped = true
+			return a.checkPoolExists(ctx, tx, nil)
+		}
+		err = a.allocateSpecificInTx(ctx, tx, move.To, func(record *storage.Record) {
+			record.RequestID = from.RequestID
+			record.Labels = from.Labels
+			record.ExpiresAt = from.ExpiresAt
+			record.MovedFrom = &from.C
+		})
+		if err != nil {
+			return
+		}
+		return a.copyHosts(ctx, tx, move.From, move.To)
+	})
+	return
+}
+
+// endMove deallocates move.From if it is still allocated to move.RequestID, and then clears MovedFrom of move.To.
+func (a *Allocator) endMove(ctx context.Context, move DefragMove) error {
+	return a.doTransaction(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	}, func(tx storage.Transaction) error {
+		from, err := tx.Get(ctx, a.poolID, move.From)
+		if err != nil {
+			return err
+		}
+		if from != nil && from.RequestID == move.RequestID && from.MovedFrom == nil {
+			if err := a.release(ctx, tx, *from); err != nil {
+				return err
+			}
+		}
+		to, err := tx.Get(ctx, a.poolID, move.To)
+		if err != nil {
+			return err
+		}
+		if to == nil || to.RequestID != move.RequestID || to.MovedFrom == nil {
+			return nil
+		}
+		to.MovedFrom = nil
+		return tx.Update(ctx, *to)
+	})
+}
+
+// planDefrag returns the plan to free a range of IP addresses of family and size prefixBits (see PlanDefrag),
+// or nil if no such range can be freed. roots must be blocks (see mergeBlocks).
+//
+// A range that is not contained in a single record is the supernet of the records within it, so the candidate
+// ranges to free are the supernets of size prefixBits of the smaller records.
+func planDefrag(records []storage.Record, roots []cidr.CIDR, family cidr.Family, prefixBits int) *DefragPlan {
+	var free []storage.Record
+	for _, record := range records {
+		if record.RequestID == "" && !record.Retired && record.C.IsValid() && record.C.Family() == family {
+			free = append(free, record)
+		}
+	}
+	if i := findSmallestFree(free, prefixBits); i >= 0 {
+		return &DefragPlan{Block: cidr.CIDR{IP: free[i].C.IP, PrefixBits: prefixBits}}
+	}
+	candidates := map[string]cidr.CIDR{}
+	for _, record := range records {
+		if record.C.IsValid() && record.C.Family() == family && record.C.PrefixBits > prefixBits {
+			block := record.C.Supernet(prefixBits)
+			candidates[block.String()] = block
+		}
+	}
+	var best *DefragPlan
+	var bestSize *big.Int
+	for _, block := range candidates {
+		if !containedInOne(roots, block) {
+			continue
+		}
+		moves := planMoves(records, free, block)
+		if moves == nil {
+			continue
+		}
+		size := new(big.Int)
+		for _, move := range moves {
+			size.Add(size, move.From.Size())
+		}
+		if best == nil || len(moves) < len(best.Moves) || len(moves) == len(best.Moves) &&
+			(size.Cmp(bestSize) < 0 || size.Cmp(bestSize) == 0 && storage.CompareAddress(block, best.Block) < 0) {
+			best = &DefragPlan{Block: block, Moves: moves}
+			bestSize = size
+		}
+	}
+	return best
+}
+
+// planMoves returns the moves of the allocated records within block to the free records outside block, ordered by
+// From, or nil if block contains retired records or the allocated records do not fit outside block.
+// Larger allocations are placed first, each in the smallest big-enough free range (see findSmallestFree).
+func planMoves(records, free []storage.Record, block cidr.CIDR) []DefragMove {
+	var allocated []storage.Record
+	for _, record := range records {
+		if !block.Contains(record.C) {
+			continue
+		}
+		if record.Retired {
+			return nil
+		}
+		if record.RequestID != "" {
+			allocated = append(allocated, record)
+		}
+	}
+	var outside []storage.Record
+	for _, record := range free {
+		if !record.C.Overlaps(block) {
+			outside = append(outside, record)
+		}
+	}
+	sort.Slice(allocated, func(i, j int) bool {
+		if allocated[i].C.PrefixBits != allocated[j].C.PrefixBits {
+			return allocated[i].C.PrefixBits < allocated[j].C.PrefixBits
+		}
+		return storage.CompareAddress(allocated[i].C, allocated[j].C) < 0
+	})
+	moves := make([]DefragMove, 0, len(allocated))
+	for _, record := range allocated {
+		i := findSmallestFree(outside, record.C.PrefixBits)
+		if i < 0 {
+			return nil
+		}
+		target := outside[i]
+		outside = append(outside[:i], outside[i+1:]...)
+		outside = append(outside, splitDown(&target, cidr.CIDR{IP: target.C.IP, PrefixBits: record.C.PrefixBits})...)
+		moves = append(moves, DefragMove{RequestID: record.RequestID, From: record.C, To: target.C})
+	}
+	sort.Slice(moves, func(i, j int) bool {
+		return storage.CompareAddress(moves[i].From, moves[j].From) < 0
+	})
+	return moves
+}
+
+// findSmallestFree returns the index of the smallest record of free whose range has size prefixBits or larger, the
+// lowest by address if there are several, or -1 if there is no such record.
+func findSmallestFree(free []storage.Record, prefixBits int) int {
+	result := -1
+	for i, record := range free {
+		if record.C.PrefixBits > prefixBits {
+			continue
+		}
+		if result < 0 || record.C.PrefixBits > free[result].C.PrefixBits ||
+			record.C.PrefixBits == free[result].C.PrefixBits && storage.CompareAddress(record.C, free[result].C) < 0 {
+			result = i
+		}
+	}
+	return result
+}
@@ -0,0 +1,196 @@
+package allocator
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+// testFragmentedAllocator returns an allocator of the pool 10.0.0.0/24 in which the requests a, c, e, g and h are
+// allocated a /27 each, and the /27 ranges in between are free, so no /26 is free.
+func testFragmentedAllocator(t *testing.T) (*Allocator, storage.Storage) {
+	t.Helper()
+	ctx := context.Background()
+	a, s := testAllocator(t, "10.0.0.0/24")
+	for _, requestID := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		_, err := a.Allocate(ctx, cidr.IPv4, 27, requestID, WithLabels(map[string]string{"name": requestID}))
+		require.NoError(t, err)
+	}
+	for _, requestID := range []string{"b", "d", "f"} {
+		_, err := a.Deallocate(ctx, requestID)
+		require.NoError(t, err)
+	}
+	return a, s
+}
+
+func Test_Defrag(t *testing.T) {
+	ctx := context.Background()
+	t.Run("PlanDefrag", func(t *testing.T) {
+		a, _ := testFragmentedAllocator(t)
+		plan, err := a.PlanDefrag(ctx, cidr.IPv4, 26)
+		require.NoError(t, err)
+		assert.Equal(t, &DefragPlan{
+			Block: cidr.MustParseCIDR("10.0.0.0/26"),
+			Moves: []DefragMove{{
+				RequestID: "a",
+				From:      cidr.MustParseCIDR("10.0.0.0/27"),
+				To:        cidr.MustParseCIDR("10.0.0.96/27"),
+			}},
+		}, plan)
+
+		plan, err = a.PlanDefrag(ctx, cidr.IPv4, 28)
+		require.NoError(t, err)
+		assert.Equal(t, &DefragPlan{Block: cidr.MustParseCIDR("10.0.0.32/28")}, plan)
+
+		_, err = a.PlanDefrag(ctx, cidr.IPv4, 24)
+		assert.ErrorIs(t, err, ErrPoolExhausted)
+		_, err = a.PlanDefrag(ctx, cidr.IPv6, 64)
+		assert.ErrorIs(t, err, ErrPoolExhausted)
+		_, err = New(a.s, WithPoolID(2)).PlanDefrag(ctx, cidr.IPv4, 26)
+		assert.ErrorIs(t, err, ErrPoolNotFound)
+	})
+	t.Run("ApplyDefrag", func(t *testing.T) {
+		a, s := testFragmentedAllocator(t)
+		_, err := a.Renew(ctx, "a", time.Hour)
+		require.NoError(t, err)
+		plan, err := a.PlanDefrag(ctx, cidr.IPv4, 26)
+		require.NoError(t, err)
+		var migrated []DefragMove
+		applied, err := a.ApplyDefrag(ctx, plan, WithMigrateFunc(func(ctx context.Context, move DefragMove) error {
+			migrated = append(migrated, move)
+			records, err := a.Lookup(ctx, move.RequestID)
+			require.NoError(t, err)
+			require.Len(t, records, 2)
+			assert.Equal(t, records[0].Labels, records[1].Labels)
+			assert.Equal(t, records[0].ExpiresAt, records[1].ExpiresAt)
+			for _, record := range records {
+				if record.C.Equal(move.To) {
+					assert.Equal(t, &move.From, record.MovedFrom)
+				} else {
+					assert.Nil(t, record.MovedFrom)
+				}
+			}
+			c, err := a.Allocate(ctx, cidr.IPv4, 27, move.RequestID)
+			require.NoError(t, err)
+			assert.Equal(t, move.From, c)
+			return nil
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, plan.Moves, applied)
+		assert.Equal(t, plan.Moves, migrated)
+		records, err := a.Lookup(ctx, "a")
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		assert.Equal(t, "10.0.0.96/27", records[0].C.String())
+		assert.Equal(t, map[string]string{"name": "a"}, records[0].Labels)
+		assert.NotNil(t, records[0].ExpiresAt)
+		assert.Nil(t, testGet(t, s, "10.0.0.0/27"))
+		c, err := a.Allocate(ctx, cidr.IPv4, 26, "z")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.0/26", c.String())
+		events, err := a.HistoryOfRequest(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"allocate 10.0.0.0/27 a ",
+			"allocate 10.0.0.96/27 a ",
+			"release 10.0.0.0/27 a ",
+		}, eventStrings(events))
+	})
+	t.Run("Resume", func(t *testing.T) {
+		a, _ := testFragmentedAllocator(t)
+		plan, err := a.PlanDefrag(ctx, cidr.IPv4, 26)
+		require.NoError(t, err)
+		errMigrate := errors.New("migrate failed")
+		applied, err := a.ApplyDefrag(ctx, plan, WithMigrateFunc(func(ctx context.Context, move DefragMove) error {
+			return errMigrate
+		}))
+		assert.ErrorIs(t, err, errMigrate)
+		assert.Empty(t, applied)
+		records, err := a.Lookup(ctx, "a")
+		require.NoError(t, err)
+		assert.Len(t, records, 2)
+		_, err = a.PlanDefrag(ctx, cidr.IPv4, 26)
+		assert.ErrorIs(t, err, ErrMoveInProgress)
+
+		applied, err = a.ApplyDefrag(ctx, plan)
+		require.NoError(t, err)
+		assert.Equal(t, plan.Moves, applied)
+		records, err = a.Lookup(ctx, "a")
+		require.NoError(t, err)
+		require.Len(t, records, 1)
+		assert.Equal(t, "10.0.0.96/27", records[0].C.String())
+		plan, err = a.PlanDefrag(ctx, cidr.IPv4, 26)
+		require.NoError(t, err)
+		assert.Empty(t, plan.Moves)
+	})
+	t.Run("Stale", func(t *testing.T) {
+		a, _ := testFragmentedAllocator(t)
+		plan, err := a.PlanDefrag(ctx, cidr.IPv4, 26)
+		require.NoError(t, err)
+		require.NoError(t, a.AllocateSpecific(ctx, cidr.MustParseCIDR("10.0.0.96/28"), "x"))
+		_, err = a.ApplyDefrag(ctx, plan)
+		assert.ErrorIs(t, err, ErrRangeUnavailable)
+
+		_, err = a.Deallocate(ctx, "a")
+		require.NoError(t, err)
+		applied, err := a.ApplyDefrag(ctx, plan)
+		require.NoError(t, err)
+		assert.Empty(t, applied)
+
+		_, err = a.ApplyDefrag(ctx, nil)
+		assert.Error(t, err)
+	})
+}
+
+func Test_planDefrag(t *testing.T) {
+	records := []storage.Record{
+		{C: cidr.MustParseCIDR("10.0.0.0/26"), RequestID: "a"},
+		{C: cidr.MustParseCIDR("10.0.0.64/27")},
+		{C: cidr.MustParseCIDR("10.0.0.96/28"), RequestID: "b"},
+		{C: cidr.MustParseCIDR("10.0.0.112/28")},
+		{C: cidr.MustParseCIDR("10.0.0.128/27"), RequestID: "c"},
+		{C: cidr.MustParseCIDR("10.0.0.160/28"), RequestID: "d"},
+		{C: cidr.MustParseCIDR("10.0.0.176/28")},
+		{C: cidr.MustParseCIDR("10.0.0.192/26"), Retired: true},
+		{C: cidr.MustParseCIDR("fd00::/64")},
+	}
+	roots := mergeBlocks([]cidr.CIDR{cidr.MustParseCIDR("10.0.0.0/24"), cidr.MustParseCIDR("fd00::/64")})
+
+	// 10.0.0.64/26 needs one move, the retired 10.0.0.192/26 cannot be freed, and 10.0.0.128/26 needs two moves.
+	assert.Equal(t, &DefragPlan{
+		Block: cidr.MustParseCIDR("10.0.0.64/26"),
+		Moves: []DefragMove{{
+			RequestID: "b",
+			From:      cidr.MustParseCIDR("10.0.0.96/28"),
+			To:        cidr.MustParseCIDR("10.0.0.176/28"),
+		}},
+	}, planDefrag(records, roots, cidr.IPv4, 26))
+
+	records = []storage.Record{
+		{C: cidr.MustParseCIDR("10.0.0.0/27"), RequestID: "x"},
+		{C: cidr.MustParseCIDR("10.0.0.32/28"), RequestID: "y"},
+		{C: cidr.MustParseCIDR("10.0.0.48/28")},
+		{C: cidr.MustParseCIDR("10.0.0.64/26")},
+		{C: cidr.MustParseCIDR("10.0.0.128/28")},
+		{C: cidr.MustParseCIDR("10.0.0.144/28"), RequestID: "z"},
+		{C: cidr.MustParseCIDR("10.0.0.160/27")},
+		{C: cidr.MustParseCIDR("10.0.0.192/26"), RequestID: "w"},
+	}
+
+	// Both halves need two moves, but freeing 10.0.0.0/25 moves fewer IP addresses.
+	assert.Equal(t, &DefragPlan{
+		Block: cidr.MustParseCIDR("10.0.0.0/25"),
+		Moves: []DefragMove{
+			{RequestID: "x", From: cidr.MustParseCIDR("10.0.0.0/27"), To: cidr.MustParseCIDR("10.0.0.160/27")},
+			{RequestID: "y", From: cidr.MustParseCIDR("10.0.0.32/28"), To: cidr.MustParseCIDR("10.0.0.128/28")},
+		},
+	}, planDefrag(records, roots, cidr.IPv4, 25))
+	assert.Nil(t, planDefrag(records, roots, cidr.IPv4, 24))
+}
@@ -0,0 +1,117 @@
+package allocator
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+)
+
+var (
+	// ErrHostsNotEnabled is returned if host addresses are allocated from a range of IP addresses for which hosts are
+	// not enabled (see EnableHosts).
+	ErrHostsNotEnabled = errors.New("host addresses are not enabled for the IP address range")
+
+	// ErrInvalidLabels is returned if labels are invalid, e.g. if a key is empty (see WithLabels).
+	ErrInvalidLabels = errors.New("invalid labels")
+
+	// ErrInvalidPageToken is returned by ListAllocations if the page token is malformed.
+	ErrInvalidPageToken = errors.New("invalid page token")
+
+	// ErrMoveInProgress is returned by PlanDefrag if a move of a previous plan is unfinished, for example because the
+	// function given with WithMigrateFunc failed. Apply the previous plan again to finish its moves.
+	// Also returned by EnableHosts, AllocateHost and DeallocateHost if the range of IP addresses is being moved.
+	ErrMoveInProgress = errors.New("a move of an IP address range is in progress")
+
+	// ErrNotFound is returned if no range of IP addresses is allocated to a requestID, and by DeallocateHost and
+	// LookupHost if no host address of the subnet is allocated to a requestID.
+	ErrNotFound = errors.New("no IP address range is allocated to the request")
+
+	// ErrPoolExhausted is returned if a pool has no free range of IP addresses that is big enough.
+	ErrPoolExhausted = errors.New("no free IP address range")
+
+	// ErrPoolNameConflict is returned if a pool with the same name already exists.
+	ErrPoolNameConflict = errors.New("a pool with the same name already exists")
+
+	// ErrPoolNotEmpty is returned by DeletePool if ranges of IP addresses are allocated from the pool.
+	ErrPoolNotEmpty = errors.New("pool has allocations")
+
+	// ErrPoolNotFound is returned if the pool does not exist.
+	ErrPoolNotFound = errors.New("pool does not exist")
+
+	// ErrRequestConflict is returned if a requestID was previously used to allocate a different range of IP addresses.
+	// Use errors.As with *RequestConflictError to get the details.
+	ErrRequestConflict = errors.New("request conflicts with a previous request with the same requestID")
+
+	// ErrRangeNotInPool is returned by AllocateSpecific if the requested range of IP addresses is not contained
+	// in a single range of the pool, by RetireRange if the range of IP addresses is not entirely in the pool, and by
+	// EnableHosts if the range of IP addresses is not allocated from the pool.
+	ErrRangeNotInPool = errors.New("IP address range is not in the pool")
+
+	// ErrRangeOverlap is returned by AddRange if the range of IP addresses overlaps a range of the pool.
+	ErrRangeOverlap = errors.New("IP address range overlaps a range of the pool")
+
+	// ErrRangeUnavailable is returned by AllocateSpecific if the requested range of IP addresses overlaps a range that is
+	// allocated to another object or is retired, and by RetireRange if the range of IP addresses is part of an allocated range.
+	ErrRangeUnavailable = errors.New("IP address range overlaps an existing allocation")
+
+	// ErrRetryable is returned if an operation failed with a transient error and the retry policy was exhausted,
+	// or the context was done while waiting to retry. The transient error is wrapped, so errors.As can be used to
+	// get the storage-specific error.
+	ErrRetryable = errors.New("transient error")
+
+	// ErrWatchNotSupported is returned by Watch if the storage does not implement storage.Watcher.
+	ErrWatchNotSupported = errors.New("storage does not support watching")
+)
+
+// RequestConflictError is the error returned if a requestID was previously used to allocate a different range of
+// IP addresses.
+// errors.Is(err, ErrRequestConflict) returns true for all errors of this type.
+type RequestConflictError struct {
+	RequestID string
+
+	// Previous is the range of IP addresses previously allocated to RequestID.
+	Previous cidr.CIDR
+
+	// PreviousPrefixBits is the size of the range of IP addresses previously allocated to RequestID.
+	PreviousPrefixBits int
+
+	// Requested is the range of IP addresses that was requested.
+	// Only set if a specific range was requested (see AllocateSpecific).
+	Requested *cidr.CIDR
+
+	// RequestedPrefixBits is the size of the range of IP addresses that was requested.
+	RequestedPrefixBits int
+}
+
+func (e *RequestConflictError) Error() string {
+	if e.Requested != nil {
+		return fmt.Sprintf(`%v: requestID=%#v was previously allocated %s but now got %s`,
+			ErrRequestConflict, e.RequestID, e.Previous, *e.Requested)
+	}
+	return fmt.Sprintf(`%v: requestID=%#v was previously allocated with prefixBits=%d but now got prefixBits=%d`,
+		ErrRequestConflict, e.RequestID, e.PreviousPrefixBits, e.RequestedPrefixBits)
+}
+
+// Is returns true if target is ErrRequestConflict.
+func (e *RequestConflictError) Is(target error) bool {
+	return target == ErrRequestConflict
+}
+
+// retryableError wraps a transient error.
+// errors.Is(err, ErrRetryable) returns true for all errors of this type.
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrRetryable, e.err)
+}
+
+func (e *retryableError) Is(target error) bool {
+	return target == ErrRetryable
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
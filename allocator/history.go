@@ -0,0 +1,78 @@
+package allocator
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+// actorKey is the context key of the actor.
+type actorKey struct{}
+
+// ContextWithActor returns a copy of ctx with actor, which identifies who causes the changes made using the returned
+// context (for example a user name). The actor is recorded in the events of the history of ranges (see History).
+func ContextWithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the actor of ctx (see ContextWithActor), or an empty string if ctx has no actor.
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// History returns the events of the ranges of the pool that have at least one IP address in common with c, ordered
+// from oldest to newest. That is, the allocations and releases of c, of ranges contained in c and of ranges
+// containing c, and the splits and merges that involve c.
+// Returns ErrPoolNotFound if the pool does not exist.
+func (a *Allocator) History(ctx context.Context, c cidr.CIDR) (events []storage.Event, err error) {
+	ctx, end := a.measure(ctx, &err, attributePoolID.Int(a.poolID), attributeCIDR.String(c.String()))
+	defer end()
+	if !c.IsValid() {
+		return nil, fmt.Errorf(`History: invalid CIDR %s`, c)
+	}
+	return a.history(ctx, storage.EventFilter{Overlapping: &c})
+}
+
+// HistoryOfRequest returns the allocate and release events of the object identified as requestID, ordered from oldest
+// to newest.
+// Returns ErrPoolNotFound if the pool does not exist.
+func (a *Allocator) HistoryOfRequest(ctx context.Context, requestID string) (events []storage.Event, err error) {
+	ctx, end := a.measure(ctx, &err, attributePoolID.Int(a.poolID), attributeRequestID.String(requestID))
+	defer end()
+	if requestID == "" {
+		return nil, fmt.Errorf("requestID must not be empty")
+	}
+	return a.history(ctx, storage.EventFilter{RequestID: requestID})
+}
+
+func (a *Allocator) history(ctx context.Context, filter storage.EventFilter) (events []storage.Event, err error) {
+	err = a.retry(ctx, func(ctx context.Context) error {
+		return a.doTransaction(ctx, &sql.TxOptions{
+			ReadOnly:  true,
+			Isolation: sql.LevelRepeatableRead,
+		}, func(tx storage.Transaction) (err error) {
+			events, err = tx.ListEvents(ctx, a.poolID, filter)
+			if err != nil || len(events) > 0 {
+				return
+			}
+			return a.checkPoolExists(ctx, tx, nil)
+		})
+	})
+	return
+}
+
+// event returns an event of type eventType of the range of record, which happens now and is caused by the actor of ctx.
+func (a *Allocator) event(ctx context.Context, eventType storage.EventType, record storage.Record) storage.Event {
+	return storage.Event{
+		PoolID:    record.PoolID,
+		Time:      a.now().UTC(),
+		Type:      eventType,
+		C:         record.C,
+		RequestID: record.RequestID,
+		Actor:     ActorFromContext(ctx),
+	}
+}
@@ -0,0 +1,96 @@
+package allocator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+	"github.com/jbrekelmans/go-sql-ip-management/storage/memory"
+)
+
+// eventStrings formats events as "<type> <cidr> <requestID> <actor>" for readable assertions.
+func eventStrings(events []storage.Event) []string {
+	var result []string
+	for _, event := range events {
+		result = append(result, string(event.Type)+" "+event.C.String()+" "+event.RequestID+" "+event.Actor)
+	}
+	return result
+}
+
+func Test_History(t *testing.T) {
+	ctx := ContextWithActor(context.Background(), "alice")
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	_, s := testAllocator(t, "10.0.0.0/24")
+	a := New(s, WithLogger(zerolog.Nop()), WithClock(func() time.Time { return now }))
+	_, err := a.Allocate(ctx, cidr.IPv4, 26, "a")
+	require.NoError(t, err)
+	require.NoError(t, a.AllocateSpecific(ctx, cidr.MustParseCIDR("10.0.0.192/26"), "b", WithLease(time.Minute)))
+	_, err = a.Deallocate(ContextWithActor(ctx, "bob"), "a")
+	require.NoError(t, err)
+	now = now.Add(time.Hour)
+	_, err = a.Reap(ContextWithActor(ctx, "reaper"))
+	require.NoError(t, err)
+
+	events, err := a.History(ctx, cidr.MustParseCIDR("10.0.0.0/26"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"split 10.0.0.0/24  alice",
+		"allocate 10.0.0.0/26 a alice",
+		"release 10.0.0.0/26 a bob",
+		"merge 10.0.0.0/25  bob",
+		"merge 10.0.0.0/24  reaper",
+	}, eventStrings(events))
+	for i := 1; i < len(events); i++ {
+		assert.Less(t, events[i-1].ID, events[i].ID)
+	}
+	assert.Equal(t, now.Add(-time.Hour), events[0].Time)
+	assert.Equal(t, 1, events[0].PoolID)
+
+	events, err = a.HistoryOfRequest(ctx, "b")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"allocate 10.0.0.192/26 b alice",
+		"release 10.0.0.192/26 b reaper",
+	}, eventStrings(events))
+	assert.Equal(t, now, events[1].Time)
+
+	events, err = a.History(ctx, cidr.MustParseCIDR("fd00::/64"))
+	require.NoError(t, err)
+	assert.Empty(t, events)
+	_, err = New(s, WithLogger(zerolog.Nop()), WithPoolID(2)).HistoryOfRequest(ctx, "a")
+	assert.ErrorIs(t, err, ErrPoolNotFound)
+}
+
+func Test_History_DeletePool(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewMemoryStorage()
+	m := NewPoolManager(s, WithLogger(zerolog.Nop()))
+	pool, err := m.CreatePool(ctx, "pool1", cidr.MustParseCIDR("10.0.0.0/24"))
+	require.NoError(t, err)
+	a := New(s, WithLogger(zerolog.Nop()), WithPoolID(pool.ID))
+	_, err = a.Allocate(ctx, cidr.IPv4, 24, "a")
+	require.NoError(t, err)
+	require.NoError(t, m.DeletePool(ctx, pool.ID, true))
+
+	// The history of the deleted pool is kept, and its identifier is not reused.
+	pool, err = m.CreatePool(ctx, "pool1", cidr.MustParseCIDR("10.0.0.0/24"))
+	require.NoError(t, err)
+	assert.Equal(t, a.PoolID()+1, pool.ID)
+	events, err := New(s, WithLogger(zerolog.Nop()), WithPoolID(pool.ID)).History(ctx, cidr.MustParseCIDR("10.0.0.0/24"))
+	require.NoError(t, err)
+	assert.Empty(t, events)
+	tx, err := s.BeginTransaction(ctx, nil)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, tx.Rollback())
+	}()
+	events, err = tx.ListEvents(ctx, a.PoolID(), storage.EventFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"allocate 10.0.0.0/24 a ", "remove 10.0.0.0/24 a "}, eventStrings(events))
+}
@@ -0,0 +1,454 @@
+package allocator
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+// maxHostBits is the largest number of host bits of a host subnet, which limits its bitmap to 8 KiB.
+const maxHostBits = 16
+
+type hostSubnetOptions struct {
+	gateway    net.IP
+	gatewaySet bool
+}
+
+// HostSubnetOption is an option of EnableHosts.
+type HostSubnetOption func(*hostSubnetOptions)
+
+// WithGateway sets the gateway address of the subnet, which is reserved. If gateway is nil then the subnet has no
+// gateway. Defaults to the first address after the network address if the subnet has at least 4 addresses, and no
+// gateway otherwise.
+func WithGateway(gateway net.IP) HostSubnetOption {
+	return func(o *hostSubnetOptions) {
+		o.gateway = gateway
+		o.gatewaySet = true
+	}
+}
+
+// EnableHosts enables allocating individual host addresses from subnet (see AllocateHost), which must be a range of
+// IP addresses allocated from the pool. The used addresses of subnet are kept in a bitmap, so subnet can have at most
+// 2^16 addresses.
+//
+// Subnets of at least 4 addresses reserve their network address (the first address), and IPv4 subnets of at least
+// 4 addresses also reserve their broadcast address (the last address). The gateway is reserved too (see WithGateway).
+// Allocating and deallocating host addresses is recorded in the history of the pool (see History and Watch).
+// Deallocating subnet deallocates its host addresses, and moving it with ApplyDefrag moves its host addresses to the
+// addresses at the same offsets in the new range.
+//
+// Enabling hosts again with the same gateway does nothing.
+// Returns ErrRangeNotInPool if subnet is not allocated from the pool, ErrMoveInProgress if subnet is being moved (see
+// ApplyDefrag), and ErrPoolNotFound if the pool does not exist.
+func (a *Allocator) EnableHosts(ctx context.Context, subnet cidr.CIDR, opts ...HostSubnetOption) (err error) {
+	ctx, end := a.measure(ctx, &err, attributePoolID.Int(a.poolID), attributeCIDR.String(subnet.String()))
+	defer end()
+	if !subnet.IsValid() {
+		return fmt.Errorf(`EnableHosts: invalid CIDR %s`, subnet)
+	}
+	if hostBits := subnet.Family().Bits() - subnet.PrefixBits; hostBits > maxHostBits {
+		return fmt.Errorf(`EnableHosts: %s has %d host bits but at most %d are supported`, subnet, hostBits,
+			maxHostBits)
+	}
+	var o hostSubnetOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if !o.gatewaySet && hostCount(subnet) >= 4 {
+		o.gateway = hostIP(subnet, 1)
+	}
+	hostSubnet, err := newHostSubnet(a.poolID, subnet, o.gateway)
+	if err != nil {
+		return
+	}
+	return a.retry(ctx, func(ctx context.Context) error {
+		return a.doTransaction(ctx, &sql.TxOptions{
+			Isolation: sql.LevelSerializable,
+			ReadOnly:  false,
+		}, func(tx storage.Transaction) error {
+			record, err := tx.Get(ctx, a.poolID, subnet)
+			if err != nil {
+				return err
+			}
+			if record == nil || record.RequestID == "" {
+				return a.checkPoolExists(ctx, tx, fmt.Errorf(`%w: %s is not allocated`, ErrRangeNotInPool, subnet))
+			}
+			if err = a.checkNotMoving(ctx, tx, *record); err != nil {
+				return err
+			}
+			existing, err := tx.GetHostSubnet(ctx, a.poolID, subnet)
+			if err != nil {
+				return err
+			}
+			if existing == nil {
+				return tx.InsertHostSubnet(ctx, hostSubnet)
+			}
+			if !existing.Gateway.Equal(hostSubnet.Gateway) {
+				return fmt.Errorf(`hosts of %s are already enabled with gateway %v`, subnet, existing.Gateway)
+			}
+			return nil
+		})
+	})
+}
+
+// AllocateHost allocates the lowest free host address of subnet (see EnableHosts) to the object identified as
+// requestID, and returns it.
+// If a host address of subnet is already allocated to requestID then returns that address.
+// Returns ErrPoolExhausted if subnet has no free host address, ErrHostsNotEnabled if hosts are not enabled for subnet,
+// ErrMoveInProgress if subnet is being moved (see ApplyDefrag), and ErrPoolNotFound if the pool does not exist.
+func (a *Allocator) AllocateHost(ctx context.Context, subnet cidr.CIDR, requestID string) (ip net.IP, err error) {
+	ctx, end := a.measure(ctx, &err, attributePoolID.Int(a.poolID), attributeCIDR.String(subnet.String()),
+		attributeRequestID.String(requestID))
+	defer end()
+	if requestID == "" {
+		return nil, fmt.Errorf(`AllocateHost: requestID must not be empty`)
+	}
+	err = a.retry(ctx, func(ctx context.Context) error {
+		return a.doTransaction(ctx, &sql.TxOptions{
+			Isolation: sql.LevelSerializable,
+			ReadOnly:  false,
+		}, func(tx storage.Transaction) (err error) {
+			host, err := tx.FindHost(ctx, a.poolID, subnet, requestID)
+			if err != nil {
+				return
+			}
+			if host != nil {
+				ip = host.IP
+				return
+			}
+			hostSubnet, err := a.getHostSubnet(ctx, tx, subnet)
+			if err != nil {
+				return
+			}
+			if err = a.checkSubnetNotMoving(ctx, tx, subnet); err != nil {
+				return
+			}
+			i := firstClear(hostSubnet.Used, hostCount(subnet))
+			if i < 0 {
+				return fmt.Errorf(`%w: no free host address in %s`, ErrPoolExhausted, subnet)
+			}
+			setBit(hostSubnet.Used, i, true)
+			if err = tx.UpdateHostSubnet(ctx, *hostSubnet); err != nil {
+				return
+			}
+			ip = hostIP(subnet, i)
+			host = &storage.Host{PoolID: a.poolID, Subnet: subnet, IP: ip, RequestID: requestID}
+			if err = tx.InsertHost(ctx, *host); err != nil {
+				return
+			}
+			return tx.InsertEvents(ctx, []storage.Event{a.hostEvent(ctx, storage.EventAllocateHost, *host)})
+		})
+	})
+	if err != nil {
+		ip = nil
+	}
+	return
+}
+
+// DeallocateHost deallocates the host address of subnet allocated to the object identified as requestID, and returns
+// it.
+// Returns ErrNotFound if no host address of subnet is allocated to requestID, ErrHostsNotEnabled if hosts are not
+// enabled for subnet, ErrMoveInProgress if subnet is being moved (see ApplyDefrag), and ErrPoolNotFound if the pool
+// does not exist.
+func (a *Allocator) DeallocateHost(ctx context.Context, subnet cidr.CIDR, requestID string) (ip net.IP, err error) {
+	ctx, end := a.measure(ctx, &err, attributePoolID.Int(a.poolID), attributeCIDR.String(subnet.String()),
+		attributeRequestID.String(requestID))
+	defer end()
+	err = a.retry(ctx, func(ctx context.Context) error {
+		return a.doTransaction(ctx, &sql.TxOptions{
+			Isolation: sql.LevelSerializable,
+			ReadOnly:  false,
+		}, func(tx storage.Transaction) (err error) {
+			hostSubnet, err := a.getHostSubnet(ctx, tx, subnet)
+			if err != nil {
+				return
+			}
+			if err = a.checkSubnetNotMoving(ctx, tx, subnet); err != nil {
+				return
+			}
+			host, err := tx.FindHost(ctx, a.poolID, subnet, requestID)
+			if err != nil {
+				return
+			}
+			if host == nil {
+				return fmt.Errorf(`%w: no host address of %s is allocated to requestID=%#v`, ErrNotFound, subnet,
+					requestID)
+			}
+			setBit(hostSubnet.Used, hostIndex(subnet, host.IP), false)
+			if err = tx.UpdateHostSubnet(ctx, *hostSubnet); err != nil {
+				return
+			}
+			ip = host.IP
+			if err = tx.DeleteHost(ctx, a.poolID, subnet, requestID); err != nil {
+				return
+			}
+			return tx.InsertEvents(ctx, []storage.Event{a.hostEvent(ctx, storage.EventReleaseHost, *host)})
+		})
+	})
+	if err != nil {
+		ip = nil
+	}
+	return
+}
+
+// LookupHost returns the host address of subnet allocated to the object identified as requestID.
+// Returns ErrNotFound if no host address of subnet is allocated to requestID, ErrHostsNotEnabled if hosts are not
+// enabled for subnet, and ErrPoolNotFound if the pool does not exist.
+func (a *Allocator) LookupHost(ctx context.Context, subnet cidr.CIDR, requestID string) (ip net.IP, err error) {
+	ctx, end := a.measure(ctx, &err, attributePoolID.Int(a.poolID), attributeCIDR.String(subnet.String()),
+		attributeRequestID.String(requestID))
+	defer end()
+	err = a.retry(ctx, func(ctx context.Context) error {
+		return a.doTransaction(ctx, &sql.TxOptions{
+			ReadOnly:  true,
+			Isolation: sql.LevelRepeatableRead,
+		}, func(tx storage.Transaction) (err error) {
+			host, err := tx.FindHost(ctx, a.poolID, subnet, requestID)
+			if err != nil {
+				return
+			}
+			if host != nil {
+				ip = host.IP
+				return
+			}
+			if _, err = a.getHostSubnet(ctx, tx, subnet); err != nil {
+				return
+			}
+			return fmt.Errorf(`%w: no host address of %s is allocated to requestID=%#v`, ErrNotFound, subnet, requestID)
+		})
+	})
+	return
+}
+
+// ListHosts lists the host addresses allocated from subnet, ordered by address.
+// Returns ErrHostsNotEnabled if hosts are not enabled for subnet, and ErrPoolNotFound if the pool does not exist.
+func (a *Allocator) ListHosts(ctx context.Context, subnet cidr.CIDR) (hosts []storage.Host, err error) {
+	ctx, end := a.measure(ctx, &err, attributePoolID.Int(a.poolID), attributeCIDR.String(subnet.String()))
+	defer end()
+	err = a.retry(ctx, func(ctx context.Context) error {
+		return a.doTransaction(ctx, &sql.TxOptions{
+			ReadOnly:  true,
+			Isolation: sql.LevelRepeatableRead,
+		}, func(tx storage.Transaction) (err error) {
+			if _, err = a.getHostSubnet(ctx, tx, subnet); err != nil {
+				return
+			}
+			hosts, err = tx.ListHosts(ctx, a.poolID, subnet)
+			return
+		})
+	})
+	return
+}
+
+// getHostSubnet gets the host subnet of subnet.
+// Returns ErrHostsNotEnabled if it does not exist, and ErrPoolNotFound if the pool does not exist.
+func (a *Allocator) getHostSubnet(ctx context.Context, tx storage.Transaction, subnet cidr.CIDR) (
+	*storage.HostSubnet, error) {
+	hostSubnet, err := tx.GetHostSubnet(ctx, a.poolID, subnet)
+	if err != nil {
+		return nil, err
+	}
+	if hostSubnet == nil {
+		return nil, a.checkPoolExists(ctx, tx, fmt.Errorf(`%w: %s`, ErrHostsNotEnabled, subnet))
+	}
+	return hostSubnet, nil
+}
+
+// checkSubnetNotMoving is like checkNotMoving for the record of subnet, if it exists.
+func (a *Allocator) checkSubnetNotMoving(ctx context.Context, tx storage.Transaction, subnet cidr.CIDR) error {
+	record, err := tx.Get(ctx, a.poolID, subnet)
+	if err != nil || record == nil {
+		return err
+	}
+	return a.checkNotMoving(ctx, tx, *record)
+}
+
+// checkNotMoving returns ErrMoveInProgress if record is the range From of an unfinished move (see ApplyDefrag). The
+// host addresses of record were copied to the range To when the move began, so changes to them would be lost when
+// the move ends.
+func (a *Allocator) checkNotMoving(ctx context.Context, tx storage.Transaction, record storage.Record) error {
+	if record.RequestID == "" {
+		return nil
+	}
+	records, err := tx.FindAllocated(ctx, a.poolID, record.RequestID)
+	if err != nil {
+		return err
+	}
+	for _, other := range records {
+		if other.MovedFrom != nil && other.MovedFrom.Equal(record.C) {
+			return fmt.Errorf(`%w: %s is moving to %s`, ErrMoveInProgress, record.C, other.C)
+		}
+	}
+	return nil
+}
+
+// hostEvent returns an event of type eventType of host, like event.
+func (a *Allocator) hostEvent(ctx context.Context, eventType storage.EventType, host storage.Host) storage.Event {
+	return a.event(ctx, eventType, storage.Record{
+		PoolID:    host.PoolID,
+		C:         cidr.CIDR{IP: host.IP, PrefixBits: len(host.IP) * 8},
+		RequestID: host.RequestID,
+	})
+}
+
+// hostReleaseEvents returns the release events of the host addresses allocated from the range of the pool identified
+// by poolID and c, which is about to be deallocated, or nil if hosts are not enabled for c.
+func (a *Allocator) hostReleaseEvents(ctx context.Context, tx storage.Transaction, poolID int, c cidr.CIDR) (
+	[]storage.Event, error) {
+	hostSubnet, err := tx.GetHostSubnet(ctx, poolID, c)
+	if err != nil || hostSubnet == nil {
+		return nil, err
+	}
+	hosts, err := tx.ListHosts(ctx, poolID, c)
+	if err != nil {
+		return nil, err
+	}
+	var events []storage.Event
+	for _, host := range hosts {
+		events = append(events, a.hostEvent(ctx, storage.EventReleaseHost, host))
+	}
+	return events, nil
+}
+
+// expectedHostBitmap returns the bitmap of used addresses of hostSubnet that follows from its reserved addresses and
+// the host addresses allocated from it, or nil if there is no such bitmap, for example because two host addresses are
+// the same.
+func (a *Allocator) expectedHostBitmap(ctx context.Context, tx storage.Transaction, hostSubnet storage.HostSubnet) (
+	[]byte, error) {
+	expected, err := newHostSubnet(hostSubnet.PoolID, hostSubnet.C, hostSubnet.Gateway)
+	if err != nil {
+		return nil, nil
+	}
+	hosts, err := tx.ListHosts(ctx, hostSubnet.PoolID, hostSubnet.C)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range hosts {
+		if len(host.IP) != len(hostSubnet.C.IP) || !hostSubnet.C.Contains(cidr.CIDR{IP: host.IP,
+			PrefixBits: len(host.IP) * 8}) {
+			return nil, nil
+		}
+		i := hostIndex(hostSubnet.C, host.IP)
+		if getBit(expected.Used, i) {
+			return nil, nil
+		}
+		setBit(expected.Used, i, true)
+	}
+	return expected.Used, nil
+}
+
+// copyHosts copies the host subnet of from and its hosts to to, which has the same size, keeping the offsets of the
+// addresses, and inserts the allocate events of the copied host addresses. Does nothing if hosts are not enabled for
+// from.
+func (a *Allocator) copyHosts(ctx context.Context, tx storage.Transaction, from, to cidr.CIDR) error {
+	hostSubnet, err := tx.GetHostSubnet(ctx, a.poolID, from)
+	if err != nil || hostSubnet == nil {
+		return err
+	}
+	hosts, err := tx.ListHosts(ctx, a.poolID, from)
+	if err != nil {
+		return err
+	}
+	hostSubnet.C = to
+	if hostSubnet.Gateway != nil {
+		hostSubnet.Gateway = hostIP(to, hostIndex(from, hostSubnet.Gateway))
+	}
+	if err := tx.InsertHostSubnet(ctx, *hostSubnet); err != nil {
+		return err
+	}
+	var events []storage.Event
+	for _, host := range hosts {
+		host.Subnet = to
+		host.IP = hostIP(to, hostIndex(from, host.IP))
+		if err := tx.InsertHost(ctx, host); err != nil {
+			return err
+		}
+		events = append(events, a.hostEvent(ctx, storage.EventAllocateHost, host))
+	}
+	return tx.InsertEvents(ctx, events)
+}
+
+// newHostSubnet returns a host subnet of c with gateway, in which the reserved addresses are used (see EnableHosts).
+func newHostSubnet(poolID int, c cidr.CIDR, gateway net.IP) (hostSubnet storage.HostSubnet, err error) {
+	n := hostCount(c)
+	hostSubnet = storage.HostSubnet{PoolID: poolID, C: c, Used: make([]byte, (n+7)/8)}
+	if n >= 4 {
+		setBit(hostSubnet.Used, 0, true)
+		if c.IsIPv4() {
+			setBit(hostSubnet.Used, n-1, true)
+		}
+	}
+	if gateway == nil {
+		return
+	}
+	if ip4 := gateway.To4(); c.IsIPv4() && ip4 != nil {
+		gateway = ip4
+	}
+	if len(gateway) != len(c.IP) || !c.Contains(cidr.CIDR{IP: gateway, PrefixBits: len(gateway) * 8}) {
+		return hostSubnet, fmt.Errorf(`gateway %s is not in %s`, gateway, c)
+	}
+	i := hostIndex(c, gateway)
+	if getBit(hostSubnet.Used, i) {
+		return hostSubnet, fmt.Errorf(`gateway %s is a reserved address of %s`, gateway, c)
+	}
+	setBit(hostSubnet.Used, i, true)
+	hostSubnet.Gateway = gateway
+	return
+}
+
+// hostCount returns the number of addresses of c, which has at most maxHostBits host bits.
+func hostCount(c cidr.CIDR) int {
+	return 1 << (len(c.IP)*8 - c.PrefixBits)
+}
+
+// hostIndex returns the offset of ip in c, which contains ip.
+func hostIndex(c cidr.CIDR, ip net.IP) int {
+	i := 0
+	for j := range ip {
+		i = i<<8 | int(ip[j]&^c.IP[j])
+	}
+	return i
+}
+
+// hostIP returns the address at offset i in c.
+func hostIP(c cidr.CIDR, i int) net.IP {
+	ip := append(net.IP(nil), c.IP...)
+	for j := len(ip) - 1; i > 0; j-- {
+		ip[j] |= byte(i)
+		i >>= 8
+	}
+	return ip
+}
+
+// firstClear returns the index of the first bit of the n bits of bitmap that is not set, or -1 if all are set.
+func firstClear(bitmap []byte, n int) int {
+	for j, b := range bitmap {
+		if b == 0xff {
+			continue
+		}
+		for i := j * 8; i < j*8+8 && i < n; i++ {
+			if !getBit(bitmap, i) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// getBit returns bit i of bitmap, where bit 0 is the most significant bit of the first byte.
+func getBit(bitmap []byte, i int) bool {
+	return bitmap[i/8]&(0x80>>(i%8)) != 0
+}
+
+// setBit sets or clears bit i of bitmap (see getBit).
+func setBit(bitmap []byte, i int, value bool) {
+	if value {
+		bitmap[i/8] |= 0x80 >> (i % 8)
+	} else {
+		bitmap[i/8] &^= 0x80 >> (i % 8)
+	}
+}
@@ -0,0 +1,194 @@
+package allocator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+// hostStrings formats hosts as "<ip> <requestID>" for readable assertions.
+func hostStrings(hosts []storage.Host) []string {
+	var result []string
+	for _, host := range hosts {
+		result = append(result, host.IP.String()+" "+host.RequestID)
+	}
+	return result
+}
+
+func Test_Hosts(t *testing.T) {
+	ctx := context.Background()
+	t.Run("AllocateHost", func(t *testing.T) {
+		a, _ := testAllocator(t, "10.0.0.0/24")
+		subnet, err := a.Allocate(ctx, cidr.IPv4, 29, "subnet")
+		require.NoError(t, err)
+		_, err = a.AllocateHost(ctx, subnet, "vm1")
+		assert.ErrorIs(t, err, ErrHostsNotEnabled)
+		require.NoError(t, a.EnableHosts(ctx, subnet))
+		require.NoError(t, a.EnableHosts(ctx, subnet))
+
+		// The network address, the gateway 10.0.0.1 and the broadcast address are reserved.
+		var ips []string
+		for _, requestID := range []string{"vm1", "vm2", "vm3", "vm4", "vm5"} {
+			ip, err := a.AllocateHost(ctx, subnet, requestID)
+			require.NoError(t, err)
+			ips = append(ips, ip.String())
+		}
+		assert.Equal(t, []string{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6"}, ips)
+		_, err = a.AllocateHost(ctx, subnet, "vm6")
+		assert.ErrorIs(t, err, ErrPoolExhausted)
+		ip, err := a.AllocateHost(ctx, subnet, "vm2")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.3", ip.String())
+
+		ip, err = a.DeallocateHost(ctx, subnet, "vm2")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.3", ip.String())
+		_, err = a.DeallocateHost(ctx, subnet, "vm2")
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = a.LookupHost(ctx, subnet, "vm2")
+		assert.ErrorIs(t, err, ErrNotFound)
+		ip, err = a.AllocateHost(ctx, subnet, "vm6")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.3", ip.String())
+		ip, err = a.LookupHost(ctx, subnet, "vm6")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.3", ip.String())
+		hosts, err := a.ListHosts(ctx, subnet)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.0.0.2 vm1", "10.0.0.3 vm6", "10.0.0.4 vm3", "10.0.0.5 vm4", "10.0.0.6 vm5"},
+			hostStrings(hosts))
+
+		// Deallocating the subnet deallocates its hosts.
+		_, err = a.Deallocate(ctx, "subnet")
+		require.NoError(t, err)
+		_, err = a.ListHosts(ctx, subnet)
+		assert.ErrorIs(t, err, ErrHostsNotEnabled)
+		events, err := a.HistoryOfRequest(ctx, "vm2")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"allocate_host 10.0.0.3/32 vm2 ", "release_host 10.0.0.3/32 vm2 "},
+			eventStrings(events))
+		events, err = a.HistoryOfRequest(ctx, "vm6")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"allocate_host 10.0.0.3/32 vm6 ", "release_host 10.0.0.3/32 vm6 "},
+			eventStrings(events))
+		subnet, err = a.Allocate(ctx, cidr.IPv4, 29, "subnet")
+		require.NoError(t, err)
+		require.NoError(t, a.EnableHosts(ctx, subnet))
+		hosts, err = a.ListHosts(ctx, subnet)
+		require.NoError(t, err)
+		assert.Empty(t, hosts)
+	})
+	t.Run("EnableHosts", func(t *testing.T) {
+		a, _ := testAllocator(t, "10.0.0.0/16", "fd00::/64")
+		err := a.EnableHosts(ctx, cidr.MustParseCIDR("10.0.0.0/24"))
+		assert.ErrorIs(t, err, ErrRangeNotInPool)
+		v6, err := a.Allocate(ctx, cidr.IPv6, 126, "v6")
+		require.NoError(t, err)
+		require.NoError(t, a.EnableHosts(ctx, v6, WithGateway(nil)))
+		assert.Error(t, a.EnableHosts(ctx, v6))
+
+		// IPv6 subnets have no broadcast address.
+		var ips []string
+		for _, requestID := range []string{"vm1", "vm2", "vm3"} {
+			ip, err := a.AllocateHost(ctx, v6, requestID)
+			require.NoError(t, err)
+			ips = append(ips, ip.String())
+		}
+		assert.Equal(t, []string{"fd00::1", "fd00::2", "fd00::3"}, ips)
+
+		v4, err := a.Allocate(ctx, cidr.IPv4, 31, "v4")
+		require.NoError(t, err)
+		require.NoError(t, a.EnableHosts(ctx, v4))
+		ip, err := a.AllocateHost(ctx, v4, "vm1")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.0", ip.String())
+
+		v4, err = a.Allocate(ctx, cidr.IPv4, 28, "v4gw")
+		require.NoError(t, err)
+		assert.Error(t, a.EnableHosts(ctx, v4, WithGateway(net.ParseIP("10.0.0.16"))))
+		assert.Error(t, a.EnableHosts(ctx, v4, WithGateway(net.ParseIP("10.0.1.1"))))
+		require.NoError(t, a.EnableHosts(ctx, v4, WithGateway(net.ParseIP("10.0.0.30"))))
+		ip, err = a.AllocateHost(ctx, v4, "vm1")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.17", ip.String())
+
+		assert.Error(t, a.EnableHosts(ctx, cidr.MustParseCIDR("10.0.0.0/15")))
+		_, err = New(a.s, WithPoolID(2)).AllocateHost(ctx, v4, "vm1")
+		assert.ErrorIs(t, err, ErrPoolNotFound)
+	})
+	t.Run("ApplyDefrag", func(t *testing.T) {
+		a, _ := testFragmentedAllocator(t)
+		from := cidr.MustParseCIDR("10.0.0.0/27")
+		require.NoError(t, a.EnableHosts(ctx, from))
+		_, err := a.AllocateHost(ctx, from, "vm1")
+		require.NoError(t, err)
+		_, err = a.AllocateHost(ctx, from, "vm2")
+		require.NoError(t, err)
+		plan, err := a.PlanDefrag(ctx, cidr.IPv4, 26)
+		require.NoError(t, err)
+		require.Len(t, plan.Moves, 1)
+
+		// While the move is in progress, the host addresses of the range it moves from cannot change.
+		errMigrate := errors.New("migrate failed")
+		_, err = a.ApplyDefrag(ctx, plan, WithMigrateFunc(func(ctx context.Context, move DefragMove) error {
+			return errMigrate
+		}))
+		require.ErrorIs(t, err, errMigrate)
+		_, err = a.AllocateHost(ctx, from, "vm3")
+		assert.ErrorIs(t, err, ErrMoveInProgress)
+		_, err = a.DeallocateHost(ctx, from, "vm2")
+		assert.ErrorIs(t, err, ErrMoveInProgress)
+		assert.ErrorIs(t, a.EnableHosts(ctx, from), ErrMoveInProgress)
+		ip, err := a.LookupHost(ctx, from, "vm1")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.2", ip.String())
+		_, err = a.ApplyDefrag(ctx, plan)
+		require.NoError(t, err)
+		_, err = a.DeallocateHost(ctx, plan.Moves[0].To, "vm2")
+		require.NoError(t, err)
+		hosts, err := a.ListHosts(ctx, plan.Moves[0].To)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"10.0.0.98 vm1"}, hostStrings(hosts))
+		events, err := a.HistoryOfRequest(ctx, "vm1")
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"allocate_host 10.0.0.2/32 vm1 ",
+			"allocate_host 10.0.0.98/32 vm1 ",
+			"release_host 10.0.0.2/32 vm1 ",
+		}, eventStrings(events))
+		ip, err = a.AllocateHost(ctx, plan.Moves[0].To, "vm2")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.99", ip.String())
+		_, err = a.ListHosts(ctx, from)
+		assert.ErrorIs(t, err, ErrHostsNotEnabled)
+	})
+}
+
+func Test_newHostSubnet(t *testing.T) {
+	hostSubnet, err := newHostSubnet(1, cidr.MustParseCIDR("10.0.0.0/28"), net.ParseIP("10.0.0.9"))
+	require.NoError(t, err)
+	assert.Equal(t, net.IP{10, 0, 0, 9}, hostSubnet.Gateway)
+	assert.Equal(t, []byte{0x80, 0x41}, hostSubnet.Used)
+	assert.Equal(t, 9, hostIndex(hostSubnet.C, hostSubnet.Gateway))
+	assert.Equal(t, 1, firstClear(hostSubnet.Used, hostCount(hostSubnet.C)))
+
+	hostSubnet, err = newHostSubnet(1, cidr.MustParseCIDR("fd00::ff00/120"), nil)
+	require.NoError(t, err)
+	assert.Len(t, hostSubnet.Used, 32)
+	assert.Equal(t, "fd00::ffff", hostIP(hostSubnet.C, 255).String())
+	assert.Equal(t, 255, hostIndex(hostSubnet.C, net.ParseIP("fd00::ffff")))
+
+	hostSubnet, err = newHostSubnet(1, cidr.MustParseCIDR("10.0.0.0/32"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0}, hostSubnet.Used)
+	assert.Equal(t, 0, firstClear(hostSubnet.Used, 1))
+	setBit(hostSubnet.Used, 0, true)
+	assert.Equal(t, -1, firstClear(hostSubnet.Used, 1))
+}
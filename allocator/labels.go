@@ -0,0 +1,87 @@
+package allocator
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+// WithLabels allocates the range with labels, which are key-value metadata of the allocation
+// (e.g. team=payments). The labels of a range that was already allocated to the request ID are not changed.
+// Keys must not be empty.
+func WithLabels(labels map[string]string) AllocateOption {
+	return func(o *allocateOptions) {
+		o.labels = labels
+	}
+}
+
+// checkLabels returns ErrInvalidLabels if labels are invalid.
+func checkLabels(labels map[string]string) error {
+	for key := range labels {
+		if key == "" {
+			return fmt.Errorf(`%w: label keys must not be empty`, ErrInvalidLabels)
+		}
+	}
+	return nil
+}
+
+// SetLabels replaces the labels of the ranges allocated to the object identified as requestID.
+// A nil or empty labels removes all labels.
+// If no range is allocated to requestID then returns ErrNotFound, or ErrPoolNotFound if the pool does not exist.
+func (a *Allocator) SetLabels(ctx context.Context, requestID string, labels map[string]string) (err error) {
+	ctx, end := a.measure(ctx, &err, attributePoolID.Int(a.poolID), attributeRequestID.String(requestID))
+	defer end()
+	if err = checkLabels(labels); err != nil {
+		return
+	}
+	if len(labels) == 0 {
+		labels = nil
+	}
+	return a.retry(ctx, func(ctx context.Context) error {
+		return a.doTransaction(ctx, &sql.TxOptions{
+			Isolation: sql.LevelSerializable,
+			ReadOnly:  false,
+		}, func(tx storage.Transaction) (err error) {
+			records, err := tx.FindAllocated(ctx, a.poolID, requestID)
+			if err != nil {
+				return
+			}
+			if len(records) == 0 {
+				return a.checkPoolExists(ctx, tx, ErrNotFound)
+			}
+			for _, record := range records {
+				record.Labels = labels
+				if err = tx.Update(ctx, record); err != nil {
+					return
+				}
+			}
+			return
+		})
+	})
+}
+
+// FindByLabels finds the allocated records that have all labels of selector, ordered by IP address (IPv4 first).
+// An empty selector finds all allocated records. See ListAllocations to list records page by page.
+// Returns ErrPoolNotFound if the pool does not exist.
+func (a *Allocator) FindByLabels(ctx context.Context, selector map[string]string) (records []storage.Record, err error) {
+	ctx, end := a.measure(ctx, &err, attributePoolID.Int(a.poolID))
+	defer end()
+	err = a.retry(ctx, func(ctx context.Context) error {
+		return a.doTransaction(ctx, &sql.TxOptions{
+			ReadOnly:  true,
+			Isolation: sql.LevelRepeatableRead,
+		}, func(tx storage.Transaction) (err error) {
+			records, err = tx.ListAllocations(ctx, a.poolID, storage.ListFilter{
+				State:  storage.StateAllocated,
+				Labels: selector,
+			}, nil, 0)
+			if err != nil || len(records) > 0 {
+				return
+			}
+			return a.checkPoolExists(ctx, tx, nil)
+		})
+	})
+	return
+}
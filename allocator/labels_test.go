@@ -0,0 +1,58 @@
+package allocator
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+func Test_Labels(t *testing.T) {
+	ctx := context.Background()
+	a, s := testAllocator(t, "10.0.0.0/24", "fd00::/48")
+	_, _, err := a.AllocateDualStack(ctx, 26, 64, "a", WithLabels(map[string]string{"team": "payments", "env": "ci"}))
+	require.NoError(t, err)
+	_, err = a.Allocate(ctx, cidr.IPv4, 26, "b", WithLabels(map[string]string{"team": "search"}))
+	require.NoError(t, err)
+	_, err = a.Allocate(ctx, cidr.IPv4, 26, "c")
+	require.NoError(t, err)
+	_, err = a.Allocate(ctx, cidr.IPv4, 26, "d", WithLabels(map[string]string{"": "x"}))
+	assert.Error(t, err)
+	assert.Equal(t, map[string]string{"team": "payments", "env": "ci"}, testGet(t, s, "fd00::/64").Labels)
+
+	requestIDs := func(records []storage.Record) (ids []string) {
+		for _, record := range records {
+			ids = append(ids, record.RequestID+" "+record.C.String())
+		}
+		return
+	}
+	records, err := a.FindByLabels(ctx, map[string]string{"team": "payments"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a 10.0.0.0/26", "a fd00::/64"}, requestIDs(records))
+	records, err = a.FindByLabels(ctx, map[string]string{"team": "payments", "env": "prod"})
+	require.NoError(t, err)
+	assert.Empty(t, records)
+	records, err = a.FindByLabels(ctx, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a 10.0.0.0/26", "b 10.0.0.64/26", "c 10.0.0.128/26", "a fd00::/64"}, requestIDs(records))
+
+	require.NoError(t, a.SetLabels(ctx, "c", map[string]string{"team": "payments"}))
+	records, err = a.FindByLabels(ctx, map[string]string{"team": "payments"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a 10.0.0.0/26", "c 10.0.0.128/26", "a fd00::/64"}, requestIDs(records))
+	require.NoError(t, a.SetLabels(ctx, "c", nil))
+	assert.Nil(t, testGet(t, s, "10.0.0.128/26").Labels)
+	assert.ErrorIs(t, a.SetLabels(ctx, "e", nil), ErrNotFound)
+
+	// Deallocating removes the labels.
+	_, err = a.Deallocate(ctx, "b")
+	require.NoError(t, err)
+	assert.Nil(t, testGet(t, s, "10.0.0.64/26").Labels)
+
+	_, err = New(s, WithPoolID(2)).FindByLabels(ctx, nil)
+	assert.ErrorIs(t, err, ErrPoolNotFound)
+}
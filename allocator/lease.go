@@ -0,0 +1,160 @@
+package allocator
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+// reapBatchSize is the maximum number of expired records that Reap reads per query.
+const reapBatchSize = 100
+
+// WithLease allocates the range with a lease that expires ttl after the allocation, unless it is renewed (see Renew).
+// Expired leases are deallocated by Reap. ttl must be positive.
+// The lease of a range that was already allocated to the request ID is not changed.
+func WithLease(ttl time.Duration) AllocateOption {
+	return func(o *allocateOptions) {
+		o.ttl = ttl
+	}
+}
+
+// Renew sets the lease of the ranges allocated to the object identified as requestID to expire ttl from now,
+// and returns the new expiry time. Ranges allocated without a lease are given a lease.
+// If no range is allocated to requestID then returns ErrNotFound, or ErrPoolNotFound if the pool does not exist.
+func (a *Allocator) Renew(ctx context.Context, requestID string, ttl time.Duration) (expiresAt time.Time, err error) {
+	ctx, end := a.measure(ctx, &err, attributePoolID.Int(a.poolID), attributeRequestID.String(requestID))
+	defer end()
+	if ttl <= 0 {
+		err = fmt.Errorf(`Renew: ttl must be positive but got %v`, ttl)
+		return
+	}
+	err = a.retry(ctx, func(ctx context.Context) (err error) {
+		expiresAt, err = a.renew(ctx, requestID, ttl)
+		return
+	})
+	return
+}
+
+func (a *Allocator) renew(ctx context.Context, requestID string, ttl time.Duration) (expiresAt time.Time, err error) {
+	err = a.doTransaction(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	}, func(tx storage.Transaction) (err error) {
+		records, err := tx.FindAllocated(ctx, a.poolID, requestID)
+		if err != nil {
+			return
+		}
+		if len(records) == 0 {
+			return a.checkPoolExists(ctx, tx, ErrNotFound)
+		}
+		expiresAt = a.now().Add(ttl).UTC()
+		for _, record := range records {
+			record.ExpiresAt = &expiresAt
+			if err = tx.Update(ctx, record); err != nil {
+				return
+			}
+		}
+		return
+	})
+	return
+}
+
+// Reap deallocates the ranges whose lease has expired, and returns the deallocated records
+// (with the request ID and expiry time they had before they were deallocated).
+// Each request ID is deallocated in its own transaction, so that it is safe to reap concurrently
+// (e.g. on multiple replicas): a range that was renewed or deallocated concurrently is skipped.
+// If deallocating a request ID fails then the error is logged and Reap continues with the next request ID, and returns
+// the errors joined (see errors.Join) together with the records that were deallocated.
+func (a *Allocator) Reap(ctx context.Context) (reaped []storage.Record, err error) {
+	ctx, end := a.measure(ctx, &err, attributePoolID.Int(a.poolID))
+	defer end()
+	var errs []error
+	defer func() {
+		err = errors.Join(append(errs, err)...)
+	}()
+	// failed is the set of request IDs that failed to be deallocated, which are not tried again.
+	failed := map[string]struct{}{}
+	for {
+		var expired []storage.Record
+		err = a.retry(ctx, func(ctx context.Context) error {
+			return a.doTransaction(ctx, &sql.TxOptions{
+				ReadOnly:  true,
+				Isolation: sql.LevelReadUncommitted,
+			}, func(tx storage.Transaction) (err error) {
+				expired, err = tx.FindExpired(ctx, a.poolID, a.now(), reapBatchSize)
+				return
+			})
+		})
+		if err != nil || len(expired) == 0 {
+			return
+		}
+		progress := false
+		seen := map[string]struct{}{}
+		for _, record := range expired {
+			if _, ok := seen[record.RequestID]; ok {
+				continue
+			}
+			seen[record.RequestID] = struct{}{}
+			if _, ok := failed[record.RequestID]; ok {
+				continue
+			}
+			var records []storage.Record
+			reapErr := a.retry(ctx, func(ctx context.Context) (err error) {
+				records, err = a.reap(ctx, record.RequestID)
+				return
+			})
+			if reapErr != nil {
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					err = ctxErr
+					return
+				}
+				a.logger.Error().Err(reapErr).Int("poolID", a.poolID).Str("requestID", record.RequestID).
+					Msg("error reaping expired lease")
+				failed[record.RequestID] = struct{}{}
+				errs = append(errs, fmt.Errorf(`error reaping requestID=%#v: %w`, record.RequestID, reapErr))
+				continue
+			}
+			if len(records) > 0 {
+				progress = true
+			}
+			reaped = append(reaped, records...)
+		}
+		if len(expired) < reapBatchSize || !progress {
+			// Either all expired records were read, or another reaper is concurrently deallocating the same records.
+			return
+		}
+	}
+}
+
+// reap deallocates the ranges allocated to requestID whose lease has expired.
+func (a *Allocator) reap(ctx context.Context, requestID string) (reaped []storage.Record, err error) {
+	err = a.doTransaction(ctx, &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  false,
+	}, func(tx storage.Transaction) (err error) {
+		records, err := tx.FindAllocated(ctx, a.poolID, requestID)
+		if err != nil {
+			return
+		}
+		now := a.now()
+		reaped = nil
+		for _, record := range records {
+			if record.ExpiresAt == nil || record.ExpiresAt.After(now) {
+				continue
+			}
+			reaped = append(reaped, record.DeepCopy())
+			if err = a.release(ctx, tx, record); err != nil {
+				return
+			}
+		}
+		return
+	})
+	if err != nil {
+		reaped = nil
+	}
+	return
+}
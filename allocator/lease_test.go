@@ -0,0 +1,187 @@
+package allocator
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+var errTestFindAllocated = errors.New("find allocated failed")
+
+// failingStorage is a storage.Storage whose transactions fail to find the records allocated to requestID.
+type failingStorage struct {
+	storage.Storage
+	requestID string
+}
+
+func (s *failingStorage) BeginTransaction(ctx context.Context, txOpts *sql.TxOptions) (storage.Transaction, error) {
+	tx, err := s.Storage.BeginTransaction(ctx, txOpts)
+	if err != nil {
+		return nil, err
+	}
+	return &failingTransaction{Transaction: tx, requestID: s.requestID}, nil
+}
+
+type failingTransaction struct {
+	storage.Transaction
+	requestID string
+}
+
+func (t *failingTransaction) FindAllocated(ctx context.Context, poolID int, requestID string) ([]storage.Record, error) {
+	if requestID == t.requestID {
+		return nil, errTestFindAllocated
+	}
+	return t.Transaction.FindAllocated(ctx, poolID, requestID)
+}
+
+// testLeaseAllocator is like testAllocator, but the allocator uses the returned clock.
+func testLeaseAllocator(t *testing.T, roots ...string) (*Allocator, storage.Storage, *testClock) {
+	t.Helper()
+	a, s := testAllocator(t, roots...)
+	clock := &testClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	return New(s, WithLogger(zerolog.Nop()), WithRetryPolicy(a.retryPolicy), WithClock(clock.Now)), s, clock
+}
+
+func Test_Lease(t *testing.T) {
+	ctx := context.Background()
+	t.Run("Allocate", func(t *testing.T) {
+		a, s, clock := testLeaseAllocator(t, "10.0.0.0/24")
+		_, err := a.Allocate(ctx, cidr.IPv4, 25, "a", WithLease(time.Minute))
+		require.NoError(t, err)
+		expiresAt := clock.Now().Add(time.Minute)
+		assert.Equal(t, &expiresAt, testGet(t, s, "10.0.0.0/25").ExpiresAt)
+		// Idempotent allocation does not change the lease.
+		clock.Advance(time.Second)
+		_, err = a.Allocate(ctx, cidr.IPv4, 25, "a", WithLease(time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, &expiresAt, testGet(t, s, "10.0.0.0/25").ExpiresAt)
+		_, err = a.Allocate(ctx, cidr.IPv4, 25, "b")
+		require.NoError(t, err)
+		assert.Nil(t, testGet(t, s, "10.0.0.128/25").ExpiresAt)
+		require.NoError(t, a.AllocateSpecific(ctx, cidr.MustParseCIDR("10.0.0.0/25"), "a", WithLease(time.Hour)))
+		assert.Equal(t, &expiresAt, testGet(t, s, "10.0.0.0/25").ExpiresAt)
+	})
+	t.Run("Renew", func(t *testing.T) {
+		a, s, clock := testLeaseAllocator(t, "10.0.0.0/24", "fd00::/48")
+		_, _, err := a.AllocateDualStack(ctx, 25, 64, "a", WithLease(time.Minute))
+		require.NoError(t, err)
+		clock.Advance(30 * time.Second)
+		expiresAt, err := a.Renew(ctx, "a", time.Minute)
+		require.NoError(t, err)
+		assert.Equal(t, clock.Now().Add(time.Minute), expiresAt)
+		assert.Equal(t, &expiresAt, testGet(t, s, "10.0.0.0/25").ExpiresAt)
+		assert.Equal(t, &expiresAt, testGet(t, s, "fd00::/64").ExpiresAt)
+		_, err = a.Renew(ctx, "b", time.Minute)
+		assert.ErrorIs(t, err, ErrNotFound)
+		_, err = a.Renew(ctx, "a", 0)
+		assert.Error(t, err)
+	})
+	t.Run("Reap", func(t *testing.T) {
+		a, s, clock := testLeaseAllocator(t, "10.0.0.0/24")
+		_, err := a.Allocate(ctx, cidr.IPv4, 26, "a", WithLease(time.Minute))
+		require.NoError(t, err)
+		_, err = a.Allocate(ctx, cidr.IPv4, 26, "b", WithLease(2*time.Minute))
+		require.NoError(t, err)
+		_, err = a.Allocate(ctx, cidr.IPv4, 25, "c")
+		require.NoError(t, err)
+		reaped, err := a.Reap(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, reaped)
+
+		clock.Advance(time.Minute)
+		reaped, err = a.Reap(ctx)
+		require.NoError(t, err)
+		if assert.Len(t, reaped, 1) {
+			assert.Equal(t, "a", reaped[0].RequestID)
+			assert.Equal(t, "10.0.0.0/26", reaped[0].C.String())
+		}
+		assert.Equal(t, &storage.Record{PoolID: 1, C: cidr.MustParseCIDR("10.0.0.0/26")}, testGet(t, s, "10.0.0.0/26"))
+
+		_, err = a.Renew(ctx, "b", time.Hour)
+		require.NoError(t, err)
+		clock.Advance(time.Minute)
+		reaped, err = a.Reap(ctx)
+		require.NoError(t, err)
+		assert.Empty(t, reaped)
+
+		// The reaped range is merged with its free buddy.
+		clock.Advance(time.Hour)
+		reaped, err = a.Reap(ctx)
+		require.NoError(t, err)
+		assert.Len(t, reaped, 1)
+		assert.Equal(t, &storage.Record{PoolID: 1, C: cidr.MustParseCIDR("10.0.0.0/25")}, testGet(t, s, "10.0.0.0/25"))
+		_, err = a.Lookup(ctx, "c")
+		assert.NoError(t, err)
+	})
+	t.Run("ReapError", func(t *testing.T) {
+		a, s, clock := testLeaseAllocator(t, "10.0.0.0/24")
+		for _, requestID := range []string{"a", "b", "c"} {
+			_, err := a.Allocate(ctx, cidr.IPv4, 26, requestID, WithLease(time.Minute))
+			require.NoError(t, err)
+		}
+		clock.Advance(time.Minute)
+		a = New(&failingStorage{Storage: s, requestID: "b"}, WithLogger(zerolog.Nop()), WithRetryPolicy(a.retryPolicy),
+			WithClock(clock.Now))
+		reaped, err := a.Reap(ctx)
+		assert.ErrorIs(t, err, errTestFindAllocated)
+		assert.ErrorContains(t, err, `requestID="b"`)
+		var requestIDs []string
+		for _, record := range reaped {
+			requestIDs = append(requestIDs, record.RequestID)
+		}
+		assert.ElementsMatch(t, []string{"a", "c"}, requestIDs)
+		assert.Equal(t, "b", testGet(t, s, "10.0.0.64/26").RequestID)
+	})
+	t.Run("ReapConcurrent", func(t *testing.T) {
+		a, s, clock := testLeaseAllocator(t, "10.0.0.0/16")
+		for i := 0; i < 256; i++ {
+			_, err := a.Allocate(ctx, cidr.IPv4, 24, string(rune('a'+i%26))+string(rune('a'+i/26)), WithLease(time.Minute))
+			require.NoError(t, err)
+		}
+		clock.Advance(time.Minute)
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		reapedCount := 0
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				reaped, err := a.Reap(ctx)
+				assert.NoError(t, err)
+				mu.Lock()
+				reapedCount += len(reaped)
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, 256, reapedCount)
+		assert.Equal(t, &storage.Record{PoolID: 1, C: cidr.MustParseCIDR("10.0.0.0/16")}, testGet(t, s, "10.0.0.0/16"))
+	})
+}
@@ -0,0 +1,87 @@
+package allocator
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+const (
+	// DefaultPageSize is the page size of ListAllocations if the page size is not positive.
+	DefaultPageSize = 100
+	// MaxPageSize is the maximum page size of ListAllocations.
+	MaxPageSize = 1000
+)
+
+// ListAllocations lists a page of the records of the pool that are selected by filter, ordered by address
+// (IPv4 before IPv6, then by IP address, then by prefix length). Despite its name, it can also list free records
+// (see storage.ListFilter.State).
+//
+// pageToken is empty to list the first page, or the nextPageToken returned by the previous call to list the next page.
+// nextPageToken is empty if there are no more records. The page token is a cursor on the address of the last
+// listed record, so records are neither skipped nor repeated across pages, except for records that are split,
+// merged, allocated or deallocated between calls.
+// pageSize defaults to DefaultPageSize if not positive, and is capped at MaxPageSize.
+//
+// Returns ErrInvalidPageToken if pageToken is malformed, and ErrPoolNotFound if the pool does not exist.
+func (a *Allocator) ListAllocations(ctx context.Context, filter storage.ListFilter, pageToken string,
+	pageSize int) (records []storage.Record, nextPageToken string, err error) {
+	ctx, end := a.measure(ctx, &err, attributePoolID.Int(a.poolID))
+	defer end()
+	if filter.Within != nil && !filter.Within.IsValid() {
+		err = fmt.Errorf(`ListAllocations: invalid CIDR %s`, *filter.Within)
+		return
+	}
+	var after *cidr.CIDR
+	if pageToken != "" {
+		if after, err = decodePageToken(pageToken); err != nil {
+			return
+		}
+	}
+	if pageSize <= 0 {
+		pageSize = DefaultPageSize
+	} else if pageSize > MaxPageSize {
+		pageSize = MaxPageSize
+	}
+	err = a.retry(ctx, func(ctx context.Context) error {
+		return a.doTransaction(ctx, &sql.TxOptions{
+			ReadOnly:  true,
+			Isolation: sql.LevelRepeatableRead,
+		}, func(tx storage.Transaction) (err error) {
+			// Read one record more than the page size to find out whether there is a next page.
+			records, err = tx.ListAllocations(ctx, a.poolID, filter, after, pageSize+1)
+			if err != nil || len(records) > 0 {
+				return
+			}
+			return a.checkPoolExists(ctx, tx, nil)
+		})
+	})
+	if err != nil {
+		return
+	}
+	if len(records) > pageSize {
+		records = records[:pageSize]
+		nextPageToken = encodePageToken(records[pageSize-1].C)
+	}
+	return
+}
+
+func encodePageToken(c cidr.CIDR) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.String()))
+}
+
+func decodePageToken(pageToken string) (*cidr.CIDR, error) {
+	data, err := base64.RawURLEncoding.DecodeString(pageToken)
+	if err != nil {
+		return nil, fmt.Errorf(`%w: %v`, ErrInvalidPageToken, err)
+	}
+	c, err := cidr.ParseCIDR(string(data))
+	if err != nil {
+		return nil, fmt.Errorf(`%w: %v`, ErrInvalidPageToken, err)
+	}
+	return &c, nil
+}
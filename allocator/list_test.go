@@ -0,0 +1,67 @@
+package allocator
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+func Test_ListAllocations(t *testing.T) {
+	ctx := context.Background()
+	a, _ := testAllocator(t, "10.0.0.0/24", "fd00::/48")
+	for i := 0; i < 4; i++ {
+		_, err := a.Allocate(ctx, cidr.IPv4, 27, fmt.Sprintf("vpc-%d", i))
+		require.NoError(t, err)
+	}
+	_, err := a.Allocate(ctx, cidr.IPv4, 28, "ci-1")
+	require.NoError(t, err)
+	_, err = a.Allocate(ctx, cidr.IPv6, 64, "vpc-0")
+	require.NoError(t, err)
+
+	list := func(filter storage.ListFilter, pageSize int) (pages [][]string) {
+		t.Helper()
+		pageToken := ""
+		for {
+			records, nextPageToken, err := a.ListAllocations(ctx, filter, pageToken, pageSize)
+			require.NoError(t, err)
+			var page []string
+			for _, record := range records {
+				page = append(page, record.RequestID+" "+record.C.String())
+			}
+			pages = append(pages, page)
+			if nextPageToken == "" {
+				return
+			}
+			pageToken = nextPageToken
+		}
+	}
+	assert.Equal(t, [][]string{
+		{"vpc-0 10.0.0.0/27", "vpc-1 10.0.0.32/27"},
+		{"vpc-2 10.0.0.64/27", "vpc-3 10.0.0.96/27"},
+		{"ci-1 10.0.0.128/28", "vpc-0 fd00::/64"},
+	}, list(storage.ListFilter{State: storage.StateAllocated}, 2))
+	assert.Equal(t, [][]string{
+		{"vpc-0 10.0.0.0/27", "vpc-1 10.0.0.32/27", "vpc-2 10.0.0.64/27", "vpc-3 10.0.0.96/27", "vpc-0 fd00::/64"},
+	}, list(storage.ListFilter{RequestIDPrefix: "vpc-"}, 0))
+	within := cidr.MustParseCIDR("10.0.0.64/26")
+	assert.Equal(t, [][]string{
+		{"vpc-2 10.0.0.64/27", "vpc-3 10.0.0.96/27"},
+	}, list(storage.ListFilter{Within: &within}, 0))
+	assert.Equal(t, [][]string{
+		{" 10.0.0.144/28", " 10.0.0.160/27", " 10.0.0.192/26"},
+	}, list(storage.ListFilter{State: storage.StateFree, MaxPrefixBits: 28}, 0))
+	assert.Equal(t, [][]string{
+		{"ci-1 10.0.0.128/28", " 10.0.0.144/28"},
+	}, list(storage.ListFilter{MinPrefixBits: 28, MaxPrefixBits: 28}, 0))
+
+	_, _, err = a.ListAllocations(ctx, storage.ListFilter{}, "!", 0)
+	assert.ErrorIs(t, err, ErrInvalidPageToken)
+	_, _, err = New(a.s, WithPoolID(2)).ListAllocations(ctx, storage.ListFilter{}, "", 0)
+	assert.ErrorIs(t, err, ErrPoolNotFound)
+}
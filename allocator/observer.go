@@ -0,0 +1,22 @@
+package allocator
+
+import (
+	"time"
+)
+
+// Observer is notified of the operations of an Allocator or PoolManager, for example to export metrics
+// (see package metrics). An Observer must be safe for concurrent use.
+type Observer interface {
+	// ObserveOperation is called when an operation returns, where operation is the name of the method
+	// (e.g. "Allocate" or "Deallocate") and err is the error it returned (nil on success).
+	ObserveOperation(operation string, duration time.Duration, err error)
+	// ObserveRetry is called when a transaction is about to be retried because it failed with the retryable error err.
+	ObserveRetry(err error)
+}
+
+// WithObserver sets the observer of operations. Defaults to none.
+func WithObserver(observer Observer) Option {
+	return func(a *Allocator) {
+		a.observer = observer
+	}
+}
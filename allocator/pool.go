@@ -0,0 +1,395 @@
+package allocator
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+// maxPoolID is the maximum pool ID, because pool IDs are stored as SMALLINT.
+const maxPoolID = 1<<15 - 1
+
+// PoolManager creates, lists, renames and deletes pools.
+// A PoolManager is safe for concurrent use.
+type PoolManager struct {
+	a *Allocator
+}
+
+// NewPoolManager returns a PoolManager that stores pools in s.
+// The options are the same as for New, except that WithPoolID is ignored.
+func NewPoolManager(s storage.Storage, opts ...Option) *PoolManager {
+	return &PoolManager{
+		a: New(s, opts...),
+	}
+}
+
+// AddRange adds the free range of IP addresses c to the pool identified by poolID, for example to grow a pool that
+// is running out of free ranges.
+// Returns ErrRangeOverlap if c overlaps a range of the pool, and ErrPoolNotFound if the pool does not exist.
+func (m *PoolManager) AddRange(ctx context.Context, poolID int, c cidr.CIDR) (err error) {
+	ctx, end := m.a.measure(ctx, &err, attributePoolID.Int(poolID), attributeCIDR.String(c.String()))
+	defer end()
+	if !c.IsValid() {
+		return fmt.Errorf(`invalid CIDR %s`, c)
+	}
+	return m.a.retry(ctx, func(ctx context.Context) error {
+		return m.a.doTransaction(ctx, &sql.TxOptions{
+			Isolation: sql.LevelSerializable,
+			ReadOnly:  false,
+		}, func(tx storage.Transaction) (err error) {
+			pool, err := tx.GetPool(ctx, poolID)
+			if err != nil {
+				return
+			}
+			if pool == nil {
+				return ErrPoolNotFound
+			}
+			records, err := tx.FindOverlapping(ctx, poolID, c)
+			if err != nil {
+				return
+			}
+			if len(records) > 0 {
+				return fmt.Errorf(`%w: %s overlaps %s`, ErrRangeOverlap, c, records[0].C)
+			}
+			roots, err := m.a.poolRoots(ctx, tx, poolID, nil)
+			if err != nil {
+				return
+			}
+			if err = tx.SetRoots(ctx, poolID, mergeBlocks(append(roots, c))); err != nil {
+				return
+			}
+			return m.a.insertFree(ctx, tx, storage.Record{PoolID: poolID, C: c})
+		})
+	})
+}
+
+// CreatePool creates a pool named name, with the free ranges of IP addresses roots.
+// The roots must not overlap.
+// Returns ErrPoolNameConflict if a pool named name already exists.
+func (m *PoolManager) CreatePool(ctx context.Context, name string, roots ...cidr.CIDR) (pool *storage.Pool, err error) {
+	ctx, end := m.a.measure(ctx, &err, attributePoolName.String(name))
+	defer end()
+	if name == "" {
+		return nil, errors.New("pool name must not be empty")
+	}
+	for i, root := range roots {
+		if !root.IsValid() {
+			return nil, fmt.Errorf(`invalid CIDR %s`, root)
+		}
+		for _, other := range roots[:i] {
+			if root.Overlaps(other) {
+				return nil, fmt.Errorf(`CIDR %s overlaps CIDR %s`, root, other)
+			}
+		}
+	}
+	err = m.a.retry(ctx, func(ctx context.Context) error {
+		return m.a.doTransaction(ctx, &sql.TxOptions{
+			Isolation: sql.LevelSerializable,
+			ReadOnly:  false,
+		}, func(tx storage.Transaction) (err error) {
+			pools, err := tx.ListPools(ctx)
+			if err != nil {
+				return
+			}
+			for _, other := range pools {
+				if other.Name == name {
+					return fmt.Errorf(`%w: %#v`, ErrPoolNameConflict, name)
+				}
+			}
+			// The IDs of deleted pools are not reused, so that their history is not mistaken for the history of the
+			// new pool.
+			lastPoolID, err := tx.MaxPoolID(ctx)
+			if err != nil {
+				return
+			}
+			pool = &storage.Pool{ID: lastPoolID + 1, Name: name}
+			if pool.ID > maxPoolID {
+				return fmt.Errorf(`cannot create more than %d pools`, maxPoolID)
+			}
+			err = tx.InsertPool(ctx, *pool)
+			if err != nil {
+				return
+			}
+			records := make([]storage.Record, 0, len(roots))
+			for _, root := range roots {
+				records = append(records, storage.Record{PoolID: pool.ID, C: root})
+			}
+			if err = tx.InsertMany(ctx, records); err != nil {
+				return
+			}
+			return tx.SetRoots(ctx, pool.ID, mergeBlocks(roots))
+		})
+	})
+	if err != nil {
+		pool = nil
+	}
+	return
+}
+
+// DeletePool deletes the pool identified by poolID and all its ranges of IP addresses.
+// The history of the pool is kept, and its identifier is never used again.
+// Returns ErrPoolNotEmpty if ranges of IP addresses are allocated from the pool, unless force is true, in which case
+// the deletion of each allocated range (and its host addresses) is recorded in the history.
+func (m *PoolManager) DeletePool(ctx context.Context, poolID int, force bool) (err error) {
+	ctx, end := m.a.measure(ctx, &err, attributePoolID.Int(poolID))
+	defer end()
+	return m.a.retry(ctx, func(ctx context.Context) error {
+		return m.a.doTransaction(ctx, &sql.TxOptions{
+			Isolation: sql.LevelSerializable,
+			ReadOnly:  false,
+		}, func(tx storage.Transaction) (err error) {
+			pool, err := tx.GetPool(ctx, poolID)
+			if err != nil {
+				return
+			}
+			if pool == nil {
+				return ErrPoolNotFound
+			}
+			records, err := tx.ListRecords(ctx, poolID)
+			if err != nil {
+				return
+			}
+			var events []storage.Event
+			allocated := 0
+			for _, record := range records {
+				if record.RequestID == "" {
+					continue
+				}
+				allocated++
+				hostEvents, err := m.a.hostReleaseEvents(ctx, tx, poolID, record.C)
+				if err != nil {
+					return err
+				}
+				events = append(append(events, hostEvents...), m.a.event(ctx, storage.EventRemove, record))
+			}
+			if allocated > 0 && !force {
+				return fmt.Errorf(`%w: pool %d has %d allocations`, ErrPoolNotEmpty, poolID, allocated)
+			}
+			if err = tx.InsertEvents(ctx, events); err != nil {
+				return
+			}
+			return tx.DeletePool(ctx, poolID)
+		})
+	})
+}
+
+// GetPool gets the pool identified by poolID.
+// Returns ErrPoolNotFound if no such pool exists.
+func (m *PoolManager) GetPool(ctx context.Context, poolID int) (pool *storage.Pool, err error) {
+	ctx, end := m.a.measure(ctx, &err, attributePoolID.Int(poolID))
+	defer end()
+	err = m.a.retry(ctx, func(ctx context.Context) error {
+		return m.a.doTransaction(ctx, &sql.TxOptions{
+			ReadOnly:  true,
+			Isolation: sql.LevelReadUncommitted,
+		}, func(tx storage.Transaction) (err error) {
+			pool, err = tx.GetPool(ctx, poolID)
+			if err == nil && pool == nil {
+				err = ErrPoolNotFound
+			}
+			return
+		})
+	})
+	return
+}
+
+// ListPools lists all pools, ordered by ID.
+func (m *PoolManager) ListPools(ctx context.Context) (pools []storage.Pool, err error) {
+	ctx, end := m.a.measure(ctx, &err)
+	defer end()
+	err = m.a.retry(ctx, func(ctx context.Context) error {
+		return m.a.doTransaction(ctx, &sql.TxOptions{
+			ReadOnly:  true,
+			Isolation: sql.LevelReadUncommitted,
+		}, func(tx storage.Transaction) (err error) {
+			pools, err = tx.ListPools(ctx)
+			return
+		})
+	})
+	return
+}
+
+// PoolSnapshotAt returns the records of the pool identified by poolID as they were at time at, ordered by address and
+// then by prefix length (see storage.Transaction.ListRecordsAt).
+// Returns ErrPoolNotFound if the pool does not exist.
+func (m *PoolManager) PoolSnapshotAt(ctx context.Context, poolID int, at time.Time) (records []storage.Record, err error) {
+	ctx, end := m.a.measure(ctx, &err, attributePoolID.Int(poolID))
+	defer end()
+	err = m.a.retry(ctx, func(ctx context.Context) error {
+		return m.a.doTransaction(ctx, &sql.TxOptions{
+			ReadOnly:  true,
+			Isolation: sql.LevelRepeatableRead,
+		}, func(tx storage.Transaction) (err error) {
+			pool, err := tx.GetPool(ctx, poolID)
+			if err != nil {
+				return
+			}
+			if pool == nil {
+				return ErrPoolNotFound
+			}
+			records, err = tx.ListRecordsAt(ctx, poolID, at)
+			return
+		})
+	})
+	return
+}
+
+// RetireRange stops allocations from the range of IP addresses c of the pool identified by poolID, for example
+// to drain a range of IP addresses that is needed elsewhere.
+//
+// If no ranges of IP addresses within c are allocated then c is removed from the pool and nil is returned.
+// Otherwise, c is marked as retired and the records of the ranges within c that are still allocated are returned.
+// Retired ranges are never allocated, and stay retired when deallocated. Call RetireRange again once the returned
+// allocations have been deallocated to remove c from the pool.
+// Each range that is retired or removed is recorded in the history, as a retire or remove event.
+//
+// Returns ErrRangeNotInPool if c is not entirely in the pool, ErrRangeUnavailable if c is part of a larger allocated range,
+// and ErrPoolNotFound if the pool does not exist.
+func (m *PoolManager) RetireRange(ctx context.Context, poolID int, c cidr.CIDR) (allocated []storage.Record, err error) {
+	ctx, end := m.a.measure(ctx, &err, attributePoolID.Int(poolID), attributeCIDR.String(c.String()))
+	defer end()
+	if !c.IsValid() {
+		return nil, fmt.Errorf(`invalid CIDR %s`, c)
+	}
+	err = m.a.retry(ctx, func(ctx context.Context) error {
+		allocated = nil
+		return m.a.doTransaction(ctx, &sql.TxOptions{
+			Isolation: sql.LevelSerializable,
+			ReadOnly:  false,
+		}, func(tx storage.Transaction) (err error) {
+			pool, err := tx.GetPool(ctx, poolID)
+			if err != nil {
+				return
+			}
+			if pool == nil {
+				return ErrPoolNotFound
+			}
+			roots, err := m.a.poolRoots(ctx, tx, poolID, nil)
+			if err != nil {
+				return
+			}
+			records, err := tx.FindOverlapping(ctx, poolID, c)
+			if err != nil {
+				return
+			}
+			if len(records) == 1 && !records[0].C.Equal(c) && records[0].C.Contains(c) {
+				// c is part of a larger range.
+				record := records[0]
+				if record.RequestID != "" {
+					return fmt.Errorf(`%w: %s is part of %s, which is allocated to requestID=%#v`, ErrRangeUnavailable, c, record.C,
+						record.RequestID)
+				}
+				// Split the free range and remove c from the pool.
+				err = tx.Delete(ctx, record.PoolID, record.C)
+				if err != nil {
+					return
+				}
+				if err = tx.InsertEvents(ctx, []storage.Event{
+					m.a.event(ctx, storage.EventSplit, record),
+					m.a.event(ctx, storage.EventRemove, storage.Record{PoolID: poolID, C: c}),
+				}); err != nil {
+					return
+				}
+				if err = tx.InsertMany(ctx, splitDown(&record, c)); err != nil {
+					return
+				}
+				return tx.SetRoots(ctx, poolID, subtractBlock(roots, c))
+			}
+			size := new(big.Int)
+			for _, record := range records {
+				size.Add(size, record.C.Size())
+				if record.RequestID != "" {
+					allocated = append(allocated, record)
+				}
+			}
+			if size.Cmp(c.Size()) != 0 {
+				return fmt.Errorf(`%w: %s`, ErrRangeNotInPool, c)
+			}
+			var events []storage.Event
+			for _, record := range records {
+				if len(allocated) == 0 {
+					events = append(events, m.a.event(ctx, storage.EventRemove, record))
+				} else if !record.Retired {
+					events = append(events, m.a.event(ctx, storage.EventRetire, record))
+				}
+				if record.RequestID == "" {
+					err = tx.Delete(ctx, record.PoolID, record.C)
+					if err != nil {
+						return
+					}
+				}
+			}
+			if len(allocated) == 0 {
+				if err = tx.InsertEvents(ctx, events); err != nil {
+					return
+				}
+				return tx.SetRoots(ctx, poolID, subtractBlock(roots, c))
+			}
+			for i := range allocated {
+				if !allocated[i].Retired {
+					allocated[i].Retired = true
+					err = tx.Update(ctx, allocated[i])
+					if err != nil {
+						return
+					}
+				}
+			}
+			if err = tx.InsertEvents(ctx, events); err != nil {
+				return
+			}
+			for _, record := range records {
+				if record.RequestID == "" {
+					record.Retired = true
+					err = m.a.insertFree(ctx, tx, record)
+					if err != nil {
+						return
+					}
+				}
+			}
+			return
+		})
+	})
+	if err != nil {
+		allocated = nil
+	}
+	return
+}
+
+// RenamePool renames the pool identified by poolID.
+// Returns ErrPoolNotFound if no such pool exists, and ErrPoolNameConflict if another pool is named name.
+func (m *PoolManager) RenamePool(ctx context.Context, poolID int, name string) (err error) {
+	ctx, end := m.a.measure(ctx, &err, attributePoolID.Int(poolID))
+	defer end()
+	if name == "" {
+		return errors.New("pool name must not be empty")
+	}
+	return m.a.retry(ctx, func(ctx context.Context) error {
+		return m.a.doTransaction(ctx, &sql.TxOptions{
+			Isolation: sql.LevelSerializable,
+			ReadOnly:  false,
+		}, func(tx storage.Transaction) (err error) {
+			pools, err := tx.ListPools(ctx)
+			if err != nil {
+				return
+			}
+			found := false
+			for _, other := range pools {
+				if other.ID == poolID {
+					found = true
+				} else if other.Name == name {
+					return fmt.Errorf(`%w: %#v`, ErrPoolNameConflict, name)
+				}
+			}
+			if !found {
+				return ErrPoolNotFound
+			}
+			return tx.UpdatePool(ctx, storage.Pool{ID: poolID, Name: name})
+		})
+	})
+}
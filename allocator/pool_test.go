@@ -0,0 +1,185 @@
+package allocator
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+	"github.com/jbrekelmans/go-sql-ip-management/storage/memory"
+)
+
+func Test_PoolManager(t *testing.T) {
+	ctx := context.Background()
+	t.Run("CreatePool", func(t *testing.T) {
+		s := memory.NewMemoryStorage()
+		m := NewPoolManager(s, WithLogger(zerolog.Nop()))
+		pool1, err := m.CreatePool(ctx, "pool1", cidr.MustParseCIDR("10.0.0.0/16"), cidr.MustParseCIDR("10.1.0.0/16"))
+		require.NoError(t, err)
+		assert.Equal(t, &storage.Pool{ID: 1, Name: "pool1"}, pool1)
+		pool2, err := m.CreatePool(ctx, "pool2", cidr.MustParseCIDR("10.0.0.0/16"))
+		require.NoError(t, err)
+		assert.Equal(t, &storage.Pool{ID: 2, Name: "pool2"}, pool2)
+		_, err = m.CreatePool(ctx, "pool1")
+		assert.ErrorIs(t, err, ErrPoolNameConflict)
+		_, err = m.CreatePool(ctx, "pool3", cidr.MustParseCIDR("10.0.0.0/16"), cidr.MustParseCIDR("10.0.0.0/24"))
+		assert.ErrorContains(t, err, "overlaps")
+		a := New(s, WithLogger(zerolog.Nop()), WithPoolID(pool1.ID))
+		_, err = a.Allocate(ctx, cidr.IPv4, 16, "a")
+		require.NoError(t, err)
+		_, err = a.Allocate(ctx, cidr.IPv4, 16, "b")
+		require.NoError(t, err)
+		_, err = a.Allocate(ctx, cidr.IPv4, 16, "c")
+		assert.ErrorIs(t, err, ErrPoolExhausted)
+		pools, err := m.ListPools(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []storage.Pool{*pool1, *pool2}, pools)
+	})
+	t.Run("AddRange", func(t *testing.T) {
+		s := memory.NewMemoryStorage()
+		m := NewPoolManager(s, WithLogger(zerolog.Nop()))
+		pool, err := m.CreatePool(ctx, "pool1", cidr.MustParseCIDR("10.0.0.0/24"))
+		require.NoError(t, err)
+		a := New(s, WithLogger(zerolog.Nop()), WithPoolID(pool.ID))
+		_, err = a.Allocate(ctx, cidr.IPv4, 24, "a")
+		require.NoError(t, err)
+		_, err = a.Allocate(ctx, cidr.IPv4, 24, "b")
+		assert.ErrorIs(t, err, ErrPoolExhausted)
+		assert.ErrorIs(t, m.AddRange(ctx, pool.ID, cidr.MustParseCIDR("10.0.0.128/25")), ErrRangeOverlap)
+		assert.ErrorIs(t, m.AddRange(ctx, 2, cidr.MustParseCIDR("10.0.1.0/24")), ErrPoolNotFound)
+		require.NoError(t, m.AddRange(ctx, pool.ID, cidr.MustParseCIDR("10.0.1.0/24")))
+		c, err := a.Allocate(ctx, cidr.IPv4, 24, "b")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.1.0/24", c.String())
+		_, err = a.Deallocate(ctx, "a")
+		require.NoError(t, err)
+		_, err = a.Deallocate(ctx, "b")
+		require.NoError(t, err)
+		assert.Equal(t, &storage.Record{PoolID: 1, C: cidr.MustParseCIDR("10.0.0.0/23")}, testGet(t, s, "10.0.0.0/23"))
+	})
+	t.Run("RetireRange", func(t *testing.T) {
+		s := memory.NewMemoryStorage()
+		m := NewPoolManager(s, WithLogger(zerolog.Nop()))
+		pool, err := m.CreatePool(ctx, "pool1", cidr.MustParseCIDR("10.0.0.0/16"), cidr.MustParseCIDR("10.2.0.0/16"))
+		require.NoError(t, err)
+		a := New(s, WithLogger(zerolog.Nop()), WithPoolID(pool.ID))
+		require.NoError(t, a.AllocateSpecific(ctx, cidr.MustParseCIDR("10.2.3.0/24"), "a"))
+		allocated, err := m.RetireRange(ctx, pool.ID, cidr.MustParseCIDR("10.2.0.0/16"))
+		require.NoError(t, err)
+		assert.Equal(t, []storage.Record{{PoolID: 1, C: cidr.MustParseCIDR("10.2.3.0/24"), RequestID: "a", Retired: true}}, allocated)
+		assert.Equal(t, &storage.Record{PoolID: 1, C: cidr.MustParseCIDR("10.2.128.0/17"), Retired: true}, testGet(t, s, "10.2.128.0/17"))
+		for i := 0; i < 256; i++ {
+			c, err := a.Allocate(ctx, cidr.IPv4, 24, fmt.Sprintf("b%d", i))
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("10.0.%d.0/24", i), c.String())
+		}
+		_, err = a.Allocate(ctx, cidr.IPv4, 24, "c")
+		assert.ErrorIs(t, err, ErrPoolExhausted)
+		assert.ErrorIs(t, a.AllocateSpecific(ctx, cidr.MustParseCIDR("10.2.4.0/24"), "c"), ErrRangeUnavailable)
+		_, err = a.Deallocate(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, &storage.Record{PoolID: 1, C: cidr.MustParseCIDR("10.2.0.0/16"), Retired: true}, testGet(t, s, "10.2.0.0/16"))
+		allocated, err = m.RetireRange(ctx, pool.ID, cidr.MustParseCIDR("10.2.0.0/16"))
+		require.NoError(t, err)
+		assert.Empty(t, allocated)
+		assert.Nil(t, testGet(t, s, "10.2.0.0/16"))
+		events, err := a.HistoryOfRequest(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, []string{
+			"allocate 10.2.3.0/24 a ",
+			"retire 10.2.3.0/24 a ",
+			"release 10.2.3.0/24 a ",
+		}, eventStrings(events))
+		events, err = a.History(ctx, cidr.MustParseCIDR("10.2.0.0/16"))
+		require.NoError(t, err)
+		require.NotEmpty(t, events)
+		assert.Equal(t, "remove 10.2.0.0/16  ", eventStrings(events)[len(events)-1])
+		_, err = m.RetireRange(ctx, pool.ID, cidr.MustParseCIDR("10.2.0.0/16"))
+		assert.ErrorIs(t, err, ErrRangeNotInPool)
+		_, err = m.RetireRange(ctx, pool.ID, cidr.MustParseCIDR("10.0.0.0/15"))
+		assert.ErrorIs(t, err, ErrRangeNotInPool)
+		_, err = m.RetireRange(ctx, pool.ID, cidr.MustParseCIDR("10.0.0.0/25"))
+		assert.ErrorIs(t, err, ErrRangeUnavailable)
+	})
+	t.Run("RetireRangeFree", func(t *testing.T) {
+		s := memory.NewMemoryStorage()
+		m := NewPoolManager(s, WithLogger(zerolog.Nop()))
+		pool, err := m.CreatePool(ctx, "pool1", cidr.MustParseCIDR("10.0.0.0/16"))
+		require.NoError(t, err)
+		allocated, err := m.RetireRange(ctx, pool.ID, cidr.MustParseCIDR("10.0.0.0/17"))
+		require.NoError(t, err)
+		assert.Empty(t, allocated)
+		assert.Nil(t, testGet(t, s, "10.0.0.0/16"))
+		assert.Nil(t, testGet(t, s, "10.0.0.0/17"))
+		assert.Equal(t, &storage.Record{PoolID: 1, C: cidr.MustParseCIDR("10.0.128.0/17")}, testGet(t, s, "10.0.128.0/17"))
+		events, err := New(s, WithLogger(zerolog.Nop()), WithPoolID(pool.ID)).History(ctx, cidr.MustParseCIDR("10.0.0.0/17"))
+		require.NoError(t, err)
+		assert.Equal(t, []string{"split 10.0.0.0/16  ", "remove 10.0.0.0/17  "}, eventStrings(events))
+	})
+	t.Run("RenamePool", func(t *testing.T) {
+		m := NewPoolManager(memory.NewMemoryStorage(), WithLogger(zerolog.Nop()))
+		pool1, err := m.CreatePool(ctx, "pool1")
+		require.NoError(t, err)
+		_, err = m.CreatePool(ctx, "pool2")
+		require.NoError(t, err)
+		require.NoError(t, m.RenamePool(ctx, pool1.ID, "pool3"))
+		pool, err := m.GetPool(ctx, pool1.ID)
+		require.NoError(t, err)
+		assert.Equal(t, &storage.Pool{ID: pool1.ID, Name: "pool3"}, pool)
+		assert.ErrorIs(t, m.RenamePool(ctx, pool1.ID, "pool2"), ErrPoolNameConflict)
+		assert.ErrorIs(t, m.RenamePool(ctx, 3, "pool4"), ErrPoolNotFound)
+	})
+	t.Run("DeletePool", func(t *testing.T) {
+		s := memory.NewMemoryStorage()
+		m := NewPoolManager(s, WithLogger(zerolog.Nop()))
+		pool, err := m.CreatePool(ctx, "pool1", cidr.MustParseCIDR("10.0.0.0/16"))
+		require.NoError(t, err)
+		a := New(s, WithLogger(zerolog.Nop()), WithPoolID(pool.ID))
+		_, err = a.Allocate(ctx, cidr.IPv4, 24, "a")
+		require.NoError(t, err)
+		assert.ErrorIs(t, m.DeletePool(ctx, pool.ID, false), ErrPoolNotEmpty)
+		require.NoError(t, m.DeletePool(ctx, pool.ID, true))
+		_, err = m.GetPool(ctx, pool.ID)
+		assert.ErrorIs(t, err, ErrPoolNotFound)
+		_, err = a.Lookup(ctx, "a")
+		assert.ErrorIs(t, err, ErrPoolNotFound)
+		assert.ErrorIs(t, m.DeletePool(ctx, pool.ID, false), ErrPoolNotFound)
+	})
+	t.Run("PoolSnapshotAt", func(t *testing.T) {
+		s := memory.NewMemoryStorage()
+		m := NewPoolManager(s, WithLogger(zerolog.Nop()))
+		created := time.Now()
+		pool, err := m.CreatePool(ctx, "pool1", cidr.MustParseCIDR("10.0.0.0/24"))
+		require.NoError(t, err)
+		a := New(s, WithLogger(zerolog.Nop()), WithPoolID(pool.ID))
+		_, err = a.Allocate(ctx, cidr.IPv4, 25, "a")
+		require.NoError(t, err)
+		allocated := time.Now()
+		require.NoError(t, a.SetLabels(ctx, "a", map[string]string{"team": "payments"}))
+		labeled := time.Now()
+		_, err = a.Deallocate(ctx, "a")
+		require.NoError(t, err)
+
+		snapshot := func(at time.Time) []string {
+			records, err := m.PoolSnapshotAt(ctx, pool.ID, at)
+			require.NoError(t, err)
+			var result []string
+			for _, record := range records {
+				result = append(result, fmt.Sprintf("%s %q %v", record.C, record.RequestID, record.Labels))
+			}
+			return result
+		}
+		assert.Empty(t, snapshot(created))
+		assert.Equal(t, []string{`10.0.0.0/25 "a" map[]`, `10.0.0.128/25 "" map[]`}, snapshot(allocated))
+		assert.Equal(t, []string{`10.0.0.0/25 "a" map[team:payments]`, `10.0.0.128/25 "" map[]`}, snapshot(labeled))
+		assert.Equal(t, []string{`10.0.0.0/24 "" map[]`}, snapshot(time.Now()))
+		_, err = m.PoolSnapshotAt(ctx, 2, time.Now())
+		assert.ErrorIs(t, err, ErrPoolNotFound)
+	})
+}
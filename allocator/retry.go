@@ -0,0 +1,129 @@
+package allocator
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+// RetryPolicy determines which failed transactions are retried, how often,
+// and how long to wait between attempts.
+//
+// The wait before the n-th retry is InitialBackoff * Multiplier^(n-1), capped at MaxBackoff,
+// and then reduced by a random fraction of at most Jitter.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of times an operation is attempted.
+	// Values less than 1 are treated as 1.
+	MaxAttempts int
+
+	// InitialBackoff is the wait before the first retry.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the wait between attempts. Zero means no cap.
+	MaxBackoff time.Duration
+
+	// Multiplier is the factor by which the wait grows after each retry.
+	// Values less than 1 are treated as 1.
+	Multiplier float64
+
+	// Jitter is the maximum fraction (between 0 and 1) by which the wait is randomly reduced,
+	// so that concurrent transactions that conflicted do not retry in lockstep.
+	Jitter float64
+
+	// Classifier determines which errors are retried.
+	// If nil then the Storage is used if it implements storage.RetryClassifier,
+	// and otherwise no errors are retried.
+	Classifier storage.RetryClassifier
+}
+
+// DefaultRetryPolicy returns the RetryPolicy used by Allocators that are not configured
+// using WithRetryPolicy.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    10,
+		InitialBackoff: 5 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+		Jitter:         0.5,
+	}
+}
+
+// NoRetryPolicy returns a RetryPolicy that does not retry.
+func NoRetryPolicy() RetryPolicy {
+	return RetryPolicy{MaxAttempts: 1}
+}
+
+// backoff returns the wait before retrying after the attempt-th attempt failed.
+// r is a random number in [0, 1).
+func (p *RetryPolicy) backoff(attempt int, r float64) time.Duration {
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	d := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		d *= multiplier
+		if p.MaxBackoff > 0 && d >= float64(p.MaxBackoff) {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	jitter := p.Jitter
+	if jitter < 0 {
+		jitter = 0
+	} else if jitter > 1 {
+		jitter = 1
+	}
+	return time.Duration(d * (1 - jitter*r))
+}
+
+func (a *Allocator) isRetryable(err error) bool {
+	classifier := a.retryPolicy.Classifier
+	if classifier == nil {
+		var ok bool
+		classifier, ok = a.s.(storage.RetryClassifier)
+		if !ok {
+			return false
+		}
+	}
+	return classifier.IsRetryable(err)
+}
+
+// retry calls f until it succeeds, returns an error that is not retryable,
+// the maximum number of attempts is reached, or ctx is done.
+// In the latter two cases the error of the last attempt is wrapped so that it matches ErrRetryable.
+// f is passed ctx with the attempt number (starting at 1), which is an attribute of the spans of the attempt.
+func (a *Allocator) retry(ctx context.Context, f func(ctx context.Context) error) (err error) {
+	for attempt := 1; ; attempt++ {
+		err = f(context.WithValue(ctx, attemptKey{}, attempt))
+		if err == nil || !a.isRetryable(err) {
+			return
+		}
+		if attempt >= a.retryPolicy.MaxAttempts {
+			err = &retryableError{err: err}
+			return
+		}
+		if a.observer != nil {
+			a.observer.ObserveRetry(err)
+		}
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(attributeAttempt.Int(attempt),
+			attribute.String("error", err.Error())))
+		wait := a.retryPolicy.backoff(attempt, rand.Float64())
+		a.logger.Debug().Err(err).Int("attempt", attempt).Dur("wait", wait).Msg("retrying on expected concurrency error")
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			err = &retryableError{err: err}
+			return
+		case <-timer.C:
+		}
+	}
+}
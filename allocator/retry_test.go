@@ -0,0 +1,88 @@
+package allocator
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+func Test_RetryPolicy(t *testing.T) {
+	t.Run("Backoff", func(t *testing.T) {
+		p := RetryPolicy{
+			InitialBackoff: 10 * time.Millisecond,
+			MaxBackoff:     50 * time.Millisecond,
+			Multiplier:     2,
+			Jitter:         0.5,
+		}
+		assert.Equal(t, 10*time.Millisecond, p.backoff(1, 0))
+		assert.Equal(t, 20*time.Millisecond, p.backoff(2, 0))
+		assert.Equal(t, 40*time.Millisecond, p.backoff(3, 0))
+		assert.Equal(t, 50*time.Millisecond, p.backoff(4, 0))
+		assert.Equal(t, 50*time.Millisecond, p.backoff(100, 0))
+		assert.Equal(t, 5*time.Millisecond, p.backoff(1, 1))
+	})
+	t.Run("Retry", func(t *testing.T) {
+		errTransient := errors.New("transient")
+		errPermanent := errors.New("permanent")
+		newAllocator := func(maxAttempts int) *Allocator {
+			return New(nil, WithLogger(zerolog.Nop()), WithRetryPolicy(RetryPolicy{
+				MaxAttempts: maxAttempts,
+				Classifier: storage.RetryClassifierFunc(func(err error) bool {
+					return errors.Is(err, errTransient)
+				}),
+			}))
+		}
+		t.Run("Case1", func(t *testing.T) {
+			attempts := 0
+			err := newAllocator(3).retry(context.Background(), func(context.Context) error {
+				attempts++
+				if attempts < 3 {
+					return errTransient
+				}
+				return nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, 3, attempts)
+		})
+		t.Run("Case2", func(t *testing.T) {
+			attempts := 0
+			err := newAllocator(3).retry(context.Background(), func(context.Context) error {
+				attempts++
+				return errTransient
+			})
+			assert.ErrorIs(t, err, errTransient)
+			assert.ErrorIs(t, err, ErrRetryable)
+			assert.Equal(t, 3, attempts)
+		})
+		t.Run("Case3", func(t *testing.T) {
+			attempts := 0
+			err := newAllocator(3).retry(context.Background(), func(context.Context) error {
+				attempts++
+				return errPermanent
+			})
+			assert.ErrorIs(t, err, errPermanent)
+			assert.NotErrorIs(t, err, ErrRetryable)
+			assert.Equal(t, 1, attempts)
+		})
+		t.Run("Case4", func(t *testing.T) {
+			a := newAllocator(3)
+			a.retryPolicy.InitialBackoff = time.Hour
+			ctx, cancel := context.WithCancel(context.Background())
+			attempts := 0
+			err := a.retry(ctx, func(context.Context) error {
+				attempts++
+				cancel()
+				return errTransient
+			})
+			assert.ErrorIs(t, err, errTransient)
+			assert.ErrorIs(t, err, ErrRetryable)
+			assert.Equal(t, 1, attempts)
+		})
+	})
+}
@@ -0,0 +1,129 @@
+package allocator
+
+import (
+	"context"
+	"database/sql"
+	"math/big"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+// PoolStats are utilization statistics of a pool.
+type PoolStats struct {
+	IPv4 FamilyStats
+	IPv6 FamilyStats
+}
+
+// Family returns the statistics of the ranges of address family family.
+func (s *PoolStats) Family(family cidr.Family) *FamilyStats {
+	if family == cidr.IPv6 {
+		return &s.IPv6
+	}
+	return &s.IPv4
+}
+
+// FamilyStats are utilization statistics of the ranges of one address family of a pool.
+// Address counts are big.Int, because IPv6 counts do not fit in 64 bits.
+// Total is the sum of Allocated, Free and Retired.
+type FamilyStats struct {
+	// Total is the number of IP addresses of the pool.
+	Total *big.Int
+	// Allocated is the number of allocated IP addresses, including allocated IP addresses in retired ranges.
+	Allocated *big.Int
+	// Free is the number of IP addresses that can be allocated (free IP addresses that are not retired).
+	Free *big.Int
+	// Retired is the number of free IP addresses that are retired, and thus can not be allocated.
+	Retired *big.Int
+	// FreeBlocks is a histogram of the free ranges that are not retired:
+	// FreeBlocks[prefixBits] is the number of such ranges with prefix length prefixBits.
+	FreeBlocks map[int]int
+	// LargestFreePrefixBits is the prefix length of the largest range that can be allocated, or -1 if no range
+	// can be allocated. Allocate fails with ErrPoolExhausted for any prefix length less than LargestFreePrefixBits.
+	LargestFreePrefixBits int
+	// Fragmentation is the fraction of the free IP addresses that are not in the largest free range, from 0 (all
+	// free IP addresses are in one range, or there are none) to almost 1 (free IP addresses are scattered over
+	// many small ranges).
+	Fragmentation float64
+}
+
+func newFamilyStats() FamilyStats {
+	return FamilyStats{
+		Total:                 new(big.Int),
+		Allocated:             new(big.Int),
+		Free:                  new(big.Int),
+		Retired:               new(big.Int),
+		FreeBlocks:            map[int]int{},
+		LargestFreePrefixBits: -1,
+	}
+}
+
+// add adds the ranges counted by count to s.
+func (s *FamilyStats) add(count storage.RecordCount) {
+	size := new(big.Int).Lsh(big.NewInt(int64(count.Count)), uint(count.Family.Bits()-count.PrefixBits))
+	s.Total.Add(s.Total, size)
+	switch {
+	case count.Allocated:
+		s.Allocated.Add(s.Allocated, size)
+	case count.Retired:
+		s.Retired.Add(s.Retired, size)
+	default:
+		s.Free.Add(s.Free, size)
+		s.FreeBlocks[count.PrefixBits] += count.Count
+		if s.LargestFreePrefixBits < 0 || count.PrefixBits < s.LargestFreePrefixBits {
+			s.LargestFreePrefixBits = count.PrefixBits
+		}
+	}
+}
+
+// computeFragmentation computes s.Fragmentation as (number of free IP addresses - size of the largest free range) /
+// (number of free IP addresses).
+func (s *FamilyStats) computeFragmentation(family cidr.Family) {
+	if s.LargestFreePrefixBits < 0 {
+		s.Fragmentation = 0
+		return
+	}
+	largest := new(big.Int).Lsh(big.NewInt(1), uint(family.Bits()-s.LargestFreePrefixBits))
+	notLargest := new(big.Int).Sub(s.Free, largest)
+	s.Fragmentation, _ = new(big.Float).Quo(new(big.Float).SetInt(notLargest), new(big.Float).SetInt(s.Free)).Float64()
+}
+
+// PoolStats computes utilization statistics of the pool identified by poolID, such as the number of free IP addresses
+// and the largest range that can be allocated, in one read-only transaction.
+// Returns ErrPoolNotFound if the pool does not exist.
+func (m *PoolManager) PoolStats(ctx context.Context, poolID int) (stats *PoolStats, err error) {
+	ctx, end := m.a.measure(ctx, &err, attributePoolID.Int(poolID))
+	defer end()
+	err = m.a.retry(ctx, func(ctx context.Context) error {
+		return m.a.doTransaction(ctx, &sql.TxOptions{
+			ReadOnly:  true,
+			Isolation: sql.LevelRepeatableRead,
+		}, func(tx storage.Transaction) (err error) {
+			pool, err := tx.GetPool(ctx, poolID)
+			if err != nil {
+				return
+			}
+			if pool == nil {
+				return ErrPoolNotFound
+			}
+			counts, err := tx.CountRecords(ctx, poolID)
+			if err != nil {
+				return
+			}
+			stats = &PoolStats{
+				IPv4: newFamilyStats(),
+				IPv6: newFamilyStats(),
+			}
+			for _, count := range counts {
+				stats.Family(count.Family).add(count)
+			}
+			return
+		})
+	})
+	if err != nil {
+		return
+	}
+	stats.IPv4.computeFragmentation(cidr.IPv4)
+	stats.IPv6.computeFragmentation(cidr.IPv6)
+	return
+}
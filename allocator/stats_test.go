@@ -0,0 +1,54 @@
+package allocator
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage/memory"
+)
+
+func Test_PoolStats(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewMemoryStorage()
+	m := NewPoolManager(s, WithLogger(zerolog.Nop()))
+	pool, err := m.CreatePool(ctx, "pool1", cidr.MustParseCIDR("10.0.0.0/24"), cidr.MustParseCIDR("10.2.0.0/24"),
+		cidr.MustParseCIDR("fd00::/64"))
+	require.NoError(t, err)
+	a := New(s, WithLogger(zerolog.Nop()), WithPoolID(pool.ID))
+	_, err = a.Allocate(ctx, cidr.IPv4, 26, "a")
+	require.NoError(t, err)
+	require.NoError(t, a.AllocateSpecific(ctx, cidr.MustParseCIDR("10.2.0.0/26"), "b"))
+	_, err = m.RetireRange(ctx, pool.ID, cidr.MustParseCIDR("10.2.0.0/24"))
+	require.NoError(t, err)
+	_, err = a.Allocate(ctx, cidr.IPv6, 64, "c")
+	require.NoError(t, err)
+
+	stats, err := m.PoolStats(ctx, pool.ID)
+	require.NoError(t, err)
+	assert.Equal(t, FamilyStats{
+		Total:                 big.NewInt(512),
+		Allocated:             big.NewInt(128),
+		Free:                  big.NewInt(192),
+		Retired:               big.NewInt(192),
+		FreeBlocks:            map[int]int{25: 1, 26: 1},
+		LargestFreePrefixBits: 25,
+		Fragmentation:         64.0 / 192.0,
+	}, stats.IPv4)
+	assert.Equal(t, FamilyStats{
+		Total:                 new(big.Int).Lsh(big.NewInt(1), 64),
+		Allocated:             new(big.Int).Lsh(big.NewInt(1), 64),
+		Free:                  new(big.Int),
+		Retired:               new(big.Int),
+		FreeBlocks:            map[int]int{},
+		LargestFreePrefixBits: -1,
+	}, stats.IPv6)
+
+	_, err = m.PoolStats(ctx, pool.ID+1)
+	assert.ErrorIs(t, err, ErrPoolNotFound)
+}
@@ -0,0 +1,308 @@
+package allocator
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+// tracerName is the name of the OpenTelemetry tracer of this package.
+const tracerName = "github.com/jbrekelmans/go-sql-ip-management/allocator"
+
+// Attributes of spans.
+const (
+	attributeAttempt          = attribute.Key("ipam.attempt")
+	attributeCIDR             = attribute.Key("ipam.cidr")
+	attributeEvents           = attribute.Key("ipam.events")
+	attributeFamily           = attribute.Key("ipam.family")
+	attributeIPv4PrefixLength = attribute.Key("ipam.ipv4_prefix_length")
+	attributeIPv6PrefixLength = attribute.Key("ipam.ipv6_prefix_length")
+	attributeIsolation        = attribute.Key("ipam.isolation")
+	attributeLimit            = attribute.Key("ipam.limit")
+	attributePoolID           = attribute.Key("ipam.pool_id")
+	attributePoolName         = attribute.Key("ipam.pool_name")
+	attributePrefixLength     = attribute.Key("ipam.prefix_length")
+	attributeReadOnly         = attribute.Key("ipam.read_only")
+	attributeRecords          = attribute.Key("ipam.records")
+	attributeRequestID        = attribute.Key("ipam.request_id")
+)
+
+// WithTracerProvider sets the provider of the OpenTelemetry tracer used to trace operations.
+// Defaults to the global tracer provider (see go.opentelemetry.io/otel.GetTracerProvider).
+//
+// Each operation (e.g. Allocate) is traced as a span named after the method (e.g. "allocator.Allocate"), which is a
+// child of the span of the context passed to the method. Each transaction is a child span "storage.Transaction",
+// and each method of storage.Transaction is a child span of the transaction (e.g. "storage.FindSmallestFree").
+// Spans have attributes such as ipam.pool_id, ipam.prefix_length and ipam.attempt (the attempt number of the retry
+// policy). Retries are recorded as events "retry" of the span of the operation.
+func WithTracerProvider(tracerProvider trace.TracerProvider) Option {
+	return func(a *Allocator) {
+		a.tracer = tracerProvider.Tracer(tracerName)
+	}
+}
+
+// attemptKey is the context key of the attempt number of the retry policy.
+type attemptKey struct{}
+
+// startSpan starts a span that is a child of the span of ctx, with the attempt number of ctx (if any) as attribute.
+// The returned function ends the span, recording *err if it is not nil.
+func startSpan(ctx context.Context, tracer trace.Tracer, name string, err *error,
+	attrs ...attribute.KeyValue) (context.Context, func()) {
+	if attempt, ok := ctx.Value(attemptKey{}).(int); ok {
+		attrs = append(attrs, attributeAttempt.Int(attempt))
+	}
+	ctx, span := tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	return ctx, func() {
+		if *err != nil {
+			span.RecordError(*err)
+			span.SetStatus(codes.Error, (*err).Error())
+		}
+		span.End()
+	}
+}
+
+func transactionAttributes(txOpts *sql.TxOptions) []attribute.KeyValue {
+	if txOpts == nil {
+		return nil
+	}
+	return []attribute.KeyValue{
+		attributeIsolation.String(txOpts.Isolation.String()),
+		attributeReadOnly.Bool(txOpts.ReadOnly),
+	}
+}
+
+// tracedTransaction is a storage.Transaction that traces each method as a child span of the span of ctx.
+// The context passed to a method is only used for cancellation and the attempt number.
+type tracedTransaction struct {
+	ctx    context.Context
+	tracer trace.Tracer
+	tx     storage.Transaction
+}
+
+var _ storage.Transaction = (*tracedTransaction)(nil)
+
+func (t *tracedTransaction) start(ctx context.Context, name string, err *error,
+	attrs ...attribute.KeyValue) (context.Context, func()) {
+	return startSpan(trace.ContextWithSpan(ctx, trace.SpanFromContext(t.ctx)), t.tracer, "storage."+name, err, attrs...)
+}
+
+func (t *tracedTransaction) Commit() (err error) {
+	_, end := t.start(t.ctx, "Commit", &err)
+	defer end()
+	return t.tx.Commit()
+}
+
+func (t *tracedTransaction) CountRecords(ctx context.Context, poolID int) (counts []storage.RecordCount, err error) {
+	ctx, end := t.start(ctx, "CountRecords", &err, attributePoolID.Int(poolID))
+	defer end()
+	return t.tx.CountRecords(ctx, poolID)
+}
+
+func (t *tracedTransaction) Delete(ctx context.Context, poolID int, c cidr.CIDR) (err error) {
+	ctx, end := t.start(ctx, "Delete", &err, attributePoolID.Int(poolID), attributeCIDR.String(c.String()))
+	defer end()
+	return t.tx.Delete(ctx, poolID, c)
+}
+
+func (t *tracedTransaction) DeleteHost(ctx context.Context, poolID int, subnet cidr.CIDR,
+	requestID string) (err error) {
+	ctx, end := t.start(ctx, "DeleteHost", &err, attributePoolID.Int(poolID), attributeCIDR.String(subnet.String()),
+		attributeRequestID.String(requestID))
+	defer end()
+	return t.tx.DeleteHost(ctx, poolID, subnet, requestID)
+}
+
+func (t *tracedTransaction) DeletePool(ctx context.Context, poolID int) (err error) {
+	ctx, end := t.start(ctx, "DeletePool", &err, attributePoolID.Int(poolID))
+	defer end()
+	return t.tx.DeletePool(ctx, poolID)
+}
+
+func (t *tracedTransaction) FindAllocated(ctx context.Context, poolID int, requestID string) (records []storage.Record,
+	err error) {
+	ctx, end := t.start(ctx, "FindAllocated", &err, attributePoolID.Int(poolID), attributeRequestID.String(requestID))
+	defer end()
+	return t.tx.FindAllocated(ctx, poolID, requestID)
+}
+
+func (t *tracedTransaction) FindSmallestFree(ctx context.Context, poolID int, family cidr.Family,
+	prefixBits int) (record *storage.Record, err error) {
+	ctx, end := t.start(ctx, "FindSmallestFree", &err, attributePoolID.Int(poolID), attributeFamily.Int(int(family)),
+		attributePrefixLength.Int(prefixBits))
+	defer end()
+	return t.tx.FindSmallestFree(ctx, poolID, family, prefixBits)
+}
+
+func (t *tracedTransaction) FindExpired(ctx context.Context, poolID int, now time.Time, limit int) (records []storage.Record,
+	err error) {
+	ctx, end := t.start(ctx, "FindExpired", &err, attributePoolID.Int(poolID), attributeLimit.Int(limit))
+	defer end()
+	return t.tx.FindExpired(ctx, poolID, now, limit)
+}
+
+func (t *tracedTransaction) FindOverlapping(ctx context.Context, poolID int, c cidr.CIDR) (records []storage.Record,
+	err error) {
+	ctx, end := t.start(ctx, "FindOverlapping", &err, attributePoolID.Int(poolID), attributeCIDR.String(c.String()))
+	defer end()
+	return t.tx.FindOverlapping(ctx, poolID, c)
+}
+
+func (t *tracedTransaction) FindHost(ctx context.Context, poolID int, subnet cidr.CIDR, requestID string) (
+	host *storage.Host, err error) {
+	ctx, end := t.start(ctx, "FindHost", &err, attributePoolID.Int(poolID), attributeCIDR.String(subnet.String()),
+		attributeRequestID.String(requestID))
+	defer end()
+	return t.tx.FindHost(ctx, poolID, subnet, requestID)
+}
+
+func (t *tracedTransaction) Get(ctx context.Context, poolID int, c cidr.CIDR) (record *storage.Record, err error) {
+	ctx, end := t.start(ctx, "Get", &err, attributePoolID.Int(poolID), attributeCIDR.String(c.String()))
+	defer end()
+	return t.tx.Get(ctx, poolID, c)
+}
+
+func (t *tracedTransaction) GetPool(ctx context.Context, poolID int) (pool *storage.Pool, err error) {
+	ctx, end := t.start(ctx, "GetPool", &err, attributePoolID.Int(poolID))
+	defer end()
+	return t.tx.GetPool(ctx, poolID)
+}
+
+func (t *tracedTransaction) GetHostSubnet(ctx context.Context, poolID int, c cidr.CIDR) (hostSubnet *storage.HostSubnet,
+	err error) {
+	ctx, end := t.start(ctx, "GetHostSubnet", &err, attributePoolID.Int(poolID), attributeCIDR.String(c.String()))
+	defer end()
+	return t.tx.GetHostSubnet(ctx, poolID, c)
+}
+
+func (t *tracedTransaction) InsertMany(ctx context.Context, records []storage.Record) (err error) {
+	attrs := []attribute.KeyValue{attributeRecords.Int(len(records))}
+	if len(records) > 0 {
+		attrs = append(attrs, attributePoolID.Int(records[0].PoolID))
+	}
+	ctx, end := t.start(ctx, "InsertMany", &err, attrs...)
+	defer end()
+	return t.tx.InsertMany(ctx, records)
+}
+
+func (t *tracedTransaction) InsertEvents(ctx context.Context, events []storage.Event) (err error) {
+	ctx, end := t.start(ctx, "InsertEvents", &err, attributeEvents.Int(len(events)))
+	defer end()
+	return t.tx.InsertEvents(ctx, events)
+}
+
+func (t *tracedTransaction) InsertHost(ctx context.Context, host storage.Host) (err error) {
+	ctx, end := t.start(ctx, "InsertHost", &err, attributePoolID.Int(host.PoolID),
+		attributeCIDR.String(host.Subnet.String()), attributeRequestID.String(host.RequestID))
+	defer end()
+	return t.tx.InsertHost(ctx, host)
+}
+
+func (t *tracedTransaction) InsertHostSubnet(ctx context.Context, hostSubnet storage.HostSubnet) (err error) {
+	ctx, end := t.start(ctx, "InsertHostSubnet", &err, attributePoolID.Int(hostSubnet.PoolID),
+		attributeCIDR.String(hostSubnet.C.String()))
+	defer end()
+	return t.tx.InsertHostSubnet(ctx, hostSubnet)
+}
+
+func (t *tracedTransaction) InsertPool(ctx context.Context, pool storage.Pool) (err error) {
+	ctx, end := t.start(ctx, "InsertPool", &err, attributePoolID.Int(pool.ID), attributePoolName.String(pool.Name))
+	defer end()
+	return t.tx.InsertPool(ctx, pool)
+}
+
+func (t *tracedTransaction) ListHostSubnets(ctx context.Context, poolID int) (hostSubnets []storage.HostSubnet,
+	err error) {
+	ctx, end := t.start(ctx, "ListHostSubnets", &err, attributePoolID.Int(poolID))
+	defer end()
+	return t.tx.ListHostSubnets(ctx, poolID)
+}
+
+func (t *tracedTransaction) ListHosts(ctx context.Context, poolID int, subnet cidr.CIDR) (hosts []storage.Host,
+	err error) {
+	ctx, end := t.start(ctx, "ListHosts", &err, attributePoolID.Int(poolID), attributeCIDR.String(subnet.String()))
+	defer end()
+	return t.tx.ListHosts(ctx, poolID, subnet)
+}
+
+func (t *tracedTransaction) ListPools(ctx context.Context) (pools []storage.Pool, err error) {
+	ctx, end := t.start(ctx, "ListPools", &err)
+	defer end()
+	return t.tx.ListPools(ctx)
+}
+
+func (t *tracedTransaction) ListAllocations(ctx context.Context, poolID int, filter storage.ListFilter, after *cidr.CIDR,
+	limit int) (records []storage.Record, err error) {
+	ctx, end := t.start(ctx, "ListAllocations", &err, attributePoolID.Int(poolID), attributeLimit.Int(limit))
+	defer end()
+	return t.tx.ListAllocations(ctx, poolID, filter, after, limit)
+}
+
+func (t *tracedTransaction) ListEvents(ctx context.Context, poolID int, filter storage.EventFilter) (events []storage.Event,
+	err error) {
+	ctx, end := t.start(ctx, "ListEvents", &err, attributePoolID.Int(poolID))
+	defer end()
+	return t.tx.ListEvents(ctx, poolID, filter)
+}
+
+func (t *tracedTransaction) ListRecords(ctx context.Context, poolID int) (records []storage.Record, err error) {
+	ctx, end := t.start(ctx, "ListRecords", &err, attributePoolID.Int(poolID))
+	defer end()
+	return t.tx.ListRecords(ctx, poolID)
+}
+
+func (t *tracedTransaction) ListRecordsAt(ctx context.Context, poolID int, at time.Time) (records []storage.Record,
+	err error) {
+	ctx, end := t.start(ctx, "ListRecordsAt", &err, attributePoolID.Int(poolID))
+	defer end()
+	return t.tx.ListRecordsAt(ctx, poolID, at)
+}
+
+func (t *tracedTransaction) ListRoots(ctx context.Context, poolID int) (roots []cidr.CIDR, err error) {
+	ctx, end := t.start(ctx, "ListRoots", &err, attributePoolID.Int(poolID))
+	defer end()
+	return t.tx.ListRoots(ctx, poolID)
+}
+
+func (t *tracedTransaction) MaxPoolID(ctx context.Context) (maxPoolID int, err error) {
+	ctx, end := t.start(ctx, "MaxPoolID", &err)
+	defer end()
+	return t.tx.MaxPoolID(ctx)
+}
+
+func (t *tracedTransaction) Rollback() (err error) {
+	_, end := t.start(t.ctx, "Rollback", &err)
+	defer end()
+	return t.tx.Rollback()
+}
+
+func (t *tracedTransaction) SetRoots(ctx context.Context, poolID int, roots []cidr.CIDR) (err error) {
+	ctx, end := t.start(ctx, "SetRoots", &err, attributePoolID.Int(poolID))
+	defer end()
+	return t.tx.SetRoots(ctx, poolID, roots)
+}
+
+func (t *tracedTransaction) Update(ctx context.Context, record storage.Record) (err error) {
+	ctx, end := t.start(ctx, "Update", &err, attributePoolID.Int(record.PoolID), attributeCIDR.String(record.C.String()))
+	defer end()
+	return t.tx.Update(ctx, record)
+}
+
+func (t *tracedTransaction) UpdateHostSubnet(ctx context.Context, hostSubnet storage.HostSubnet) (err error) {
+	ctx, end := t.start(ctx, "UpdateHostSubnet", &err, attributePoolID.Int(hostSubnet.PoolID),
+		attributeCIDR.String(hostSubnet.C.String()))
+	defer end()
+	return t.tx.UpdateHostSubnet(ctx, hostSubnet)
+}
+
+func (t *tracedTransaction) UpdatePool(ctx context.Context, pool storage.Pool) (err error) {
+	ctx, end := t.start(ctx, "UpdatePool", &err, attributePoolID.Int(pool.ID), attributePoolName.String(pool.Name))
+	defer end()
+	return t.tx.UpdatePool(ctx, pool)
+}
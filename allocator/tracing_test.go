@@ -0,0 +1,110 @@
+package allocator
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+var errTestTransient = errors.New("transient")
+
+// flakyStorage is a storage.Storage of which the first commit fails with errTestTransient.
+type flakyStorage struct {
+	storage.Storage
+	failed bool
+}
+
+func (s *flakyStorage) BeginTransaction(ctx context.Context, txOpts *sql.TxOptions) (storage.Transaction, error) {
+	tx, err := s.Storage.BeginTransaction(ctx, txOpts)
+	if err != nil {
+		return nil, err
+	}
+	return &flakyTransaction{Transaction: tx, s: s}, nil
+}
+
+type flakyTransaction struct {
+	storage.Transaction
+	s *flakyStorage
+}
+
+func (t *flakyTransaction) Commit() error {
+	if !t.s.failed {
+		t.s.failed = true
+		if err := t.Transaction.Rollback(); err != nil {
+			return err
+		}
+		return errTestTransient
+	}
+	return t.Transaction.Commit()
+}
+
+func Test_Tracing(t *testing.T) {
+	ctx := context.Background()
+	_, s := testAllocator(t, "10.0.0.0/24")
+	recorder := tracetest.NewSpanRecorder()
+	retryPolicy := DefaultRetryPolicy()
+	retryPolicy.InitialBackoff = 0
+	retryPolicy.Classifier = storage.RetryClassifierFunc(func(err error) bool {
+		return errors.Is(err, errTestTransient)
+	})
+	a := New(&flakyStorage{Storage: s}, WithLogger(zerolog.Nop()), WithRetryPolicy(retryPolicy),
+		WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))))
+	_, err := a.Allocate(ctx, cidr.IPv4, 25, "a")
+	require.NoError(t, err)
+
+	spans := recorder.Ended()
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name())
+	}
+	// Spans end children first. The first attempt fails when committing the transaction that looks up requestID.
+	assert.Equal(t, []string{
+		"storage.FindAllocated", "storage.Commit", "storage.Transaction",
+		"storage.FindAllocated", "storage.Commit", "storage.Transaction",
+		"storage.FindSmallestFree", "storage.Delete", "storage.InsertMany", "storage.InsertEvents", "storage.Commit",
+		"storage.Transaction",
+		"allocator.Allocate",
+	}, names)
+	root := spans[len(spans)-1]
+	assert.False(t, root.Parent().IsValid())
+	assert.Contains(t, root.Attributes(), attributePoolID.Int(1))
+	assert.Contains(t, root.Attributes(), attributePrefixLength.Int(25))
+	assert.Contains(t, root.Attributes(), attributeRequestID.String("a"))
+	if assert.Len(t, root.Events(), 1) {
+		assert.Equal(t, "retry", root.Events()[0].Name)
+		assert.Contains(t, root.Events()[0].Attributes, attributeAttempt.Int(1))
+	}
+	for i, span := range spans[:len(spans)-1] {
+		attempt := 2
+		if i < 3 {
+			attempt = 1
+		}
+		assert.Contains(t, span.Attributes(), attributeAttempt.Int(attempt), span.Name())
+		if span.Name() == "storage.Transaction" {
+			assert.Equal(t, root.SpanContext().SpanID(), span.Parent().SpanID())
+			continue
+		}
+		// The parent of a storage method is the next transaction span.
+		for _, parent := range spans[i+1:] {
+			if parent.Name() == "storage.Transaction" {
+				assert.Equal(t, parent.SpanContext().SpanID(), span.Parent().SpanID(), span.Name())
+				break
+			}
+		}
+	}
+	assert.Equal(t, errTestTransient.Error(), spans[1].Status().Description)
+	assert.Contains(t, spans[6].Attributes(), attributePoolID.Int(1))
+	assert.Contains(t, spans[6].Attributes(), attributePrefixLength.Int(25))
+	assert.Contains(t, spans[11].Attributes(), attribute.String("ipam.isolation", sql.LevelSerializable.String()))
+}
@@ -0,0 +1,54 @@
+package allocator
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+// Watch sends the allocate and release events of the pool with IDs greater than afterID to the returned events
+// channel, ordered by ID: first the events that are already committed, and then the events of transactions as they
+// commit. To resume watching, for example after a restart, pass the ID of the last received event as afterID. Pass 0
+// to receive all events.
+//
+// The events channel is closed when watching ends, after which exactly one error is sent to the returned error
+// channel: ctx.Err() if ctx is done, ErrPoolNotFound if the pool does not exist, ErrWatchNotSupported if the storage
+// does not implement storage.Watcher, or the error of the storage.
+func (a *Allocator) Watch(ctx context.Context, afterID int64) (<-chan storage.Event, <-chan error) {
+	events := make(chan storage.Event)
+	errc := make(chan error, 1)
+	go func() {
+		err := a.watch(ctx, afterID, events)
+		close(events)
+		errc <- err
+	}()
+	return events, errc
+}
+
+func (a *Allocator) watch(ctx context.Context, afterID int64, events chan<- storage.Event) error {
+	watcher, ok := a.s.(storage.Watcher)
+	if !ok {
+		return ErrWatchNotSupported
+	}
+	err := a.retry(ctx, func(ctx context.Context) error {
+		return a.doTransaction(ctx, &sql.TxOptions{
+			ReadOnly:  true,
+			Isolation: sql.LevelReadUncommitted,
+		}, func(tx storage.Transaction) error {
+			return a.checkPoolExists(ctx, tx, nil)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	a.logger.Debug().Int("poolID", a.poolID).Int64("afterID", afterID).Msg("watching events")
+	return watcher.Watch(ctx, a.poolID, afterID, func(event storage.Event) error {
+		select {
+		case events <- event:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
@@ -0,0 +1,69 @@
+package allocator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+// receive receives an event from events, failing the test if none is received within a second.
+func receive(t *testing.T, events <-chan storage.Event) storage.Event {
+	t.Helper()
+	select {
+	case event, ok := <-events:
+		require.True(t, ok, "events channel closed")
+		return event
+	case <-time.After(time.Second):
+		require.Fail(t, "timed out waiting for an event")
+		return storage.Event{}
+	}
+}
+
+func Test_Watch(t *testing.T) {
+	ctx := context.Background()
+	a, s := testAllocator(t, "10.0.0.0/24")
+	_, err := a.Allocate(ctx, cidr.IPv4, 26, "a")
+	require.NoError(t, err)
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	events, errc := a.Watch(watchCtx, 0)
+	// Committed events are received first, without the split events.
+	first := receive(t, events)
+	assert.Equal(t, "allocate 10.0.0.0/26 a ", eventStrings([]storage.Event{first})[0])
+	_, err = a.Deallocate(ContextWithActor(ctx, "bob"), "a")
+	require.NoError(t, err)
+	second := receive(t, events)
+	assert.Equal(t, "release 10.0.0.0/26 a bob", eventStrings([]storage.Event{second})[0])
+	assert.Greater(t, second.ID, first.ID)
+	cancel()
+	for range events {
+	}
+	assert.ErrorIs(t, <-errc, context.Canceled)
+
+	// Resume from the first event.
+	watchCtx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	events, _ = a.Watch(watchCtx, first.ID)
+	assert.Equal(t, second, receive(t, events))
+
+	// Host addresses are watched too.
+	subnet, err := a.Allocate(ctx, cidr.IPv4, 29, "subnet")
+	require.NoError(t, err)
+	assert.Equal(t, "allocate 10.0.0.0/29 subnet ", eventStrings([]storage.Event{receive(t, events)})[0])
+	require.NoError(t, a.EnableHosts(ctx, subnet))
+	_, err = a.AllocateHost(ctx, subnet, "vm1")
+	require.NoError(t, err)
+	assert.Equal(t, "allocate_host 10.0.0.2/32 vm1 ", eventStrings([]storage.Event{receive(t, events)})[0])
+
+	_, errc = New(s, WithLogger(zerolog.Nop()), WithPoolID(2)).Watch(ctx, 0)
+	assert.ErrorIs(t, <-errc, ErrPoolNotFound)
+	_, errc = New(&flakyStorage{Storage: s}, WithLogger(zerolog.Nop())).Watch(ctx, 0)
+	assert.ErrorIs(t, <-errc, ErrWatchNotSupported)
+}
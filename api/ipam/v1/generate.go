@@ -0,0 +1,4 @@
+// Package ipamv1 contains the gRPC service definition of the IPAM API, and the generated Go client and server code.
+package ipamv1
+
+//go:generate protoc -I ../../.. --go_out=../../.. --go_opt=paths=source_relative --go-grpc_out=../../.. --go-grpc_opt=paths=source_relative api/ipam/v1/ipam.proto
@@ -0,0 +1,1069 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.11
+// 	protoc        v5.29.3
+// source: api/ipam/v1/ipam.proto
+
+package ipamv1
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type Family int32
+
+const (
+	Family_FAMILY_UNSPECIFIED Family = 0
+	Family_FAMILY_IPV4        Family = 4
+	Family_FAMILY_IPV6        Family = 6
+)
+
+// Enum value maps for Family.
+var (
+	Family_name = map[int32]string{
+		0: "FAMILY_UNSPECIFIED",
+		4: "FAMILY_IPV4",
+		6: "FAMILY_IPV6",
+	}
+	Family_value = map[string]int32{
+		"FAMILY_UNSPECIFIED": 0,
+		"FAMILY_IPV4":        4,
+		"FAMILY_IPV6":        6,
+	}
+)
+
+func (x Family) Enum() *Family {
+	p := new(Family)
+	*p = x
+	return p
+}
+
+func (x Family) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Family) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_ipam_v1_ipam_proto_enumTypes[0].Descriptor()
+}
+
+func (Family) Type() protoreflect.EnumType {
+	return &file_api_ipam_v1_ipam_proto_enumTypes[0]
+}
+
+func (x Family) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Family.Descriptor instead.
+func (Family) EnumDescriptor() ([]byte, []int) {
+	return file_api_ipam_v1_ipam_proto_rawDescGZIP(), []int{0}
+}
+
+// State selects ranges by whether they are allocated.
+type State int32
+
+const (
+	// STATE_UNSPECIFIED selects allocated ranges.
+	State_STATE_UNSPECIFIED State = 0
+	State_STATE_ALLOCATED   State = 1
+	// STATE_FREE selects free ranges, including retired ranges.
+	State_STATE_FREE State = 2
+	State_STATE_ANY  State = 3
+)
+
+// Enum value maps for State.
+var (
+	State_name = map[int32]string{
+		0: "STATE_UNSPECIFIED",
+		1: "STATE_ALLOCATED",
+		2: "STATE_FREE",
+		3: "STATE_ANY",
+	}
+	State_value = map[string]int32{
+		"STATE_UNSPECIFIED": 0,
+		"STATE_ALLOCATED":   1,
+		"STATE_FREE":        2,
+		"STATE_ANY":         3,
+	}
+)
+
+func (x State) Enum() *State {
+	p := new(State)
+	*p = x
+	return p
+}
+
+func (x State) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (State) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_ipam_v1_ipam_proto_enumTypes[1].Descriptor()
+}
+
+func (State) Type() protoreflect.EnumType {
+	return &file_api_ipam_v1_ipam_proto_enumTypes[1]
+}
+
+func (x State) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use State.Descriptor instead.
+func (State) EnumDescriptor() ([]byte, []int) {
+	return file_api_ipam_v1_ipam_proto_rawDescGZIP(), []int{1}
+}
+
+type AllocateRequest struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	PoolId       int32                  `protobuf:"varint,1,opt,name=pool_id,json=poolId,proto3" json:"pool_id,omitempty"`
+	RequestId    string                 `protobuf:"bytes,2,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	PrefixLength int32                  `protobuf:"varint,3,opt,name=prefix_length,json=prefixLength,proto3" json:"prefix_length,omitempty"`
+	// family defaults to FAMILY_IPV4.
+	Family Family `protobuf:"varint,4,opt,name=family,proto3,enum=ipam.v1.Family" json:"family,omitempty"`
+	// labels are key-value metadata of the allocation, e.g. team=payments.
+	// The labels of a range that was already allocated to the request are not changed.
+	Labels        map[string]string `protobuf:"bytes,5,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *AllocateRequest) Reset() {
+	*x = AllocateRequest{}
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *AllocateRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AllocateRequest) ProtoMessage() {}
+
+func (x *AllocateRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AllocateRequest.ProtoReflect.Descriptor instead.
+func (*AllocateRequest) Descriptor() ([]byte, []int) {
+	return file_api_ipam_v1_ipam_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *AllocateRequest) GetPoolId() int32 {
+	if x != nil {
+		return x.PoolId
+	}
+	return 0
+}
+
+func (x *AllocateRequest) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+func (x *AllocateRequest) GetPrefixLength() int32 {
+	if x != nil {
+		return x.PrefixLength
+	}
+	return 0
+}
+
+func (x *AllocateRequest) GetFamily() Family {
+	if x != nil {
+		return x.Family
+	}
+	return Family_FAMILY_UNSPECIFIED
+}
+
+func (x *AllocateRequest) GetLabels() map[string]string {
+	if x != nil {
+		return x.Labels
+	}
+	return nil
+}
+
+type Allocation struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	PoolId    int32                  `protobuf:"varint,1,opt,name=pool_id,json=poolId,proto3" json:"pool_id,omitempty"`
+	RequestId string                 `protobuf:"bytes,2,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	// cidr is the range of IP addresses in CIDR notation, e.g. "10.0.0.0/24".
+	Cidr          string            `protobuf:"bytes,3,opt,name=cidr,proto3" json:"cidr,omitempty"`
+	Labels        map[string]string `protobuf:"bytes,4,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Allocation) Reset() {
+	*x = Allocation{}
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Allocation) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Allocation) ProtoMessage() {}
+
+func (x *Allocation) ProtoReflect() protoreflect.Message {
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Allocation.ProtoReflect.Descriptor instead.
+func (*Allocation) Descriptor() ([]byte, []int) {
+	return file_api_ipam_v1_ipam_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Allocation) GetPoolId() int32 {
+	if x != nil {
+		return x.PoolId
+	}
+	return 0
+}
+
+func (x *Allocation) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+func (x *Allocation) GetCidr() string {
+	if x != nil {
+		return x.Cidr
+	}
+	return ""
+}
+
+func (x *Allocation) GetLabels() map[string]string {
+	if x != nil {
+		return x.Labels
+	}
+	return nil
+}
+
+type ReleaseRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	PoolId        int32                  `protobuf:"varint,1,opt,name=pool_id,json=poolId,proto3" json:"pool_id,omitempty"`
+	RequestId     string                 `protobuf:"bytes,2,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ReleaseRequest) Reset() {
+	*x = ReleaseRequest{}
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReleaseRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReleaseRequest) ProtoMessage() {}
+
+func (x *ReleaseRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReleaseRequest.ProtoReflect.Descriptor instead.
+func (*ReleaseRequest) Descriptor() ([]byte, []int) {
+	return file_api_ipam_v1_ipam_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ReleaseRequest) GetPoolId() int32 {
+	if x != nil {
+		return x.PoolId
+	}
+	return 0
+}
+
+func (x *ReleaseRequest) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+type ReleaseResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Cidrs         []string               `protobuf:"bytes,1,rep,name=cidrs,proto3" json:"cidrs,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ReleaseResponse) Reset() {
+	*x = ReleaseResponse{}
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ReleaseResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ReleaseResponse) ProtoMessage() {}
+
+func (x *ReleaseResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ReleaseResponse.ProtoReflect.Descriptor instead.
+func (*ReleaseResponse) Descriptor() ([]byte, []int) {
+	return file_api_ipam_v1_ipam_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *ReleaseResponse) GetCidrs() []string {
+	if x != nil {
+		return x.Cidrs
+	}
+	return nil
+}
+
+type GetRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	PoolId        int32                  `protobuf:"varint,1,opt,name=pool_id,json=poolId,proto3" json:"pool_id,omitempty"`
+	RequestId     string                 `protobuf:"bytes,2,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetRequest) Reset() {
+	*x = GetRequest{}
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetRequest) ProtoMessage() {}
+
+func (x *GetRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetRequest.ProtoReflect.Descriptor instead.
+func (*GetRequest) Descriptor() ([]byte, []int) {
+	return file_api_ipam_v1_ipam_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *GetRequest) GetPoolId() int32 {
+	if x != nil {
+		return x.PoolId
+	}
+	return 0
+}
+
+func (x *GetRequest) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+type GetResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// allocations has at most one element per family, ordered by family (IPv4 first).
+	Allocations   []*Allocation `protobuf:"bytes,1,rep,name=allocations,proto3" json:"allocations,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetResponse) Reset() {
+	*x = GetResponse{}
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetResponse) ProtoMessage() {}
+
+func (x *GetResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetResponse.ProtoReflect.Descriptor instead.
+func (*GetResponse) Descriptor() ([]byte, []int) {
+	return file_api_ipam_v1_ipam_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *GetResponse) GetAllocations() []*Allocation {
+	if x != nil {
+		return x.Allocations
+	}
+	return nil
+}
+
+type SetLabelsRequest struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	PoolId    int32                  `protobuf:"varint,1,opt,name=pool_id,json=poolId,proto3" json:"pool_id,omitempty"`
+	RequestId string                 `protobuf:"bytes,2,opt,name=request_id,json=requestId,proto3" json:"request_id,omitempty"`
+	// labels replace all labels of the request. Empty removes all labels.
+	Labels        map[string]string `protobuf:"bytes,3,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SetLabelsRequest) Reset() {
+	*x = SetLabelsRequest{}
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetLabelsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetLabelsRequest) ProtoMessage() {}
+
+func (x *SetLabelsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetLabelsRequest.ProtoReflect.Descriptor instead.
+func (*SetLabelsRequest) Descriptor() ([]byte, []int) {
+	return file_api_ipam_v1_ipam_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *SetLabelsRequest) GetPoolId() int32 {
+	if x != nil {
+		return x.PoolId
+	}
+	return 0
+}
+
+func (x *SetLabelsRequest) GetRequestId() string {
+	if x != nil {
+		return x.RequestId
+	}
+	return ""
+}
+
+func (x *SetLabelsRequest) GetLabels() map[string]string {
+	if x != nil {
+		return x.Labels
+	}
+	return nil
+}
+
+type SetLabelsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *SetLabelsResponse) Reset() {
+	*x = SetLabelsResponse{}
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *SetLabelsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*SetLabelsResponse) ProtoMessage() {}
+
+func (x *SetLabelsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use SetLabelsResponse.ProtoReflect.Descriptor instead.
+func (*SetLabelsResponse) Descriptor() ([]byte, []int) {
+	return file_api_ipam_v1_ipam_proto_rawDescGZIP(), []int{7}
+}
+
+type ListAllocationsRequest struct {
+	state  protoimpl.MessageState `protogen:"open.v1"`
+	PoolId int32                  `protobuf:"varint,1,opt,name=pool_id,json=poolId,proto3" json:"pool_id,omitempty"`
+	// labels selects the allocations that have all of these labels.
+	Labels map[string]string `protobuf:"bytes,2,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	// within selects the ranges contained in this CIDR, if not empty.
+	Within string `protobuf:"bytes,3,opt,name=within,proto3" json:"within,omitempty"`
+	// min_prefix_length selects the ranges with a prefix length of at least min_prefix_length.
+	MinPrefixLength int32 `protobuf:"varint,4,opt,name=min_prefix_length,json=minPrefixLength,proto3" json:"min_prefix_length,omitempty"`
+	// max_prefix_length selects the ranges with a prefix length of at most max_prefix_length, if positive.
+	MaxPrefixLength int32 `protobuf:"varint,5,opt,name=max_prefix_length,json=maxPrefixLength,proto3" json:"max_prefix_length,omitempty"`
+	// request_id_prefix selects the ranges whose request ID starts with request_id_prefix, if not empty.
+	RequestIdPrefix string `protobuf:"bytes,6,opt,name=request_id_prefix,json=requestIdPrefix,proto3" json:"request_id_prefix,omitempty"`
+	State           State  `protobuf:"varint,7,opt,name=state,proto3,enum=ipam.v1.State" json:"state,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *ListAllocationsRequest) Reset() {
+	*x = ListAllocationsRequest{}
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListAllocationsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListAllocationsRequest) ProtoMessage() {}
+
+func (x *ListAllocationsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListAllocationsRequest.ProtoReflect.Descriptor instead.
+func (*ListAllocationsRequest) Descriptor() ([]byte, []int) {
+	return file_api_ipam_v1_ipam_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *ListAllocationsRequest) GetPoolId() int32 {
+	if x != nil {
+		return x.PoolId
+	}
+	return 0
+}
+
+func (x *ListAllocationsRequest) GetLabels() map[string]string {
+	if x != nil {
+		return x.Labels
+	}
+	return nil
+}
+
+func (x *ListAllocationsRequest) GetWithin() string {
+	if x != nil {
+		return x.Within
+	}
+	return ""
+}
+
+func (x *ListAllocationsRequest) GetMinPrefixLength() int32 {
+	if x != nil {
+		return x.MinPrefixLength
+	}
+	return 0
+}
+
+func (x *ListAllocationsRequest) GetMaxPrefixLength() int32 {
+	if x != nil {
+		return x.MaxPrefixLength
+	}
+	return 0
+}
+
+func (x *ListAllocationsRequest) GetRequestIdPrefix() string {
+	if x != nil {
+		return x.RequestIdPrefix
+	}
+	return ""
+}
+
+func (x *ListAllocationsRequest) GetState() State {
+	if x != nil {
+		return x.State
+	}
+	return State_STATE_UNSPECIFIED
+}
+
+type PoolStatsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	PoolId        int32                  `protobuf:"varint,1,opt,name=pool_id,json=poolId,proto3" json:"pool_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PoolStatsRequest) Reset() {
+	*x = PoolStatsRequest{}
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PoolStatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PoolStatsRequest) ProtoMessage() {}
+
+func (x *PoolStatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PoolStatsRequest.ProtoReflect.Descriptor instead.
+func (*PoolStatsRequest) Descriptor() ([]byte, []int) {
+	return file_api_ipam_v1_ipam_proto_rawDescGZIP(), []int{9}
+}
+
+func (x *PoolStatsRequest) GetPoolId() int32 {
+	if x != nil {
+		return x.PoolId
+	}
+	return 0
+}
+
+// Address counts are decimal strings, because IPv6 counts do not fit in 64 bits.
+type PoolStatsResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// total_addresses, allocated_addresses and free_addresses are the sums over all families.
+	TotalAddresses     string `protobuf:"bytes,1,opt,name=total_addresses,json=totalAddresses,proto3" json:"total_addresses,omitempty"`
+	AllocatedAddresses string `protobuf:"bytes,2,opt,name=allocated_addresses,json=allocatedAddresses,proto3" json:"allocated_addresses,omitempty"`
+	FreeAddresses      string `protobuf:"bytes,3,opt,name=free_addresses,json=freeAddresses,proto3" json:"free_addresses,omitempty"`
+	// families has one element per family, ordered by family (IPv4 first).
+	Families      []*FamilyStats `protobuf:"bytes,4,rep,name=families,proto3" json:"families,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *PoolStatsResponse) Reset() {
+	*x = PoolStatsResponse{}
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *PoolStatsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*PoolStatsResponse) ProtoMessage() {}
+
+func (x *PoolStatsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use PoolStatsResponse.ProtoReflect.Descriptor instead.
+func (*PoolStatsResponse) Descriptor() ([]byte, []int) {
+	return file_api_ipam_v1_ipam_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *PoolStatsResponse) GetTotalAddresses() string {
+	if x != nil {
+		return x.TotalAddresses
+	}
+	return ""
+}
+
+func (x *PoolStatsResponse) GetAllocatedAddresses() string {
+	if x != nil {
+		return x.AllocatedAddresses
+	}
+	return ""
+}
+
+func (x *PoolStatsResponse) GetFreeAddresses() string {
+	if x != nil {
+		return x.FreeAddresses
+	}
+	return ""
+}
+
+func (x *PoolStatsResponse) GetFamilies() []*FamilyStats {
+	if x != nil {
+		return x.Families
+	}
+	return nil
+}
+
+type FamilyStats struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	Family         Family                 `protobuf:"varint,1,opt,name=family,proto3,enum=ipam.v1.Family" json:"family,omitempty"`
+	TotalAddresses string                 `protobuf:"bytes,2,opt,name=total_addresses,json=totalAddresses,proto3" json:"total_addresses,omitempty"`
+	// allocated_addresses includes allocated addresses of retired ranges.
+	AllocatedAddresses string `protobuf:"bytes,3,opt,name=allocated_addresses,json=allocatedAddresses,proto3" json:"allocated_addresses,omitempty"`
+	// free_addresses are the addresses that can be allocated, excluding retired addresses.
+	FreeAddresses string `protobuf:"bytes,4,opt,name=free_addresses,json=freeAddresses,proto3" json:"free_addresses,omitempty"`
+	// retired_addresses are the free addresses of retired ranges, which can not be allocated.
+	RetiredAddresses string `protobuf:"bytes,5,opt,name=retired_addresses,json=retiredAddresses,proto3" json:"retired_addresses,omitempty"`
+	// free_blocks maps prefix lengths to the number of free ranges (excluding retired ranges) with that prefix length.
+	FreeBlocks map[int32]int32 `protobuf:"bytes,6,rep,name=free_blocks,json=freeBlocks,proto3" json:"free_blocks,omitempty" protobuf_key:"varint,1,opt,name=key" protobuf_val:"varint,2,opt,name=value"`
+	// largest_free_prefix_length is the prefix length of the largest range that can be allocated,
+	// or -1 if no range can be allocated.
+	LargestFreePrefixLength int32 `protobuf:"varint,7,opt,name=largest_free_prefix_length,json=largestFreePrefixLength,proto3" json:"largest_free_prefix_length,omitempty"`
+	// fragmentation is the fraction of the free addresses that are not in the largest free range, from 0 to almost 1.
+	Fragmentation float64 `protobuf:"fixed64,8,opt,name=fragmentation,proto3" json:"fragmentation,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FamilyStats) Reset() {
+	*x = FamilyStats{}
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FamilyStats) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FamilyStats) ProtoMessage() {}
+
+func (x *FamilyStats) ProtoReflect() protoreflect.Message {
+	mi := &file_api_ipam_v1_ipam_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FamilyStats.ProtoReflect.Descriptor instead.
+func (*FamilyStats) Descriptor() ([]byte, []int) {
+	return file_api_ipam_v1_ipam_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *FamilyStats) GetFamily() Family {
+	if x != nil {
+		return x.Family
+	}
+	return Family_FAMILY_UNSPECIFIED
+}
+
+func (x *FamilyStats) GetTotalAddresses() string {
+	if x != nil {
+		return x.TotalAddresses
+	}
+	return ""
+}
+
+func (x *FamilyStats) GetAllocatedAddresses() string {
+	if x != nil {
+		return x.AllocatedAddresses
+	}
+	return ""
+}
+
+func (x *FamilyStats) GetFreeAddresses() string {
+	if x != nil {
+		return x.FreeAddresses
+	}
+	return ""
+}
+
+func (x *FamilyStats) GetRetiredAddresses() string {
+	if x != nil {
+		return x.RetiredAddresses
+	}
+	return ""
+}
+
+func (x *FamilyStats) GetFreeBlocks() map[int32]int32 {
+	if x != nil {
+		return x.FreeBlocks
+	}
+	return nil
+}
+
+func (x *FamilyStats) GetLargestFreePrefixLength() int32 {
+	if x != nil {
+		return x.LargestFreePrefixLength
+	}
+	return 0
+}
+
+func (x *FamilyStats) GetFragmentation() float64 {
+	if x != nil {
+		return x.Fragmentation
+	}
+	return 0
+}
+
+var File_api_ipam_v1_ipam_proto protoreflect.FileDescriptor
+
+const file_api_ipam_v1_ipam_proto_rawDesc = "" +
+	"\n" +
+	"\x16api/ipam/v1/ipam.proto\x12\aipam.v1\"\x90\x02\n" +
+	"\x0fAllocateRequest\x12\x17\n" +
+	"\apool_id\x18\x01 \x01(\x05R\x06poolId\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x02 \x01(\tR\trequestId\x12#\n" +
+	"\rprefix_length\x18\x03 \x01(\x05R\fprefixLength\x12'\n" +
+	"\x06family\x18\x04 \x01(\x0e2\x0f.ipam.v1.FamilyR\x06family\x12<\n" +
+	"\x06labels\x18\x05 \x03(\v2$.ipam.v1.AllocateRequest.LabelsEntryR\x06labels\x1a9\n" +
+	"\vLabelsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\xcc\x01\n" +
+	"\n" +
+	"Allocation\x12\x17\n" +
+	"\apool_id\x18\x01 \x01(\x05R\x06poolId\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x02 \x01(\tR\trequestId\x12\x12\n" +
+	"\x04cidr\x18\x03 \x01(\tR\x04cidr\x127\n" +
+	"\x06labels\x18\x04 \x03(\v2\x1f.ipam.v1.Allocation.LabelsEntryR\x06labels\x1a9\n" +
+	"\vLabelsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"H\n" +
+	"\x0eReleaseRequest\x12\x17\n" +
+	"\apool_id\x18\x01 \x01(\x05R\x06poolId\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x02 \x01(\tR\trequestId\"'\n" +
+	"\x0fReleaseResponse\x12\x14\n" +
+	"\x05cidrs\x18\x01 \x03(\tR\x05cidrs\"D\n" +
+	"\n" +
+	"GetRequest\x12\x17\n" +
+	"\apool_id\x18\x01 \x01(\x05R\x06poolId\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x02 \x01(\tR\trequestId\"D\n" +
+	"\vGetResponse\x125\n" +
+	"\vallocations\x18\x01 \x03(\v2\x13.ipam.v1.AllocationR\vallocations\"\xc4\x01\n" +
+	"\x10SetLabelsRequest\x12\x17\n" +
+	"\apool_id\x18\x01 \x01(\x05R\x06poolId\x12\x1d\n" +
+	"\n" +
+	"request_id\x18\x02 \x01(\tR\trequestId\x12=\n" +
+	"\x06labels\x18\x03 \x03(\v2%.ipam.v1.SetLabelsRequest.LabelsEntryR\x06labels\x1a9\n" +
+	"\vLabelsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\x13\n" +
+	"\x11SetLabelsResponse\"\xf3\x02\n" +
+	"\x16ListAllocationsRequest\x12\x17\n" +
+	"\apool_id\x18\x01 \x01(\x05R\x06poolId\x12C\n" +
+	"\x06labels\x18\x02 \x03(\v2+.ipam.v1.ListAllocationsRequest.LabelsEntryR\x06labels\x12\x16\n" +
+	"\x06within\x18\x03 \x01(\tR\x06within\x12*\n" +
+	"\x11min_prefix_length\x18\x04 \x01(\x05R\x0fminPrefixLength\x12*\n" +
+	"\x11max_prefix_length\x18\x05 \x01(\x05R\x0fmaxPrefixLength\x12*\n" +
+	"\x11request_id_prefix\x18\x06 \x01(\tR\x0frequestIdPrefix\x12$\n" +
+	"\x05state\x18\a \x01(\x0e2\x0e.ipam.v1.StateR\x05state\x1a9\n" +
+	"\vLabelsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"+\n" +
+	"\x10PoolStatsRequest\x12\x17\n" +
+	"\apool_id\x18\x01 \x01(\x05R\x06poolId\"\xc6\x01\n" +
+	"\x11PoolStatsResponse\x12'\n" +
+	"\x0ftotal_addresses\x18\x01 \x01(\tR\x0etotalAddresses\x12/\n" +
+	"\x13allocated_addresses\x18\x02 \x01(\tR\x12allocatedAddresses\x12%\n" +
+	"\x0efree_addresses\x18\x03 \x01(\tR\rfreeAddresses\x120\n" +
+	"\bfamilies\x18\x04 \x03(\v2\x14.ipam.v1.FamilyStatsR\bfamilies\"\xcd\x03\n" +
+	"\vFamilyStats\x12'\n" +
+	"\x06family\x18\x01 \x01(\x0e2\x0f.ipam.v1.FamilyR\x06family\x12'\n" +
+	"\x0ftotal_addresses\x18\x02 \x01(\tR\x0etotalAddresses\x12/\n" +
+	"\x13allocated_addresses\x18\x03 \x01(\tR\x12allocatedAddresses\x12%\n" +
+	"\x0efree_addresses\x18\x04 \x01(\tR\rfreeAddresses\x12+\n" +
+	"\x11retired_addresses\x18\x05 \x01(\tR\x10retiredAddresses\x12E\n" +
+	"\vfree_blocks\x18\x06 \x03(\v2$.ipam.v1.FamilyStats.FreeBlocksEntryR\n" +
+	"freeBlocks\x12;\n" +
+	"\x1alargest_free_prefix_length\x18\a \x01(\x05R\x17largestFreePrefixLength\x12$\n" +
+	"\rfragmentation\x18\b \x01(\x01R\rfragmentation\x1a=\n" +
+	"\x0fFreeBlocksEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\x05R\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\x05R\x05value:\x028\x01*B\n" +
+	"\x06Family\x12\x16\n" +
+	"\x12FAMILY_UNSPECIFIED\x10\x00\x12\x0f\n" +
+	"\vFAMILY_IPV4\x10\x04\x12\x0f\n" +
+	"\vFAMILY_IPV6\x10\x06*R\n" +
+	"\x05State\x12\x15\n" +
+	"\x11STATE_UNSPECIFIED\x10\x00\x12\x13\n" +
+	"\x0fSTATE_ALLOCATED\x10\x01\x12\x0e\n" +
+	"\n" +
+	"STATE_FREE\x10\x02\x12\r\n" +
+	"\tSTATE_ANY\x10\x032\x84\x03\n" +
+	"\x04IPAM\x129\n" +
+	"\bAllocate\x12\x18.ipam.v1.AllocateRequest\x1a\x13.ipam.v1.Allocation\x12<\n" +
+	"\aRelease\x12\x17.ipam.v1.ReleaseRequest\x1a\x18.ipam.v1.ReleaseResponse\x120\n" +
+	"\x03Get\x12\x13.ipam.v1.GetRequest\x1a\x14.ipam.v1.GetResponse\x12B\n" +
+	"\tSetLabels\x12\x19.ipam.v1.SetLabelsRequest\x1a\x1a.ipam.v1.SetLabelsResponse\x12I\n" +
+	"\x0fListAllocations\x12\x1f.ipam.v1.ListAllocationsRequest\x1a\x13.ipam.v1.Allocation0\x01\x12B\n" +
+	"\tPoolStats\x12\x19.ipam.v1.PoolStatsRequest\x1a\x1a.ipam.v1.PoolStatsResponseB@Z>github.com/jbrekelmans/go-sql-ip-management/api/ipam/v1;ipamv1b\x06proto3"
+
+var (
+	file_api_ipam_v1_ipam_proto_rawDescOnce sync.Once
+	file_api_ipam_v1_ipam_proto_rawDescData []byte
+)
+
+func file_api_ipam_v1_ipam_proto_rawDescGZIP() []byte {
+	file_api_ipam_v1_ipam_proto_rawDescOnce.Do(func() {
+		file_api_ipam_v1_ipam_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_api_ipam_v1_ipam_proto_rawDesc), len(file_api_ipam_v1_ipam_proto_rawDesc)))
+	})
+	return file_api_ipam_v1_ipam_proto_rawDescData
+}
+
+var file_api_ipam_v1_ipam_proto_enumTypes = make([]protoimpl.EnumInfo, 2)
+var file_api_ipam_v1_ipam_proto_msgTypes = make([]protoimpl.MessageInfo, 17)
+var file_api_ipam_v1_ipam_proto_goTypes = []any{
+	(Family)(0),                    // 0: ipam.v1.Family
+	(State)(0),                     // 1: ipam.v1.State
+	(*AllocateRequest)(nil),        // 2: ipam.v1.AllocateRequest
+	(*Allocation)(nil),             // 3: ipam.v1.Allocation
+	(*ReleaseRequest)(nil),         // 4: ipam.v1.ReleaseRequest
+	(*ReleaseResponse)(nil),        // 5: ipam.v1.ReleaseResponse
+	(*GetRequest)(nil),             // 6: ipam.v1.GetRequest
+	(*GetResponse)(nil),            // 7: ipam.v1.GetResponse
+	(*SetLabelsRequest)(nil),       // 8: ipam.v1.SetLabelsRequest
+	(*SetLabelsResponse)(nil),      // 9: ipam.v1.SetLabelsResponse
+	(*ListAllocationsRequest)(nil), // 10: ipam.v1.ListAllocationsRequest
+	(*PoolStatsRequest)(nil),       // 11: ipam.v1.PoolStatsRequest
+	(*PoolStatsResponse)(nil),      // 12: ipam.v1.PoolStatsResponse
+	(*FamilyStats)(nil),            // 13: ipam.v1.FamilyStats
+	nil,                            // 14: ipam.v1.AllocateRequest.LabelsEntry
+	nil,                            // 15: ipam.v1.Allocation.LabelsEntry
+	nil,                            // 16: ipam.v1.SetLabelsRequest.LabelsEntry
+	nil,                            // 17: ipam.v1.ListAllocationsRequest.LabelsEntry
+	nil,                            // 18: ipam.v1.FamilyStats.FreeBlocksEntry
+}
+var file_api_ipam_v1_ipam_proto_depIdxs = []int32{
+	0,  // 0: ipam.v1.AllocateRequest.family:type_name -> ipam.v1.Family
+	14, // 1: ipam.v1.AllocateRequest.labels:type_name -> ipam.v1.AllocateRequest.LabelsEntry
+	15, // 2: ipam.v1.Allocation.labels:type_name -> ipam.v1.Allocation.LabelsEntry
+	3,  // 3: ipam.v1.GetResponse.allocations:type_name -> ipam.v1.Allocation
+	16, // 4: ipam.v1.SetLabelsRequest.labels:type_name -> ipam.v1.SetLabelsRequest.LabelsEntry
+	17, // 5: ipam.v1.ListAllocationsRequest.labels:type_name -> ipam.v1.ListAllocationsRequest.LabelsEntry
+	1,  // 6: ipam.v1.ListAllocationsRequest.state:type_name -> ipam.v1.State
+	13, // 7: ipam.v1.PoolStatsResponse.families:type_name -> ipam.v1.FamilyStats
+	0,  // 8: ipam.v1.FamilyStats.family:type_name -> ipam.v1.Family
+	18, // 9: ipam.v1.FamilyStats.free_blocks:type_name -> ipam.v1.FamilyStats.FreeBlocksEntry
+	2,  // 10: ipam.v1.IPAM.Allocate:input_type -> ipam.v1.AllocateRequest
+	4,  // 11: ipam.v1.IPAM.Release:input_type -> ipam.v1.ReleaseRequest
+	6,  // 12: ipam.v1.IPAM.Get:input_type -> ipam.v1.GetRequest
+	8,  // 13: ipam.v1.IPAM.SetLabels:input_type -> ipam.v1.SetLabelsRequest
+	10, // 14: ipam.v1.IPAM.ListAllocations:input_type -> ipam.v1.ListAllocationsRequest
+	11, // 15: ipam.v1.IPAM.PoolStats:input_type -> ipam.v1.PoolStatsRequest
+	3,  // 16: ipam.v1.IPAM.Allocate:output_type -> ipam.v1.Allocation
+	5,  // 17: ipam.v1.IPAM.Release:output_type -> ipam.v1.ReleaseResponse
+	7,  // 18: ipam.v1.IPAM.Get:output_type -> ipam.v1.GetResponse
+	9,  // 19: ipam.v1.IPAM.SetLabels:output_type -> ipam.v1.SetLabelsResponse
+	3,  // 20: ipam.v1.IPAM.ListAllocations:output_type -> ipam.v1.Allocation
+	12, // 21: ipam.v1.IPAM.PoolStats:output_type -> ipam.v1.PoolStatsResponse
+	16, // [16:22] is the sub-list for method output_type
+	10, // [10:16] is the sub-list for method input_type
+	10, // [10:10] is the sub-list for extension type_name
+	10, // [10:10] is the sub-list for extension extendee
+	0,  // [0:10] is the sub-list for field type_name
+}
+
+func init() { file_api_ipam_v1_ipam_proto_init() }
+func file_api_ipam_v1_ipam_proto_init() {
+	if File_api_ipam_v1_ipam_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_api_ipam_v1_ipam_proto_rawDesc), len(file_api_ipam_v1_ipam_proto_rawDesc)),
+			NumEnums:      2,
+			NumMessages:   17,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_api_ipam_v1_ipam_proto_goTypes,
+		DependencyIndexes: file_api_ipam_v1_ipam_proto_depIdxs,
+		EnumInfos:         file_api_ipam_v1_ipam_proto_enumTypes,
+		MessageInfos:      file_api_ipam_v1_ipam_proto_msgTypes,
+	}.Build()
+	File_api_ipam_v1_ipam_proto = out.File
+	file_api_ipam_v1_ipam_proto_goTypes = nil
+	file_api_ipam_v1_ipam_proto_depIdxs = nil
+}
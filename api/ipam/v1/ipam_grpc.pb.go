@@ -0,0 +1,347 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             v5.29.3
+// source: api/ipam/v1/ipam.proto
+
+package ipamv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	IPAM_Allocate_FullMethodName        = "/ipam.v1.IPAM/Allocate"
+	IPAM_Release_FullMethodName         = "/ipam.v1.IPAM/Release"
+	IPAM_Get_FullMethodName             = "/ipam.v1.IPAM/Get"
+	IPAM_SetLabels_FullMethodName       = "/ipam.v1.IPAM/SetLabels"
+	IPAM_ListAllocations_FullMethodName = "/ipam.v1.IPAM/ListAllocations"
+	IPAM_PoolStats_FullMethodName       = "/ipam.v1.IPAM/PoolStats"
+)
+
+// IPAMClient is the client API for IPAM service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// IPAM allocates ranges of IP addresses from pools.
+//
+// Errors are reported with these status codes:
+//
+//	NOT_FOUND           the pool or request does not exist
+//	ALREADY_EXISTS      the request was previously allocated a range of a different size
+//	RESOURCE_EXHAUSTED  the pool has no big-enough free range
+//	INVALID_ARGUMENT    the request is malformed
+//	UNAVAILABLE         the operation was retried too often due to concurrent transactions
+type IPAMClient interface {
+	// Allocate allocates a range of IP addresses to a request. Calls with the same request ID and family are idempotent.
+	Allocate(ctx context.Context, in *AllocateRequest, opts ...grpc.CallOption) (*Allocation, error)
+	// Release deallocates the ranges of IP addresses allocated to a request.
+	Release(ctx context.Context, in *ReleaseRequest, opts ...grpc.CallOption) (*ReleaseResponse, error)
+	// Get gets the ranges of IP addresses allocated to a request.
+	Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error)
+	// SetLabels replaces the labels of the ranges of IP addresses allocated to a request.
+	SetLabels(ctx context.Context, in *SetLabelsRequest, opts ...grpc.CallOption) (*SetLabelsResponse, error)
+	// ListAllocations streams the ranges of IP addresses of a pool that match a filter, ordered by address.
+	ListAllocations(ctx context.Context, in *ListAllocationsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Allocation], error)
+	// PoolStats returns utilization statistics of a pool.
+	PoolStats(ctx context.Context, in *PoolStatsRequest, opts ...grpc.CallOption) (*PoolStatsResponse, error)
+}
+
+type iPAMClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewIPAMClient(cc grpc.ClientConnInterface) IPAMClient {
+	return &iPAMClient{cc}
+}
+
+func (c *iPAMClient) Allocate(ctx context.Context, in *AllocateRequest, opts ...grpc.CallOption) (*Allocation, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Allocation)
+	err := c.cc.Invoke(ctx, IPAM_Allocate_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *iPAMClient) Release(ctx context.Context, in *ReleaseRequest, opts ...grpc.CallOption) (*ReleaseResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ReleaseResponse)
+	err := c.cc.Invoke(ctx, IPAM_Release_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *iPAMClient) Get(ctx context.Context, in *GetRequest, opts ...grpc.CallOption) (*GetResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetResponse)
+	err := c.cc.Invoke(ctx, IPAM_Get_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *iPAMClient) SetLabels(ctx context.Context, in *SetLabelsRequest, opts ...grpc.CallOption) (*SetLabelsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SetLabelsResponse)
+	err := c.cc.Invoke(ctx, IPAM_SetLabels_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *iPAMClient) ListAllocations(ctx context.Context, in *ListAllocationsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[Allocation], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &IPAM_ServiceDesc.Streams[0], IPAM_ListAllocations_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ListAllocationsRequest, Allocation]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type IPAM_ListAllocationsClient = grpc.ServerStreamingClient[Allocation]
+
+func (c *iPAMClient) PoolStats(ctx context.Context, in *PoolStatsRequest, opts ...grpc.CallOption) (*PoolStatsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PoolStatsResponse)
+	err := c.cc.Invoke(ctx, IPAM_PoolStats_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// IPAMServer is the server API for IPAM service.
+// All implementations must embed UnimplementedIPAMServer
+// for forward compatibility.
+//
+// IPAM allocates ranges of IP addresses from pools.
+//
+// Errors are reported with these status codes:
+//
+//	NOT_FOUND           the pool or request does not exist
+//	ALREADY_EXISTS      the request was previously allocated a range of a different size
+//	RESOURCE_EXHAUSTED  the pool has no big-enough free range
+//	INVALID_ARGUMENT    the request is malformed
+//	UNAVAILABLE         the operation was retried too often due to concurrent transactions
+type IPAMServer interface {
+	// Allocate allocates a range of IP addresses to a request. Calls with the same request ID and family are idempotent.
+	Allocate(context.Context, *AllocateRequest) (*Allocation, error)
+	// Release deallocates the ranges of IP addresses allocated to a request.
+	Release(context.Context, *ReleaseRequest) (*ReleaseResponse, error)
+	// Get gets the ranges of IP addresses allocated to a request.
+	Get(context.Context, *GetRequest) (*GetResponse, error)
+	// SetLabels replaces the labels of the ranges of IP addresses allocated to a request.
+	SetLabels(context.Context, *SetLabelsRequest) (*SetLabelsResponse, error)
+	// ListAllocations streams the ranges of IP addresses of a pool that match a filter, ordered by address.
+	ListAllocations(*ListAllocationsRequest, grpc.ServerStreamingServer[Allocation]) error
+	// PoolStats returns utilization statistics of a pool.
+	PoolStats(context.Context, *PoolStatsRequest) (*PoolStatsResponse, error)
+	mustEmbedUnimplementedIPAMServer()
+}
+
+// UnimplementedIPAMServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedIPAMServer struct{}
+
+func (UnimplementedIPAMServer) Allocate(context.Context, *AllocateRequest) (*Allocation, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Allocate not implemented")
+}
+func (UnimplementedIPAMServer) Release(context.Context, *ReleaseRequest) (*ReleaseResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Release not implemented")
+}
+func (UnimplementedIPAMServer) Get(context.Context, *GetRequest) (*GetResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Get not implemented")
+}
+func (UnimplementedIPAMServer) SetLabels(context.Context, *SetLabelsRequest) (*SetLabelsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetLabels not implemented")
+}
+func (UnimplementedIPAMServer) ListAllocations(*ListAllocationsRequest, grpc.ServerStreamingServer[Allocation]) error {
+	return status.Errorf(codes.Unimplemented, "method ListAllocations not implemented")
+}
+func (UnimplementedIPAMServer) PoolStats(context.Context, *PoolStatsRequest) (*PoolStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PoolStats not implemented")
+}
+func (UnimplementedIPAMServer) mustEmbedUnimplementedIPAMServer() {}
+func (UnimplementedIPAMServer) testEmbeddedByValue()              {}
+
+// UnsafeIPAMServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to IPAMServer will
+// result in compilation errors.
+type UnsafeIPAMServer interface {
+	mustEmbedUnimplementedIPAMServer()
+}
+
+func RegisterIPAMServer(s grpc.ServiceRegistrar, srv IPAMServer) {
+	// If the following call pancis, it indicates UnimplementedIPAMServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&IPAM_ServiceDesc, srv)
+}
+
+func _IPAM_Allocate_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AllocateRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IPAMServer).Allocate(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IPAM_Allocate_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IPAMServer).Allocate(ctx, req.(*AllocateRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IPAM_Release_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ReleaseRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IPAMServer).Release(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IPAM_Release_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IPAMServer).Release(ctx, req.(*ReleaseRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IPAM_Get_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IPAMServer).Get(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IPAM_Get_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IPAMServer).Get(ctx, req.(*GetRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IPAM_SetLabels_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetLabelsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IPAMServer).SetLabels(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IPAM_SetLabels_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IPAMServer).SetLabels(ctx, req.(*SetLabelsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _IPAM_ListAllocations_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ListAllocationsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(IPAMServer).ListAllocations(m, &grpc.GenericServerStream[ListAllocationsRequest, Allocation]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type IPAM_ListAllocationsServer = grpc.ServerStreamingServer[Allocation]
+
+func _IPAM_PoolStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PoolStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(IPAMServer).PoolStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: IPAM_PoolStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(IPAMServer).PoolStats(ctx, req.(*PoolStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// IPAM_ServiceDesc is the grpc.ServiceDesc for IPAM service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var IPAM_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ipam.v1.IPAM",
+	HandlerType: (*IPAMServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Allocate",
+			Handler:    _IPAM_Allocate_Handler,
+		},
+		{
+			MethodName: "Release",
+			Handler:    _IPAM_Release_Handler,
+		},
+		{
+			MethodName: "Get",
+			Handler:    _IPAM_Get_Handler,
+		},
+		{
+			MethodName: "SetLabels",
+			Handler:    _IPAM_SetLabels_Handler,
+		},
+		{
+			MethodName: "PoolStats",
+			Handler:    _IPAM_PoolStats_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ListAllocations",
+			Handler:       _IPAM_ListAllocations_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/ipam/v1/ipam.proto",
+}
@@ -4,12 +4,53 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"math/big"
 	"net"
 	"strings"
 )
 
 var ipTo4 = (net.IP).To4
 
+// Family is an address family.
+type Family int
+
+const (
+	IPv4 Family = 4
+	IPv6 Family = 6
+)
+
+// Bits returns the number of bits of IP addresses of family f, or 0 if f is invalid.
+func (f Family) Bits() int {
+	switch f {
+	case IPv4:
+		return net.IPv4len * 8
+	case IPv6:
+		return net.IPv6len * 8
+	}
+	return 0
+}
+
+func (f Family) String() string {
+	switch f {
+	case IPv4:
+		return "IPv4"
+	case IPv6:
+		return "IPv6"
+	}
+	return fmt.Sprintf("Family(%d)", int(f))
+}
+
+// ParseFamily parses "4", "IPv4", "6" or "IPv6" (case-insensitive).
+func ParseFamily(s string) (Family, error) {
+	switch strings.ToLower(s) {
+	case "4", "ipv4":
+		return IPv4, nil
+	case "6", "ipv6":
+		return IPv6, nil
+	}
+	return 0, fmt.Errorf(`invalid address family %#v`, s)
+}
+
 type CIDR struct {
 	// IP is the IP address that is identifies the network, and is also the address of
 	// the first host in the subnetwork.
@@ -54,11 +95,55 @@ func MustParseCIDR(s string) CIDR {
 	return c
 }
 
+// Contains returns true if and only if every IP address in other is also in c.
+// CIDRs of different address families never contain each other.
+func (c CIDR) Contains(other CIDR) bool {
+	if len(c.IP) != len(other.IP) || c.PrefixBits > other.PrefixBits {
+		return false
+	}
+	for bitIndex := 0; bitIndex < c.PrefixBits; bitIndex++ {
+		if ipGetBit(c.IP, bitIndex) != ipGetBit(other.IP, bitIndex) {
+			return false
+		}
+	}
+	return true
+}
+
+// Equal returns true if and only if c and other represent the same network.
+func (c CIDR) Equal(other CIDR) bool {
+	return c.PrefixBits == other.PrefixBits && c.IP.Equal(other.IP) && len(c.IP) == len(other.IP)
+}
+
+// Family returns the address family of c.
+func (c CIDR) Family() Family {
+	if c.IsIPv4() {
+		return IPv4
+	}
+	return IPv6
+}
+
 // IsIPv4 returns true if and only if this CIDR represents an IPv4 network.
 func (c CIDR) IsIPv4() bool {
 	return len(c.IP) == net.IPv4len
 }
 
+// IsValid returns true if and only if len(c.IP) is 4 or 16, c.PrefixBits is in range, and
+// all bits of c.IP after the prefix (the host bits) are zero.
+func (c CIDR) IsValid() bool {
+	if len(c.IP) != net.IPv4len && len(c.IP) != net.IPv6len {
+		return false
+	}
+	if c.PrefixBits < 0 || c.PrefixBits > len(c.IP)*8 {
+		return false
+	}
+	for bitIndex := c.PrefixBits; bitIndex < len(c.IP)*8; bitIndex++ {
+		if ipGetBit(c.IP, bitIndex) {
+			return false
+		}
+	}
+	return true
+}
+
 func (c CIDR) IsLower() bool {
 	if c.PrefixBits == 0 {
 		return false
@@ -87,6 +172,21 @@ func (c CIDR) Other() CIDR {
 	}
 }
 
+// Last returns the last IP address in c.
+func (c CIDR) Last() net.IP {
+	ip := ipCopy(c.IP)
+	for bitIndex := c.PrefixBits; bitIndex < len(ip)*8; bitIndex++ {
+		ipSetBit(ip, bitIndex)
+	}
+	return ip
+}
+
+// Overlaps returns true if and only if c and other have at least one IP address in common.
+// This is the case if and only if c contains other or other contains c.
+func (c CIDR) Overlaps(other CIDR) bool {
+	return c.Contains(other) || other.Contains(c)
+}
+
 // Scan implements the "database/sql".Scanner interface.
 func (c *CIDR) Scan(src any) error {
 	if c == nil {
@@ -114,6 +214,27 @@ func (c CIDR) Split() CIDR {
 	}
 }
 
+// Supernet returns the CIDR with the specified prefix length that contains c.
+// Supernet panics if prefixBits is negative or greater than c.PrefixBits.
+func (c CIDR) Supernet(prefixBits int) CIDR {
+	if prefixBits < 0 || prefixBits > c.PrefixBits {
+		panic(errors.New("Supernet with invalid prefixBits"))
+	}
+	ip := ipCopy(c.IP)
+	for bitIndex := prefixBits; bitIndex < len(ip)*8; bitIndex++ {
+		ipClearBit(ip, bitIndex)
+	}
+	return CIDR{
+		IP:         ip,
+		PrefixBits: prefixBits,
+	}
+}
+
+// Size returns the number of IP addresses in c.
+func (c CIDR) Size() *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(len(c.IP)*8-c.PrefixBits))
+}
+
 func (c CIDR) String() string {
 	return fmt.Sprintf("%s/%d", ipString(c.IP), c.PrefixBits)
 }
@@ -140,6 +261,13 @@ func ipCopy(ip net.IP) net.IP {
 	return append(net.IP(nil), ip...)
 }
 
+func ipClearBit(ip net.IP, bitIndex int) net.IP {
+	j := 7 - (bitIndex & 7)
+	bit := byte(1 << j)
+	ip[bitIndex>>3] &^= bit
+	return ip
+}
+
 func ipFlipBit(ip net.IP, bitIndex int) net.IP {
 	j := 7 - (bitIndex & 7)
 	bit := byte(1 << j)
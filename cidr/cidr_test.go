@@ -41,6 +41,55 @@ func testCIDR6(t *testing.T, s string) CIDR {
 }
 
 func Test_CIDR(t *testing.T) {
+	t.Run("Contains", func(t *testing.T) {
+		t.Run("Case1", func(t *testing.T) {
+			c := testCIDR4(t, "192.168.0.0/16")
+			assert.Equal(t, true, c.Contains(testCIDR4(t, "192.168.4.0/23")))
+			assert.Equal(t, true, c.Contains(c))
+		})
+		t.Run("Case2", func(t *testing.T) {
+			c := testCIDR4(t, "192.168.4.0/23")
+			assert.Equal(t, false, c.Contains(testCIDR4(t, "192.168.0.0/16")))
+			assert.Equal(t, false, c.Contains(testCIDR4(t, "192.168.6.0/24")))
+		})
+		t.Run("Case3", func(t *testing.T) {
+			c := testCIDR4(t, "0.0.0.0/0")
+			assert.Equal(t, false, c.Contains(testCIDR6(t, "::/128")))
+		})
+	})
+	t.Run("IsValid", func(t *testing.T) {
+		assert.Equal(t, true, testCIDR4(t, "192.168.4.0/23").IsValid())
+		assert.Equal(t, true, testCIDR6(t, "::/0").IsValid())
+		assert.Equal(t, false, CIDR{IP: net.IP{192, 168, 5, 0}, PrefixBits: 23}.IsValid())
+		assert.Equal(t, false, CIDR{IP: net.IP{192, 168, 4, 0}, PrefixBits: 33}.IsValid())
+		assert.Equal(t, false, CIDR{IP: make(net.IP, 1), PrefixBits: 0}.IsValid())
+	})
+	t.Run("Last", func(t *testing.T) {
+		assert.Equal(t, net.IP{192, 168, 7, 255}, testCIDR4(t, "192.168.6.0/23").Last())
+		assert.Equal(t, net.ParseIP("fd00::ffff:ffff:ffff:ffff"), testCIDR6(t, "fd00::/64").Last())
+	})
+	t.Run("Overlaps", func(t *testing.T) {
+		c := testCIDR4(t, "192.168.4.0/23")
+		assert.Equal(t, true, c.Overlaps(testCIDR4(t, "192.168.0.0/16")))
+		assert.Equal(t, true, c.Overlaps(testCIDR4(t, "192.168.5.0/24")))
+		assert.Equal(t, false, c.Overlaps(testCIDR4(t, "192.168.6.0/23")))
+	})
+	t.Run("Size", func(t *testing.T) {
+		assert.Equal(t, "512", testCIDR4(t, "192.168.6.0/23").Size().String())
+		assert.Equal(t, "18446744073709551616", testCIDR6(t, "fd00::/64").Size().String())
+	})
+	t.Run("Supernet", func(t *testing.T) {
+		t.Run("Case1", func(t *testing.T) {
+			actual := testCIDR4(t, "192.168.6.0/23").Supernet(14)
+			expected := testCIDR4(t, "192.168.0.0/14")
+			assert.Equal(t, expected, actual)
+		})
+		t.Run("Case2", func(t *testing.T) {
+			assert.PanicsWithError(t, "Supernet with invalid prefixBits", func() {
+				testCIDR4(t, "192.168.6.0/23").Supernet(24)
+			})
+		})
+	})
 	t.Run("IsIPv4", func(t *testing.T) {
 		t.Run("Case1", func(t *testing.T) {
 			c := testCIDR4(t, "0.0.0.0/0")
@@ -108,6 +157,24 @@ func Test_CIDR(t *testing.T) {
 	})
 }
 
+func Test_Family(t *testing.T) {
+	assert.Equal(t, IPv4, testCIDR4(t, "10.0.0.0/8").Family())
+	assert.Equal(t, IPv6, testCIDR6(t, "fd00::/8").Family())
+	assert.Equal(t, 32, IPv4.Bits())
+	assert.Equal(t, 128, IPv6.Bits())
+	assert.Equal(t, 0, Family(5).Bits())
+	for _, s := range []string{"4", "IPv4", "ipv4"} {
+		f, err := ParseFamily(s)
+		assert.NoError(t, err)
+		assert.Equal(t, IPv4, f)
+	}
+	f, err := ParseFamily("6")
+	assert.NoError(t, err)
+	assert.Equal(t, IPv6, f)
+	_, err = ParseFamily("5")
+	assert.ErrorContains(t, err, "invalid address family")
+}
+
 func Test_ParseCIDR(t *testing.T) {
 	t.Run("Error", func(t *testing.T) {
 		x := ipTo4
@@ -0,0 +1,846 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jbrekelmans/go-sql-ip-management/allocator"
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/internal/database"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+func (c *cli) migrateStatus(ctx context.Context, args []string) error {
+	var dsn string
+	fs := c.flagSet("migrate status", &dsn)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return withDatabase(dsn, func(d *database.Database) error {
+		migrator, err := d.NewMigrator(d.DB)
+		if err != nil {
+			return err
+		}
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			appliedAt := "pending"
+			if status.AppliedAt != nil {
+				appliedAt = "applied " + status.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(c.stdout, "%04d %s %s\n", status.Version, status.Name, appliedAt)
+		}
+		return nil
+	})
+}
+
+func (c *cli) migrateUp(ctx context.Context, args []string) error {
+	var dsn string
+	fs := c.flagSet("migrate up", &dsn)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return withDatabase(dsn, func(d *database.Database) error {
+		migrator, err := d.NewMigrator(d.DB)
+		if err != nil {
+			return err
+		}
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		for _, migration := range applied {
+			fmt.Fprintf(c.stdout, "%04d %s applied\n", migration.Version, migration.Name)
+		}
+		return nil
+	})
+}
+
+func (c *cli) poolCreate(ctx context.Context, args []string) error {
+	var dsn, name string
+	fs := c.flagSet("pool create", &dsn)
+	fs.StringVar(&name, "name", "", "name of the pool (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if name == "" {
+		return errors.New(`--name is required`)
+	}
+	var roots []cidr.CIDR
+	for _, arg := range fs.Args() {
+		root, err := cidr.ParseCIDR(arg)
+		if err != nil {
+			return err
+		}
+		roots = append(roots, root)
+	}
+	return withDatabase(dsn, func(d *database.Database) error {
+		pool, err := allocator.NewPoolManager(d.Storage).CreatePool(ctx, name, roots...)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stdout, "%d %s\n", pool.ID, pool.Name)
+		return nil
+	})
+}
+
+func (c *cli) poolList(ctx context.Context, args []string) error {
+	var dsn string
+	fs := c.flagSet("pool list", &dsn)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return withDatabase(dsn, func(d *database.Database) error {
+		pools, err := allocator.NewPoolManager(d.Storage).ListPools(ctx)
+		if err != nil {
+			return err
+		}
+		for _, pool := range pools {
+			fmt.Fprintf(c.stdout, "%d %s\n", pool.ID, pool.Name)
+		}
+		return nil
+	})
+}
+
+func (c *cli) allocate(ctx context.Context, args []string) error {
+	var dsn, requestID, familyString string
+	var poolID, prefixBits int
+	var ttl time.Duration
+	labels := labelsFlag{}
+	fs := c.flagSet("allocate", &dsn)
+	fs.IntVar(&poolID, "pool", 0, "identifier of the pool (required)")
+	fs.IntVar(&prefixBits, "prefix", -1, "size of the range as a prefix length (required)")
+	fs.StringVar(&requestID, "request-id", "", "identifier of the request (required)")
+	fs.StringVar(&familyString, "family", "4", "address family: 4 or 6")
+	fs.DurationVar(&ttl, "ttl", 0, "allocate with a lease that expires after this duration (default no lease)")
+	fs.Var(labels, "label", "label of the allocation as key=value (repeatable)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := checkPoolAndRequestID(poolID, requestID); err != nil {
+		return err
+	}
+	if prefixBits < 0 {
+		return errors.New(`--prefix is required`)
+	}
+	family, err := cidr.ParseFamily(familyString)
+	if err != nil {
+		return err
+	}
+	if ttl < 0 {
+		return errors.New(`--ttl must not be negative`)
+	}
+	opts := []allocator.AllocateOption{allocator.WithLabels(labels)}
+	if ttl > 0 {
+		opts = append(opts, allocator.WithLease(ttl))
+	}
+	return withDatabase(dsn, func(d *database.Database) error {
+		c2, err := allocator.New(d.Storage, allocator.WithPoolID(poolID)).Allocate(ctx, family, prefixBits, requestID, opts...)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.stdout, c2.String())
+		return nil
+	})
+}
+
+func (c *cli) release(ctx context.Context, args []string) error {
+	var dsn, requestID string
+	var poolID int
+	fs := c.flagSet("release", &dsn)
+	fs.IntVar(&poolID, "pool", 0, "identifier of the pool (required)")
+	fs.StringVar(&requestID, "request-id", "", "identifier of the request (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := checkPoolAndRequestID(poolID, requestID); err != nil {
+		return err
+	}
+	return withDatabase(dsn, func(d *database.Database) error {
+		cs, err := allocator.New(d.Storage, allocator.WithPoolID(poolID)).Deallocate(ctx, requestID)
+		if err != nil {
+			return err
+		}
+		for _, c2 := range cs {
+			fmt.Fprintln(c.stdout, c2.String())
+		}
+		return nil
+	})
+}
+
+func (c *cli) label(ctx context.Context, args []string) error {
+	var dsn, requestID string
+	var poolID int
+	fs := c.flagSet("label", &dsn)
+	fs.IntVar(&poolID, "pool", 0, "identifier of the pool (required)")
+	fs.StringVar(&requestID, "request-id", "", "identifier of the request (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := checkPoolAndRequestID(poolID, requestID); err != nil {
+		return err
+	}
+	labels := labelsFlag{}
+	for _, arg := range fs.Args() {
+		if err := labels.Set(arg); err != nil {
+			return err
+		}
+	}
+	return withDatabase(dsn, func(d *database.Database) error {
+		return allocator.New(d.Storage, allocator.WithPoolID(poolID)).SetLabels(ctx, requestID, labels)
+	})
+}
+
+func (c *cli) list(ctx context.Context, args []string) error {
+	var dsn, within, state string
+	var poolID, pageSize int
+	filter := storage.ListFilter{}
+	selector := labelsFlag{}
+	fs := c.flagSet("list", &dsn)
+	fs.IntVar(&poolID, "pool", 0, "identifier of the pool (required)")
+	fs.StringVar(&within, "within", "", "only list ranges contained in this CIDR")
+	fs.IntVar(&filter.MinPrefixBits, "min-prefix", 0, "only list ranges with a prefix length of at least this")
+	fs.IntVar(&filter.MaxPrefixBits, "max-prefix", 0, "only list ranges with a prefix length of at most this")
+	fs.StringVar(&filter.RequestIDPrefix, "request-id-prefix", "", "only list ranges whose request ID starts with this")
+	fs.StringVar(&state, "state", "allocated", "only list ranges in this state: allocated, free or any")
+	fs.Var(selector, "label", "only list ranges with this label, as key=value (repeatable)")
+	fs.IntVar(&pageSize, "page-size", allocator.DefaultPageSize, "number of ranges to read per transaction")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if poolID <= 0 {
+		return errors.New(`--pool is required`)
+	}
+	if within != "" {
+		c2, err := cidr.ParseCIDR(within)
+		if err != nil {
+			return err
+		}
+		filter.Within = &c2
+	}
+	switch state {
+	case "allocated":
+		filter.State = storage.StateAllocated
+	case "free":
+		filter.State = storage.StateFree
+	case "any":
+		filter.State = storage.StateAny
+	default:
+		return fmt.Errorf(`--state must be allocated, free or any but got %#v`, state)
+	}
+	filter.Labels = selector
+	return withDatabase(dsn, func(d *database.Database) error {
+		a := allocator.New(d.Storage, allocator.WithPoolID(poolID))
+		pageToken := ""
+		for {
+			records, nextPageToken, err := a.ListAllocations(ctx, filter, pageToken, pageSize)
+			if err != nil {
+				return err
+			}
+			c.printRecords(records)
+			if nextPageToken == "" {
+				return nil
+			}
+			pageToken = nextPageToken
+		}
+	})
+}
+
+func (c *cli) renew(ctx context.Context, args []string) error {
+	var dsn, requestID string
+	var poolID int
+	var ttl time.Duration
+	fs := c.flagSet("renew", &dsn)
+	fs.IntVar(&poolID, "pool", 0, "identifier of the pool (required)")
+	fs.StringVar(&requestID, "request-id", "", "identifier of the request (required)")
+	fs.DurationVar(&ttl, "ttl", 0, "duration from now after which the lease expires (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := checkPoolAndRequestID(poolID, requestID); err != nil {
+		return err
+	}
+	if ttl <= 0 {
+		return errors.New(`--ttl is required and must be positive`)
+	}
+	return withDatabase(dsn, func(d *database.Database) error {
+		expiresAt, err := allocator.New(d.Storage, allocator.WithPoolID(poolID)).Renew(ctx, requestID, ttl)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.stdout, expiresAt.Format(time.RFC3339))
+		return nil
+	})
+}
+
+func (c *cli) reap(ctx context.Context, args []string) error {
+	var dsn string
+	var poolID int
+	fs := c.flagSet("reap", &dsn)
+	fs.IntVar(&poolID, "pool", 0, "identifier of the pool (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if poolID <= 0 {
+		return errors.New(`--pool is required`)
+	}
+	return withDatabase(dsn, func(d *database.Database) error {
+		records, err := allocator.New(d.Storage, allocator.WithPoolID(poolID)).Reap(ctx)
+		if err != nil {
+			return err
+		}
+		c.printRecords(records)
+		return nil
+	})
+}
+
+func (c *cli) show(ctx context.Context, args []string) error {
+	var dsn, requestID string
+	var poolID int
+	fs := c.flagSet("show", &dsn)
+	fs.IntVar(&poolID, "pool", 0, "identifier of the pool (required)")
+	fs.StringVar(&requestID, "request-id", "", "identifier of the request (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := checkPoolAndRequestID(poolID, requestID); err != nil {
+		return err
+	}
+	return withDatabase(dsn, func(d *database.Database) error {
+		records, err := allocator.New(d.Storage, allocator.WithPoolID(poolID)).Lookup(ctx, requestID)
+		if err != nil {
+			return err
+		}
+		c.printRecords(records)
+		return nil
+	})
+}
+
+func (c *cli) dump(ctx context.Context, args []string) error {
+	var dsn, atString string
+	var poolID int
+	fs := c.flagSet("dump", &dsn)
+	fs.IntVar(&poolID, "pool", 0, "identifier of the pool (required)")
+	fs.StringVar(&atString, "at", "", "print the ranges as they were at this time (RFC 3339) instead of now")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if poolID <= 0 {
+		return errors.New(`--pool is required`)
+	}
+	var at time.Time
+	if atString != "" {
+		var err error
+		if at, err = time.Parse(time.RFC3339Nano, atString); err != nil {
+			return fmt.Errorf(`invalid --at: %w`, err)
+		}
+	}
+	return withDatabase(dsn, func(d *database.Database) (err error) {
+		var records []storage.Record
+		err = readOnly(ctx, d.Storage, func(tx storage.Transaction) (err error) {
+			pool, err := tx.GetPool(ctx, poolID)
+			if err != nil {
+				return
+			}
+			if pool == nil {
+				return allocator.ErrPoolNotFound
+			}
+			if at.IsZero() {
+				records, err = tx.ListRecords(ctx, poolID)
+			} else {
+				records, err = tx.ListRecordsAt(ctx, poolID, at)
+			}
+			return
+		})
+		if err != nil {
+			return
+		}
+		c.printRecords(records)
+		return
+	})
+}
+
+// stats prints one line per family, for example:
+//
+//	IPv4 total=65536 allocated=256 free=65280 retired=0 largestFree=/17 fragmentation=0.4980 freeBlocks=/17:1,/18:1,...
+//
+// largestFree is none if no range can be allocated.
+func (c *cli) stats(ctx context.Context, args []string) error {
+	var dsn string
+	var poolID int
+	fs := c.flagSet("stats", &dsn)
+	fs.IntVar(&poolID, "pool", 0, "identifier of the pool (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if poolID <= 0 {
+		return errors.New(`--pool is required`)
+	}
+	return withDatabase(dsn, func(d *database.Database) error {
+		stats, err := allocator.NewPoolManager(d.Storage).PoolStats(ctx, poolID)
+		if err != nil {
+			return err
+		}
+		for _, family := range []cidr.Family{cidr.IPv4, cidr.IPv6} {
+			familyStats := stats.Family(family)
+			largestFree := "none"
+			if familyStats.LargestFreePrefixBits >= 0 {
+				largestFree = fmt.Sprintf("/%d", familyStats.LargestFreePrefixBits)
+			}
+			prefixes := make([]int, 0, len(familyStats.FreeBlocks))
+			for prefixBits := range familyStats.FreeBlocks {
+				prefixes = append(prefixes, prefixBits)
+			}
+			sort.Ints(prefixes)
+			suffix := ""
+			for i, prefixBits := range prefixes {
+				if i == 0 {
+					suffix = " freeBlocks="
+				} else {
+					suffix += ","
+				}
+				suffix += fmt.Sprintf("/%d:%d", prefixBits, familyStats.FreeBlocks[prefixBits])
+			}
+			fmt.Fprintf(c.stdout, "%s total=%s allocated=%s free=%s retired=%s largestFree=%s fragmentation=%.4f%s\n",
+				family, familyStats.Total, familyStats.Allocated, familyStats.Free, familyStats.Retired, largestFree,
+				familyStats.Fragmentation, suffix)
+		}
+		return nil
+	})
+}
+
+// history prints one line per event, oldest first, for example:
+//
+//	2024-01-02T03:04:05Z allocate 10.0.0.0/24 requestID="a" actor="alice"
+func (c *cli) history(ctx context.Context, args []string) error {
+	var dsn, cidrString, requestID string
+	var poolID int
+	fs := c.flagSet("history", &dsn)
+	fs.IntVar(&poolID, "pool", 0, "identifier of the pool (required)")
+	fs.StringVar(&cidrString, "cidr", "", "print the events of ranges that overlap this CIDR")
+	fs.StringVar(&requestID, "request-id", "", "print the events of this request")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if poolID <= 0 {
+		return errors.New(`--pool is required`)
+	}
+	if (cidrString == "") == (requestID == "") {
+		return errors.New(`exactly one of --cidr and --request-id is required`)
+	}
+	var c2 cidr.CIDR
+	if cidrString != "" {
+		var err error
+		if c2, err = cidr.ParseCIDR(cidrString); err != nil {
+			return err
+		}
+	}
+	return withDatabase(dsn, func(d *database.Database) (err error) {
+		a := allocator.New(d.Storage, allocator.WithPoolID(poolID))
+		var events []storage.Event
+		if requestID != "" {
+			events, err = a.HistoryOfRequest(ctx, requestID)
+		} else {
+			events, err = a.History(ctx, c2)
+		}
+		if err != nil {
+			return
+		}
+		for _, event := range events {
+			fmt.Fprintf(c.stdout, "%s %s %s requestID=%#v actor=%#v\n", event.Time.Format(time.RFC3339Nano), event.Type,
+				event.C.String(), event.RequestID, event.Actor)
+		}
+		return
+	})
+}
+
+// fsck prints the violations of the invariants of the records of a pool one per line, for example:
+//
+//	unmerged_buddies 10.0.0.0/25 10.0.0.128/25 repaired
+//	gap 10.0.1.0/24
+//
+// Returns an error if violations remain.
+func (c *cli) fsck(ctx context.Context, args []string) error {
+	var dsn string
+	var poolID int
+	var repair bool
+	fs := c.flagSet("fsck", &dsn)
+	fs.IntVar(&poolID, "pool", 0, "identifier of the pool (required)")
+	fs.BoolVar(&repair, "repair", false, "merge unmerged buddies")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if poolID <= 0 {
+		return errors.New(`--pool is required`)
+	}
+	return withDatabase(dsn, func(d *database.Database) (err error) {
+		m := allocator.NewPoolManager(d.Storage)
+		var violations []allocator.Violation
+		if repair {
+			violations, err = m.Repair(ctx, poolID)
+		} else {
+			violations, err = m.Check(ctx, poolID)
+		}
+		if err != nil {
+			return
+		}
+		remaining := 0
+		for _, violation := range violations {
+			line := string(violation.Type) + " " + violation.C.String()
+			if violation.Other != nil {
+				line += " " + violation.Other.String()
+			}
+			if violation.Repaired {
+				line += " repaired"
+			} else {
+				remaining++
+			}
+			fmt.Fprintln(c.stdout, line)
+		}
+		if remaining > 0 {
+			return fmt.Errorf(`pool %d has %d violations`, poolID, remaining)
+		}
+		return
+	})
+}
+
+// defragPlan prints a plan to free a range of a pool by moving allocations, for example:
+//
+//	block 10.0.0.0/25
+//	move 10.0.0.0/26 10.0.0.192/26 requestID="a"
+//
+// The plan can be saved to a file, reviewed and applied with defrag apply.
+func (c *cli) defragPlan(ctx context.Context, args []string) error {
+	var dsn, familyString string
+	var poolID, prefixBits int
+	fs := c.flagSet("defrag plan", &dsn)
+	fs.IntVar(&poolID, "pool", 0, "identifier of the pool (required)")
+	fs.IntVar(&prefixBits, "prefix", -1, "size of the range to free as a prefix length (required)")
+	fs.StringVar(&familyString, "family", "4", "address family: 4 or 6")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if poolID <= 0 {
+		return errors.New(`--pool is required`)
+	}
+	if prefixBits < 0 {
+		return errors.New(`--prefix is required`)
+	}
+	family, err := cidr.ParseFamily(familyString)
+	if err != nil {
+		return err
+	}
+	return withDatabase(dsn, func(d *database.Database) error {
+		plan, err := allocator.New(d.Storage, allocator.WithPoolID(poolID)).PlanDefrag(ctx, family, prefixBits)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.stdout, "block %s\n", plan.Block)
+		for _, move := range plan.Moves {
+			c.printMove(move)
+		}
+		return nil
+	})
+}
+
+// defragApply applies a plan printed by defrag plan, and prints the moves that were applied in the same format.
+func (c *cli) defragApply(ctx context.Context, args []string) error {
+	var dsn string
+	var poolID int
+	fs := c.flagSet("defrag apply", &dsn)
+	fs.IntVar(&poolID, "pool", 0, "identifier of the pool (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if poolID <= 0 {
+		return errors.New(`--pool is required`)
+	}
+	if fs.NArg() != 1 {
+		return errors.New(`exactly one plan file is required`)
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	plan, err := parseDefragPlan(f)
+	if err != nil {
+		return fmt.Errorf(`invalid plan %s: %w`, fs.Arg(0), err)
+	}
+	return withDatabase(dsn, func(d *database.Database) error {
+		applied, err := allocator.New(d.Storage, allocator.WithPoolID(poolID)).ApplyDefrag(ctx, plan)
+		for _, move := range applied {
+			c.printMove(move)
+		}
+		return err
+	})
+}
+
+func (c *cli) printMove(move allocator.DefragMove) {
+	fmt.Fprintf(c.stdout, "move %s %s requestID=%#v\n", move.From, move.To, move.RequestID)
+}
+
+// parseDefragPlan parses a plan in the format printed by defrag plan.
+func parseDefragPlan(r io.Reader) (*allocator.DefragPlan, error) {
+	var plan allocator.DefragPlan
+	var hasBlock bool
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		kind, rest, _ := strings.Cut(line, " ")
+		var err error
+		switch kind {
+		case "block":
+			if hasBlock {
+				return nil, fmt.Errorf(`line %d: duplicate block`, lineNumber)
+			}
+			hasBlock = true
+			plan.Block, err = cidr.ParseCIDR(rest)
+		case "move":
+			var move allocator.DefragMove
+			move, err = parseMove(rest)
+			plan.Moves = append(plan.Moves, move)
+		default:
+			err = fmt.Errorf(`unknown line %#v`, line)
+		}
+		if err != nil {
+			return nil, fmt.Errorf(`line %d: %w`, lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !hasBlock {
+		return nil, errors.New(`missing block`)
+	}
+	return &plan, nil
+}
+
+// parseMove parses a move of the form "<from> <to> requestID=<quoted request ID>".
+func parseMove(s string) (move allocator.DefragMove, err error) {
+	fromString, s, _ := strings.Cut(s, " ")
+	toString, s, _ := strings.Cut(s, " ")
+	quotedRequestID, ok := strings.CutPrefix(s, "requestID=")
+	if !ok {
+		return move, fmt.Errorf(`move is not of the form <from> <to> requestID=<request ID>`)
+	}
+	if move.From, err = cidr.ParseCIDR(fromString); err != nil {
+		return
+	}
+	if move.To, err = cidr.ParseCIDR(toString); err != nil {
+		return
+	}
+	move.RequestID, err = strconv.Unquote(quotedRequestID)
+	return
+}
+
+// hostEnable enables allocating host addresses from a subnet. The gateway defaults to the first address after the
+// network address; --gateway none reserves no gateway.
+func (c *cli) hostEnable(ctx context.Context, args []string) error {
+	var dsn, subnetString, gatewayString string
+	var poolID int
+	fs := c.flagSet("host enable", &dsn)
+	fs.IntVar(&poolID, "pool", 0, "identifier of the pool (required)")
+	fs.StringVar(&subnetString, "subnet", "", "allocated range to allocate host addresses from (required)")
+	fs.StringVar(&gatewayString, "gateway", "", "gateway address to reserve, or none (default the first host address)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	subnet, err := parseSubnet(poolID, subnetString)
+	if err != nil {
+		return err
+	}
+	var opts []allocator.HostSubnetOption
+	switch gatewayString {
+	case "":
+	case "none":
+		opts = append(opts, allocator.WithGateway(nil))
+	default:
+		gateway := net.ParseIP(gatewayString)
+		if gateway == nil {
+			return fmt.Errorf(`invalid --gateway %#v`, gatewayString)
+		}
+		opts = append(opts, allocator.WithGateway(gateway))
+	}
+	return withDatabase(dsn, func(d *database.Database) error {
+		return allocator.New(d.Storage, allocator.WithPoolID(poolID)).EnableHosts(ctx, subnet, opts...)
+	})
+}
+
+func (c *cli) hostAllocate(ctx context.Context, args []string) error {
+	var dsn, subnetString, requestID string
+	var poolID int
+	fs := c.flagSet("host allocate", &dsn)
+	fs.IntVar(&poolID, "pool", 0, "identifier of the pool (required)")
+	fs.StringVar(&subnetString, "subnet", "", "subnet to allocate from (required)")
+	fs.StringVar(&requestID, "request-id", "", "identifier of the request (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	subnet, err := parseSubnet(poolID, subnetString)
+	if err != nil {
+		return err
+	}
+	if err := checkPoolAndRequestID(poolID, requestID); err != nil {
+		return err
+	}
+	return withDatabase(dsn, func(d *database.Database) error {
+		ip, err := allocator.New(d.Storage, allocator.WithPoolID(poolID)).AllocateHost(ctx, subnet, requestID)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.stdout, ip.String())
+		return nil
+	})
+}
+
+func (c *cli) hostRelease(ctx context.Context, args []string) error {
+	var dsn, subnetString, requestID string
+	var poolID int
+	fs := c.flagSet("host release", &dsn)
+	fs.IntVar(&poolID, "pool", 0, "identifier of the pool (required)")
+	fs.StringVar(&subnetString, "subnet", "", "subnet of the host address (required)")
+	fs.StringVar(&requestID, "request-id", "", "identifier of the request (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	subnet, err := parseSubnet(poolID, subnetString)
+	if err != nil {
+		return err
+	}
+	if err := checkPoolAndRequestID(poolID, requestID); err != nil {
+		return err
+	}
+	return withDatabase(dsn, func(d *database.Database) error {
+		ip, err := allocator.New(d.Storage, allocator.WithPoolID(poolID)).DeallocateHost(ctx, subnet, requestID)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.stdout, ip.String())
+		return nil
+	})
+}
+
+func (c *cli) hostList(ctx context.Context, args []string) error {
+	var dsn, subnetString string
+	var poolID int
+	fs := c.flagSet("host list", &dsn)
+	fs.IntVar(&poolID, "pool", 0, "identifier of the pool (required)")
+	fs.StringVar(&subnetString, "subnet", "", "subnet to list (required)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	subnet, err := parseSubnet(poolID, subnetString)
+	if err != nil {
+		return err
+	}
+	return withDatabase(dsn, func(d *database.Database) error {
+		hosts, err := allocator.New(d.Storage, allocator.WithPoolID(poolID)).ListHosts(ctx, subnet)
+		if err != nil {
+			return err
+		}
+		for _, host := range hosts {
+			fmt.Fprintf(c.stdout, "%s requestID=%#v\n", host.IP, host.RequestID)
+		}
+		return nil
+	})
+}
+
+// parseSubnet checks --pool and parses --subnet of the host commands.
+func parseSubnet(poolID int, subnetString string) (cidr.CIDR, error) {
+	if poolID <= 0 {
+		return cidr.CIDR{}, errors.New(`--pool is required`)
+	}
+	if subnetString == "" {
+		return cidr.CIDR{}, errors.New(`--subnet is required`)
+	}
+	return cidr.ParseCIDR(subnetString)
+}
+
+// printRecords prints records one per line, in the format of the original demo's dump.
+func (c *cli) printRecords(records []storage.Record) {
+	for _, record := range records {
+		suffix := ""
+		if len(record.Labels) > 0 {
+			suffix += " labels=" + labelsFlag(record.Labels).String()
+		}
+		if record.ExpiresAt != nil {
+			suffix += " expiresAt=" + record.ExpiresAt.Format(time.RFC3339)
+		}
+		if record.Retired {
+			suffix += " retired"
+		}
+		if record.MovedFrom != nil {
+			suffix += " movedFrom=" + record.MovedFrom.String()
+		}
+		fmt.Fprintf(c.stdout, "%d %s requestID=%#v%s\n", record.PoolID, record.C.String(), record.RequestID, suffix)
+	}
+}
+
+// labelsFlag is a flag.Value of labels, which are set as key=value.
+type labelsFlag map[string]string
+
+func (f labelsFlag) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf(`label %#v is not of the form key=value`, s)
+	}
+	f[key] = value
+	return nil
+}
+
+// String formats the labels as key=value pairs separated by commas, ordered by key.
+func (f labelsFlag) String() string {
+	keys := make([]string, 0, len(f))
+	for key := range f {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"="+f[key])
+	}
+	return strings.Join(pairs, ",")
+}
+
+func checkPoolAndRequestID(poolID int, requestID string) error {
+	if poolID <= 0 {
+		return errors.New(`--pool is required`)
+	}
+	if requestID == "" {
+		return errors.New(`--request-id is required`)
+	}
+	return nil
+}
+
+// readOnly calls f with a read-only transaction of s, and rolls the transaction back afterwards.
+func readOnly(ctx context.Context, s storage.Storage, f func(tx storage.Transaction) error) (err error) {
+	tx, err := s.BeginTransaction(ctx, &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return
+	}
+	defer func() {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil && err == nil {
+			err = rollbackErr
+		}
+	}()
+	return f(tx)
+}
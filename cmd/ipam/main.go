@@ -0,0 +1,169 @@
+// Command ipam manages IP address pools and allocations stored in Postgres or SQLite.
+//
+// Usage:
+//
+//	ipam <command> [flags] [args]
+//
+// Run "ipam help" for the list of commands.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jbrekelmans/go-sql-ip-management/allocator"
+	"github.com/jbrekelmans/go-sql-ip-management/internal/database"
+)
+
+func main() {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	ctx := context.Background()
+	ctx, cancelFunc := signal.NotifyContext(ctx, os.Interrupt)
+	defer cancelFunc()
+	c := &cli{
+		getenv: os.Getenv,
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+	}
+	if err := c.run(ctx, os.Args[1:]); err != nil {
+		cancelFunc()
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		log.Fatal().Err(err).Send()
+	}
+}
+
+// cli holds the environment of the ipam command, so that it can be run from tests.
+type cli struct {
+	getenv func(key string) string
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// command is a (possibly nested) subcommand of ipam, such as "pool create".
+type command struct {
+	name  string
+	args  string
+	short string
+	run   func(c *cli, ctx context.Context, args []string) error
+}
+
+// commands lists the subcommands of ipam, in the order they are printed by usage.
+var commands []command
+
+func init() {
+	commands = []command{
+		{name: "init", short: "alias of migrate up", run: (*cli).migrateUp},
+		{name: "migrate status", short: "list schema migrations and whether they are applied", run: (*cli).migrateStatus},
+		{name: "migrate up", short: "apply pending schema migrations", run: (*cli).migrateUp},
+		{name: "pool create", args: "--name <name> [<cidr>...]", short: "create a pool with root ranges", run: (*cli).poolCreate},
+		{name: "pool list", short: "list pools", run: (*cli).poolList},
+		{name: "allocate",
+			args:  "--pool <id> --prefix <bits> --request-id <id> [--family 4|6] [--ttl <duration>] [--label <key>=<value>...]",
+			short: "allocate a range to a request", run: (*cli).allocate},
+		{name: "release", args: "--pool <id> --request-id <id>", short: "deallocate the ranges of a request", run: (*cli).release},
+		{name: "renew", args: "--pool <id> --request-id <id> --ttl <duration>", short: "renew the lease of a request",
+			run: (*cli).renew},
+		{name: "reap", args: "--pool <id>", short: "deallocate the ranges whose lease has expired", run: (*cli).reap},
+		{name: "label", args: "--pool <id> --request-id <id> [<key>=<value>...]", short: "replace the labels of a request",
+			run: (*cli).label},
+		{name: "list", args: "--pool <id> [--within <cidr>] [--min-prefix <bits>] [--max-prefix <bits>] " +
+			"[--request-id-prefix <prefix>] [--state allocated|free|any] [--label <key>=<value>...]",
+			short: "list ranges ordered by address, filtered by the flags", run: (*cli).list},
+		{name: "show", args: "--pool <id> --request-id <id>", short: "show the ranges of a request", run: (*cli).show},
+		{name: "dump", args: "--pool <id> [--at <time>]", short: "print all ranges of a pool", run: (*cli).dump},
+		{name: "stats", args: "--pool <id>", short: "print utilization and fragmentation of a pool per family",
+			run: (*cli).stats},
+		{name: "history", args: "--pool <id> (--cidr <cidr> | --request-id <id>)",
+			short: "print the allocations, releases, splits and merges of a range or a request", run: (*cli).history},
+		{name: "fsck", args: "--pool <id> [--repair]",
+			short: "check that the ranges of a pool do not overlap, tile the pool and are merged", run: (*cli).fsck},
+		{name: "defrag plan", args: "--pool <id> --prefix <bits> [--family 4|6]",
+			short: "print a plan to free a range of this size by moving the fewest allocations", run: (*cli).defragPlan},
+		{name: "defrag apply", args: "--pool <id> <plan-file>",
+			short: "move allocations one request at a time as planned by defrag plan", run: (*cli).defragApply},
+		{name: "host enable", args: "--pool <id> --subnet <cidr> [--gateway <ip>|none]",
+			short: "allocate individual host addresses from an allocated range", run: (*cli).hostEnable},
+		{name: "host allocate", args: "--pool <id> --subnet <cidr> --request-id <id>",
+			short: "allocate a host address of a subnet to a request", run: (*cli).hostAllocate},
+		{name: "host release", args: "--pool <id> --subnet <cidr> --request-id <id>",
+			short: "deallocate the host address of a subnet of a request", run: (*cli).hostRelease},
+		{name: "host list", args: "--pool <id> --subnet <cidr>", short: "list the host addresses of a subnet",
+			run: (*cli).hostList},
+		{name: "help", short: "print this help", run: (*cli).help},
+	}
+}
+
+// run runs the subcommand identified by the leading elements of args.
+// Changes are recorded in the history of ranges as made by the actor $IPAM_ACTOR, which defaults to $USER.
+func (c *cli) run(ctx context.Context, args []string) error {
+	actor := c.getenv("IPAM_ACTOR")
+	if actor == "" {
+		actor = c.getenv("USER")
+	}
+	ctx = allocator.ContextWithActor(ctx, actor)
+	for _, cmd := range commands {
+		nameParts := strings.Fields(cmd.name)
+		if len(args) < len(nameParts) || strings.Join(args[:len(nameParts)], " ") != cmd.name {
+			continue
+		}
+		return cmd.run(c, ctx, args[len(nameParts):])
+	}
+	c.usage()
+	if len(args) == 0 {
+		return flag.ErrHelp
+	}
+	return fmt.Errorf(`unknown command %#v`, strings.Join(args, " "))
+}
+
+func (c *cli) help(ctx context.Context, args []string) error {
+	c.usage()
+	return nil
+}
+
+func (c *cli) usage() {
+	fmt.Fprintf(c.stderr, "Usage: ipam <command> [flags] [args]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(c.stderr, "  %s %s\n        %s\n", cmd.name, cmd.args, cmd.short)
+	}
+	fmt.Fprintf(c.stderr, "\nEvery command except help accepts --dsn, which defaults to $DATABASE_URL.\n")
+	fmt.Fprintf(c.stderr, "Changes are recorded in the history as made by $IPAM_ACTOR, which defaults to $USER.\n")
+}
+
+// flagSet returns a flag set for the subcommand name that has the --dsn flag.
+func (c *cli) flagSet(name string, dsn *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("ipam "+name, flag.ContinueOnError)
+	fs.SetOutput(c.stderr)
+	fs.StringVar(dsn, "dsn", c.getenv("DATABASE_URL"),
+		"data source name: a postgres:// or postgresql:// URL, or a SQLite file: URL (default $DATABASE_URL)")
+	return fs
+}
+
+// withDatabase opens the database identified by dsn, calls f and closes the database.
+func withDatabase(dsn string, f func(d *database.Database) error) (err error) {
+	d, err := database.Open(dsn)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := d.Close(); closeErr != nil {
+			if err == nil {
+				err = closeErr
+			} else {
+				log.Error().Err(closeErr).Msg("error closing db")
+			}
+		}
+	}()
+	return f(d)
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jbrekelmans/go-sql-ip-management/allocator"
+)
+
+// testCLI returns a function that runs an ipam command against a new SQLite database, and returns
+// the standard output of the command.
+func testCLI(t *testing.T) func(args ...string) (string, error) {
+	t.Helper()
+	dsn := fmt.Sprintf("file:%s?_busy_timeout=5000&_txlock=immediate&_foreign_keys=on", filepath.Join(t.TempDir(), "ipam.db"))
+	return func(args ...string) (string, error) {
+		var stdout bytes.Buffer
+		c := &cli{
+			getenv: func(key string) string {
+				switch key {
+				case "DATABASE_URL":
+					return dsn
+				case "USER":
+					return "tester"
+				}
+				return ""
+			},
+			stdout: &stdout,
+			stderr: io.Discard,
+		}
+		err := c.run(context.Background(), args)
+		return stdout.String(), err
+	}
+}
+
+func Test_CLI(t *testing.T) {
+	run := testCLI(t)
+	out, err := run("migrate", "status")
+	require.NoError(t, err)
+	assert.Equal(t, "0001 initial pending\n0002 lease pending\n0003 labels pending\n0004 events pending\n0005 range_versions pending\n0006 pool_roots pending\n0007 moves pending\n0008 hosts pending\n0009 host_events pending\n0010 pool_tombstones pending\n0011 retire_events pending\n", out)
+	out, err = run("init")
+	require.NoError(t, err)
+	assert.Equal(t, "0001 initial applied\n0002 lease applied\n0003 labels applied\n0004 events applied\n0005 range_versions applied\n0006 pool_roots applied\n0007 moves applied\n0008 hosts applied\n0009 host_events applied\n0010 pool_tombstones applied\n0011 retire_events applied\n", out)
+	out, err = run("migrate", "up")
+	require.NoError(t, err)
+	assert.Equal(t, "", out)
+	out, err = run("migrate", "status")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out, "0001 initial applied "), out)
+	out, err = run("pool", "create", "--name", "pool1", "10.0.0.0/16", "fd00::/48")
+	require.NoError(t, err)
+	assert.Equal(t, "1 pool1\n", out)
+	out, err = run("pool", "list")
+	require.NoError(t, err)
+	assert.Equal(t, "1 pool1\n", out)
+
+	out, err = run("allocate", "--pool", "1", "--prefix", "24", "--request-id", "a")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.0/24\n", out)
+	out, err = run("allocate", "--pool=1", "--prefix=64", "--request-id=a", "--family=6")
+	require.NoError(t, err)
+	assert.Equal(t, "fd00::/64\n", out)
+	_, err = run("allocate", "--pool", "1", "--prefix", "25", "--request-id", "a")
+	assert.ErrorIs(t, err, allocator.ErrRequestConflict)
+	_, err = run("allocate", "--pool", "1", "--request-id", "a")
+	assert.Error(t, err)
+
+	out, err = run("show", "--pool", "1", "--request-id", "a")
+	require.NoError(t, err)
+	assert.Equal(t, "1 10.0.0.0/24 requestID=\"a\"\n1 fd00::/64 requestID=\"a\"\n", out)
+	out, err = run("dump", "--pool", "1")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out, "1 10.0.0.0/24 requestID=\"a\"\n1 10.0.1.0/24 requestID=\"\"\n"), out)
+	allocated, allocatedAt := out, time.Now().Format(time.RFC3339Nano)
+
+	out, err = run("stats", "--pool", "1")
+	require.NoError(t, err)
+	assert.Equal(t, "IPv4 total=65536 allocated=256 free=65280 retired=0 largestFree=/17 fragmentation=0.4980 "+
+		"freeBlocks=/17:1,/18:1,/19:1,/20:1,/21:1,/22:1,/23:1,/24:1\n"+
+		"IPv6 total=1208925819614629174706176 allocated=18446744073709551616 free=1208907372870555465154560 retired=0 "+
+		"largestFree=/49 fragmentation=0.5000 freeBlocks=/49:1,/50:1,/51:1,/52:1,/53:1,/54:1,/55:1,/56:1,/57:1,"+
+		"/58:1,/59:1,/60:1,/61:1,/62:1,/63:1,/64:1\n", out)
+	_, err = run("stats", "--pool", "2")
+	assert.ErrorIs(t, err, allocator.ErrPoolNotFound)
+
+	out, err = run("release", "--pool", "1", "--request-id", "a")
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.0/24\nfd00::/64\n", out)
+	_, err = run("show", "--pool", "1", "--request-id", "a")
+	assert.ErrorIs(t, err, allocator.ErrNotFound)
+	out, err = run("dump", "--pool", "1")
+	require.NoError(t, err)
+	assert.Equal(t, "1 10.0.0.0/16 requestID=\"\"\n1 fd00::/48 requestID=\"\"\n", out)
+	_, err = run("dump", "--pool", "2")
+	assert.ErrorIs(t, err, allocator.ErrPoolNotFound)
+	out, err = run("dump", "--pool", "1", "--at", allocatedAt)
+	require.NoError(t, err)
+	assert.Equal(t, allocated, out)
+	out, err = run("dump", "--pool", "1", "--at", "2000-01-01T00:00:00Z")
+	require.NoError(t, err)
+	assert.Equal(t, "", out)
+	_, err = run("dump", "--pool", "1", "--at", "yesterday")
+	assert.Error(t, err)
+
+	_, err = run("allocate", "--pool", "1", "--prefix", "24", "--request-id", "b", "--ttl", "1h")
+	require.NoError(t, err)
+	out, err = run("show", "--pool", "1", "--request-id", "b")
+	require.NoError(t, err)
+	assert.Contains(t, out, " expiresAt=")
+	_, err = run("renew", "--pool", "1", "--request-id", "b", "--ttl", "2h")
+	require.NoError(t, err)
+	_, err = run("renew", "--pool", "1", "--request-id", "c", "--ttl", "2h")
+	assert.ErrorIs(t, err, allocator.ErrNotFound)
+	out, err = run("reap", "--pool", "1")
+	require.NoError(t, err)
+	assert.Equal(t, "", out)
+
+	_, err = run("allocate", "--pool", "1", "--prefix", "24", "--request-id", "c", "--label", "team=payments", "--label", "env=ci")
+	require.NoError(t, err)
+	out, err = run("list", "--pool", "1", "--label", "team=payments")
+	require.NoError(t, err)
+	assert.Equal(t, "1 10.0.1.0/24 requestID=\"c\" labels=env=ci,team=payments\n", out)
+	_, err = run("label", "--pool", "1", "--request-id", "c", "team=search")
+	require.NoError(t, err)
+	out, err = run("list", "--pool", "1", "--label", "team=payments")
+	require.NoError(t, err)
+	assert.Equal(t, "", out)
+	_, err = run("allocate", "--pool", "1", "--prefix", "24", "--request-id", "d", "--label", "team")
+	assert.Error(t, err)
+	out, err = run("list", "--pool", "1", "--page-size", "1", "--within", "10.0.0.0/23", "--state", "any")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(out, "1 10.0.0.0/24 requestID=\"b\" expiresAt="), out)
+	assert.True(t, strings.HasSuffix(out, "\n1 10.0.1.0/24 requestID=\"c\" labels=team=search\n"), out)
+	out, err = run("list", "--pool", "1", "--state", "free", "--max-prefix", "16")
+	require.NoError(t, err)
+	assert.Equal(t, "", out)
+	_, err = run("list", "--pool", "1", "--state", "other")
+	assert.Error(t, err)
+
+	out, err = run("history", "--pool", "1", "--request-id", "a")
+	require.NoError(t, err)
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		// Strip the time.
+		_, line, _ = strings.Cut(line, " ")
+		lines = append(lines, line)
+	}
+	assert.Equal(t, []string{
+		`allocate 10.0.0.0/24 requestID="a" actor="tester"`,
+		`allocate fd00::/64 requestID="a" actor="tester"`,
+		`release 10.0.0.0/24 requestID="a" actor="tester"`,
+		`release fd00::/64 requestID="a" actor="tester"`,
+	}, lines)
+	out, err = run("history", "--pool", "1", "--cidr", "10.0.1.0/24")
+	require.NoError(t, err)
+	assert.Equal(t, 4, strings.Count(out, "\n"), out)
+	assert.True(t, strings.HasSuffix(out, " allocate 10.0.1.0/24 requestID=\"c\" actor=\"tester\"\n"), out)
+	_, err = run("history", "--pool", "1")
+	assert.Error(t, err)
+
+	out, err = run("fsck", "--pool", "1")
+	require.NoError(t, err)
+	assert.Equal(t, "", out)
+	out, err = run("fsck", "--pool", "1", "--repair")
+	require.NoError(t, err)
+	assert.Equal(t, "", out)
+	_, err = run("fsck", "--pool", "2")
+	assert.ErrorIs(t, err, allocator.ErrPoolNotFound)
+
+	out, err = run("pool", "create", "--name", "pool2", "10.1.0.0/24")
+	require.NoError(t, err)
+	assert.Equal(t, "2 pool2\n", out)
+	for _, requestID := range []string{"w", "x", "y", "z"} {
+		_, err = run("allocate", "--pool", "2", "--prefix", "26", "--request-id", requestID)
+		require.NoError(t, err)
+	}
+	for _, requestID := range []string{"x", "z"} {
+		_, err = run("release", "--pool", "2", "--request-id", requestID)
+		require.NoError(t, err)
+	}
+	plan, err := run("defrag", "plan", "--pool", "2", "--prefix", "25")
+	require.NoError(t, err)
+	assert.Equal(t, "block 10.1.0.0/25\nmove 10.1.0.0/26 10.1.0.192/26 requestID=\"w\"\n", plan)
+	planFile := filepath.Join(t.TempDir(), "plan.txt")
+	require.NoError(t, os.WriteFile(planFile, []byte(plan), 0o600))
+	out, err = run("defrag", "apply", "--pool", "2", planFile)
+	require.NoError(t, err)
+	assert.Equal(t, "move 10.1.0.0/26 10.1.0.192/26 requestID=\"w\"\n", out)
+	out, err = run("allocate", "--pool", "2", "--prefix", "25", "--request-id", "v")
+	require.NoError(t, err)
+	assert.Equal(t, "10.1.0.0/25\n", out)
+	_, err = run("defrag", "plan", "--pool", "2", "--prefix", "24")
+	assert.ErrorIs(t, err, allocator.ErrPoolExhausted)
+	require.NoError(t, os.WriteFile(planFile, []byte("move 10.1.0.0/26 10.1.0.192/26\n"), 0o600))
+	_, err = run("defrag", "apply", "--pool", "2", planFile)
+	assert.Error(t, err)
+
+	_, err = run("host", "allocate", "--pool", "2", "--subnet", "10.1.0.0/25", "--request-id", "vm1")
+	assert.ErrorIs(t, err, allocator.ErrHostsNotEnabled)
+	_, err = run("host", "enable", "--pool", "2", "--subnet", "10.1.0.0/25", "--gateway", "10.1.0")
+	assert.Error(t, err)
+	_, err = run("host", "enable", "--pool", "2", "--subnet", "10.1.0.0/25", "--gateway", "10.1.0.126")
+	require.NoError(t, err)
+	for _, requestID := range []string{"vm1", "vm2", "vm1"} {
+		_, err = run("host", "allocate", "--pool", "2", "--subnet", "10.1.0.0/25", "--request-id", requestID)
+		require.NoError(t, err)
+	}
+	out, err = run("host", "list", "--pool", "2", "--subnet", "10.1.0.0/25")
+	require.NoError(t, err)
+	assert.Equal(t, "10.1.0.1 requestID=\"vm1\"\n10.1.0.2 requestID=\"vm2\"\n", out)
+	out, err = run("host", "release", "--pool", "2", "--subnet", "10.1.0.0/25", "--request-id", "vm1")
+	require.NoError(t, err)
+	assert.Equal(t, "10.1.0.1\n", out)
+	_, err = run("host", "release", "--pool", "2", "--subnet", "10.1.0.0/25", "--request-id", "vm1")
+	assert.ErrorIs(t, err, allocator.ErrNotFound)
+	_, err = run("host", "list", "--pool", "2")
+	assert.Error(t, err)
+
+	_, err = run("frobnicate")
+	assert.Error(t, err)
+	_, err = run("dump", "--pool", "1", "--dsn", "mysql://localhost")
+	assert.Error(t, err)
+}
@@ -0,0 +1,172 @@
+// Command ipamd serves the HTTP/JSON API of package rest and the gRPC API of package rpc.
+// Prometheus metrics (see package metrics) are served on /metrics of the HTTP/JSON API address.
+//
+// Usage:
+//
+//	ipamd [--dsn <dsn>] [--listen <address>] [--grpc-listen <address>] [--migrate] [--reap-interval <duration>]
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+
+	"github.com/jbrekelmans/go-sql-ip-management/allocator"
+	ipamv1 "github.com/jbrekelmans/go-sql-ip-management/api/ipam/v1"
+	"github.com/jbrekelmans/go-sql-ip-management/internal/database"
+	"github.com/jbrekelmans/go-sql-ip-management/metrics"
+	"github.com/jbrekelmans/go-sql-ip-management/server/rest"
+	"github.com/jbrekelmans/go-sql-ip-management/server/rpc"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+func main() {
+	if err := mainCore(); err != nil {
+		log.Fatal().Err(err).Send()
+	}
+}
+
+func mainCore() (err error) {
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stderr})
+	zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	var dsn, grpcListen, listen string
+	var migrate bool
+	var reapInterval time.Duration
+	flag.StringVar(&dsn, "dsn", os.Getenv("DATABASE_URL"),
+		"data source name: a postgres:// or postgresql:// URL, or a SQLite file: URL (default $DATABASE_URL)")
+	flag.StringVar(&listen, "listen", ":8080", "address to serve the HTTP/JSON API on")
+	flag.StringVar(&grpcListen, "grpc-listen", ":9090", "address to serve the gRPC API on (empty to disable)")
+	flag.BoolVar(&migrate, "migrate", false, "apply pending schema migrations before serving")
+	flag.DurationVar(&reapInterval, "reap-interval", time.Minute,
+		"interval at which expired leases are deallocated (0 to disable)")
+	flag.Parse()
+	ctx := context.Background()
+	ctx, cancelFunc := signal.NotifyContext(ctx, os.Interrupt)
+	defer cancelFunc()
+
+	d, err := database.Open(dsn)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := d.Close(); closeErr != nil {
+			if err == nil {
+				err = closeErr
+			} else {
+				log.Error().Err(closeErr).Msg("error closing db")
+			}
+		}
+	}()
+	if migrate {
+		if err = migrateUp(ctx, d); err != nil {
+			return
+		}
+	}
+	collector := metrics.NewCollector(allocator.NewPoolManager(d.Storage))
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector, collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	allocatorOpts := []allocator.Option{allocator.WithObserver(collector)}
+	if reapInterval > 0 {
+		go runReaper(ctx, d.Storage, reapInterval, allocatorOpts)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	mux.Handle("/", rest.NewHandler(d.Storage, rest.WithAllocatorOptions(allocatorOpts...)))
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Info().Str("listen", listen).Msg("serving HTTP/JSON API")
+		serveErr <- server.ListenAndServe()
+	}()
+	var grpcServer *grpc.Server
+	grpcServeErr := make(chan error, 1)
+	if grpcListen != "" {
+		var listener net.Listener
+		listener, err = net.Listen("tcp", grpcListen)
+		if err != nil {
+			return
+		}
+		grpcServer = grpc.NewServer()
+		ipamv1.RegisterIPAMServer(grpcServer, rpc.NewServer(d.Storage, rpc.WithAllocatorOptions(allocatorOpts...)))
+		go func() {
+			log.Info().Str("listen", grpcListen).Msg("serving gRPC API")
+			grpcServeErr <- grpcServer.Serve(listener)
+		}()
+	}
+	select {
+	case err = <-serveErr:
+	case err = <-grpcServeErr:
+	case <-ctx.Done():
+	}
+	log.Info().Msg("shutting down")
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
+	}
+	shutdownCtx, shutdownCancelFunc := context.WithTimeout(context.Background(), 10*time.Second)
+	defer shutdownCancelFunc()
+	if shutdownErr := server.Shutdown(shutdownCtx); shutdownErr != nil && err == nil {
+		err = shutdownErr
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	return
+}
+
+// migrateUp applies pending schema migrations. It is safe to call from multiple instances concurrently.
+func migrateUp(ctx context.Context, d *database.Database) error {
+	migrator, err := d.NewMigrator(d.DB)
+	if err != nil {
+		return err
+	}
+	_, err = migrator.Up(ctx)
+	return err
+}
+
+// runReaper deallocates expired leases in all pools every interval, until ctx is done.
+// The allocators are configured with opts, and the reaped leases are recorded as released by the actor "reaper".
+// It is safe to run on multiple instances concurrently.
+func runReaper(ctx context.Context, s storage.Storage, interval time.Duration, opts []allocator.Option) {
+	ctx = allocator.ContextWithActor(ctx, "reaper")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		pools, err := allocator.NewPoolManager(s, opts...).ListPools(ctx)
+		if err != nil {
+			log.Error().Err(err).Msg("error listing pools to reap")
+			continue
+		}
+		for _, pool := range pools {
+			reaped, err := allocator.New(s, append(append([]allocator.Option{}, opts...), allocator.WithPoolID(pool.ID))...).Reap(ctx)
+			if err != nil {
+				log.Error().Err(err).Int("poolID", pool.ID).Msg("error reaping expired leases")
+			}
+			for _, record := range reaped {
+				log.Info().Int("poolID", pool.ID).Str("requestID", record.RequestID).Stringer("cidr", record.C).
+					Msg("deallocated expired lease")
+			}
+		}
+	}
+}
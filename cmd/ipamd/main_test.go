@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jbrekelmans/go-sql-ip-management/allocator"
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/internal/database"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+// Test_runReaper runs a reaper on each of two replicas of ipamd that share a SQLite database, and checks that every
+// expired lease of every pool is released exactly once.
+func Test_runReaper(t *testing.T) {
+	ctx := context.Background()
+	dsn := fmt.Sprintf("file:%s?_busy_timeout=5000&_txlock=immediate&_foreign_keys=on", filepath.Join(t.TempDir(), "ipam.db"))
+	var replicas []*database.Database
+	for i := 0; i < 2; i++ {
+		d, err := database.Open(dsn)
+		require.NoError(t, err)
+		t.Cleanup(func() {
+			assert.NoError(t, d.Close())
+		})
+		require.NoError(t, migrateUp(ctx, d))
+		replicas = append(replicas, d)
+	}
+	s := replicas[0].Storage
+	m := allocator.NewPoolManager(s, allocator.WithLogger(zerolog.Nop()))
+	const leases = 20
+	var allocators []*allocator.Allocator
+	for _, name := range []string{"pool1", "pool2"} {
+		pool, err := m.CreatePool(ctx, name, cidr.MustParseCIDR("10.0.0.0/16"))
+		require.NoError(t, err)
+		a := allocator.New(s, allocator.WithLogger(zerolog.Nop()), allocator.WithPoolID(pool.ID))
+		for i := 0; i < leases; i++ {
+			_, err = a.Allocate(ctx, cidr.IPv4, 24, fmt.Sprintf("lease%d", i), allocator.WithLease(time.Minute))
+			require.NoError(t, err)
+		}
+		_, err = a.Allocate(ctx, cidr.IPv4, 24, "static")
+		require.NoError(t, err)
+		allocators = append(allocators, a)
+	}
+
+	// The reapers run as if an hour has passed, so all leases have expired.
+	later := time.Now().Add(time.Hour)
+	opts := []allocator.Option{allocator.WithLogger(zerolog.Nop()), allocator.WithClock(func() time.Time { return later })}
+	reapCtx, cancelFunc := context.WithCancel(ctx)
+	var waitGroup sync.WaitGroup
+	for _, d := range replicas {
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			runReaper(reapCtx, d.Storage, time.Millisecond, opts)
+		}()
+	}
+	assert.Eventually(t, func() bool {
+		for _, a := range allocators {
+			for i := 0; i < leases; i++ {
+				if _, err := a.Lookup(ctx, fmt.Sprintf("lease%d", i)); err == nil {
+					return false
+				}
+			}
+		}
+		return true
+	}, 10*time.Second, 10*time.Millisecond)
+	cancelFunc()
+	waitGroup.Wait()
+
+	for _, a := range allocators {
+		for i := 0; i < leases; i++ {
+			events, err := a.HistoryOfRequest(ctx, fmt.Sprintf("lease%d", i))
+			require.NoError(t, err)
+			var releases []storage.Event
+			for _, event := range events {
+				if event.Type == storage.EventRelease {
+					releases = append(releases, event)
+				}
+			}
+			if assert.Len(t, releases, 1) {
+				assert.Equal(t, "reaper", releases[0].Actor)
+			}
+		}
+		_, err := a.Lookup(ctx, "static")
+		assert.NoError(t, err)
+	}
+}
@@ -0,0 +1,57 @@
+// Package database opens the storage identified by a data source name, for the ipam and ipamd commands.
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	// Register postgres driver
+	_ "github.com/jackc/pgx/v5/stdlib"
+	// Register sqlite3 driver
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+	"github.com/jbrekelmans/go-sql-ip-management/storage/migrate"
+	"github.com/jbrekelmans/go-sql-ip-management/storage/postgres"
+	"github.com/jbrekelmans/go-sql-ip-management/storage/sqlite"
+)
+
+// Database is an open database together with the storage on top of it.
+type Database struct {
+	DB          *sql.DB
+	Storage     storage.Storage
+	NewMigrator func(db *sql.DB, opts ...migrate.Option) (*migrate.Migrator, error)
+}
+
+// Open opens the database identified by dsn. The backend is chosen based on the scheme of dsn:
+// postgres:// and postgresql:// URLs use Postgres, file: URLs use SQLite.
+func Open(dsn string) (d *Database, err error) {
+	d = &Database{}
+	switch {
+	case dsn == "":
+		return nil, errors.New(`no data source name: use --dsn or set DATABASE_URL`)
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		d.DB, err = sql.Open("pgx/v5", dsn)
+		if err != nil {
+			return nil, err
+		}
+		d.Storage = postgres.NewSQLStorage(d.DB)
+		d.NewMigrator = postgres.NewMigrator
+	case strings.HasPrefix(dsn, "file:"):
+		d.DB, err = sql.Open("sqlite3", dsn)
+		if err != nil {
+			return nil, err
+		}
+		d.Storage = sqlite.NewSQLiteStorage(d.DB)
+		d.NewMigrator = sqlite.NewMigrator
+	default:
+		return nil, errors.New(`unsupported data source name: expected a postgres://, postgresql:// or file: URL`)
+	}
+	return d, nil
+}
+
+// Close closes the database.
+func (d *Database) Close() error {
+	return d.DB.Close()
+}
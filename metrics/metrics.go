@@ -0,0 +1,201 @@
+// Package metrics exports Prometheus metrics of allocator operations and pool capacity.
+//
+// Metrics:
+//
+//	ipam_operations_total{operation,outcome}                  counter of allocator operations by outcome
+//	ipam_operation_duration_seconds{operation,outcome}        histogram of the latency of allocator operations
+//	ipam_transaction_retries_total{sqlstate}                  counter of transaction retries by SQLSTATE
+//	ipam_pool_free_addresses{pool,family}                     gauge of the number of IP addresses that can be allocated
+//	ipam_pool_allocated_addresses{pool,family}                gauge of the number of allocated IP addresses
+//	ipam_pool_largest_free_prefix_length{pool,family}         gauge of the prefix length of the largest free range (-1 if none)
+//	ipam_pool_fragmentation_ratio{pool,family}                gauge of the fragmentation of free IP addresses (see allocator.FamilyStats)
+//
+// Operations are the methods of allocator.Allocator and allocator.PoolManager, e.g. "Allocate" and "Deallocate".
+// Outcomes are "success" or a stable identifier of the error, e.g. "pool_exhausted".
+// The pool gauges are computed when scraped, using one allocator.PoolManager.PoolStats transaction per pool.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/jbrekelmans/go-sql-ip-management/allocator"
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+)
+
+// DefaultScrapeTimeout is the default timeout of computing the pool gauges when scraped.
+const DefaultScrapeTimeout = 10 * time.Second
+
+// Collector is a prometheus.Collector of the metrics of package metrics, and an allocator.Observer that counts
+// operations. Pass it to allocators using allocator.WithObserver and register it with a prometheus.Registerer.
+// A Collector is safe for concurrent use.
+type Collector struct {
+	operations    *prometheus.CounterVec
+	durations     *prometheus.HistogramVec
+	retries       *prometheus.CounterVec
+	freeAddresses *prometheus.Desc
+	allocated     *prometheus.Desc
+	largestFree   *prometheus.Desc
+	fragmentation *prometheus.Desc
+	pm            *allocator.PoolManager
+	scrapeTimeout time.Duration
+}
+
+var (
+	_ prometheus.Collector = (*Collector)(nil)
+	_ allocator.Observer   = (*Collector)(nil)
+)
+
+type Option func(*Collector)
+
+// WithScrapeTimeout sets the timeout of computing the pool gauges when scraped. Defaults to DefaultScrapeTimeout.
+func WithScrapeTimeout(timeout time.Duration) Option {
+	return func(c *Collector) {
+		c.scrapeTimeout = timeout
+	}
+}
+
+// NewCollector returns a Collector that reads the pool gauges using pm.
+// pm should not be configured with the returned Collector as observer, so that scrapes are not counted as operations.
+func NewCollector(pm *allocator.PoolManager, opts ...Option) *Collector {
+	poolLabels := []string{"pool", "family"}
+	c := &Collector{
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ipam_operations_total",
+			Help: "Number of allocator operations by outcome.",
+		}, []string{"operation", "outcome"}),
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ipam_operation_duration_seconds",
+			Help:    "Latency of allocator operations, including retries.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		}, []string{"operation", "outcome"}),
+		retries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ipam_transaction_retries_total",
+			Help: "Number of transactions retried because of transient errors, by SQLSTATE (unknown for non-SQL errors).",
+		}, []string{"sqlstate"}),
+		freeAddresses: prometheus.NewDesc("ipam_pool_free_addresses",
+			"Number of IP addresses of a pool that can be allocated.", poolLabels, nil),
+		allocated: prometheus.NewDesc("ipam_pool_allocated_addresses",
+			"Number of allocated IP addresses of a pool.", poolLabels, nil),
+		largestFree: prometheus.NewDesc("ipam_pool_largest_free_prefix_length",
+			"Prefix length of the largest range of a pool that can be allocated, or -1 if no range can be allocated.",
+			poolLabels, nil),
+		fragmentation: prometheus.NewDesc("ipam_pool_fragmentation_ratio",
+			"Fraction of the free IP addresses of a pool that are not in the largest free range.", poolLabels, nil),
+		pm:            pm,
+		scrapeTimeout: DefaultScrapeTimeout,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.operations.Describe(ch)
+	c.durations.Describe(ch)
+	c.retries.Describe(ch)
+	ch <- c.freeAddresses
+	ch <- c.allocated
+	ch <- c.largestFree
+	ch <- c.fragmentation
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.operations.Collect(ch)
+	c.durations.Collect(ch)
+	c.retries.Collect(ch)
+	ctx, cancelFunc := context.WithTimeout(context.Background(), c.scrapeTimeout)
+	defer cancelFunc()
+	pools, err := c.pm.ListPools(ctx)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(c.freeAddresses, err)
+		return
+	}
+	for _, pool := range pools {
+		stats, err := c.pm.PoolStats(ctx, pool.ID)
+		if errors.Is(err, allocator.ErrPoolNotFound) {
+			// The pool was deleted after it was listed.
+			continue
+		}
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(c.freeAddresses, err)
+			return
+		}
+		poolLabel := strconv.Itoa(pool.ID)
+		for _, family := range []cidr.Family{cidr.IPv4, cidr.IPv6} {
+			familyStats := stats.Family(family)
+			familyLabel := strings.ToLower(family.String())
+			free, _ := familyStats.Free.Float64()
+			allocated, _ := familyStats.Allocated.Float64()
+			ch <- prometheus.MustNewConstMetric(c.freeAddresses, prometheus.GaugeValue, free, poolLabel, familyLabel)
+			ch <- prometheus.MustNewConstMetric(c.allocated, prometheus.GaugeValue, allocated, poolLabel, familyLabel)
+			ch <- prometheus.MustNewConstMetric(c.largestFree, prometheus.GaugeValue,
+				float64(familyStats.LargestFreePrefixBits), poolLabel, familyLabel)
+			ch <- prometheus.MustNewConstMetric(c.fragmentation, prometheus.GaugeValue, familyStats.Fragmentation,
+				poolLabel, familyLabel)
+		}
+	}
+}
+
+// ObserveOperation implements allocator.Observer.
+func (c *Collector) ObserveOperation(operation string, duration time.Duration, err error) {
+	outcome := Outcome(err)
+	c.operations.WithLabelValues(operation, outcome).Inc()
+	c.durations.WithLabelValues(operation, outcome).Observe(duration.Seconds())
+}
+
+// ObserveRetry implements allocator.Observer.
+func (c *Collector) ObserveRetry(err error) {
+	c.retries.WithLabelValues(SQLState(err)).Inc()
+}
+
+// Outcome returns "success" if err is nil, and otherwise a stable identifier of the error returned by an allocator
+// operation, such as "pool_exhausted". Returns "error" for unexpected errors.
+func Outcome(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case errors.Is(err, allocator.ErrPoolExhausted):
+		return "pool_exhausted"
+	case errors.Is(err, allocator.ErrPoolNotFound):
+		return "pool_not_found"
+	case errors.Is(err, allocator.ErrNotFound):
+		return "not_found"
+	case errors.Is(err, allocator.ErrRequestConflict):
+		return "request_conflict"
+	case errors.Is(err, allocator.ErrRangeNotInPool):
+		return "range_not_in_pool"
+	case errors.Is(err, allocator.ErrRangeUnavailable):
+		return "range_unavailable"
+	case errors.Is(err, allocator.ErrHostsNotEnabled):
+		return "hosts_not_enabled"
+	case errors.Is(err, allocator.ErrInvalidLabels):
+		return "invalid_labels"
+	case errors.Is(err, allocator.ErrMoveInProgress):
+		return "move_in_progress"
+	case errors.Is(err, allocator.ErrRetryable):
+		return "retryable"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	}
+	return "error"
+}
+
+// SQLState returns the SQLSTATE of err (e.g. "40001" for serialization failures), or "unknown" if err does not have one.
+// The SQLSTATE of an error is found using errors.As with interface{ SQLState() string }, which is implemented by the
+// errors of the Postgres driver.
+func SQLState(err error) string {
+	var sqlStateErr interface{ SQLState() string }
+	if errors.As(err, &sqlStateErr) {
+		return sqlStateErr.SQLState()
+	}
+	return "unknown"
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jbrekelmans/go-sql-ip-management/allocator"
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage/memory"
+)
+
+type sqlStateError string
+
+func (e sqlStateError) Error() string    { return "sqlstate " + string(e) }
+func (e sqlStateError) SQLState() string { return string(e) }
+
+func Test_Collector(t *testing.T) {
+	ctx := context.Background()
+	s := memory.NewMemoryStorage()
+	pm := allocator.NewPoolManager(s, allocator.WithLogger(zerolog.Nop()))
+	_, err := pm.CreatePool(ctx, "pool1", cidr.MustParseCIDR("10.0.0.0/24"))
+	require.NoError(t, err)
+	c := NewCollector(pm)
+	a := allocator.New(s, allocator.WithLogger(zerolog.Nop()), allocator.WithObserver(c))
+	_, err = a.Allocate(ctx, cidr.IPv4, 25, "a")
+	require.NoError(t, err)
+	_, err = a.Allocate(ctx, cidr.IPv4, 24, "b")
+	assert.ErrorIs(t, err, allocator.ErrPoolExhausted)
+	_, err = a.Deallocate(ctx, "c")
+	assert.ErrorIs(t, err, allocator.ErrNotFound)
+	c.ObserveRetry(fmt.Errorf("wrapped: %w", sqlStateError("40001")))
+	c.ObserveRetry(fmt.Errorf("not an SQL error"))
+
+	assert.NoError(t, testutil.CollectAndCompare(c, strings.NewReader(`
+# HELP ipam_operations_total Number of allocator operations by outcome.
+# TYPE ipam_operations_total counter
+ipam_operations_total{operation="Allocate",outcome="pool_exhausted"} 1
+ipam_operations_total{operation="Allocate",outcome="success"} 1
+ipam_operations_total{operation="Deallocate",outcome="not_found"} 1
+# HELP ipam_transaction_retries_total Number of transactions retried because of transient errors, by SQLSTATE (unknown for non-SQL errors).
+# TYPE ipam_transaction_retries_total counter
+ipam_transaction_retries_total{sqlstate="40001"} 1
+ipam_transaction_retries_total{sqlstate="unknown"} 1
+# HELP ipam_pool_free_addresses Number of IP addresses of a pool that can be allocated.
+# TYPE ipam_pool_free_addresses gauge
+ipam_pool_free_addresses{family="ipv4",pool="1"} 128
+ipam_pool_free_addresses{family="ipv6",pool="1"} 0
+# HELP ipam_pool_largest_free_prefix_length Prefix length of the largest range of a pool that can be allocated, or -1 if no range can be allocated.
+# TYPE ipam_pool_largest_free_prefix_length gauge
+ipam_pool_largest_free_prefix_length{family="ipv4",pool="1"} 25
+ipam_pool_largest_free_prefix_length{family="ipv6",pool="1"} -1
+`), "ipam_operations_total", "ipam_transaction_retries_total", "ipam_pool_free_addresses",
+		"ipam_pool_largest_free_prefix_length"))
+	assert.Equal(t, 3, testutil.CollectAndCount(c, "ipam_operation_duration_seconds"))
+}
+
+func Test_Outcome(t *testing.T) {
+	assert.Equal(t, "success", Outcome(nil))
+	assert.Equal(t, "request_conflict", Outcome(&allocator.RequestConflictError{}))
+	assert.Equal(t, "canceled", Outcome(fmt.Errorf("wrapped: %w", context.Canceled)))
+	assert.Equal(t, "error", Outcome(fmt.Errorf("unexpected")))
+}
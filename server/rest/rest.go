@@ -0,0 +1,550 @@
+// Package rest implements an HTTP/JSON API on top of the allocator package.
+//
+// Routes:
+//
+//	GET    /pools                                         lists pools
+//	GET    /pools/{poolID}                                gets a pool
+//	GET    /pools/{poolID}/stats                          gets utilization statistics of a pool
+//	GET    /pools/{poolID}/history                        lists the events of a range or a request (see history)
+//	GET    /pools/{poolID}/allocations                    lists allocations page by page (see listAllocations)
+//	POST   /pools/{poolID}/allocations                    allocates a range (idempotent on requestId)
+//	GET    /pools/{poolID}/allocations/{requestID}        looks up the ranges allocated to a request
+//	DELETE /pools/{poolID}/allocations/{requestID}        deallocates the ranges allocated to a request
+//	PUT    /pools/{poolID}/allocations/{requestID}/labels replaces the labels of a request (body and response {"key":"value"})
+//
+// The ActorHeader request header identifies who makes the request, and is recorded in the history of ranges.
+package rest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jbrekelmans/go-sql-ip-management/allocator"
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+// ActorHeader is the request header that identifies who makes the request, such as a user name.
+// The actor is recorded in the history of ranges (see allocator.ContextWithActor).
+const ActorHeader = "X-Actor"
+
+// Handler is a http.Handler that serves the API.
+type Handler struct {
+	allocatorOpts []allocator.Option
+	logger        zerolog.Logger
+	pm            *allocator.PoolManager
+	s             storage.Storage
+}
+
+var _ http.Handler = (*Handler)(nil)
+
+type Option func(*Handler)
+
+// WithAllocatorOptions sets the options of the allocators used to serve requests (e.g. the retry policy).
+// allocator.WithPoolID is overridden by the pool identifier in the request path.
+func WithAllocatorOptions(opts ...allocator.Option) Option {
+	return func(h *Handler) {
+		h.allocatorOpts = opts
+	}
+}
+
+// WithLogger sets the logger used to log unexpected errors.
+func WithLogger(logger zerolog.Logger) Option {
+	return func(h *Handler) {
+		h.logger = logger
+	}
+}
+
+func NewHandler(s storage.Storage, opts ...Option) *Handler {
+	h := &Handler{
+		logger: log.Logger,
+		s:      s,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	h.pm = allocator.NewPoolManager(s, h.allocatorOpts...)
+	return h
+}
+
+// Pool is the JSON representation of storage.Pool.
+type Pool struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// AllocateRequest is the body of POST /pools/{poolID}/allocations.
+type AllocateRequest struct {
+	RequestID    string `json:"requestId"`
+	PrefixLength *int   `json:"prefixLength"`
+	// Family is "ipv4" (the default) or "ipv6".
+	Family string            `json:"family,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Allocation is the response of POST /pools/{poolID}/allocations, and an element of AllocationPage.
+// RequestID is empty for free ranges.
+type Allocation struct {
+	PoolID    int               `json:"poolId"`
+	RequestID string            `json:"requestId"`
+	CIDR      string            `json:"cidr"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// AllocationPage is the response of GET /pools/{poolID}/allocations.
+type AllocationPage struct {
+	Allocations []Allocation `json:"allocations"`
+	// NextPageToken is the pageToken query parameter to get the next page, or empty if this is the last page.
+	NextPageToken string `json:"nextPageToken,omitempty"`
+}
+
+// Allocations is the response of GET and DELETE /pools/{poolID}/allocations/{requestID}.
+type Allocations struct {
+	PoolID    int      `json:"poolId"`
+	RequestID string   `json:"requestId"`
+	CIDRs     []string `json:"cidrs"`
+}
+
+// PoolStats is the response of GET /pools/{poolID}/stats.
+type PoolStats struct {
+	// Families has one element per family, IPv4 first.
+	Families []FamilyStats `json:"families"`
+}
+
+// FamilyStats is the JSON representation of allocator.FamilyStats.
+// Address counts are decimal strings, because IPv6 counts do not fit in 64 bits.
+type FamilyStats struct {
+	// Family is "ipv4" or "ipv6".
+	Family             string `json:"family"`
+	TotalAddresses     string `json:"totalAddresses"`
+	AllocatedAddresses string `json:"allocatedAddresses"`
+	FreeAddresses      string `json:"freeAddresses"`
+	RetiredAddresses   string `json:"retiredAddresses"`
+	// FreeBlocks maps prefix lengths to the number of free ranges with that prefix length.
+	FreeBlocks map[int]int `json:"freeBlocks"`
+	// LargestFreePrefixLength is -1 if no range can be allocated.
+	LargestFreePrefixLength int     `json:"largestFreePrefixLength"`
+	Fragmentation           float64 `json:"fragmentation"`
+}
+
+// Event is the JSON representation of storage.Event.
+type Event struct {
+	ID   int64     `json:"id"`
+	Time time.Time `json:"time"`
+	// Type is the type of the event, such as "allocate" or "release" (see storage.EventType).
+	Type      string `json:"type"`
+	CIDR      string `json:"cidr"`
+	RequestID string `json:"requestId,omitempty"`
+	Actor     string `json:"actor,omitempty"`
+}
+
+// History is the response of GET /pools/{poolID}/history.
+type History struct {
+	// Events are ordered from oldest to newest.
+	Events []Event `json:"events"`
+}
+
+// Error is the body of responses with a non-2xx status code.
+type Error struct {
+	// Code is a stable, machine-readable identifier of the error, such as "pool_exhausted".
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// errBadRequest is returned by handlers for malformed requests.
+var errBadRequest = errors.New("bad request")
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if actor := r.Header.Get(ActorHeader); actor != "" {
+		r = r.WithContext(allocator.ContextWithActor(r.Context(), actor))
+	}
+	segments, err := splitPath(r.URL.EscapedPath())
+	if err != nil || len(segments) == 0 || segments[0] != "pools" {
+		h.writeError(w, http.StatusNotFound, "not_found", "no such route")
+		return
+	}
+	segments = segments[1:]
+	if len(segments) == 0 {
+		h.route(w, r, map[string]func() error{
+			http.MethodGet: func() error { return h.listPools(w, r) },
+		})
+		return
+	}
+	poolID, err := strconv.Atoi(segments[0])
+	if err != nil || poolID <= 0 {
+		h.writeError(w, http.StatusNotFound, "pool_not_found", fmt.Sprintf("invalid pool identifier %#v", segments[0]))
+		return
+	}
+	segments = segments[1:]
+	switch {
+	case len(segments) == 0:
+		h.route(w, r, map[string]func() error{
+			http.MethodGet: func() error { return h.getPool(w, r, poolID) },
+		})
+	case len(segments) == 1 && segments[0] == "stats":
+		h.route(w, r, map[string]func() error{
+			http.MethodGet: func() error { return h.poolStats(w, r, poolID) },
+		})
+	case len(segments) == 1 && segments[0] == "history":
+		h.route(w, r, map[string]func() error{
+			http.MethodGet: func() error { return h.history(w, r, poolID) },
+		})
+	case len(segments) == 1 && segments[0] == "allocations":
+		h.route(w, r, map[string]func() error{
+			http.MethodGet:  func() error { return h.listAllocations(w, r, poolID) },
+			http.MethodPost: func() error { return h.allocate(w, r, poolID) },
+		})
+	case len(segments) == 2 && segments[0] == "allocations" && segments[1] != "":
+		requestID := segments[1]
+		h.route(w, r, map[string]func() error{
+			http.MethodDelete: func() error { return h.deallocate(w, r, poolID, requestID) },
+			http.MethodGet:    func() error { return h.lookup(w, r, poolID, requestID) },
+		})
+	case len(segments) == 3 && segments[0] == "allocations" && segments[1] != "" && segments[2] == "labels":
+		requestID := segments[1]
+		h.route(w, r, map[string]func() error{
+			http.MethodPut: func() error { return h.setLabels(w, r, poolID, requestID) },
+		})
+	default:
+		h.writeError(w, http.StatusNotFound, "not_found", "no such route")
+	}
+}
+
+// route calls the handler for the method of r, and writes errors returned by the handler.
+func (h *Handler) route(w http.ResponseWriter, r *http.Request, handlers map[string]func() error) {
+	handler, ok := handlers[r.Method]
+	if !ok {
+		var allow []string
+		for method := range handlers {
+			allow = append(allow, method)
+		}
+		sort.Strings(allow)
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+		h.writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", fmt.Sprintf("method %s is not allowed", r.Method))
+		return
+	}
+	if err := handler(); err != nil {
+		status, code := errorStatus(err)
+		if status == http.StatusInternalServerError {
+			h.logger.Error().Err(err).Str("method", r.Method).Str("path", r.URL.Path).Msg("unexpected error")
+		}
+		h.writeError(w, status, code, err.Error())
+	}
+}
+
+func (h *Handler) allocate(w http.ResponseWriter, r *http.Request, poolID int) error {
+	var req AllocateRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		return fmt.Errorf(`%w: invalid JSON body: %v`, errBadRequest, err)
+	}
+	if req.RequestID == "" {
+		return fmt.Errorf(`%w: requestId is required`, errBadRequest)
+	}
+	family := cidr.IPv4
+	if req.Family != "" {
+		var err error
+		family, err = cidr.ParseFamily(req.Family)
+		if err != nil {
+			return fmt.Errorf(`%w: %v`, errBadRequest, err)
+		}
+	}
+	if req.PrefixLength == nil || *req.PrefixLength < 0 || *req.PrefixLength > family.Bits() {
+		return fmt.Errorf(`%w: prefixLength is required and must be between 0 and %d`, errBadRequest, family.Bits())
+	}
+	c, err := h.allocator(poolID).Allocate(r.Context(), family, *req.PrefixLength, req.RequestID,
+		allocator.WithLabels(req.Labels))
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, Allocation{
+		PoolID:    poolID,
+		RequestID: req.RequestID,
+		CIDR:      c.String(),
+	})
+	return nil
+}
+
+func (h *Handler) deallocate(w http.ResponseWriter, r *http.Request, poolID int, requestID string) error {
+	cs, err := h.allocator(poolID).Deallocate(r.Context(), requestID)
+	if err != nil {
+		return err
+	}
+	resp := Allocations{
+		PoolID:    poolID,
+		RequestID: requestID,
+		CIDRs:     []string{},
+	}
+	for _, c := range cs {
+		resp.CIDRs = append(resp.CIDRs, c.String())
+	}
+	writeJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+func (h *Handler) getPool(w http.ResponseWriter, r *http.Request, poolID int) error {
+	pool, err := h.pm.GetPool(r.Context(), poolID)
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusOK, Pool{ID: pool.ID, Name: pool.Name})
+	return nil
+}
+
+// history serves the events of a range or a request, oldest first. Exactly one of the query parameters is required:
+//
+//	cidr=<cidr>        the events of ranges that overlap the CIDR (see allocator.History)
+//	requestId=<id>     the events of the request (see allocator.HistoryOfRequest)
+func (h *Handler) history(w http.ResponseWriter, r *http.Request, poolID int) error {
+	query := r.URL.Query()
+	cidrString, requestID := query.Get("cidr"), query.Get("requestId")
+	if (cidrString == "") == (requestID == "") {
+		return fmt.Errorf(`%w: exactly one of cidr and requestId is required`, errBadRequest)
+	}
+	var events []storage.Event
+	if requestID != "" {
+		var err error
+		if events, err = h.allocator(poolID).HistoryOfRequest(r.Context(), requestID); err != nil {
+			return err
+		}
+	} else {
+		c, err := cidr.ParseCIDR(cidrString)
+		if err != nil {
+			return fmt.Errorf(`%w: cidr: %v`, errBadRequest, err)
+		}
+		if events, err = h.allocator(poolID).History(r.Context(), c); err != nil {
+			return err
+		}
+	}
+	resp := History{Events: []Event{}}
+	for _, event := range events {
+		resp.Events = append(resp.Events, Event{
+			ID:        event.ID,
+			Time:      event.Time,
+			Type:      string(event.Type),
+			CIDR:      event.C.String(),
+			RequestID: event.RequestID,
+			Actor:     event.Actor,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+func (h *Handler) listPools(w http.ResponseWriter, r *http.Request) error {
+	pools, err := h.pm.ListPools(r.Context())
+	if err != nil {
+		return err
+	}
+	resp := []Pool{}
+	for _, pool := range pools {
+		resp = append(resp, Pool{ID: pool.ID, Name: pool.Name})
+	}
+	writeJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+// listAllocations serves a page of allocations, ordered by address. The query parameters are:
+//
+//	within=<cidr>             only ranges contained in the CIDR
+//	minPrefixLength=<bits>    only ranges with a prefix length of at least bits
+//	maxPrefixLength=<bits>    only ranges with a prefix length of at most bits
+//	requestIdPrefix=<prefix>  only ranges whose request ID starts with prefix
+//	state=allocated|free|any  only allocated ranges (the default), free ranges, or all ranges
+//	label=<key>=<value>       only ranges with the label (repeatable)
+//	pageToken=<token>         the nextPageToken of the previous page
+//	pageSize=<n>              the maximum number of ranges (see allocator.ListAllocations)
+func (h *Handler) listAllocations(w http.ResponseWriter, r *http.Request, poolID int) error {
+	query := r.URL.Query()
+	filter := storage.ListFilter{State: storage.StateAllocated}
+	var pageSize int
+	if within := query.Get("within"); within != "" {
+		c, err := cidr.ParseCIDR(within)
+		if err != nil {
+			return fmt.Errorf(`%w: within: %v`, errBadRequest, err)
+		}
+		filter.Within = &c
+	}
+	intParams := []struct {
+		name string
+		dest *int
+	}{
+		{"minPrefixLength", &filter.MinPrefixBits},
+		{"maxPrefixLength", &filter.MaxPrefixBits},
+		{"pageSize", &pageSize},
+	}
+	for _, param := range intParams {
+		if value := query.Get(param.name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf(`%w: %s must be a non-negative integer`, errBadRequest, param.name)
+			}
+			*param.dest = n
+		}
+	}
+	filter.RequestIDPrefix = query.Get("requestIdPrefix")
+	switch state := query.Get("state"); state {
+	case "", "allocated":
+	case "free":
+		filter.State = storage.StateFree
+	case "any":
+		filter.State = storage.StateAny
+	default:
+		return fmt.Errorf(`%w: state must be allocated, free or any but got %#v`, errBadRequest, state)
+	}
+	for _, label := range query["label"] {
+		key, value, ok := strings.Cut(label, "=")
+		if !ok {
+			return fmt.Errorf(`%w: label filter %#v is not of the form key=value`, errBadRequest, label)
+		}
+		if filter.Labels == nil {
+			filter.Labels = map[string]string{}
+		}
+		filter.Labels[key] = value
+	}
+	records, nextPageToken, err := h.allocator(poolID).ListAllocations(r.Context(), filter, query.Get("pageToken"), pageSize)
+	if err != nil {
+		return err
+	}
+	resp := AllocationPage{
+		Allocations:   []Allocation{},
+		NextPageToken: nextPageToken,
+	}
+	for _, record := range records {
+		resp.Allocations = append(resp.Allocations, Allocation{
+			PoolID:    poolID,
+			RequestID: record.RequestID,
+			CIDR:      record.C.String(),
+			Labels:    record.Labels,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+func (h *Handler) lookup(w http.ResponseWriter, r *http.Request, poolID int, requestID string) error {
+	records, err := h.allocator(poolID).Lookup(r.Context(), requestID)
+	if err != nil {
+		return err
+	}
+	resp := Allocations{
+		PoolID:    poolID,
+		RequestID: requestID,
+		CIDRs:     []string{},
+	}
+	for _, record := range records {
+		resp.CIDRs = append(resp.CIDRs, record.C.String())
+	}
+	writeJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+func (h *Handler) poolStats(w http.ResponseWriter, r *http.Request, poolID int) error {
+	stats, err := h.pm.PoolStats(r.Context(), poolID)
+	if err != nil {
+		return err
+	}
+	resp := PoolStats{}
+	for _, family := range []cidr.Family{cidr.IPv4, cidr.IPv6} {
+		familyStats := stats.Family(family)
+		resp.Families = append(resp.Families, FamilyStats{
+			Family:                  strings.ToLower(family.String()),
+			TotalAddresses:          familyStats.Total.String(),
+			AllocatedAddresses:      familyStats.Allocated.String(),
+			FreeAddresses:           familyStats.Free.String(),
+			RetiredAddresses:        familyStats.Retired.String(),
+			FreeBlocks:              familyStats.FreeBlocks,
+			LargestFreePrefixLength: familyStats.LargestFreePrefixBits,
+			Fragmentation:           familyStats.Fragmentation,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+	return nil
+}
+
+func (h *Handler) setLabels(w http.ResponseWriter, r *http.Request, poolID int, requestID string) error {
+	var labels map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&labels); err != nil {
+		return fmt.Errorf(`%w: invalid JSON body: %v`, errBadRequest, err)
+	}
+	if err := h.allocator(poolID).SetLabels(r.Context(), requestID, labels); err != nil {
+		return err
+	}
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	writeJSON(w, http.StatusOK, labels)
+	return nil
+}
+
+// allocator returns an allocator for the pool identified by poolID.
+func (h *Handler) allocator(poolID int) *allocator.Allocator {
+	opts := append(append([]allocator.Option{}, h.allocatorOpts...), allocator.WithPoolID(poolID))
+	return allocator.New(h.s, opts...)
+}
+
+func (h *Handler) writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, Error{
+		Code:    code,
+		Message: message,
+	})
+}
+
+// errorStatus maps an error returned by the allocator package to a HTTP status code and an Error.Code.
+func errorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, errBadRequest):
+		return http.StatusBadRequest, "bad_request"
+	case errors.Is(err, allocator.ErrInvalidLabels):
+		return http.StatusBadRequest, "invalid_labels"
+	case errors.Is(err, allocator.ErrInvalidPageToken):
+		return http.StatusBadRequest, "invalid_page_token"
+	case errors.Is(err, allocator.ErrPoolNotFound):
+		return http.StatusNotFound, "pool_not_found"
+	case errors.Is(err, allocator.ErrNotFound):
+		return http.StatusNotFound, "not_found"
+	case errors.Is(err, allocator.ErrRequestConflict):
+		return http.StatusConflict, "request_conflict"
+	case errors.Is(err, allocator.ErrPoolExhausted):
+		return http.StatusConflict, "pool_exhausted"
+	case errors.Is(err, allocator.ErrRetryable):
+		return http.StatusServiceUnavailable, "retryable"
+	}
+	return http.StatusInternalServerError, "internal"
+}
+
+// splitPath splits an escaped URL path into unescaped segments, ignoring a trailing slash.
+func splitPath(escapedPath string) (segments []string, err error) {
+	escapedPath = strings.TrimSuffix(strings.TrimPrefix(escapedPath, "/"), "/")
+	if escapedPath == "" {
+		return nil, nil
+	}
+	for _, escapedSegment := range strings.Split(escapedPath, "/") {
+		segment, err := url.PathUnescape(escapedSegment)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+	return
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	if err := encoder.Encode(v); err != nil {
+		log.Error().Err(err).Msg("error writing response")
+	}
+}
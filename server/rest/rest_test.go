@@ -0,0 +1,247 @@
+package rest
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jbrekelmans/go-sql-ip-management/allocator"
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage/memory"
+)
+
+// testServer returns a server with one pool named pool1 with the free ranges 10.0.0.0/24 and fd00::/48.
+func testServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	s := memory.NewMemoryStorage()
+	_, err := allocator.NewPoolManager(s).CreatePool(context.Background(), "pool1",
+		cidr.MustParseCIDR("10.0.0.0/24"), cidr.MustParseCIDR("fd00::/48"))
+	require.NoError(t, err)
+	server := httptest.NewServer(NewHandler(s, WithLogger(zerolog.Nop()), WithAllocatorOptions(allocator.WithLogger(zerolog.Nop()))))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// testDo does a request and decodes the JSON response body into v.
+func testDo(t *testing.T, server *httptest.Server, method, path, body string, v interface{}) int {
+	t.Helper()
+	var bodyReader io.Reader
+	if body != "" {
+		bodyReader = strings.NewReader(body)
+	}
+	req, err := http.NewRequest(method, server.URL+path, bodyReader)
+	require.NoError(t, err)
+	resp, err := server.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	if v != nil {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+	}
+	return resp.StatusCode
+}
+
+func Test_Handler(t *testing.T) {
+	t.Run("Pools", func(t *testing.T) {
+		server := testServer(t)
+		var pools []Pool
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodGet, "/pools", "", &pools))
+		assert.Equal(t, []Pool{{ID: 1, Name: "pool1"}}, pools)
+		var pool Pool
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodGet, "/pools/1", "", &pool))
+		assert.Equal(t, Pool{ID: 1, Name: "pool1"}, pool)
+		var e Error
+		assert.Equal(t, http.StatusNotFound, testDo(t, server, http.MethodGet, "/pools/2", "", &e))
+		assert.Equal(t, "pool_not_found", e.Code)
+		assert.Equal(t, http.StatusNotFound, testDo(t, server, http.MethodGet, "/pools/x", "", &e))
+		assert.Equal(t, http.StatusNotFound, testDo(t, server, http.MethodGet, "/other", "", &e))
+		assert.Equal(t, http.StatusMethodNotAllowed, testDo(t, server, http.MethodPost, "/pools", "", &e))
+	})
+	t.Run("PoolStats", func(t *testing.T) {
+		server := testServer(t)
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodPost, "/pools/1/allocations",
+			`{"requestId":"a","prefixLength":26}`, nil))
+		var stats PoolStats
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodGet, "/pools/1/stats", "", &stats))
+		assert.Equal(t, PoolStats{Families: []FamilyStats{
+			{
+				Family:                  "ipv4",
+				TotalAddresses:          "256",
+				AllocatedAddresses:      "64",
+				FreeAddresses:           "192",
+				RetiredAddresses:        "0",
+				FreeBlocks:              map[int]int{25: 1, 26: 1},
+				LargestFreePrefixLength: 25,
+				Fragmentation:           64.0 / 192.0,
+			},
+			{
+				Family:                  "ipv6",
+				TotalAddresses:          "1208925819614629174706176",
+				AllocatedAddresses:      "0",
+				FreeAddresses:           "1208925819614629174706176",
+				RetiredAddresses:        "0",
+				FreeBlocks:              map[int]int{48: 1},
+				LargestFreePrefixLength: 48,
+			},
+		}}, stats)
+		var e Error
+		assert.Equal(t, http.StatusNotFound, testDo(t, server, http.MethodGet, "/pools/2/stats", "", &e))
+		assert.Equal(t, "pool_not_found", e.Code)
+	})
+	t.Run("History", func(t *testing.T) {
+		server := testServer(t)
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodPost, "/pools/1/allocations",
+			`{"requestId":"a","prefixLength":25}`, nil))
+		req, err := http.NewRequest(http.MethodDelete, server.URL+"/pools/1/allocations/a", nil)
+		require.NoError(t, err)
+		req.Header.Set(ActorHeader, "bob")
+		resp, err := server.Client().Do(req)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		var history History
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodGet, "/pools/1/history?requestId=a", "", &history))
+		if assert.Len(t, history.Events, 2) {
+			assert.Equal(t, "allocate", history.Events[0].Type)
+			assert.Equal(t, "10.0.0.0/25", history.Events[0].CIDR)
+			assert.Empty(t, history.Events[0].Actor)
+			assert.Equal(t, "release", history.Events[1].Type)
+			assert.Equal(t, "bob", history.Events[1].Actor)
+		}
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodGet, "/pools/1/history?cidr=10.0.0.128/25", "", &history))
+		var types []string
+		for _, event := range history.Events {
+			types = append(types, event.Type)
+		}
+		assert.Equal(t, []string{"split", "merge"}, types)
+		var e Error
+		assert.Equal(t, http.StatusBadRequest, testDo(t, server, http.MethodGet, "/pools/1/history", "", &e))
+		assert.Equal(t, http.StatusBadRequest, testDo(t, server, http.MethodGet, "/pools/1/history?cidr=x", "", &e))
+		assert.Equal(t, http.StatusNotFound, testDo(t, server, http.MethodGet, "/pools/2/history?requestId=a", "", &e))
+		assert.Equal(t, "pool_not_found", e.Code)
+	})
+	t.Run("Allocations", func(t *testing.T) {
+		server := testServer(t)
+		var allocation Allocation
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodPost, "/pools/1/allocations",
+			`{"requestId":"vpc/a","prefixLength":25}`, &allocation))
+		assert.Equal(t, Allocation{PoolID: 1, RequestID: "vpc/a", CIDR: "10.0.0.0/25"}, allocation)
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodPost, "/pools/1/allocations",
+			`{"requestId":"vpc/a","prefixLength":25}`, &allocation))
+		assert.Equal(t, Allocation{PoolID: 1, RequestID: "vpc/a", CIDR: "10.0.0.0/25"}, allocation)
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodPost, "/pools/1/allocations",
+			`{"requestId":"vpc/a","prefixLength":64,"family":"ipv6"}`, &allocation))
+		assert.Equal(t, Allocation{PoolID: 1, RequestID: "vpc/a", CIDR: "fd00::/64"}, allocation)
+
+		var allocations Allocations
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodGet, "/pools/1/allocations/vpc%2Fa", "", &allocations))
+		assert.Equal(t, Allocations{PoolID: 1, RequestID: "vpc/a", CIDRs: []string{"10.0.0.0/25", "fd00::/64"}}, allocations)
+
+		var e Error
+		assert.Equal(t, http.StatusConflict, testDo(t, server, http.MethodPost, "/pools/1/allocations",
+			`{"requestId":"vpc/a","prefixLength":26}`, &e))
+		assert.Equal(t, "request_conflict", e.Code)
+		assert.Equal(t, http.StatusConflict, testDo(t, server, http.MethodPost, "/pools/1/allocations",
+			`{"requestId":"b","prefixLength":24}`, &e))
+		assert.Equal(t, "pool_exhausted", e.Code)
+		assert.Equal(t, http.StatusBadRequest, testDo(t, server, http.MethodPost, "/pools/1/allocations",
+			`{"requestId":"b","prefixLength":33}`, &e))
+		assert.Equal(t, http.StatusBadRequest, testDo(t, server, http.MethodPost, "/pools/1/allocations",
+			`{"prefixLength":24}`, &e))
+		assert.Equal(t, http.StatusBadRequest, testDo(t, server, http.MethodPost, "/pools/1/allocations", `{`, &e))
+		assert.Equal(t, http.StatusNotFound, testDo(t, server, http.MethodPost, "/pools/2/allocations",
+			`{"requestId":"b","prefixLength":24}`, &e))
+		assert.Equal(t, "pool_not_found", e.Code)
+
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodDelete, "/pools/1/allocations/vpc%2Fa", "", &allocations))
+		assert.Equal(t, Allocations{PoolID: 1, RequestID: "vpc/a", CIDRs: []string{"10.0.0.0/25", "fd00::/64"}}, allocations)
+		assert.Equal(t, http.StatusNotFound, testDo(t, server, http.MethodDelete, "/pools/1/allocations/vpc%2Fa", "", &e))
+		assert.Equal(t, "not_found", e.Code)
+		assert.Equal(t, http.StatusNotFound, testDo(t, server, http.MethodGet, "/pools/1/allocations/vpc%2Fa", "", &e))
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodPost, "/pools/1/allocations",
+			`{"requestId":"b","prefixLength":24}`, &allocation))
+		assert.Equal(t, "10.0.0.0/24", allocation.CIDR)
+	})
+	t.Run("Labels", func(t *testing.T) {
+		server := testServer(t)
+		var allocation Allocation
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodPost, "/pools/1/allocations",
+			`{"requestId":"a","prefixLength":25,"labels":{"team":"payments"}}`, &allocation))
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodPost, "/pools/1/allocations",
+			`{"requestId":"b","prefixLength":25,"labels":{"team":"search"}}`, &allocation))
+		var page AllocationPage
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodGet, "/pools/1/allocations?label=team%3Dpayments", "",
+			&page))
+		assert.Equal(t, AllocationPage{Allocations: []Allocation{{PoolID: 1, RequestID: "a", CIDR: "10.0.0.0/25",
+			Labels: map[string]string{"team": "payments"}}}}, page)
+
+		var labels map[string]string
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodPut, "/pools/1/allocations/b/labels",
+			`{"team":"payments","env":"ci"}`, &labels))
+		assert.Equal(t, map[string]string{"team": "payments", "env": "ci"}, labels)
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodGet, "/pools/1/allocations?label=team%3Dpayments", "",
+			&page))
+		assert.Len(t, page.Allocations, 2)
+
+		var e Error
+		assert.Equal(t, http.StatusBadRequest, testDo(t, server, http.MethodGet, "/pools/1/allocations?label=team", "", &e))
+		assert.Equal(t, http.StatusBadRequest, testDo(t, server, http.MethodPut, "/pools/1/allocations/b/labels", `{"":"x"}`, &e))
+		assert.Equal(t, "invalid_labels", e.Code)
+		assert.Equal(t, http.StatusBadRequest, testDo(t, server, http.MethodPost, "/pools/1/allocations",
+			`{"requestId":"c","prefixLength":25,"labels":{"":"x"}}`, &e))
+		assert.Equal(t, "invalid_labels", e.Code)
+		assert.Equal(t, http.StatusNotFound, testDo(t, server, http.MethodPut, "/pools/1/allocations/c/labels", `{}`, &e))
+		assert.Equal(t, http.StatusNotFound, testDo(t, server, http.MethodGet, "/pools/2/allocations", "", &e))
+	})
+	t.Run("ListAllocations", func(t *testing.T) {
+		server := testServer(t)
+		for _, body := range []string{
+			`{"requestId":"vpc-a","prefixLength":26}`,
+			`{"requestId":"vpc-b","prefixLength":26}`,
+			`{"requestId":"ci-a","prefixLength":26}`,
+			`{"requestId":"vpc-a","prefixLength":64,"family":"ipv6"}`,
+		} {
+			require.Equal(t, http.StatusOK, testDo(t, server, http.MethodPost, "/pools/1/allocations", body, nil))
+		}
+		var listed []string
+		path := "/pools/1/allocations?pageSize=3&requestIdPrefix=vpc-"
+		for {
+			var page AllocationPage
+			require.Equal(t, http.StatusOK, testDo(t, server, http.MethodGet, path, "", &page))
+			for _, allocation := range page.Allocations {
+				listed = append(listed, allocation.RequestID+" "+allocation.CIDR)
+			}
+			if page.NextPageToken == "" {
+				break
+			}
+			path = "/pools/1/allocations?pageSize=2&requestIdPrefix=vpc-&pageToken=" + page.NextPageToken
+		}
+		assert.Equal(t, []string{"vpc-a 10.0.0.0/26", "vpc-b 10.0.0.64/26", "vpc-a fd00::/64"}, listed)
+
+		var page AllocationPage
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodGet,
+			"/pools/1/allocations?state=any&within=10.0.0.128/25&minPrefixLength=26&maxPrefixLength=26", "", &page))
+		assert.Equal(t, []Allocation{
+			{PoolID: 1, RequestID: "ci-a", CIDR: "10.0.0.128/26"},
+			{PoolID: 1, CIDR: "10.0.0.192/26"},
+		}, page.Allocations)
+		assert.Equal(t, http.StatusOK, testDo(t, server, http.MethodGet, "/pools/1/allocations?state=free&maxPrefixLength=48", "",
+			&page))
+		assert.Equal(t, []Allocation{{PoolID: 1, CIDR: "10.0.0.192/26"}}, page.Allocations)
+
+		var e Error
+		for _, query := range []string{"state=other", "within=x", "pageSize=-1", "minPrefixLength=x"} {
+			assert.Equal(t, http.StatusBadRequest, testDo(t, server, http.MethodGet, "/pools/1/allocations?"+query, "", &e), query)
+		}
+		assert.Equal(t, http.StatusBadRequest, testDo(t, server, http.MethodGet, "/pools/1/allocations?pageToken=x", "", &e))
+		assert.Equal(t, "invalid_page_token", e.Code)
+	})
+}
@@ -0,0 +1,261 @@
+// Package rpc implements the gRPC service ipam.v1.IPAM (see api/ipam/v1) on top of the allocator package.
+package rpc
+
+import (
+	"context"
+	"errors"
+	"math/big"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/jbrekelmans/go-sql-ip-management/allocator"
+	ipamv1 "github.com/jbrekelmans/go-sql-ip-management/api/ipam/v1"
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+// ActorMetadataKey is the key of the request metadata that identifies who makes the request, such as a user name.
+// The actor is recorded in the history of ranges (see allocator.ContextWithActor).
+const ActorMetadataKey = "x-actor"
+
+// Server implements ipamv1.IPAMServer.
+type Server struct {
+	ipamv1.UnimplementedIPAMServer
+	allocatorOpts []allocator.Option
+	s             storage.Storage
+}
+
+var _ ipamv1.IPAMServer = (*Server)(nil)
+
+type Option func(*Server)
+
+// WithAllocatorOptions sets the options of the allocators used to serve requests (e.g. the retry policy).
+// allocator.WithPoolID is overridden by the pool identifier in the request.
+func WithAllocatorOptions(opts ...allocator.Option) Option {
+	return func(s *Server) {
+		s.allocatorOpts = opts
+	}
+}
+
+func NewServer(s storage.Storage, opts ...Option) *Server {
+	server := &Server{
+		s: s,
+	}
+	for _, opt := range opts {
+		opt(server)
+	}
+	return server
+}
+
+func (s *Server) Allocate(ctx context.Context, req *ipamv1.AllocateRequest) (*ipamv1.Allocation, error) {
+	if err := checkPoolAndRequestID(req.PoolId, req.RequestId); err != nil {
+		return nil, err
+	}
+	family := cidr.IPv4
+	switch req.Family {
+	case ipamv1.Family_FAMILY_UNSPECIFIED, ipamv1.Family_FAMILY_IPV4:
+	case ipamv1.Family_FAMILY_IPV6:
+		family = cidr.IPv6
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "invalid family %v", req.Family)
+	}
+	if req.PrefixLength < 0 || int(req.PrefixLength) > family.Bits() {
+		return nil, status.Errorf(codes.InvalidArgument, "prefix_length must be between 0 and %d", family.Bits())
+	}
+	c, err := s.allocator(req.PoolId).Allocate(actorContext(ctx), family, int(req.PrefixLength), req.RequestId,
+		allocator.WithLabels(req.Labels))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &ipamv1.Allocation{
+		PoolId:    req.PoolId,
+		RequestId: req.RequestId,
+		Cidr:      c.String(),
+	}, nil
+}
+
+func (s *Server) Get(ctx context.Context, req *ipamv1.GetRequest) (*ipamv1.GetResponse, error) {
+	if err := checkPoolAndRequestID(req.PoolId, req.RequestId); err != nil {
+		return nil, err
+	}
+	records, err := s.allocator(req.PoolId).Lookup(ctx, req.RequestId)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	resp := &ipamv1.GetResponse{}
+	for _, record := range records {
+		resp.Allocations = append(resp.Allocations, toAllocation(record))
+	}
+	return resp, nil
+}
+
+func (s *Server) ListAllocations(req *ipamv1.ListAllocationsRequest, stream ipamv1.IPAM_ListAllocationsServer) error {
+	if req.PoolId <= 0 {
+		return status.Error(codes.InvalidArgument, "pool_id is required")
+	}
+	filter := storage.ListFilter{
+		MinPrefixBits:   int(req.MinPrefixLength),
+		MaxPrefixBits:   int(req.MaxPrefixLength),
+		RequestIDPrefix: req.RequestIdPrefix,
+		Labels:          req.Labels,
+	}
+	if req.Within != "" {
+		c, err := cidr.ParseCIDR(req.Within)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "within: %v", err)
+		}
+		filter.Within = &c
+	}
+	switch req.State {
+	case ipamv1.State_STATE_UNSPECIFIED, ipamv1.State_STATE_ALLOCATED:
+		filter.State = storage.StateAllocated
+	case ipamv1.State_STATE_FREE:
+		filter.State = storage.StateFree
+	case ipamv1.State_STATE_ANY:
+		filter.State = storage.StateAny
+	default:
+		return status.Errorf(codes.InvalidArgument, "invalid state %v", req.State)
+	}
+	// Stream page by page, so that no transaction is open while sending.
+	a := s.allocator(req.PoolId)
+	pageToken := ""
+	for {
+		records, nextPageToken, err := a.ListAllocations(stream.Context(), filter, pageToken, allocator.MaxPageSize)
+		if err != nil {
+			return toStatus(err)
+		}
+		for _, record := range records {
+			if err := stream.Send(toAllocation(record)); err != nil {
+				return err
+			}
+		}
+		if nextPageToken == "" {
+			return nil
+		}
+		pageToken = nextPageToken
+	}
+}
+
+func (s *Server) PoolStats(ctx context.Context, req *ipamv1.PoolStatsRequest) (*ipamv1.PoolStatsResponse, error) {
+	if req.PoolId <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "pool_id is required")
+	}
+	stats, err := allocator.NewPoolManager(s.s, s.allocatorOpts...).PoolStats(ctx, int(req.PoolId))
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	total, allocated, free := new(big.Int), new(big.Int), new(big.Int)
+	resp := &ipamv1.PoolStatsResponse{}
+	for _, family := range []cidr.Family{cidr.IPv4, cidr.IPv6} {
+		familyStats := stats.Family(family)
+		total.Add(total, familyStats.Total)
+		allocated.Add(allocated, familyStats.Allocated)
+		free.Add(free, familyStats.Free)
+		resp.Families = append(resp.Families, toFamilyStats(family, familyStats))
+	}
+	resp.TotalAddresses = total.String()
+	resp.AllocatedAddresses = allocated.String()
+	resp.FreeAddresses = free.String()
+	return resp, nil
+}
+
+func (s *Server) Release(ctx context.Context, req *ipamv1.ReleaseRequest) (*ipamv1.ReleaseResponse, error) {
+	if err := checkPoolAndRequestID(req.PoolId, req.RequestId); err != nil {
+		return nil, err
+	}
+	cs, err := s.allocator(req.PoolId).Deallocate(actorContext(ctx), req.RequestId)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	resp := &ipamv1.ReleaseResponse{}
+	for _, c := range cs {
+		resp.Cidrs = append(resp.Cidrs, c.String())
+	}
+	return resp, nil
+}
+
+func (s *Server) SetLabels(ctx context.Context, req *ipamv1.SetLabelsRequest) (*ipamv1.SetLabelsResponse, error) {
+	if err := checkPoolAndRequestID(req.PoolId, req.RequestId); err != nil {
+		return nil, err
+	}
+	if err := s.allocator(req.PoolId).SetLabels(ctx, req.RequestId, req.Labels); err != nil {
+		return nil, toStatus(err)
+	}
+	return &ipamv1.SetLabelsResponse{}, nil
+}
+
+// allocator returns an allocator for the pool identified by poolID.
+func (s *Server) allocator(poolID int32) *allocator.Allocator {
+	opts := append(append([]allocator.Option{}, s.allocatorOpts...), allocator.WithPoolID(int(poolID)))
+	return allocator.New(s.s, opts...)
+}
+
+// actorContext returns ctx with the actor of the ActorMetadataKey metadata of the request, if any.
+func actorContext(ctx context.Context) context.Context {
+	if values := metadata.ValueFromIncomingContext(ctx, ActorMetadataKey); len(values) > 0 {
+		return allocator.ContextWithActor(ctx, values[0])
+	}
+	return ctx
+}
+
+func checkPoolAndRequestID(poolID int32, requestID string) error {
+	if poolID <= 0 {
+		return status.Error(codes.InvalidArgument, "pool_id is required")
+	}
+	if requestID == "" {
+		return status.Error(codes.InvalidArgument, "request_id is required")
+	}
+	return nil
+}
+
+func toAllocation(record storage.Record) *ipamv1.Allocation {
+	return &ipamv1.Allocation{
+		PoolId:    int32(record.PoolID),
+		RequestId: record.RequestID,
+		Cidr:      record.C.String(),
+		Labels:    record.Labels,
+	}
+}
+
+func toFamilyStats(family cidr.Family, stats *allocator.FamilyStats) *ipamv1.FamilyStats {
+	freeBlocks := map[int32]int32{}
+	for prefixBits, count := range stats.FreeBlocks {
+		freeBlocks[int32(prefixBits)] = int32(count)
+	}
+	return &ipamv1.FamilyStats{
+		Family:                  ipamv1.Family(family),
+		TotalAddresses:          stats.Total.String(),
+		AllocatedAddresses:      stats.Allocated.String(),
+		FreeAddresses:           stats.Free.String(),
+		RetiredAddresses:        stats.Retired.String(),
+		FreeBlocks:              freeBlocks,
+		LargestFreePrefixLength: int32(stats.LargestFreePrefixBits),
+		Fragmentation:           stats.Fragmentation,
+	}
+}
+
+// toStatus maps an error returned by the allocator package to a gRPC status error.
+func toStatus(err error) error {
+	var code codes.Code
+	switch {
+	case errors.Is(err, allocator.ErrInvalidLabels):
+		code = codes.InvalidArgument
+	case errors.Is(err, allocator.ErrPoolNotFound), errors.Is(err, allocator.ErrNotFound):
+		code = codes.NotFound
+	case errors.Is(err, allocator.ErrRequestConflict):
+		code = codes.AlreadyExists
+	case errors.Is(err, allocator.ErrPoolExhausted):
+		code = codes.ResourceExhausted
+	case errors.Is(err, allocator.ErrRetryable):
+		code = codes.Unavailable
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	default:
+		code = codes.Internal
+	}
+	return status.Error(code, err.Error())
+}
@@ -0,0 +1,157 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/jbrekelmans/go-sql-ip-management/allocator"
+	ipamv1 "github.com/jbrekelmans/go-sql-ip-management/api/ipam/v1"
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage/memory"
+)
+
+// testClient returns a client of a server with one pool with the free ranges 10.0.0.0/24 and fd00::/48,
+// connected over an in-memory connection, and the storage of the server.
+func testClient(t *testing.T) (ipamv1.IPAMClient, *memory.MemoryStorage) {
+	t.Helper()
+	s := memory.NewMemoryStorage()
+	_, err := allocator.NewPoolManager(s).CreatePool(context.Background(), "pool1",
+		cidr.MustParseCIDR("10.0.0.0/24"), cidr.MustParseCIDR("fd00::/48"))
+	require.NoError(t, err)
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	ipamv1.RegisterIPAMServer(grpcServer, NewServer(s, WithAllocatorOptions(allocator.WithLogger(zerolog.Nop()))))
+	go func() {
+		_ = grpcServer.Serve(listener)
+	}()
+	t.Cleanup(grpcServer.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return ipamv1.NewIPAMClient(conn), s
+}
+
+func Test_Server(t *testing.T) {
+	ctx := context.Background()
+	client, s := testClient(t)
+
+	allocation, err := client.Allocate(ctx, &ipamv1.AllocateRequest{PoolId: 1, RequestId: "a", PrefixLength: 25})
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.0/25", allocation.Cidr)
+	allocation, err = client.Allocate(ctx, &ipamv1.AllocateRequest{PoolId: 1, RequestId: "a", PrefixLength: 25})
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.0/25", allocation.Cidr)
+	allocation, err = client.Allocate(ctx, &ipamv1.AllocateRequest{PoolId: 1, RequestId: "a", PrefixLength: 64,
+		Family: ipamv1.Family_FAMILY_IPV6})
+	require.NoError(t, err)
+	assert.Equal(t, "fd00::/64", allocation.Cidr)
+	_, err = client.Allocate(ctx, &ipamv1.AllocateRequest{PoolId: 1, RequestId: "b", PrefixLength: 26})
+	require.NoError(t, err)
+
+	_, err = client.Allocate(ctx, &ipamv1.AllocateRequest{PoolId: 1, RequestId: "a", PrefixLength: 26})
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = client.Allocate(ctx, &ipamv1.AllocateRequest{PoolId: 1, RequestId: "c", PrefixLength: 24})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+	_, err = client.Allocate(ctx, &ipamv1.AllocateRequest{PoolId: 1, RequestId: "c", PrefixLength: 33})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.Allocate(ctx, &ipamv1.AllocateRequest{PoolId: 2, RequestId: "c", PrefixLength: 24})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	getResp, err := client.Get(ctx, &ipamv1.GetRequest{PoolId: 1, RequestId: "a"})
+	require.NoError(t, err)
+	if assert.Len(t, getResp.Allocations, 2) {
+		assert.Equal(t, "10.0.0.0/25", getResp.Allocations[0].Cidr)
+		assert.Equal(t, "fd00::/64", getResp.Allocations[1].Cidr)
+	}
+
+	stream, err := client.ListAllocations(ctx, &ipamv1.ListAllocationsRequest{PoolId: 1})
+	require.NoError(t, err)
+	var listed []string
+	for {
+		allocation, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		listed = append(listed, allocation.RequestId+" "+allocation.Cidr)
+	}
+	assert.Equal(t, []string{"a 10.0.0.0/25", "b 10.0.0.128/26", "a fd00::/64"}, listed)
+
+	_, err = client.SetLabels(ctx, &ipamv1.SetLabelsRequest{PoolId: 1, RequestId: "b", Labels: map[string]string{"team": "payments"}})
+	require.NoError(t, err)
+	_, err = client.SetLabels(ctx, &ipamv1.SetLabelsRequest{PoolId: 1, RequestId: "c"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.SetLabels(ctx, &ipamv1.SetLabelsRequest{PoolId: 1, RequestId: "b", Labels: map[string]string{"": "x"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	stream, err = client.ListAllocations(ctx, &ipamv1.ListAllocationsRequest{PoolId: 1, Labels: map[string]string{"team": "payments"}})
+	require.NoError(t, err)
+	allocation, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "b", allocation.RequestId)
+	assert.Equal(t, map[string]string{"team": "payments"}, allocation.Labels)
+	_, err = stream.Recv()
+	assert.ErrorIs(t, err, io.EOF)
+
+	stream, err = client.ListAllocations(ctx, &ipamv1.ListAllocationsRequest{PoolId: 1, State: ipamv1.State_STATE_FREE,
+		Within: "10.0.0.0/24"})
+	require.NoError(t, err)
+	allocation, err = stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.192/26", allocation.Cidr)
+	assert.Empty(t, allocation.RequestId)
+	_, err = stream.Recv()
+	assert.ErrorIs(t, err, io.EOF)
+	stream, err = client.ListAllocations(ctx, &ipamv1.ListAllocationsRequest{PoolId: 1, Within: "10.0.0.0/33"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	statsResp, err := client.PoolStats(ctx, &ipamv1.PoolStatsRequest{PoolId: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "1208925819614629174706432", statsResp.TotalAddresses)
+	assert.Equal(t, "18446744073709551808", statsResp.AllocatedAddresses)
+	assert.Equal(t, "1208907372870555465154624", statsResp.FreeAddresses)
+	if assert.Len(t, statsResp.Families, 2) {
+		assert.Equal(t, ipamv1.Family_FAMILY_IPV4, statsResp.Families[0].Family)
+		assert.Equal(t, "64", statsResp.Families[0].FreeAddresses)
+		assert.Equal(t, map[int32]int32{26: 1}, statsResp.Families[0].FreeBlocks)
+		assert.Equal(t, int32(26), statsResp.Families[0].LargestFreePrefixLength)
+		assert.Equal(t, ipamv1.Family_FAMILY_IPV6, statsResp.Families[1].Family)
+	}
+	_, err = client.PoolStats(ctx, &ipamv1.PoolStatsRequest{PoolId: 2})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	releaseResp, err := client.Release(metadata.AppendToOutgoingContext(ctx, ActorMetadataKey, "bob"),
+		&ipamv1.ReleaseRequest{PoolId: 1, RequestId: "a"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/25", "fd00::/64"}, releaseResp.Cidrs)
+	events, err := allocator.New(s, allocator.WithLogger(zerolog.Nop())).HistoryOfRequest(ctx, "a")
+	require.NoError(t, err)
+	if assert.Len(t, events, 4) {
+		assert.Empty(t, events[0].Actor)
+		assert.Equal(t, "bob", events[3].Actor)
+	}
+	_, err = client.Release(ctx, &ipamv1.ReleaseRequest{PoolId: 1, RequestId: "a"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Get(ctx, &ipamv1.GetRequest{PoolId: 1, RequestId: "a"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+}
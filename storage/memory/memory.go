@@ -0,0 +1,1138 @@
+// Package memory implements storage.Storage in memory.
+//
+// Transactions are serializable: each transaction reads from a copy-on-write snapshot of the
+// committed state, and on commit fails with ErrSerializationFailure if another transaction
+// committed changes to something it read or wrote since the snapshot was taken.
+package memory
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+var (
+	// ErrSerializationFailure is returned by Commit if the transaction conflicts with a concurrent
+	// transaction that committed first. The transaction can be retried.
+	ErrSerializationFailure = errors.New("could not serialize access due to concurrent update")
+
+	// ErrUniqueViolation is returned by Commit if the transaction would allocate two records of the same address family
+	// in a pool to the same requestID, which happens if a concurrent transaction allocated a record to the same requestID.
+	// The transaction can be retried.
+	ErrUniqueViolation = errors.New("duplicate requestID")
+
+	// ErrTxDone is returned by operations on a transaction that has been committed or rolled back.
+	ErrTxDone = errors.New("transaction has already been committed or rolled back")
+)
+
+// recordKey identifies a record.
+type recordKey struct {
+	poolID int
+	c      string
+}
+
+// hostKey identifies a host.
+type hostKey struct {
+	poolID    int
+	subnet    string
+	requestID string
+}
+
+// recordVersion is a version of a record, which is valid from from (inclusive) until to (exclusive).
+// to is zero for the current version of a record that exists.
+type recordVersion struct {
+	record storage.Record
+	from   time.Time
+	to     time.Time
+}
+
+// state is committed state. A state is never modified once it is committed.
+type state struct {
+	pools map[int]storage.Pool
+	// deletedPools is the set of IDs of deleted pools, which are never used again.
+	deletedPools map[int]struct{}
+	// records maps pool IDs to the records of the pool, keyed by CIDR notation.
+	records map[int]map[string]storage.Record
+	// events maps pool IDs to the events of the pool, ordered by ID.
+	events map[int][]storage.Event
+	// versions maps pool IDs to the versions of the records of the pool, keyed by CIDR notation and ordered by time.
+	versions map[int]map[string][]recordVersion
+	// roots maps pool IDs to the roots of the pool, ordered by address.
+	roots map[int][]cidr.CIDR
+	// hostSubnets maps pool IDs to the host subnets of the pool, keyed by CIDR notation.
+	hostSubnets map[int]map[string]storage.HostSubnet
+	// hosts maps pool IDs to the hosts of the pool.
+	hosts map[int]map[hostKey]storage.Host
+}
+
+type MemoryStorage struct {
+	mu sync.Mutex
+	// committed is the latest committed state.
+	committed *state
+	// version is incremented by each commit that writes.
+	version uint64
+	// poolVersions maps pool IDs to the version of the last commit that wrote to the pool.
+	poolVersions map[int]uint64
+	// recordVersions maps records to the version of the last commit that wrote to the record.
+	recordVersions map[recordKey]uint64
+	// poolTableVersion is the version of the last commit that created, updated or deleted a pool.
+	poolTableVersion uint64
+	// lastEventID is the ID of the last inserted event. Like a database sequence, IDs of events of transactions
+	// that are rolled back are not reused.
+	lastEventID int64
+	// eventsCommitted is closed and replaced by each commit of events, to notify watchers.
+	eventsCommitted chan struct{}
+}
+
+var _ storage.Storage = (*MemoryStorage)(nil)
+var _ storage.RetryClassifier = (*MemoryStorage)(nil)
+var _ storage.Watcher = (*MemoryStorage)(nil)
+
+// NewMemoryStorage returns an empty MemoryStorage with the specified pools.
+func NewMemoryStorage(pools ...storage.Pool) *MemoryStorage {
+	s := &MemoryStorage{
+		committed: &state{
+			pools:    map[int]storage.Pool{},
+			records:  map[int]map[string]storage.Record{},
+			events:   map[int][]storage.Event{},
+			versions: map[int]map[string][]recordVersion{},
+			roots:    map[int][]cidr.CIDR{},
+
+			hostSubnets: map[int]map[string]storage.HostSubnet{},
+			hosts:       map[int]map[hostKey]storage.Host{},
+
+			deletedPools: map[int]struct{}{},
+		},
+		poolVersions:    map[int]uint64{},
+		recordVersions:  map[recordKey]uint64{},
+		eventsCommitted: make(chan struct{}),
+	}
+	for _, pool := range pools {
+		s.committed.pools[pool.ID] = pool
+		s.committed.records[pool.ID] = map[string]storage.Record{}
+	}
+	return s
+}
+
+func (s *MemoryStorage) BeginTransaction(ctx context.Context, txOpts *sql.TxOptions) (storage.Transaction, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := &transaction{
+		ctx:        ctx,
+		s:          s,
+		snapshot:   s.committed,
+		version:    s.version,
+		readPools:  map[int]struct{}{},
+		readKeys:   map[recordKey]struct{}{},
+		writes:     map[recordKey]*storage.Record{},
+		poolWrites: map[int]*storage.Pool{},
+		rootWrites: map[int][]cidr.CIDR{},
+
+		hostSubnetWrites: map[recordKey]*storage.HostSubnet{},
+		hostWrites:       map[hostKey]*storage.Host{},
+	}
+	if txOpts != nil {
+		t.readOnly = txOpts.ReadOnly
+	}
+	return t, nil
+}
+
+// IsRetryable implements storage.RetryClassifier.
+func (s *MemoryStorage) IsRetryable(err error) bool {
+	return errors.Is(err, ErrSerializationFailure) || errors.Is(err, ErrUniqueViolation)
+}
+
+// commit validates and applies the writes of t.
+func (s *MemoryStorage) commit(t *transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(t.writes) == 0 && len(t.poolWrites) == 0 && len(t.events) == 0 && len(t.rootWrites) == 0 &&
+		len(t.hostSubnetWrites) == 0 && len(t.hostWrites) == 0 {
+		// Read-only transactions read a consistent snapshot, which is equivalent to executing at the time
+		// the snapshot was taken.
+		return nil
+	}
+	for poolID := range t.readPools {
+		if s.poolVersions[poolID] > t.version {
+			return ErrSerializationFailure
+		}
+	}
+	for key := range t.readKeys {
+		if s.recordVersions[key] > t.version {
+			return ErrSerializationFailure
+		}
+	}
+	for key := range t.writes {
+		if s.recordVersions[key] > t.version {
+			return ErrSerializationFailure
+		}
+	}
+	for poolID := range t.rootWrites {
+		if s.poolVersions[poolID] > t.version {
+			return ErrSerializationFailure
+		}
+	}
+	for poolID := range t.hostPools() {
+		if s.poolVersions[poolID] > t.version {
+			return ErrSerializationFailure
+		}
+	}
+	if (t.readPoolTable || len(t.poolWrites) > 0) && s.poolTableVersion > t.version {
+		return ErrSerializationFailure
+	}
+	for _, event := range t.events {
+		// Events of a pool must be committed in the order of their IDs (see storage.Event).
+		if events := s.committed.events[event.PoolID]; len(events) > 0 && events[len(events)-1].ID > event.ID {
+			return ErrSerializationFailure
+		}
+	}
+	next := &state{
+		pools:    s.committed.pools,
+		records:  make(map[int]map[string]storage.Record, len(s.committed.records)),
+		events:   make(map[int][]storage.Event, len(s.committed.events)),
+		versions: make(map[int]map[string][]recordVersion, len(s.committed.versions)),
+		roots:    make(map[int][]cidr.CIDR, len(s.committed.roots)),
+
+		hostSubnets: make(map[int]map[string]storage.HostSubnet, len(s.committed.hostSubnets)),
+		hosts:       make(map[int]map[hostKey]storage.Host, len(s.committed.hosts)),
+
+		deletedPools: s.committed.deletedPools,
+	}
+	for poolID, hostSubnets := range s.committed.hostSubnets {
+		next.hostSubnets[poolID] = hostSubnets
+	}
+	for poolID, hosts := range s.committed.hosts {
+		next.hosts[poolID] = hosts
+	}
+	for poolID, roots := range s.committed.roots {
+		next.roots[poolID] = roots
+	}
+	for poolID, records := range s.committed.records {
+		next.records[poolID] = records
+	}
+	for poolID, versions := range s.committed.versions {
+		next.versions[poolID] = versions
+	}
+	for poolID, events := range s.committed.events {
+		next.events[poolID] = events
+	}
+	now := time.Now().UTC()
+	if len(t.poolWrites) > 0 {
+		next.pools = make(map[int]storage.Pool, len(s.committed.pools))
+		for poolID, pool := range s.committed.pools {
+			next.pools[poolID] = pool
+		}
+		next.deletedPools = make(map[int]struct{}, len(s.committed.deletedPools))
+		for poolID := range s.committed.deletedPools {
+			next.deletedPools[poolID] = struct{}{}
+		}
+		for poolID, pool := range t.poolWrites {
+			if pool == nil {
+				// The events and versions of a deleted pool are kept, and the current versions are ended.
+				delete(next.pools, poolID)
+				delete(next.records, poolID)
+				delete(next.roots, poolID)
+				delete(next.hostSubnets, poolID)
+				delete(next.hosts, poolID)
+				next.deletedPools[poolID] = struct{}{}
+				versions := make(map[string][]recordVersion, len(next.versions[poolID]))
+				for c, v := range next.versions[poolID] {
+					if n := len(v); n > 0 && v[n-1].to.IsZero() {
+						v = append(v[:n-1:n-1], recordVersion{record: v[n-1].record, from: v[n-1].from, to: now})
+					}
+					versions[c] = v
+				}
+				next.versions[poolID] = versions
+				continue
+			}
+			next.pools[poolID] = *pool
+			if _, ok := next.records[poolID]; !ok {
+				next.records[poolID] = map[string]storage.Record{}
+			}
+		}
+	}
+	copied := map[int]bool{}
+	for key, record := range t.writes {
+		if _, ok := next.pools[key.poolID]; !ok {
+			// The pool was deleted, and with it all its records.
+			continue
+		}
+		if !copied[key.poolID] {
+			records := make(map[string]storage.Record, len(next.records[key.poolID]))
+			for c, r := range next.records[key.poolID] {
+				records[c] = r
+			}
+			next.records[key.poolID] = records
+			versions := make(map[string][]recordVersion, len(next.versions[key.poolID]))
+			for c, v := range next.versions[key.poolID] {
+				versions[c] = v
+			}
+			next.versions[key.poolID] = versions
+			copied[key.poolID] = true
+		}
+		// Copy the versions of the record, so that ending the current version does not modify committed states.
+		versions := append([]recordVersion(nil), next.versions[key.poolID][key.c]...)
+		if n := len(versions); n > 0 && versions[n-1].to.IsZero() {
+			versions[n-1].to = now
+		}
+		if record == nil {
+			delete(next.records[key.poolID], key.c)
+		} else {
+			next.records[key.poolID][key.c] = *record
+			versions = append(versions, recordVersion{record: *record, from: now})
+		}
+		next.versions[key.poolID][key.c] = versions
+	}
+	for poolID, roots := range t.rootWrites {
+		if _, ok := next.pools[poolID]; ok {
+			next.roots[poolID] = roots
+		}
+	}
+	copiedHosts := map[int]bool{}
+	for poolID := range t.hostPools() {
+		if _, ok := next.pools[poolID]; !ok {
+			continue
+		}
+		hostSubnets := make(map[string]storage.HostSubnet, len(next.hostSubnets[poolID]))
+		for c, hostSubnet := range next.hostSubnets[poolID] {
+			hostSubnets[c] = hostSubnet
+		}
+		next.hostSubnets[poolID] = hostSubnets
+		hosts := make(map[hostKey]storage.Host, len(next.hosts[poolID]))
+		for key, host := range next.hosts[poolID] {
+			hosts[key] = host
+		}
+		next.hosts[poolID] = hosts
+		copiedHosts[poolID] = true
+	}
+	for key, hostSubnet := range t.hostSubnetWrites {
+		if !copiedHosts[key.poolID] {
+			continue
+		}
+		if hostSubnet == nil {
+			delete(next.hostSubnets[key.poolID], key.c)
+		} else {
+			next.hostSubnets[key.poolID][key.c] = *hostSubnet
+		}
+	}
+	for key, host := range t.hostWrites {
+		if !copiedHosts[key.poolID] {
+			continue
+		}
+		if host == nil {
+			delete(next.hosts[key.poolID], key)
+		} else {
+			next.hosts[key.poolID][key] = *host
+		}
+	}
+	for _, event := range t.events {
+		// Limit the capacity so that appending never modifies the events of committed states.
+		events := next.events[event.PoolID]
+		next.events[event.PoolID] = append(events[:len(events):len(events)], event)
+	}
+	// A requestID has at most one record per family that is not being moved to, and one that is (see
+	// storage.Record.MovedFrom).
+	type requestKey struct {
+		family    cidr.Family
+		requestID string
+		moving    bool
+	}
+	for poolID := range copied {
+		requestKeys := map[requestKey]struct{}{}
+		for _, record := range next.records[poolID] {
+			if record.RequestID == "" {
+				continue
+			}
+			key := requestKey{family: record.C.Family(), requestID: record.RequestID, moving: record.MovedFrom != nil}
+			if _, ok := requestKeys[key]; ok {
+				return fmt.Errorf(`%w: pool %d has multiple %v records with requestID=%#v`, ErrUniqueViolation, poolID,
+					key.family, record.RequestID)
+			}
+			requestKeys[key] = struct{}{}
+		}
+	}
+	s.version++
+	for key := range t.writes {
+		s.poolVersions[key.poolID] = s.version
+		s.recordVersions[key] = s.version
+	}
+	for poolID := range t.rootWrites {
+		s.poolVersions[poolID] = s.version
+	}
+	for poolID := range t.hostPools() {
+		s.poolVersions[poolID] = s.version
+	}
+	if len(t.poolWrites) > 0 {
+		s.poolTableVersion = s.version
+	}
+	s.committed = next
+	if len(t.events) > 0 {
+		close(s.eventsCommitted)
+		s.eventsCommitted = make(chan struct{})
+	}
+	return nil
+}
+
+// Watch implements storage.Watcher.
+func (s *MemoryStorage) Watch(ctx context.Context, poolID int, afterID int64,
+	handle func(event storage.Event) error) error {
+	for {
+		s.mu.Lock()
+		events, eventsCommitted := s.committed.events[poolID], s.eventsCommitted
+		s.mu.Unlock()
+		i := sort.Search(len(events), func(i int) bool {
+			return events[i].ID > afterID
+		})
+		for _, event := range events[i:] {
+			afterID = event.ID
+			if !event.Type.IsWatched() {
+				continue
+			}
+			event.C.IP = append(event.C.IP[:0:0], event.C.IP...)
+			if err := handle(event); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-eventsCommitted:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+type transaction struct {
+	ctx      context.Context
+	done     bool
+	readOnly bool
+	s        *MemoryStorage
+	snapshot *state
+	version  uint64
+	// readPools is the set of pools read using a predicate (as opposed to reading a single record).
+	readPools map[int]struct{}
+	readKeys  map[recordKey]struct{}
+	// readPoolTable is true if pools were read.
+	readPoolTable bool
+	// writes maps records to their new value, or nil if deleted.
+	writes map[recordKey]*storage.Record
+	// poolWrites maps pool IDs to their new value, or nil if deleted.
+	poolWrites map[int]*storage.Pool
+	// rootWrites maps pool IDs to their new roots.
+	rootWrites map[int][]cidr.CIDR
+	// hostSubnetWrites maps host subnets to their new value, or nil if deleted.
+	hostSubnetWrites map[recordKey]*storage.HostSubnet
+	// hostWrites maps hosts to their new value, or nil if deleted.
+	hostWrites map[hostKey]*storage.Host
+	// events are the inserted events, ordered by ID.
+	events []storage.Event
+}
+
+var _ storage.Transaction = (*transaction)(nil)
+
+func (t *transaction) Commit() error {
+	if t.done {
+		return ErrTxDone
+	}
+	t.done = true
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	return t.s.commit(t)
+}
+
+func (t *transaction) CountRecords(ctx context.Context, poolID int) ([]storage.RecordCount, error) {
+	records, err := t.poolRecords(poolID)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[storage.RecordCount]int{}
+	for _, record := range records {
+		counts[storage.RecordCount{
+			Family:     record.C.Family(),
+			PrefixBits: record.C.PrefixBits,
+			Allocated:  record.RequestID != "",
+			Retired:    record.Retired,
+		}]++
+	}
+	var result []storage.RecordCount
+	for group, count := range counts {
+		group.Count = count
+		result = append(result, group)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Family != b.Family {
+			return a.Family < b.Family
+		}
+		if a.PrefixBits != b.PrefixBits {
+			return a.PrefixBits < b.PrefixBits
+		}
+		if a.Allocated != b.Allocated {
+			return !a.Allocated
+		}
+		return !a.Retired && b.Retired
+	})
+	return result, nil
+}
+
+func (t *transaction) Delete(ctx context.Context, poolID int, c cidr.CIDR) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	key := recordKey{poolID: poolID, c: c.String()}
+	if t.get(key) == nil {
+		return fmt.Errorf(`record %d %s does not exist`, poolID, key.c)
+	}
+	t.writes[key] = nil
+	return t.deleteHostSubnet(key)
+}
+
+// DeleteHost implements storage.Transaction.
+func (t *transaction) DeleteHost(ctx context.Context, poolID int, subnet cidr.CIDR, requestID string) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	key := hostKey{poolID: poolID, subnet: subnet.String(), requestID: requestID}
+	if t.getHost(key) == nil {
+		return fmt.Errorf(`host %d %s %#v does not exist`, poolID, key.subnet, requestID)
+	}
+	t.hostWrites[key] = nil
+	return nil
+}
+
+func (t *transaction) DeletePool(ctx context.Context, poolID int) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	if t.getPool(poolID) == nil {
+		return fmt.Errorf(`pool %d does not exist`, poolID)
+	}
+	records, err := t.poolRecords(poolID)
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		t.writes[recordKey{poolID: poolID, c: record.C.String()}] = nil
+	}
+	t.poolWrites[poolID] = nil
+	t.rootWrites[poolID] = nil
+	return nil
+}
+
+func (t *transaction) FindAllocated(ctx context.Context, poolID int, requestID string) ([]storage.Record, error) {
+	if requestID == "" {
+		return nil, fmt.Errorf("requestID must not be empty")
+	}
+	records, err := t.poolRecords(poolID)
+	if err != nil {
+		return nil, err
+	}
+	var result []storage.Record
+	for _, record := range records {
+		if record.RequestID == requestID {
+			result = append(result, record)
+		}
+	}
+	return result, nil
+}
+
+func (t *transaction) FindExpired(ctx context.Context, poolID int, now time.Time, limit int) ([]storage.Record, error) {
+	records, err := t.poolRecords(poolID)
+	if err != nil {
+		return nil, err
+	}
+	var result []storage.Record
+	for _, record := range records {
+		if record.RequestID != "" && record.ExpiresAt != nil && !record.ExpiresAt.After(now) {
+			result = append(result, record)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].ExpiresAt.Before(*result[j].ExpiresAt)
+	})
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (t *transaction) FindOverlapping(ctx context.Context, poolID int, c cidr.CIDR) ([]storage.Record, error) {
+	records, err := t.poolRecords(poolID)
+	if err != nil {
+		return nil, err
+	}
+	var result []storage.Record
+	for _, record := range records {
+		if record.C.Overlaps(c) {
+			result = append(result, record)
+		}
+	}
+	return result, nil
+}
+
+// FindHost implements storage.Transaction.
+func (t *transaction) FindHost(ctx context.Context, poolID int, subnet cidr.CIDR, requestID string) (*storage.Host,
+	error) {
+	if t.done {
+		return nil, ErrTxDone
+	}
+	t.readPools[poolID] = struct{}{}
+	host := t.getHost(hostKey{poolID: poolID, subnet: subnet.String(), requestID: requestID})
+	if host == nil {
+		return nil, nil
+	}
+	hostCopy := host.DeepCopy()
+	return &hostCopy, nil
+}
+
+func (t *transaction) FindSmallestFree(ctx context.Context, poolID int, family cidr.Family, prefixBits int) (*storage.Record, error) {
+	records, err := t.poolRecords(poolID)
+	if err != nil {
+		return nil, err
+	}
+	var result *storage.Record
+	for i := range records {
+		record := &records[i]
+		if record.RequestID != "" || record.Retired || record.C.Family() != family || record.C.PrefixBits > prefixBits {
+			continue
+		}
+		if result == nil || record.C.PrefixBits > result.C.PrefixBits {
+			result = record
+		}
+	}
+	return result, nil
+}
+
+func (t *transaction) Get(ctx context.Context, poolID int, c cidr.CIDR) (*storage.Record, error) {
+	if t.done {
+		return nil, ErrTxDone
+	}
+	key := recordKey{poolID: poolID, c: c.String()}
+	t.readKeys[key] = struct{}{}
+	record := t.get(key)
+	if record == nil {
+		return nil, nil
+	}
+	recordCopy := record.DeepCopy()
+	return &recordCopy, nil
+}
+
+// GetHostSubnet implements storage.Transaction.
+func (t *transaction) GetHostSubnet(ctx context.Context, poolID int, c cidr.CIDR) (*storage.HostSubnet, error) {
+	if t.done {
+		return nil, ErrTxDone
+	}
+	t.readPools[poolID] = struct{}{}
+	hostSubnet := t.getHostSubnet(recordKey{poolID: poolID, c: c.String()})
+	if hostSubnet == nil {
+		return nil, nil
+	}
+	hostSubnetCopy := hostSubnet.DeepCopy()
+	return &hostSubnetCopy, nil
+}
+
+func (t *transaction) GetPool(ctx context.Context, poolID int) (*storage.Pool, error) {
+	if t.done {
+		return nil, ErrTxDone
+	}
+	pool := t.getPool(poolID)
+	if pool == nil {
+		return nil, nil
+	}
+	poolCopy := *pool
+	return &poolCopy, nil
+}
+
+func (t *transaction) InsertMany(ctx context.Context, records []storage.Record) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	for _, record := range records {
+		if t.getPool(record.PoolID) == nil {
+			return fmt.Errorf(`pool %d does not exist`, record.PoolID)
+		}
+		key := recordKey{poolID: record.PoolID, c: record.C.String()}
+		if t.get(key) != nil {
+			return fmt.Errorf(`record %d %s already exists`, record.PoolID, key.c)
+		}
+		recordCopy := record.DeepCopy()
+		t.writes[key] = &recordCopy
+	}
+	return nil
+}
+
+func (t *transaction) InsertEvents(ctx context.Context, events []storage.Event) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	for _, event := range events {
+		if t.getPool(event.PoolID) == nil {
+			return fmt.Errorf(`pool %d does not exist`, event.PoolID)
+		}
+	}
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	for _, event := range events {
+		t.s.lastEventID++
+		event.ID = t.s.lastEventID
+		event.C.IP = append(event.C.IP[:0:0], event.C.IP...)
+		t.events = append(t.events, event)
+	}
+	return nil
+}
+
+// InsertHost implements storage.Transaction.
+func (t *transaction) InsertHost(ctx context.Context, host storage.Host) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	if t.getHostSubnet(recordKey{poolID: host.PoolID, c: host.Subnet.String()}) == nil {
+		return fmt.Errorf(`host subnet %d %s does not exist`, host.PoolID, host.Subnet)
+	}
+	key := hostKey{poolID: host.PoolID, subnet: host.Subnet.String(), requestID: host.RequestID}
+	if t.getHost(key) != nil {
+		return fmt.Errorf(`%w: host subnet %d %s has multiple hosts with requestID=%#v`, ErrUniqueViolation,
+			host.PoolID, key.subnet, host.RequestID)
+	}
+	hosts, err := t.ListHosts(ctx, host.PoolID, host.Subnet)
+	if err != nil {
+		return err
+	}
+	for _, other := range hosts {
+		if other.IP.Equal(host.IP) {
+			return fmt.Errorf(`%w: host subnet %d %s has multiple hosts with address %s`, ErrUniqueViolation,
+				host.PoolID, key.subnet, host.IP)
+		}
+	}
+	hostCopy := host.DeepCopy()
+	t.hostWrites[key] = &hostCopy
+	return nil
+}
+
+// InsertHostSubnet implements storage.Transaction.
+func (t *transaction) InsertHostSubnet(ctx context.Context, hostSubnet storage.HostSubnet) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	key := recordKey{poolID: hostSubnet.PoolID, c: hostSubnet.C.String()}
+	t.readKeys[key] = struct{}{}
+	if t.get(key) == nil {
+		return fmt.Errorf(`record %d %s does not exist`, hostSubnet.PoolID, key.c)
+	}
+	if t.getHostSubnet(key) != nil {
+		return fmt.Errorf(`host subnet %d %s already exists`, hostSubnet.PoolID, key.c)
+	}
+	hostSubnetCopy := hostSubnet.DeepCopy()
+	t.hostSubnetWrites[key] = &hostSubnetCopy
+	return nil
+}
+
+func (t *transaction) InsertPool(ctx context.Context, pool storage.Pool) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	if pool.ID <= 0 {
+		return fmt.Errorf(`pool ID must be positive`)
+	}
+	if t.getPool(pool.ID) != nil {
+		return fmt.Errorf(`pool %d already exists`, pool.ID)
+	}
+	_, deleted := t.snapshot.deletedPools[pool.ID]
+	if _, written := t.poolWrites[pool.ID]; deleted || written {
+		return fmt.Errorf(`pool %d was deleted`, pool.ID)
+	}
+	if err := t.checkPoolName(pool); err != nil {
+		return err
+	}
+	t.poolWrites[pool.ID] = &pool
+	return nil
+}
+
+// ListHostSubnets implements storage.Transaction.
+func (t *transaction) ListHostSubnets(ctx context.Context, poolID int) ([]storage.HostSubnet, error) {
+	if t.done {
+		return nil, ErrTxDone
+	}
+	t.readPools[poolID] = struct{}{}
+	var hostSubnets []storage.HostSubnet
+	for c, hostSubnet := range t.snapshot.hostSubnets[poolID] {
+		if _, ok := t.hostSubnetWrites[recordKey{poolID: poolID, c: c}]; !ok {
+			hostSubnets = append(hostSubnets, hostSubnet.DeepCopy())
+		}
+	}
+	for key, hostSubnet := range t.hostSubnetWrites {
+		if key.poolID == poolID && hostSubnet != nil {
+			hostSubnets = append(hostSubnets, hostSubnet.DeepCopy())
+		}
+	}
+	sort.Slice(hostSubnets, func(i, j int) bool {
+		return storage.CompareAddress(hostSubnets[i].C, hostSubnets[j].C) < 0
+	})
+	return hostSubnets, nil
+}
+
+// ListHosts implements storage.Transaction.
+func (t *transaction) ListHosts(ctx context.Context, poolID int, subnet cidr.CIDR) ([]storage.Host, error) {
+	if t.done {
+		return nil, ErrTxDone
+	}
+	t.readPools[poolID] = struct{}{}
+	c := subnet.String()
+	var hosts []storage.Host
+	for key, host := range t.snapshot.hosts[poolID] {
+		if _, ok := t.hostWrites[key]; !ok && key.subnet == c {
+			hosts = append(hosts, host.DeepCopy())
+		}
+	}
+	for key, host := range t.hostWrites {
+		if key.poolID == poolID && key.subnet == c && host != nil {
+			hosts = append(hosts, host.DeepCopy())
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return bytes.Compare(hosts[i].IP, hosts[j].IP) < 0
+	})
+	return hosts, nil
+}
+
+func (t *transaction) ListPools(ctx context.Context) ([]storage.Pool, error) {
+	if t.done {
+		return nil, ErrTxDone
+	}
+	return t.pools(), nil
+}
+
+func (t *transaction) ListAllocations(ctx context.Context, poolID int, filter storage.ListFilter, after *cidr.CIDR,
+	limit int) ([]storage.Record, error) {
+	records, err := t.poolRecords(poolID)
+	if err != nil {
+		return nil, err
+	}
+	var result []storage.Record
+	for _, record := range records {
+		if after != nil && storage.CompareAddress(record.C, *after) <= 0 {
+			continue
+		}
+		if !filter.Match(record) {
+			continue
+		}
+		result = append(result, record)
+		if len(result) == limit {
+			break
+		}
+	}
+	return result, nil
+}
+
+// ListEvents implements storage.Transaction.
+// Reading events does not cause serialization failures, because events are never updated.
+func (t *transaction) ListEvents(ctx context.Context, poolID int, filter storage.EventFilter) ([]storage.Event, error) {
+	if t.done {
+		return nil, ErrTxDone
+	}
+	events := append([]storage.Event(nil), t.snapshot.events[poolID]...)
+	for _, event := range t.events {
+		if event.PoolID == poolID {
+			events = append(events, event)
+		}
+	}
+	var result []storage.Event
+	for _, event := range events {
+		if filter.Match(event) {
+			event.C.IP = append(event.C.IP[:0:0], event.C.IP...)
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
+
+func (t *transaction) ListRecords(ctx context.Context, poolID int) ([]storage.Record, error) {
+	return t.poolRecords(poolID)
+}
+
+// ListRecordsAt implements storage.Transaction.
+// Versions are stamped with the time of the commit that wrote them, and writes of t are not listed.
+func (t *transaction) ListRecordsAt(ctx context.Context, poolID int, at time.Time) ([]storage.Record, error) {
+	if t.done {
+		return nil, ErrTxDone
+	}
+	var records []storage.Record
+	for _, versions := range t.snapshot.versions[poolID] {
+		for _, version := range versions {
+			if !version.from.After(at) && (version.to.IsZero() || version.to.After(at)) {
+				records = append(records, version.record.DeepCopy())
+				break
+			}
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return storage.CompareAddress(records[i].C, records[j].C) < 0
+	})
+	return records, nil
+}
+
+// ListRoots implements storage.Transaction.
+// Reading roots conflicts with concurrent writes of records or roots of the pool.
+func (t *transaction) ListRoots(ctx context.Context, poolID int) ([]cidr.CIDR, error) {
+	if t.done {
+		return nil, ErrTxDone
+	}
+	t.readPools[poolID] = struct{}{}
+	roots, ok := t.rootWrites[poolID]
+	if !ok {
+		roots = t.snapshot.roots[poolID]
+	}
+	return copyCIDRs(roots), nil
+}
+
+// MaxPoolID implements storage.Transaction.
+func (t *transaction) MaxPoolID(ctx context.Context) (int, error) {
+	if t.done {
+		return 0, ErrTxDone
+	}
+	maxPoolID := 0
+	for _, pool := range t.pools() {
+		maxPoolID = max(maxPoolID, pool.ID)
+	}
+	for poolID := range t.snapshot.deletedPools {
+		maxPoolID = max(maxPoolID, poolID)
+	}
+	for poolID := range t.poolWrites {
+		maxPoolID = max(maxPoolID, poolID)
+	}
+	return maxPoolID, nil
+}
+
+func (t *transaction) Rollback() error {
+	if t.done {
+		return ErrTxDone
+	}
+	t.done = true
+	return nil
+}
+
+func (t *transaction) SetRoots(ctx context.Context, poolID int, roots []cidr.CIDR) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	if t.getPool(poolID) == nil {
+		return fmt.Errorf(`pool %d does not exist`, poolID)
+	}
+	roots = copyCIDRs(roots)
+	sort.Slice(roots, func(i, j int) bool {
+		return storage.CompareAddress(roots[i], roots[j]) < 0
+	})
+	t.rootWrites[poolID] = roots
+	return nil
+}
+
+func (t *transaction) Update(ctx context.Context, record storage.Record) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	key := recordKey{poolID: record.PoolID, c: record.C.String()}
+	if t.get(key) == nil {
+		return fmt.Errorf(`record %d %s does not exist`, record.PoolID, key.c)
+	}
+	recordCopy := record.DeepCopy()
+	t.writes[key] = &recordCopy
+	return nil
+}
+
+// UpdateHostSubnet implements storage.Transaction.
+func (t *transaction) UpdateHostSubnet(ctx context.Context, hostSubnet storage.HostSubnet) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	key := recordKey{poolID: hostSubnet.PoolID, c: hostSubnet.C.String()}
+	existing := t.getHostSubnet(key)
+	if existing == nil {
+		return fmt.Errorf(`host subnet %d %s does not exist`, hostSubnet.PoolID, key.c)
+	}
+	hostSubnetCopy := existing.DeepCopy()
+	hostSubnetCopy.Used = append([]byte(nil), hostSubnet.Used...)
+	t.hostSubnetWrites[key] = &hostSubnetCopy
+	return nil
+}
+
+func (t *transaction) UpdatePool(ctx context.Context, pool storage.Pool) error {
+	if err := t.checkWritable(); err != nil {
+		return err
+	}
+	if t.getPool(pool.ID) == nil {
+		return fmt.Errorf(`pool %d does not exist`, pool.ID)
+	}
+	if err := t.checkPoolName(pool); err != nil {
+		return err
+	}
+	t.poolWrites[pool.ID] = &pool
+	return nil
+}
+
+// checkPoolName returns an error if pool.Name is empty or is the name of another pool.
+func (t *transaction) checkPoolName(pool storage.Pool) error {
+	if pool.Name == "" {
+		return fmt.Errorf(`pool name must not be empty`)
+	}
+	for _, other := range t.pools() {
+		if other.ID != pool.ID && other.Name == pool.Name {
+			return fmt.Errorf(`%w: pool name %#v`, ErrUniqueViolation, pool.Name)
+		}
+	}
+	return nil
+}
+
+func (t *transaction) checkWritable() error {
+	if t.done {
+		return ErrTxDone
+	}
+	if t.readOnly {
+		return errors.New("cannot write in a read-only transaction")
+	}
+	return nil
+}
+
+// get returns the record identified by key as seen by t, or nil if it does not exist.
+// The returned record must not be modified.
+func (t *transaction) get(key recordKey) *storage.Record {
+	if record, ok := t.writes[key]; ok {
+		return record
+	}
+	record, ok := t.snapshot.records[key.poolID][key.c]
+	if !ok {
+		return nil
+	}
+	return &record
+}
+
+// getHostSubnet returns the host subnet identified by key as seen by t, or nil if it does not exist.
+// The returned host subnet must not be modified.
+func (t *transaction) getHostSubnet(key recordKey) *storage.HostSubnet {
+	if hostSubnet, ok := t.hostSubnetWrites[key]; ok {
+		return hostSubnet
+	}
+	hostSubnet, ok := t.snapshot.hostSubnets[key.poolID][key.c]
+	if !ok {
+		return nil
+	}
+	return &hostSubnet
+}
+
+// getHost returns the host identified by key as seen by t, or nil if it does not exist.
+// The returned host must not be modified.
+func (t *transaction) getHost(key hostKey) *storage.Host {
+	if host, ok := t.hostWrites[key]; ok {
+		return host
+	}
+	host, ok := t.snapshot.hosts[key.poolID][key]
+	if !ok {
+		return nil
+	}
+	return &host
+}
+
+// deleteHostSubnet deletes the host subnet identified by key and its hosts, if the host subnet exists.
+// Like the foreign keys of the SQL implementations, deleting a record deletes its host subnet.
+func (t *transaction) deleteHostSubnet(key recordKey) error {
+	if t.getHostSubnet(key) == nil {
+		return nil
+	}
+	hosts, err := t.ListHosts(t.ctx, key.poolID, cidr.MustParseCIDR(key.c))
+	if err != nil {
+		return err
+	}
+	for _, host := range hosts {
+		t.hostWrites[hostKey{poolID: key.poolID, subnet: key.c, requestID: host.RequestID}] = nil
+	}
+	t.hostSubnetWrites[key] = nil
+	return nil
+}
+
+// hostPools returns the set of pools whose host subnets or hosts are written by t.
+func (t *transaction) hostPools() map[int]struct{} {
+	poolIDs := map[int]struct{}{}
+	for key := range t.hostSubnetWrites {
+		poolIDs[key.poolID] = struct{}{}
+	}
+	for key := range t.hostWrites {
+		poolIDs[key.poolID] = struct{}{}
+	}
+	return poolIDs
+}
+
+// getPool returns the pool identified by poolID as seen by t, or nil if it does not exist.
+// The returned pool must not be modified.
+func (t *transaction) getPool(poolID int) *storage.Pool {
+	t.readPoolTable = true
+	if pool, ok := t.poolWrites[poolID]; ok {
+		return pool
+	}
+	pool, ok := t.snapshot.pools[poolID]
+	if !ok {
+		return nil
+	}
+	return &pool
+}
+
+// pools returns all pools as seen by t, ordered by ID.
+func (t *transaction) pools() []storage.Pool {
+	t.readPoolTable = true
+	var pools []storage.Pool
+	for poolID, pool := range t.snapshot.pools {
+		if _, ok := t.poolWrites[poolID]; !ok {
+			pools = append(pools, pool)
+		}
+	}
+	for _, pool := range t.poolWrites {
+		if pool != nil {
+			pools = append(pools, *pool)
+		}
+	}
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].ID < pools[j].ID
+	})
+	return pools
+}
+
+// copyCIDRs returns a deep copy of cs.
+func copyCIDRs(cs []cidr.CIDR) []cidr.CIDR {
+	var result []cidr.CIDR
+	for _, c := range cs {
+		result = append(result, cidr.CIDR{IP: append(c.IP[:0:0], c.IP...), PrefixBits: c.PrefixBits})
+	}
+	return result
+}
+
+// poolRecords returns deep copies of all records of a pool as seen by t, ordered by IP address, IPv4 before IPv6.
+func (t *transaction) poolRecords(poolID int) ([]storage.Record, error) {
+	if t.done {
+		return nil, ErrTxDone
+	}
+	t.readPools[poolID] = struct{}{}
+	var records []storage.Record
+	for c, record := range t.snapshot.records[poolID] {
+		if _, ok := t.writes[recordKey{poolID: poolID, c: c}]; !ok {
+			records = append(records, record.DeepCopy())
+		}
+	}
+	for key, record := range t.writes {
+		if key.poolID == poolID && record != nil {
+			records = append(records, record.DeepCopy())
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return storage.CompareAddress(records[i].C, records[j].C) < 0
+	})
+	return records, nil
+}
@@ -0,0 +1,223 @@
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+)
+
+func testStorage(t *testing.T, records ...storage.Record) *MemoryStorage {
+	t.Helper()
+	s := NewMemoryStorage(storage.Pool{ID: 1, Name: "pool1"})
+	tx, err := s.BeginTransaction(context.Background(), nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.InsertMany(context.Background(), records))
+	require.NoError(t, tx.Commit())
+	return s
+}
+
+func Test_MemoryStorage(t *testing.T) {
+	ctx := context.Background()
+	c16 := cidr.MustParseCIDR("10.0.0.0/16")
+	c17 := cidr.MustParseCIDR("10.0.0.0/17")
+	c17Upper := cidr.MustParseCIDR("10.0.128.0/17")
+	t.Run("ReadYourWrites", func(t *testing.T) {
+		s := testStorage(t, storage.Record{PoolID: 1, C: c16})
+		tx, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		require.NoError(t, tx.Delete(ctx, 1, c16))
+		require.NoError(t, tx.InsertMany(ctx, []storage.Record{
+			{PoolID: 1, C: c17, RequestID: "a"},
+			{PoolID: 1, C: c17Upper},
+		}))
+		records, err := tx.FindAllocated(ctx, 1, "a")
+		require.NoError(t, err)
+		assert.Equal(t, []storage.Record{{PoolID: 1, C: c17, RequestID: "a"}}, records)
+		record, err := tx.FindSmallestFree(ctx, 1, cidr.IPv4, 24)
+		require.NoError(t, err)
+		assert.Equal(t, &storage.Record{PoolID: 1, C: c17Upper}, record)
+		record, err = tx.FindSmallestFree(ctx, 1, cidr.IPv6, 24)
+		require.NoError(t, err)
+		assert.Nil(t, record)
+		record, err = tx.FindSmallestFree(ctx, 1, cidr.IPv4, 24)
+		require.NoError(t, err)
+		assert.Equal(t, &storage.Record{PoolID: 1, C: c17Upper}, record)
+		record, err = tx.Get(ctx, 1, c16)
+		require.NoError(t, err)
+		assert.Nil(t, record)
+		require.NoError(t, tx.Commit())
+	})
+	t.Run("Isolation", func(t *testing.T) {
+		s := testStorage(t, storage.Record{PoolID: 1, C: c16})
+		tx1, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		tx2, err := s.BeginTransaction(ctx, &sql.TxOptions{ReadOnly: true})
+		require.NoError(t, err)
+		require.NoError(t, tx1.Update(ctx, storage.Record{PoolID: 1, C: c16, RequestID: "a"}))
+		require.NoError(t, tx1.Commit())
+		record, err := tx2.Get(ctx, 1, c16)
+		require.NoError(t, err)
+		assert.Equal(t, "", record.RequestID)
+		require.NoError(t, tx2.Commit())
+	})
+	t.Run("SerializationFailure", func(t *testing.T) {
+		s := testStorage(t, storage.Record{PoolID: 1, C: c16})
+		tx1, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		tx2, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		for _, tx := range []storage.Transaction{tx1, tx2} {
+			record, err := tx.FindSmallestFree(ctx, 1, cidr.IPv4, 16)
+			require.NoError(t, err)
+			require.NotNil(t, record)
+		}
+		require.NoError(t, tx1.Update(ctx, storage.Record{PoolID: 1, C: c16, RequestID: "a"}))
+		require.NoError(t, tx2.Update(ctx, storage.Record{PoolID: 1, C: c16, RequestID: "b"}))
+		require.NoError(t, tx1.Commit())
+		err = tx2.Commit()
+		assert.ErrorIs(t, err, ErrSerializationFailure)
+		assert.True(t, s.IsRetryable(err))
+	})
+	t.Run("UniqueViolation", func(t *testing.T) {
+		s := testStorage(t, storage.Record{PoolID: 1, C: c17}, storage.Record{PoolID: 1, C: c17Upper})
+		tx1, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		tx2, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		require.NoError(t, tx1.Update(ctx, storage.Record{PoolID: 1, C: c17, RequestID: "a"}))
+		require.NoError(t, tx2.Update(ctx, storage.Record{PoolID: 1, C: c17Upper, RequestID: "a"}))
+		require.NoError(t, tx1.Commit())
+		err = tx2.Commit()
+		assert.ErrorIs(t, err, ErrUniqueViolation)
+	})
+	t.Run("Hosts", func(t *testing.T) {
+		s := testStorage(t, storage.Record{PoolID: 1, C: c16, RequestID: "a"})
+		tx, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		require.Error(t, tx.InsertHostSubnet(ctx, storage.HostSubnet{PoolID: 1, C: c17, Used: []byte{0}}))
+		require.NoError(t, tx.InsertHostSubnet(ctx, storage.HostSubnet{PoolID: 1, C: c16, Used: []byte{0}}))
+		host := storage.Host{PoolID: 1, Subnet: c16, IP: c16.IP, RequestID: "x"}
+		require.NoError(t, tx.InsertHost(ctx, host))
+		assert.ErrorIs(t, tx.InsertHost(ctx, storage.Host{PoolID: 1, Subnet: c16, IP: c16.IP, RequestID: "y"}),
+			ErrUniqueViolation)
+		require.NoError(t, tx.Commit())
+
+		// Concurrent writes of the same host subnet conflict.
+		tx1, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		tx2, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		for _, tx := range []storage.Transaction{tx1, tx2} {
+			hostSubnet, err := tx.GetHostSubnet(ctx, 1, c16)
+			require.NoError(t, err)
+			hostSubnet.Used[0] = 1
+			require.NoError(t, tx.UpdateHostSubnet(ctx, *hostSubnet))
+		}
+		require.NoError(t, tx1.Commit())
+		assert.ErrorIs(t, tx2.Commit(), ErrSerializationFailure)
+
+		// Deleting a record deletes its host subnet and hosts, even if the record is inserted again.
+		tx, err = s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		found, err := tx.FindHost(ctx, 1, c16, "x")
+		require.NoError(t, err)
+		assert.Equal(t, &host, found)
+		require.NoError(t, tx.Delete(ctx, 1, c16))
+		require.NoError(t, tx.InsertMany(ctx, []storage.Record{{PoolID: 1, C: c16}}))
+		require.NoError(t, tx.Commit())
+		tx, err = s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		hostSubnet, err := tx.GetHostSubnet(ctx, 1, c16)
+		require.NoError(t, err)
+		assert.Nil(t, hostSubnet)
+		hosts, err := tx.ListHosts(ctx, 1, c16)
+		require.NoError(t, err)
+		assert.Empty(t, hosts)
+		require.NoError(t, tx.Rollback())
+	})
+	t.Run("Rollback", func(t *testing.T) {
+		s := testStorage(t, storage.Record{PoolID: 1, C: c16})
+		tx, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		require.NoError(t, tx.Delete(ctx, 1, c16))
+		require.NoError(t, tx.Rollback())
+		assert.ErrorIs(t, tx.Commit(), ErrTxDone)
+		tx, err = s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		record, err := tx.Get(ctx, 1, c16)
+		require.NoError(t, err)
+		assert.NotNil(t, record)
+		require.NoError(t, tx.Rollback())
+	})
+	t.Run("Events", func(t *testing.T) {
+		s := testStorage(t)
+		tx, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		require.NoError(t, tx.InsertEvents(ctx, []storage.Event{{PoolID: 1, Type: storage.EventSplit, C: c16}}))
+		require.NoError(t, tx.Rollback())
+		tx, err = s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		require.NoError(t, tx.InsertEvents(ctx, []storage.Event{
+			{PoolID: 1, Type: storage.EventAllocate, C: c17, RequestID: "a"},
+			{PoolID: 1, Type: storage.EventAllocate, C: c17Upper, RequestID: "b"},
+		}))
+		events, err := tx.ListEvents(ctx, 1, storage.EventFilter{RequestID: "b"})
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, int64(3), events[0].ID)
+		require.NoError(t, tx.Commit())
+		tx, err = s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		events, err = tx.ListEvents(ctx, 1, storage.EventFilter{Overlapping: &c16})
+		require.NoError(t, err)
+		assert.Len(t, events, 2)
+		events, err = tx.ListEvents(ctx, 1, storage.EventFilter{Overlapping: &c17Upper})
+		require.NoError(t, err)
+		assert.Len(t, events, 1)
+		require.NoError(t, tx.DeletePool(ctx, 1))
+		assert.ErrorContains(t, tx.InsertEvents(ctx, []storage.Event{{PoolID: 1}}), "pool 1 does not exist")
+		require.NoError(t, tx.Commit())
+		// The events of a deleted pool are kept, and its ID is not used again.
+		tx, err = s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		events, err = tx.ListEvents(ctx, 1, storage.EventFilter{})
+		require.NoError(t, err)
+		assert.Len(t, events, 2)
+		maxPoolID, err := tx.MaxPoolID(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 1, maxPoolID)
+		assert.ErrorContains(t, tx.InsertPool(ctx, storage.Pool{ID: 1, Name: "pool1"}), "pool 1 was deleted")
+		require.NoError(t, tx.Rollback())
+	})
+	t.Run("EventOrder", func(t *testing.T) {
+		s := testStorage(t)
+		tx1, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		require.NoError(t, tx1.InsertEvents(ctx, []storage.Event{{PoolID: 1, Type: storage.EventAllocate, C: c17}}))
+		tx2, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		require.NoError(t, tx2.InsertEvents(ctx, []storage.Event{{PoolID: 1, Type: storage.EventAllocate, C: c17Upper}}))
+		require.NoError(t, tx2.Commit())
+		// The event of tx1 has a smaller ID than the committed event of tx2.
+		assert.ErrorIs(t, tx1.Commit(), ErrSerializationFailure)
+	})
+	t.Run("Errors", func(t *testing.T) {
+		s := testStorage(t, storage.Record{PoolID: 1, C: c16})
+		tx, err := s.BeginTransaction(ctx, &sql.TxOptions{ReadOnly: true})
+		require.NoError(t, err)
+		assert.ErrorContains(t, tx.Delete(ctx, 1, c16), "read-only")
+		require.NoError(t, tx.Rollback())
+		tx, err = s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		assert.ErrorContains(t, tx.InsertMany(ctx, []storage.Record{{PoolID: 1, C: c16}}), "already exists")
+		assert.ErrorContains(t, tx.InsertMany(ctx, []storage.Record{{PoolID: 2, C: c16}}), "pool 2 does not exist")
+		assert.ErrorContains(t, tx.Delete(ctx, 1, c17), "does not exist")
+		require.NoError(t, tx.Rollback())
+	})
+}
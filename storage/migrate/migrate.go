@@ -0,0 +1,282 @@
+// Package migrate applies forward-only, numbered schema migrations to a SQL database.
+//
+// Migrations are SQL files named <version>_<name>.sql (e.g. 0001_initial.sql), usually embedded with embed.FS.
+// Applied migrations are recorded in the table schema_version. Each migration is applied in its own transaction,
+// and a Locker prevents concurrent migrators from racing.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// schemaVersionDDL creates the table that records applied migrations. It is portable between Postgres and SQLite.
+const schemaVersionDDL = `CREATE TABLE IF NOT EXISTS schema_version (
+	version INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at TIMESTAMP NOT NULL
+)`
+
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Status is the status of a migration.
+type Status struct {
+	Migration
+	// AppliedAt is the time the migration was applied, or nil if the migration is pending.
+	AppliedAt *time.Time
+}
+
+// Locker acquires a lock that excludes concurrent migrators.
+type Locker interface {
+	// Lock blocks until the lock is acquired using conn, and returns a function that releases the lock.
+	Lock(ctx context.Context, conn *sql.Conn) (unlock func(ctx context.Context) error, err error)
+}
+
+// LockerFunc is an adapter to allow the use of ordinary functions as Lockers.
+type LockerFunc func(ctx context.Context, conn *sql.Conn) (unlock func(ctx context.Context) error, err error)
+
+func (f LockerFunc) Lock(ctx context.Context, conn *sql.Conn) (unlock func(ctx context.Context) error, err error) {
+	return f(ctx, conn)
+}
+
+// Load loads the migrations in the root directory of fsys, ordered by version.
+// Returns an error if a file name is malformed or two migrations have the same version.
+func Load(fsys fs.FS) (migrations []Migration, err error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+		base := strings.TrimSuffix(entry.Name(), ".sql")
+		versionString, name, ok := strings.Cut(base, "_")
+		version, parseErr := strconv.Atoi(versionString)
+		if !ok || parseErr != nil || version <= 0 || name == "" {
+			return nil, fmt.Errorf(`migration file name %#v is not of the form <version>_<name>.sql`, entry.Name())
+		}
+		var data []byte
+		data, err = fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return
+		}
+		migrations = append(migrations, Migration{
+			Version: version,
+			Name:    name,
+			SQL:     string(data),
+		})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i-1].Version == migrations[i].Version {
+			return nil, fmt.Errorf(`duplicate migration version %d`, migrations[i].Version)
+		}
+	}
+	return
+}
+
+type Migrator struct {
+	db          *sql.DB
+	locker      Locker
+	logger      zerolog.Logger
+	migrations  []Migration
+	legacyQuery string
+}
+
+type Option func(*Migrator)
+
+// WithLogger sets the logger used to log applied migrations.
+func WithLogger(logger zerolog.Logger) Option {
+	return func(m *Migrator) {
+		m.logger = logger
+	}
+}
+
+// WithLegacyCheck makes Up refuse to migrate a database that has no applied migrations if query returns a count
+// greater than zero. query should count the tables that a database has if its schema was created without migrations,
+// because the first migration would not bring such a schema up to date.
+func WithLegacyCheck(query string) Option {
+	return func(m *Migrator) {
+		m.legacyQuery = query
+	}
+}
+
+// New returns a Migrator that applies migrations to db.
+// migrations must be ordered by version (see Load).
+func New(db *sql.DB, migrations []Migration, locker Locker, opts ...Option) *Migrator {
+	m := &Migrator{
+		db:         db,
+		locker:     locker,
+		logger:     log.Logger,
+		migrations: migrations,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Status returns the status of all migrations, ordered by version.
+func (m *Migrator) Status(ctx context.Context) (statuses []Status, err error) {
+	err = m.withConn(ctx, func(conn *sql.Conn) (err error) {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return
+		}
+		for _, migration := range m.migrations {
+			status := Status{Migration: migration}
+			if appliedAt, ok := applied[migration.Version]; ok {
+				status.AppliedAt = &appliedAt
+			}
+			statuses = append(statuses, status)
+		}
+		return
+	})
+	return
+}
+
+// Up applies all pending migrations, in order of version, and returns the applied migrations.
+// Returns an error if the database has applied a migration that is unknown to m, which means the database
+// was migrated by a newer version of this program, or if the database has a schema that was created without migrations
+// (see WithLegacyCheck).
+func (m *Migrator) Up(ctx context.Context) (appliedNow []Migration, err error) {
+	err = m.withConn(ctx, func(conn *sql.Conn) (err error) {
+		unlock, err := m.locker.Lock(ctx, conn)
+		if err != nil {
+			return
+		}
+		defer func() {
+			if unlockErr := unlock(ctx); unlockErr != nil && err == nil {
+				err = unlockErr
+			}
+		}()
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return
+		}
+		known := map[int]struct{}{}
+		for _, migration := range m.migrations {
+			known[migration.Version] = struct{}{}
+		}
+		for version := range applied {
+			if _, ok := known[version]; !ok {
+				return fmt.Errorf(`database has applied unknown migration version %d, it was migrated by a newer program`, version)
+			}
+		}
+		if len(applied) == 0 && m.legacyQuery != "" {
+			var count int
+			if err = conn.QueryRowContext(ctx, m.legacyQuery).Scan(&count); err != nil {
+				return
+			}
+			if count > 0 {
+				return fmt.Errorf(`database has tables that were not created by migrations, upgrade its schema to ` +
+					`the first migration by hand and record it in schema_version, or migrate a new database`)
+			}
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			var ok bool
+			if ok, err = m.apply(ctx, conn, migration); err != nil {
+				return
+			}
+			if ok {
+				appliedNow = append(appliedNow, migration)
+			}
+		}
+		return
+	})
+	return
+}
+
+// applied creates the schema_version table if needed, and returns the applied versions and when they were applied.
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (applied map[int]time.Time, err error) {
+	if _, err = conn.ExecContext(ctx, schemaVersionDDL); err != nil {
+		return
+	}
+	rows, err := conn.QueryContext(ctx, `SELECT version,applied_at FROM schema_version`)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+	applied = map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err = rows.Scan(&version, &appliedAt); err != nil {
+			return
+		}
+		applied[version] = appliedAt
+	}
+	err = rows.Err()
+	return
+}
+
+// apply applies migration in a transaction, unless it was already applied. Returns true if migration was applied.
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, migration Migration) (ok bool, err error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				m.logger.Error().Err(rollbackErr).Msg("error rolling back migration")
+			}
+			return
+		}
+		err = tx.Commit()
+	}()
+	// Check again inside the transaction, in case the Locker does not exclude all concurrent migrators.
+	var count int
+	if err = tx.QueryRowContext(ctx, `SELECT COUNT(*) FROM schema_version WHERE version=$1`, migration.Version).Scan(&count); err != nil {
+		return
+	}
+	if count > 0 {
+		return
+	}
+	ok = true
+	m.logger.Info().Int("version", migration.Version).Str("name", migration.Name).Msg("applying migration")
+	if _, err = tx.ExecContext(ctx, migration.SQL); err != nil {
+		err = fmt.Errorf(`error applying migration %d_%s: %w`, migration.Version, migration.Name, err)
+		return
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO schema_version (version,name,applied_at) VALUES ($1,$2,$3)`,
+		migration.Version, migration.Name, time.Now().UTC())
+	return
+}
+
+func (m *Migrator) withConn(ctx context.Context, f func(conn *sql.Conn) error) (err error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := conn.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+	return f(conn)
+}
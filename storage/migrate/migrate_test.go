@@ -0,0 +1,117 @@
+package migrate_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	// Register sqlite3 driver
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jbrekelmans/go-sql-ip-management/storage/migrate"
+)
+
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "test.db")+"?_busy_timeout=5000&_txlock=immediate")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, db.Close())
+	})
+	return db
+}
+
+func noLock(ctx context.Context, conn *sql.Conn) (func(ctx context.Context) error, error) {
+	return func(ctx context.Context) error { return nil }, nil
+}
+
+func Test_Load(t *testing.T) {
+	migrations, err := migrate.Load(fstest.MapFS{
+		"0002_second.sql": {Data: []byte("CREATE TABLE b (x INTEGER)")},
+		"0001_first.sql":  {Data: []byte("CREATE TABLE a (x INTEGER)")},
+		"README.md":       {Data: []byte("ignored")},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []migrate.Migration{
+		{Version: 1, Name: "first", SQL: "CREATE TABLE a (x INTEGER)"},
+		{Version: 2, Name: "second", SQL: "CREATE TABLE b (x INTEGER)"},
+	}, migrations)
+	_, err = migrate.Load(fstest.MapFS{"first.sql": {}})
+	assert.Error(t, err)
+	_, err = migrate.Load(fstest.MapFS{"0001_a.sql": {}, "1_b.sql": {}})
+	assert.Error(t, err)
+}
+
+func Test_Migrator(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	migrations := []migrate.Migration{
+		{Version: 1, Name: "first", SQL: "CREATE TABLE a (x INTEGER); INSERT INTO a VALUES (1)"},
+		{Version: 2, Name: "second", SQL: "CREATE TABLE b (x INTEGER)"},
+	}
+	m := migrate.New(db, migrations[:1], migrate.LockerFunc(noLock), migrate.WithLogger(zerolog.Nop()))
+	statuses, err := m.Status(ctx)
+	require.NoError(t, err)
+	require.Len(t, statuses, 1)
+	assert.Nil(t, statuses[0].AppliedAt)
+	applied, err := m.Up(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, migrations[:1], applied)
+	applied, err = m.Up(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+
+	m = migrate.New(db, migrations, migrate.LockerFunc(noLock), migrate.WithLogger(zerolog.Nop()))
+	applied, err = m.Up(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, migrations[1:], applied)
+	statuses, err = m.Status(ctx)
+	require.NoError(t, err)
+	require.Len(t, statuses, 2)
+	assert.NotNil(t, statuses[0].AppliedAt)
+	assert.NotNil(t, statuses[1].AppliedAt)
+
+	// A database migrated by a newer program is refused.
+	m = migrate.New(db, migrations[:1], migrate.LockerFunc(noLock), migrate.WithLogger(zerolog.Nop()))
+	_, err = m.Up(ctx)
+	assert.Error(t, err)
+
+	// A failing migration is rolled back.
+	m = migrate.New(db, append(migrations, migrate.Migration{Version: 3, Name: "bad", SQL: "CREATE TABLE c (x INTEGER); SYNTAX ERROR"}),
+		migrate.LockerFunc(noLock), migrate.WithLogger(zerolog.Nop()))
+	_, err = m.Up(ctx)
+	assert.Error(t, err)
+	statuses, err = m.Status(ctx)
+	require.NoError(t, err)
+	assert.Nil(t, statuses[2].AppliedAt)
+	_, err = db.ExecContext(ctx, "SELECT * FROM c")
+	assert.Error(t, err)
+}
+
+func Test_Migrator_WithLegacyCheck(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+	migrations := []migrate.Migration{
+		{Version: 1, Name: "first", SQL: "CREATE TABLE a (x INTEGER)"},
+	}
+	m := migrate.New(db, migrations, migrate.LockerFunc(noLock), migrate.WithLogger(zerolog.Nop()),
+		migrate.WithLegacyCheck(`SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='a'`))
+	_, err := db.ExecContext(ctx, "CREATE TABLE a (x INTEGER)")
+	require.NoError(t, err)
+	_, err = m.Up(ctx)
+	assert.ErrorContains(t, err, "not created by migrations")
+
+	_, err = db.ExecContext(ctx, "DROP TABLE a")
+	require.NoError(t, err)
+	applied, err := m.Up(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, migrations, applied)
+	applied, err = m.Up(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+}
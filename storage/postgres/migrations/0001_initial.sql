@@ -0,0 +1,20 @@
+CREATE TABLE ip_pool (
+    pool_id SMALLINT PRIMARY KEY CHECK (pool_id > 0),
+    pool_name TEXT NOT NULL UNIQUE CHECK (length(pool_name) > 0)
+);
+
+CREATE TABLE ip_range (
+	pool_id SMALLINT NOT NULL REFERENCES ip_pool(pool_id),
+	c CIDR NOT NULL,
+	request_id TEXT CHECK (request_id IS NULL OR length(request_id) > 0),
+	retired BOOLEAN NOT NULL DEFAULT FALSE,
+	PRIMARY KEY (pool_id, c)
+);
+
+CREATE UNIQUE INDEX ip_range_request_id ON ip_range (
+	pool_id, family(c), request_id
+) WHERE request_id IS NOT NULL;
+
+CREATE INDEX ip_range_free ON ip_range (
+	pool_id, family(c), masklen(c)
+) WHERE request_id IS NULL AND NOT retired;
@@ -0,0 +1,5 @@
+ALTER TABLE ip_range ADD COLUMN expires_at TIMESTAMPTZ CHECK (expires_at IS NULL OR request_id IS NOT NULL);
+
+CREATE INDEX ip_range_expires_at ON ip_range (
+	pool_id, expires_at
+) WHERE expires_at IS NOT NULL;
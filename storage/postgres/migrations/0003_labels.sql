@@ -0,0 +1,3 @@
+ALTER TABLE ip_range ADD COLUMN labels JSONB CHECK (labels IS NULL OR (request_id IS NOT NULL AND jsonb_typeof(labels) = 'object'));
+
+CREATE INDEX ip_range_labels ON ip_range USING GIN (labels jsonb_path_ops) WHERE labels IS NOT NULL;
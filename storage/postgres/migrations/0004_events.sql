@@ -0,0 +1,15 @@
+CREATE TABLE ip_range_event (
+	event_id BIGSERIAL PRIMARY KEY,
+	pool_id SMALLINT NOT NULL REFERENCES ip_pool(pool_id),
+	event_time TIMESTAMPTZ NOT NULL,
+	event_type TEXT NOT NULL CHECK (event_type IN ('allocate', 'release', 'split', 'merge')),
+	c CIDR NOT NULL,
+	request_id TEXT CHECK (request_id IS NULL OR length(request_id) > 0),
+	actor TEXT
+);
+
+CREATE INDEX ip_range_event_c ON ip_range_event USING GIST (c inet_ops);
+
+CREATE INDEX ip_range_event_request_id ON ip_range_event (
+	pool_id, request_id
+) WHERE request_id IS NOT NULL;
@@ -0,0 +1,24 @@
+-- ip_range_version keeps every version of the rows of ip_range. A version is valid from valid_from (inclusive) until
+-- valid_to (exclusive), which is NULL for the current version of a row. Both are the time of the transaction that
+-- wrote the version.
+CREATE TABLE ip_range_version (
+	pool_id SMALLINT NOT NULL REFERENCES ip_pool(pool_id),
+	c CIDR NOT NULL,
+	request_id TEXT,
+	retired BOOLEAN NOT NULL,
+	expires_at TIMESTAMPTZ,
+	labels JSONB,
+	valid_from TIMESTAMPTZ NOT NULL,
+	valid_to TIMESTAMPTZ
+);
+
+CREATE INDEX ip_range_version_current ON ip_range_version (
+	pool_id, c
+) WHERE valid_to IS NULL;
+
+CREATE INDEX ip_range_version_valid_from ON ip_range_version (
+	pool_id, valid_from
+);
+
+INSERT INTO ip_range_version(pool_id,c,request_id,retired,expires_at,labels,valid_from)
+SELECT pool_id,c,request_id,retired,expires_at,labels,now() FROM ip_range;
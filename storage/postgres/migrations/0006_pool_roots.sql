@@ -0,0 +1,11 @@
+-- ip_pool_root keeps the root ranges of each pool: the ranges added when creating the pool or by adding ranges to it,
+-- minus the ranges removed by retiring them. The rows of ip_range of a pool tile the union of its roots.
+-- Existing pools get their current ranges as roots.
+CREATE TABLE ip_pool_root (
+	pool_id SMALLINT NOT NULL REFERENCES ip_pool(pool_id),
+	c CIDR NOT NULL,
+	PRIMARY KEY (pool_id, c)
+);
+
+INSERT INTO ip_pool_root(pool_id,c)
+SELECT pool_id,c FROM ip_range;
@@ -0,0 +1,16 @@
+-- moved_from is the range that the allocation of a row is being moved from, which has the same size and is allocated
+-- to the same request until the move completes. A request has at most one row of each family that is not being moved
+-- to, and at most one row of each family that is being moved to.
+ALTER TABLE ip_range ADD COLUMN moved_from CIDR CHECK (moved_from IS NULL OR (request_id IS NOT NULL AND masklen(moved_from) = masklen(c)));
+
+ALTER TABLE ip_range_version ADD COLUMN moved_from CIDR;
+
+DROP INDEX ip_range_request_id;
+
+CREATE UNIQUE INDEX ip_range_request_id ON ip_range (
+	pool_id, family(c), request_id
+) WHERE request_id IS NOT NULL AND moved_from IS NULL;
+
+CREATE UNIQUE INDEX ip_range_moved_request_id ON ip_range (
+	pool_id, family(c), request_id
+) WHERE moved_from IS NOT NULL;
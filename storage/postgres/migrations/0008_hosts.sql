@@ -0,0 +1,23 @@
+-- ip_host_subnet keeps the allocated ranges from which individual host addresses are allocated. used is a bitmap of
+-- the addresses of the range that are allocated or reserved: bit i, counting from the most significant bit of the
+-- first byte, is set if the i-th address of the range is used. Deleting the range, which deallocating it does,
+-- deletes the subnet and its hosts.
+CREATE TABLE ip_host_subnet (
+	pool_id SMALLINT NOT NULL,
+	c CIDR NOT NULL,
+	gateway INET CHECK (gateway IS NULL OR gateway <<= c),
+	used BYTEA NOT NULL,
+	PRIMARY KEY (pool_id, c),
+	FOREIGN KEY (pool_id, c) REFERENCES ip_range(pool_id, c) ON DELETE CASCADE
+);
+
+-- ip_host keeps the host addresses allocated from the subnets, at most one per request and subnet.
+CREATE TABLE ip_host (
+	pool_id SMALLINT NOT NULL,
+	subnet CIDR NOT NULL,
+	ip INET NOT NULL CHECK (ip <<= subnet),
+	request_id TEXT NOT NULL CHECK (length(request_id) > 0),
+	PRIMARY KEY (pool_id, subnet, request_id),
+	UNIQUE (pool_id, subnet, ip),
+	FOREIGN KEY (pool_id, subnet) REFERENCES ip_host_subnet(pool_id, c) ON DELETE CASCADE
+);
@@ -0,0 +1,7 @@
+-- The allocations and deallocations of host addresses are recorded as allocate_host and release_host events, whose c
+-- is the host address.
+ALTER TABLE ip_range_event DROP CONSTRAINT ip_range_event_event_type_check;
+
+ALTER TABLE ip_range_event ADD CONSTRAINT ip_range_event_event_type_check CHECK (
+	event_type IN ('allocate', 'release', 'split', 'merge', 'allocate_host', 'release_host')
+);
@@ -0,0 +1,9 @@
+-- Deleted pools are kept as tombstones, with the time they were deleted in deleted_at, so that their IDs are not
+-- reused and their events and range versions are kept. Only the names of pools that are not deleted must be unique.
+ALTER TABLE ip_pool ADD COLUMN deleted_at TIMESTAMPTZ;
+
+ALTER TABLE ip_pool DROP CONSTRAINT ip_pool_pool_name_key;
+
+CREATE UNIQUE INDEX ip_pool_pool_name ON ip_pool (
+	pool_name
+) WHERE deleted_at IS NULL;
@@ -0,0 +1,6 @@
+-- Retiring a range and removing a range from its pool are recorded as retire and remove events.
+ALTER TABLE ip_range_event DROP CONSTRAINT ip_range_event_event_type_check;
+
+ALTER TABLE ip_range_event ADD CONSTRAINT ip_range_event_event_type_check CHECK (
+	event_type IN ('allocate', 'release', 'split', 'merge', 'allocate_host', 'release_host', 'retire', 'remove')
+);
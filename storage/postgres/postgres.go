@@ -0,0 +1,921 @@
+package postgres
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/stdlib"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+	"github.com/jbrekelmans/go-sql-ip-management/storage/migrate"
+)
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// recordColumns are the columns scanned by scanRecord.
+const recordColumns = `c,request_id,retired,expires_at,labels,moved_from`
+
+// eventColumns are the columns scanned by ListEvents.
+const eventColumns = `event_id,event_time,event_type,c,request_id,actor`
+
+// migrationLockKey identifies the advisory lock that excludes concurrent migrators.
+const migrationLockKey = 0x69_70_61_6d // "ipam"
+
+// poolLockKey and the pool ID are the two int4 keys of the advisory lock of a pool (see lockPool), whose lock space is
+// separate from that of the single bigint key of migrationLockKey.
+const poolLockKey = 0x69_70_70_6c // "ippl"
+
+// notifyChannel is the channel of the notifications of committed allocate and release events.
+// The payload is the pool ID.
+const notifyChannel = "ipam_events"
+
+// legacyTablesQuery counts the tables of the schema that ddl_postgres.sql created before migrations were introduced.
+const legacyTablesQuery = `SELECT COUNT(*) FROM information_schema.tables
+WHERE table_schema=current_schema() AND table_name IN ('ip_pool','ip_range')`
+
+// NewMigrator returns a migrator for the tables and indexes used by SQLStorage.
+// Concurrent migrators are excluded using a Postgres advisory lock. Databases whose schema was created by
+// ddl_postgres.sql are refused, because migrations cannot upgrade them.
+func NewMigrator(db *sql.DB, opts ...migrate.Option) (*migrate.Migrator, error) {
+	fsys, err := fs.Sub(migrationsFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := migrate.Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]migrate.Option{migrate.WithLegacyCheck(legacyTablesQuery)}, opts...)
+	return migrate.New(db, migrations, migrate.LockerFunc(advisoryLock), opts...), nil
+}
+
+// advisoryLock implements migrate.Locker using a session-level Postgres advisory lock.
+func advisoryLock(ctx context.Context, conn *sql.Conn) (unlock func(ctx context.Context) error, err error) {
+	if _, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return
+	}
+	unlock = func(ctx context.Context) error {
+		_, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+		return err
+	}
+	return
+}
+
+type SQLStorage struct {
+	db *sql.DB
+}
+
+var _ storage.Storage = (*SQLStorage)(nil)
+var _ storage.RetryClassifier = (*SQLStorage)(nil)
+var _ storage.Watcher = (*SQLStorage)(nil)
+
+func NewSQLStorage(db *sql.DB) *SQLStorage {
+	return &SQLStorage{
+		db: db,
+	}
+}
+
+func (s *SQLStorage) BeginTransaction(ctx context.Context, txOpts *sql.TxOptions) (storage.Transaction, error) {
+	tx, err := s.db.BeginTx(ctx, txOpts)
+	if err != nil {
+		return nil, err
+	}
+	return &txWrapper{
+		lockedPools: map[int]bool{},
+		tx:          tx,
+	}, nil
+}
+
+// IsRetryable implements storage.RetryClassifier.
+// Returns true if err is a Postgres error caused by concurrent transactions.
+func (s *SQLStorage) IsRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	// See https://www.postgresql.org/docs/current/errcodes-appendix.html
+	switch pgErr.Code {
+	case "40001", // Serialization Failure
+		"40P01", // Deadlock Detected
+		"23505": // Unique Violation
+		return true
+	}
+	return false
+}
+
+// Watch implements storage.Watcher using LISTEN and NOTIFY.
+// Watch holds a connection of the pool of database connections until it returns.
+func (s *SQLStorage) Watch(ctx context.Context, poolID int, afterID int64,
+	handle func(event storage.Event) error) (err error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return
+	}
+	defer func() {
+		// Discard the connection instead of returning it to the pool, because it is listening.
+		if closeErr := conn.Raw(func(driverConn any) error {
+			return driverConn.(*stdlib.Conn).Close()
+		}); closeErr != nil {
+			log.Error().Err(closeErr).Msg("error closing connection")
+		}
+		if closeErr := conn.Close(); closeErr != nil {
+			log.Error().Err(closeErr).Msg("error closing connection")
+		}
+		if ctx.Err() != nil {
+			// Errors caused by ctx wrap ctx.Err().
+			err = ctx.Err()
+		}
+	}()
+	// Listen before reading committed events, so that no commit is missed in between.
+	if _, err = conn.ExecContext(ctx, `LISTEN `+notifyChannel); err != nil {
+		return
+	}
+	payload := strconv.Itoa(poolID)
+	for {
+		var rows *sql.Rows
+		rows, err = conn.QueryContext(ctx, `SELECT `+eventColumns+` FROM public.ip_range_event
+WHERE pool_id=$1 AND event_id>$2 AND event_type IN ('allocate','release','remove','allocate_host','release_host')
+ORDER BY event_id`, poolID, afterID)
+		if err != nil {
+			return
+		}
+		var events []storage.Event
+		if events, err = scanEvents(rows, poolID); err != nil {
+			return
+		}
+		for _, event := range events {
+			if err = handle(event); err != nil {
+				return
+			}
+			afterID = event.ID
+		}
+		err = conn.Raw(func(driverConn any) error {
+			pgxConn := driverConn.(*stdlib.Conn).Conn()
+			for {
+				notification, err := pgxConn.WaitForNotification(ctx)
+				if err != nil {
+					return err
+				}
+				if notification.Payload == payload {
+					return nil
+				}
+			}
+		})
+		if err != nil {
+			return
+		}
+	}
+}
+
+type txWrapper struct {
+	// lockedPools is the set of pools locked by lockPool.
+	lockedPools map[int]bool
+	tx          *sql.Tx
+}
+
+var _ storage.Transaction = (*txWrapper)(nil)
+
+func (t *txWrapper) Commit() error {
+	return t.tx.Commit()
+}
+
+// CountRecords implements storage.Transaction.
+func (t *txWrapper) CountRecords(ctx context.Context, poolID int) (counts []storage.RecordCount, err error) {
+	rows, err := t.query(ctx, `SELECT family(c),masklen(c),request_id IS NOT NULL,retired,count(*)
+FROM public.ip_range
+WHERE pool_id=$1
+GROUP BY 1,2,3,4
+ORDER BY 1,2,3,4`, poolID)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			if err == nil {
+				err = closeErr
+			} else {
+				log.Error().Err(closeErr).Msg("error closing rows")
+			}
+		}
+	}()
+	for rows.Next() {
+		var count storage.RecordCount
+		err = rows.Scan(&count.Family, &count.PrefixBits, &count.Allocated, &count.Retired, &count.Count)
+		if err != nil {
+			return
+		}
+		counts = append(counts, count)
+	}
+	err = rows.Err()
+	return
+}
+
+func (t *txWrapper) Delete(ctx context.Context, poolID int, c cidr.CIDR) error {
+	if err := t.execContext(ctx, 1, `DELETE FROM public.ip_range WHERE pool_id=$1 AND c=$2`, poolID, c.String()); err != nil {
+		return err
+	}
+	return t.endVersion(ctx, poolID, c)
+}
+
+func (t *txWrapper) DeleteHost(ctx context.Context, poolID int, subnet cidr.CIDR, requestID string) error {
+	return t.execContext(ctx, 1, `DELETE FROM public.ip_host WHERE pool_id=$1 AND subnet=$2 AND request_id=$3`,
+		poolID, subnet.String(), requestID)
+}
+
+func (t *txWrapper) DeletePool(ctx context.Context, poolID int) error {
+	if err := t.execContext(ctx, -1, `DELETE FROM public.ip_host WHERE pool_id=$1`, poolID); err != nil {
+		return err
+	}
+	if err := t.execContext(ctx, -1, `DELETE FROM public.ip_host_subnet WHERE pool_id=$1`, poolID); err != nil {
+		return err
+	}
+	if err := t.execContext(ctx, -1, `DELETE FROM public.ip_range WHERE pool_id=$1`, poolID); err != nil {
+		return err
+	}
+	if err := t.execContext(ctx, -1, `UPDATE public.ip_range_version SET valid_to=transaction_timestamp()
+WHERE pool_id=$1 AND valid_to IS NULL`, poolID); err != nil {
+		return err
+	}
+	if err := t.execContext(ctx, -1, `DELETE FROM public.ip_pool_root WHERE pool_id=$1`, poolID); err != nil {
+		return err
+	}
+	return t.execContext(ctx, 1, `UPDATE public.ip_pool SET deleted_at=transaction_timestamp()
+WHERE pool_id=$1 AND deleted_at IS NULL`, poolID)
+}
+
+// endVersion ends the current version of the record identified by poolID and c.
+// Versions are stamped with the time of the transaction on the server, so that the clocks of clients do not matter.
+func (t *txWrapper) endVersion(ctx context.Context, poolID int, c cidr.CIDR) error {
+	return t.execContext(ctx, -1, `UPDATE public.ip_range_version SET valid_to=transaction_timestamp()
+WHERE pool_id=$1 AND c=$2 AND valid_to IS NULL`, poolID, c.String())
+}
+
+// lockPool locks the pool identified by poolID until the transaction ends, unless the transaction already locked it.
+// InsertEvents locks the pools of the events before inserting them, so that the IDs of the events of a pool are
+// assigned in the order in which the transactions commit (see storage.Event). Transactions that do not insert events
+// do not lock, so they do not wait for each other. A transaction that waits for the lock while holding row locks may
+// deadlock, which Postgres detects by failing one of the transactions with a retryable error.
+func (t *txWrapper) lockPool(ctx context.Context, poolID int) error {
+	if t.lockedPools[poolID] {
+		return nil
+	}
+	if err := t.execContext(ctx, -1, `SELECT pg_advisory_xact_lock($1,$2)`, poolLockKey, poolID); err != nil {
+		return err
+	}
+	t.lockedPools[poolID] = true
+	return nil
+}
+
+// execContext executes a statement and checks that it affected expectedRowsAffected rows.
+// If expectedRowsAffected is negative then the number of affected rows is not checked.
+func (t *txWrapper) execContext(ctx context.Context, expectedRowsAffected int, query string, args ...any) error {
+	log.Debug().Str("q", query).Any("qv", args).Msg("executing statement")
+	result, err := t.tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	actualRowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if expectedRowsAffected >= 0 && expectedRowsAffected != int(actualRowsAffected) {
+		return fmt.Errorf(`statement affected unexpected number of rows %d (expected %d)`, actualRowsAffected, expectedRowsAffected)
+	}
+	return nil
+}
+
+func (t *txWrapper) FindAllocated(ctx context.Context, poolID int, requestID string) (records []storage.Record, err error) {
+	if requestID == "" {
+		return nil, fmt.Errorf("requestID must not be empty")
+	}
+	rows, err := t.query(ctx, `SELECT `+recordColumns+` FROM public.ip_range WHERE pool_id=$1 AND request_id=$2 ORDER BY family(c)`,
+		poolID, requestID)
+	if err != nil {
+		return
+	}
+	return scanRecords(rows, poolID)
+}
+
+func (t *txWrapper) FindExpired(ctx context.Context, poolID int, now time.Time, limit int) (records []storage.Record, err error) {
+	rows, err := t.query(ctx, `SELECT `+recordColumns+` FROM public.ip_range
+WHERE pool_id=$1 AND request_id IS NOT NULL AND expires_at <= $2
+ORDER BY expires_at
+LIMIT $3`, poolID, now, limit)
+	if err != nil {
+		return
+	}
+	return scanRecords(rows, poolID)
+}
+
+func (t *txWrapper) FindOverlapping(ctx context.Context, poolID int, c cidr.CIDR) (records []storage.Record, err error) {
+	rows, err := t.query(ctx, `SELECT `+recordColumns+` FROM public.ip_range WHERE pool_id=$1 AND c && $2::cidr ORDER BY c`,
+		poolID, c.String())
+	if err != nil {
+		return
+	}
+	return scanRecords(rows, poolID)
+}
+
+func (t *txWrapper) FindHost(ctx context.Context, poolID int, subnet cidr.CIDR, requestID string) (*storage.Host,
+	error) {
+	row := t.queryRow(ctx, `SELECT ip::cidr FROM public.ip_host WHERE pool_id=$1 AND subnet=$2 AND request_id=$3`,
+		poolID, subnet.String(), requestID)
+	var ip cidr.CIDR
+	err := row.Scan(&ip)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return &storage.Host{PoolID: poolID, Subnet: subnet, IP: ip.IP, RequestID: requestID}, nil
+}
+
+func (t *txWrapper) FindSmallestFree(ctx context.Context, poolID int, family cidr.Family, prefixBits int) (*storage.Record, error) {
+	row := t.queryRow(ctx,
+		`SELECT c
+FROM public.ip_range
+WHERE pool_id=$1 AND family(c)=$2 AND request_id IS NULL AND NOT retired AND masklen(c) <= (
+	SELECT MAX(masklen(c))
+	FROM public.ip_range
+	WHERE pool_id=$1 AND family(c)=$2 AND request_id IS NULL AND NOT retired AND masklen(c) <= $3
+	)
+ORDER BY masklen(c) DESC
+LIMIT 1`, poolID, int(family), prefixBits)
+	record := &storage.Record{PoolID: poolID}
+	err := row.Scan(&record.C)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return record, nil
+}
+
+func (t *txWrapper) Get(ctx context.Context, poolID int, c cidr.CIDR) (*storage.Record, error) {
+	row := t.queryRow(ctx, `SELECT `+recordColumns+` FROM public.ip_range WHERE pool_id=$1 AND c=$2`, poolID, c.String())
+	record, err := scanRecord(row, poolID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return &record, nil
+}
+
+func (t *txWrapper) GetHostSubnet(ctx context.Context, poolID int, c cidr.CIDR) (*storage.HostSubnet, error) {
+	row := t.queryRow(ctx, `SELECT gateway::cidr,used FROM public.ip_host_subnet WHERE pool_id=$1 AND c=$2`,
+		poolID, c.String())
+	hostSubnet := &storage.HostSubnet{PoolID: poolID, C: c}
+	var gateway *cidr.CIDR
+	err := row.Scan(&gateway, &hostSubnet.Used)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	if gateway != nil {
+		hostSubnet.Gateway = gateway.IP
+	}
+	return hostSubnet, nil
+}
+
+func (t *txWrapper) GetPool(ctx context.Context, poolID int) (*storage.Pool, error) {
+	row := t.queryRow(ctx, `SELECT pool_name FROM public.ip_pool WHERE pool_id=$1 AND deleted_at IS NULL`, poolID)
+	pool := &storage.Pool{ID: poolID}
+	err := row.Scan(&pool.Name)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return pool, nil
+}
+
+// InsertMany implements storage.Transaction.
+// The records and their first versions are inserted in one statement.
+func (t *txWrapper) InsertMany(ctx context.Context, records []storage.Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	var statementBuilder bytes.Buffer
+	statementBuilder.WriteString(`WITH inserted AS (
+INSERT INTO public.ip_range(pool_id,c,request_id,retired,expires_at,labels,moved_from) VALUES `)
+	statementArgs := make([]any, 0, len(records)*2+4)
+	placeholderCounter := 1
+	nextPlaceholder := func() string {
+		p := fmt.Sprintf("$%d", placeholderCounter)
+		placeholderCounter++
+		return p
+	}
+	intPlaceholders := make(map[int]string)
+	boolPlaceholders := make(map[bool]string)
+	addStatementArg := func(a any) {
+		switch aTyped := a.(type) {
+		case nil:
+			// A literal, because a shared placeholder would be deduced to have inconsistent types across columns.
+			statementBuilder.WriteString("NULL")
+		case int:
+			p, ok := intPlaceholders[aTyped]
+			if !ok {
+				p = nextPlaceholder()
+				intPlaceholders[aTyped] = p
+				statementArgs = append(statementArgs, aTyped)
+			}
+			statementBuilder.WriteString(p)
+		case bool:
+			p, ok := boolPlaceholders[aTyped]
+			if !ok {
+				p = nextPlaceholder()
+				boolPlaceholders[aTyped] = p
+				statementArgs = append(statementArgs, aTyped)
+			}
+			statementBuilder.WriteString(p)
+		default:
+			// TODO use nil placeholder if value is another type of nil
+			statementBuilder.WriteString(nextPlaceholder())
+			statementArgs = append(statementArgs, a)
+		}
+	}
+	for _, record := range records {
+		statementBuilder.WriteByte('(')
+		addStatementArg(record.PoolID)
+		statementBuilder.WriteByte(',')
+		addStatementArg(record.C.String())
+		statementBuilder.WriteByte(',')
+		addStatementArg(emptyStringToNil(record.RequestID))
+		statementBuilder.WriteByte(',')
+		addStatementArg(record.Retired)
+		statementBuilder.WriteByte(',')
+		addStatementArg(timeOrNil(record.ExpiresAt))
+		statementBuilder.WriteByte(',')
+		addStatementArg(labelsToJSON(record.Labels))
+		statementBuilder.WriteByte(',')
+		addStatementArg(cidrOrNil(record.MovedFrom))
+		statementBuilder.WriteString("),")
+	}
+	statementBuilder.Truncate(statementBuilder.Len() - 1)
+	statementBuilder.WriteString(`
+RETURNING pool_id,c,request_id,retired,expires_at,labels,moved_from
+)
+INSERT INTO public.ip_range_version(pool_id,c,request_id,retired,expires_at,labels,moved_from,valid_from)
+SELECT pool_id,c,request_id,retired,expires_at,labels,moved_from,transaction_timestamp() FROM inserted`)
+	return t.execContext(ctx, len(records), statementBuilder.String(), statementArgs...)
+}
+
+// InsertEvents implements storage.Transaction.
+// Watchers of the pools of watched events (see storage.EventType.IsWatched) are notified when the transaction commits.
+func (t *txWrapper) InsertEvents(ctx context.Context, events []storage.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	notifyPools := map[int]bool{}
+	for _, event := range events {
+		if err := t.lockPool(ctx, event.PoolID); err != nil {
+			return err
+		}
+		if event.Type.IsWatched() {
+			notifyPools[event.PoolID] = true
+		}
+	}
+	for poolID := range notifyPools {
+		// Notifications are delivered when the transaction commits, and not at all if it is rolled back.
+		if err := t.execContext(ctx, -1, `SELECT pg_notify($1,$2)`, notifyChannel, strconv.Itoa(poolID)); err != nil {
+			return err
+		}
+	}
+	var statementBuilder bytes.Buffer
+	statementBuilder.WriteString(`INSERT INTO public.ip_range_event(pool_id,event_time,event_type,c,request_id,actor) VALUES `)
+	statementArgs := make([]any, 0, len(events)*6)
+	for i, event := range events {
+		if i > 0 {
+			statementBuilder.WriteByte(',')
+		}
+		n := len(statementArgs)
+		fmt.Fprintf(&statementBuilder, "($%d,$%d,$%d,$%d,$%d::text,$%d::text)", n+1, n+2, n+3, n+4, n+5, n+6)
+		statementArgs = append(statementArgs, event.PoolID, event.Time, string(event.Type), event.C.String(),
+			emptyStringToNil(event.RequestID), emptyStringToNil(event.Actor))
+	}
+	return t.execContext(ctx, len(events), statementBuilder.String(), statementArgs...)
+}
+
+func (t *txWrapper) InsertHost(ctx context.Context, host storage.Host) error {
+	return t.execContext(ctx, 1, `INSERT INTO public.ip_host(pool_id,subnet,ip,request_id) VALUES ($1,$2,$3,$4)`,
+		host.PoolID, host.Subnet.String(), ipCIDR(host.IP), host.RequestID)
+}
+
+func (t *txWrapper) InsertHostSubnet(ctx context.Context, hostSubnet storage.HostSubnet) error {
+	return t.execContext(ctx, 1, `INSERT INTO public.ip_host_subnet(pool_id,c,gateway,used) VALUES ($1,$2,$3,$4)`,
+		hostSubnet.PoolID, hostSubnet.C.String(), ipOrNil(hostSubnet.Gateway), hostSubnet.Used)
+}
+
+func (t *txWrapper) InsertPool(ctx context.Context, pool storage.Pool) error {
+	return t.execContext(ctx, 1, `INSERT INTO public.ip_pool(pool_id,pool_name) VALUES ($1,$2)`, pool.ID, pool.Name)
+}
+
+func (t *txWrapper) ListPools(ctx context.Context) (pools []storage.Pool, err error) {
+	rows, err := t.query(ctx, `SELECT pool_id,pool_name FROM public.ip_pool WHERE deleted_at IS NULL ORDER BY pool_id`)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			if err == nil {
+				err = closeErr
+			} else {
+				log.Error().Err(closeErr).Msg("error closing rows")
+			}
+		}
+	}()
+	for rows.Next() {
+		var pool storage.Pool
+		err = rows.Scan(&pool.ID, &pool.Name)
+		if err != nil {
+			return
+		}
+		pools = append(pools, pool)
+	}
+	err = rows.Err()
+	return
+}
+
+// ListAllocations implements storage.Transaction.
+// The order of the cidr type (family, then address, then prefix length) is the order of storage.CompareAddress.
+func (t *txWrapper) ListAllocations(ctx context.Context, poolID int, filter storage.ListFilter, after *cidr.CIDR,
+	limit int) (records []storage.Record, err error) {
+	var queryBuilder bytes.Buffer
+	queryBuilder.WriteString(`SELECT ` + recordColumns + ` FROM public.ip_range WHERE pool_id=$1`)
+	args := []any{poolID}
+	addCondition := func(condition string, arg any) {
+		args = append(args, arg)
+		fmt.Fprintf(&queryBuilder, " AND "+condition, len(args))
+	}
+	if after != nil {
+		addCondition(`c > $%d::cidr`, after.String())
+	}
+	if filter.Within != nil {
+		addCondition(`c <<= $%d::cidr`, filter.Within.String())
+	}
+	if filter.MinPrefixBits > 0 {
+		addCondition(`masklen(c) >= $%d`, filter.MinPrefixBits)
+	}
+	if filter.MaxPrefixBits > 0 {
+		addCondition(`masklen(c) <= $%d`, filter.MaxPrefixBits)
+	}
+	if filter.RequestIDPrefix != "" {
+		addCondition(`starts_with(request_id, $%d)`, filter.RequestIDPrefix)
+	}
+	switch filter.State {
+	case storage.StateAllocated:
+		queryBuilder.WriteString(` AND request_id IS NOT NULL`)
+	case storage.StateFree:
+		queryBuilder.WriteString(` AND request_id IS NULL`)
+	}
+	if len(filter.Labels) > 0 {
+		addCondition(`labels @> $%d::jsonb`, labelsToJSON(filter.Labels))
+	}
+	queryBuilder.WriteString(` ORDER BY c`)
+	if limit > 0 {
+		args = append(args, limit)
+		fmt.Fprintf(&queryBuilder, ` LIMIT $%d`, len(args))
+	}
+	rows, err := t.query(ctx, queryBuilder.String(), args...)
+	if err != nil {
+		return
+	}
+	return scanRecords(rows, poolID)
+}
+
+// ListEvents implements storage.Transaction.
+// Events overlapping a CIDR are found using the GiST index ip_range_event_c.
+func (t *txWrapper) ListEvents(ctx context.Context, poolID int, filter storage.EventFilter) (events []storage.Event,
+	err error) {
+	var queryBuilder bytes.Buffer
+	queryBuilder.WriteString(`SELECT ` + eventColumns + ` FROM public.ip_range_event WHERE pool_id=$1`)
+	args := []any{poolID}
+	addCondition := func(condition string, arg any) {
+		args = append(args, arg)
+		fmt.Fprintf(&queryBuilder, " AND "+condition, len(args))
+	}
+	if filter.Overlapping != nil {
+		addCondition(`c && $%d::cidr`, filter.Overlapping.String())
+	}
+	if filter.RequestID != "" {
+		addCondition(`request_id=$%d`, filter.RequestID)
+	}
+	queryBuilder.WriteString(` ORDER BY event_id`)
+	rows, err := t.query(ctx, queryBuilder.String(), args...)
+	if err != nil {
+		return
+	}
+	return scanEvents(rows, poolID)
+}
+
+func (t *txWrapper) ListHostSubnets(ctx context.Context, poolID int) (hostSubnets []storage.HostSubnet, err error) {
+	rows, err := t.query(ctx, `SELECT c,gateway::cidr,used FROM public.ip_host_subnet WHERE pool_id=$1 ORDER BY c`,
+		poolID)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			if err == nil {
+				err = closeErr
+			} else {
+				log.Error().Err(closeErr).Msg("error closing rows")
+			}
+		}
+	}()
+	for rows.Next() {
+		hostSubnet := storage.HostSubnet{PoolID: poolID}
+		var gateway *cidr.CIDR
+		if err = rows.Scan(&hostSubnet.C, &gateway, &hostSubnet.Used); err != nil {
+			return
+		}
+		if gateway != nil {
+			hostSubnet.Gateway = gateway.IP
+		}
+		hostSubnets = append(hostSubnets, hostSubnet)
+	}
+	err = rows.Err()
+	return
+}
+
+func (t *txWrapper) ListHosts(ctx context.Context, poolID int, subnet cidr.CIDR) (hosts []storage.Host, err error) {
+	rows, err := t.query(ctx, `SELECT ip::cidr,request_id FROM public.ip_host
+WHERE pool_id=$1 AND subnet=$2
+ORDER BY ip`, poolID, subnet.String())
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			if err == nil {
+				err = closeErr
+			} else {
+				log.Error().Err(closeErr).Msg("error closing rows")
+			}
+		}
+	}()
+	for rows.Next() {
+		var ip cidr.CIDR
+		host := storage.Host{PoolID: poolID, Subnet: subnet}
+		if err = rows.Scan(&ip, &host.RequestID); err != nil {
+			return
+		}
+		host.IP = ip.IP
+		hosts = append(hosts, host)
+	}
+	err = rows.Err()
+	return
+}
+
+func (t *txWrapper) ListRecords(ctx context.Context, poolID int) (records []storage.Record, err error) {
+	rows, err := t.query(ctx, `SELECT `+recordColumns+` FROM public.ip_range WHERE pool_id=$1 ORDER BY c`, poolID)
+	if err != nil {
+		return
+	}
+	return scanRecords(rows, poolID)
+}
+
+func (t *txWrapper) ListRecordsAt(ctx context.Context, poolID int, at time.Time) (records []storage.Record, err error) {
+	rows, err := t.query(ctx, `SELECT `+recordColumns+` FROM public.ip_range_version
+WHERE pool_id=$1 AND valid_from <= $2 AND (valid_to IS NULL OR valid_to > $2)
+ORDER BY c`, poolID, at)
+	if err != nil {
+		return
+	}
+	return scanRecords(rows, poolID)
+}
+
+func (t *txWrapper) ListRoots(ctx context.Context, poolID int) (roots []cidr.CIDR, err error) {
+	rows, err := t.query(ctx, `SELECT c FROM public.ip_pool_root WHERE pool_id=$1 ORDER BY c`, poolID)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			if err == nil {
+				err = closeErr
+			} else {
+				log.Error().Err(closeErr).Msg("error closing rows")
+			}
+		}
+	}()
+	for rows.Next() {
+		var root cidr.CIDR
+		if err = rows.Scan(&root); err != nil {
+			return
+		}
+		roots = append(roots, root)
+	}
+	err = rows.Err()
+	return
+}
+
+// MaxPoolID implements storage.Transaction. Deleted pools are kept as tombstones, so their IDs are included.
+func (t *txWrapper) MaxPoolID(ctx context.Context) (maxPoolID int, err error) {
+	err = t.queryRow(ctx, `SELECT COALESCE(MAX(pool_id),0) FROM public.ip_pool`).Scan(&maxPoolID)
+	return
+}
+
+func (t *txWrapper) query(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	log.Debug().Str("q", query).Any("qv", args).Msg("doing query")
+	return t.tx.QueryContext(ctx, query, args...)
+}
+
+func (t *txWrapper) queryRow(ctx context.Context, query string, args ...any) *sql.Row {
+	log.Debug().Str("q", query).Any("qv", args).Msg("doing query")
+	return t.tx.QueryRowContext(ctx, query, args...)
+}
+
+func (t *txWrapper) Rollback() error {
+	return t.tx.Rollback()
+}
+
+func (t *txWrapper) SetRoots(ctx context.Context, poolID int, roots []cidr.CIDR) error {
+	if err := t.execContext(ctx, -1, `DELETE FROM public.ip_pool_root WHERE pool_id=$1`, poolID); err != nil {
+		return err
+	}
+	if len(roots) == 0 {
+		return nil
+	}
+	var statementBuilder bytes.Buffer
+	statementBuilder.WriteString(`INSERT INTO public.ip_pool_root(pool_id,c) VALUES `)
+	statementArgs := []any{poolID}
+	for i, root := range roots {
+		if i > 0 {
+			statementBuilder.WriteByte(',')
+		}
+		statementArgs = append(statementArgs, root.String())
+		fmt.Fprintf(&statementBuilder, "($1,$%d)", len(statementArgs))
+	}
+	return t.execContext(ctx, len(roots), statementBuilder.String(), statementArgs...)
+}
+
+func (t *txWrapper) Update(ctx context.Context, record storage.Record) error {
+	err := t.execContext(ctx, 1,
+		`UPDATE public.ip_range SET request_id=$1,retired=$2,expires_at=$3,labels=$4,moved_from=$5 WHERE pool_id=$6 AND c=$7`,
+		emptyStringToNil(record.RequestID), record.Retired, timeOrNil(record.ExpiresAt), labelsToJSON(record.Labels),
+		cidrOrNil(record.MovedFrom), record.PoolID, record.C.String())
+	if err != nil {
+		return err
+	}
+	if err := t.endVersion(ctx, record.PoolID, record.C); err != nil {
+		return err
+	}
+	return t.execContext(ctx, 1, `INSERT INTO public.ip_range_version(
+	pool_id,c,request_id,retired,expires_at,labels,moved_from,valid_from)
+SELECT pool_id,c,request_id,retired,expires_at,labels,moved_from,transaction_timestamp() FROM public.ip_range
+WHERE pool_id=$1 AND c=$2`, record.PoolID, record.C.String())
+}
+
+func (t *txWrapper) UpdateHostSubnet(ctx context.Context, hostSubnet storage.HostSubnet) error {
+	return t.execContext(ctx, 1, `UPDATE public.ip_host_subnet SET used=$1 WHERE pool_id=$2 AND c=$3`,
+		hostSubnet.Used, hostSubnet.PoolID, hostSubnet.C.String())
+}
+
+func (t *txWrapper) UpdatePool(ctx context.Context, pool storage.Pool) error {
+	return t.execContext(ctx, 1, `UPDATE public.ip_pool SET pool_name=$1 WHERE pool_id=$2 AND deleted_at IS NULL`, pool.Name, pool.ID)
+}
+
+// scanRecord scans a row with columns recordColumns.
+func scanRecord(row interface{ Scan(dest ...any) error }, poolID int) (record storage.Record, err error) {
+	record.PoolID = poolID
+	var requestID *string
+	var expiresAt *time.Time
+	var labels []byte
+	err = row.Scan(&record.C, &requestID, &record.Retired, &expiresAt, &labels, &record.MovedFrom)
+	if err != nil {
+		return
+	}
+	if requestID != nil {
+		record.RequestID = *requestID
+	}
+	if expiresAt != nil {
+		expiresAtUTC := expiresAt.UTC()
+		record.ExpiresAt = &expiresAtUTC
+	}
+	if labels != nil {
+		err = json.Unmarshal(labels, &record.Labels)
+	}
+	return
+}
+
+// scanRecords scans rows with columns recordColumns, and closes rows.
+func scanRecords(rows *sql.Rows, poolID int) (records []storage.Record, err error) {
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			if err == nil {
+				err = closeErr
+			} else {
+				log.Error().Err(closeErr).Msg("error closing rows")
+			}
+		}
+	}()
+	for rows.Next() {
+		var record storage.Record
+		record, err = scanRecord(rows, poolID)
+		if err != nil {
+			return
+		}
+		records = append(records, record)
+	}
+	err = rows.Err()
+	return
+}
+
+// scanEvents scans rows of the columns eventColumns.
+func scanEvents(rows *sql.Rows, poolID int) (events []storage.Event, err error) {
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			if err == nil {
+				err = closeErr
+			} else {
+				log.Error().Err(closeErr).Msg("error closing rows")
+			}
+		}
+	}()
+	for rows.Next() {
+		event := storage.Event{PoolID: poolID}
+		var eventType string
+		var requestID, actor *string
+		err = rows.Scan(&event.ID, &event.Time, &eventType, &event.C, &requestID, &actor)
+		if err != nil {
+			return
+		}
+		event.Time = event.Time.UTC()
+		event.Type = storage.EventType(eventType)
+		if requestID != nil {
+			event.RequestID = *requestID
+		}
+		if actor != nil {
+			event.Actor = *actor
+		}
+		events = append(events, event)
+	}
+	err = rows.Err()
+	return
+}
+
+// cidrOrNil returns c in CIDR notation, or nil if c is nil.
+func cidrOrNil(c *cidr.CIDR) any {
+	if c == nil {
+		return nil
+	}
+	return c.String()
+}
+
+// ipOrNil returns ip as a CIDR of a single IP address, or nil if ip is nil.
+func ipOrNil(ip net.IP) any {
+	if ip == nil {
+		return nil
+	}
+	return ipCIDR(ip)
+}
+
+// ipCIDR returns ip as a CIDR of a single IP address, which unlike ip.String() keeps the address family of
+// IPv4-mapped IPv6 addresses.
+func ipCIDR(ip net.IP) string {
+	return cidr.CIDR{IP: ip, PrefixBits: len(ip) * 8}.String()
+}
+
+func emptyStringToNil(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// labelsToJSON encodes labels as a JSON object, or nil if labels is empty.
+func labelsToJSON(labels map[string]string) any {
+	if len(labels) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(labels)
+	return string(data)
+}
+
+func timeOrNil(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return *t
+}
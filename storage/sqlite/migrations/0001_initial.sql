@@ -0,0 +1,21 @@
+CREATE TABLE ip_pool (
+	pool_id INTEGER PRIMARY KEY CHECK (pool_id > 0),
+	pool_name TEXT NOT NULL UNIQUE CHECK (length(pool_name) > 0)
+);
+
+CREATE TABLE ip_range (
+	pool_id INTEGER NOT NULL REFERENCES ip_pool(pool_id),
+	ip BLOB NOT NULL CHECK (length(ip) IN (4, 16)),
+	prefix_bits INTEGER NOT NULL CHECK (prefix_bits >= 0 AND prefix_bits <= length(ip) * 8),
+	request_id TEXT CHECK (request_id IS NULL OR length(request_id) > 0),
+	retired INTEGER NOT NULL DEFAULT 0 CHECK (retired IN (0, 1)),
+	PRIMARY KEY (pool_id, ip, prefix_bits)
+);
+
+CREATE UNIQUE INDEX ip_range_request_id ON ip_range (
+	pool_id, length(ip), request_id
+) WHERE request_id IS NOT NULL;
+
+CREATE INDEX ip_range_free ON ip_range (
+	pool_id, length(ip), prefix_bits
+) WHERE request_id IS NULL AND retired = 0;
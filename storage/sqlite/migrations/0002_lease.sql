@@ -0,0 +1,6 @@
+-- expires_at is the time the lease expires, in nanoseconds since the Unix epoch.
+ALTER TABLE ip_range ADD COLUMN expires_at INTEGER CHECK (expires_at IS NULL OR request_id IS NOT NULL);
+
+CREATE INDEX ip_range_expires_at ON ip_range (
+	pool_id, expires_at
+) WHERE expires_at IS NOT NULL;
@@ -0,0 +1,2 @@
+-- labels is a JSON object of string values.
+ALTER TABLE ip_range ADD COLUMN labels TEXT CHECK (labels IS NULL OR (request_id IS NOT NULL AND json_type(labels) = 'object'));
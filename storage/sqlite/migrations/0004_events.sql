@@ -0,0 +1,19 @@
+-- event_time is the time of the event, in nanoseconds since the Unix epoch.
+CREATE TABLE ip_range_event (
+	event_id INTEGER PRIMARY KEY AUTOINCREMENT,
+	pool_id INTEGER NOT NULL REFERENCES ip_pool(pool_id),
+	event_time INTEGER NOT NULL,
+	event_type TEXT NOT NULL CHECK (event_type IN ('allocate', 'release', 'split', 'merge')),
+	ip BLOB NOT NULL CHECK (length(ip) IN (4, 16)),
+	prefix_bits INTEGER NOT NULL CHECK (prefix_bits >= 0 AND prefix_bits <= length(ip) * 8),
+	request_id TEXT CHECK (request_id IS NULL OR length(request_id) > 0),
+	actor TEXT
+);
+
+CREATE INDEX ip_range_event_ip ON ip_range_event (
+	pool_id, ip, prefix_bits
+);
+
+CREATE INDEX ip_range_event_request_id ON ip_range_event (
+	pool_id, request_id
+) WHERE request_id IS NOT NULL;
@@ -0,0 +1,26 @@
+-- ip_range_version keeps every version of the rows of ip_range. A version is valid from valid_from (inclusive) until
+-- valid_to (exclusive), which is NULL for the current version of a row. Both are the time of the transaction that
+-- wrote the version, in nanoseconds since the Unix epoch.
+CREATE TABLE ip_range_version (
+	pool_id INTEGER NOT NULL REFERENCES ip_pool(pool_id),
+	ip BLOB NOT NULL,
+	prefix_bits INTEGER NOT NULL,
+	request_id TEXT,
+	retired INTEGER NOT NULL,
+	expires_at INTEGER,
+	labels TEXT,
+	valid_from INTEGER NOT NULL,
+	valid_to INTEGER
+);
+
+CREATE INDEX ip_range_version_current ON ip_range_version (
+	pool_id, ip, prefix_bits
+) WHERE valid_to IS NULL;
+
+CREATE INDEX ip_range_version_valid_from ON ip_range_version (
+	pool_id, valid_from
+);
+
+INSERT INTO ip_range_version(pool_id,ip,prefix_bits,request_id,retired,expires_at,labels,valid_from)
+SELECT pool_id,ip,prefix_bits,request_id,retired,expires_at,labels,CAST(strftime('%s','now') AS INTEGER) * 1000000000
+FROM ip_range;
@@ -0,0 +1,16 @@
+-- moved_from is the IP address of the range that the allocation of a row is being moved from, which has the same
+-- prefix length and is allocated to the same request until the move completes. A request has at most one row of each
+-- family that is not being moved to, and at most one row of each family that is being moved to.
+ALTER TABLE ip_range ADD COLUMN moved_from BLOB CHECK (moved_from IS NULL OR (request_id IS NOT NULL AND length(moved_from) = length(ip)));
+
+ALTER TABLE ip_range_version ADD COLUMN moved_from BLOB;
+
+DROP INDEX ip_range_request_id;
+
+CREATE UNIQUE INDEX ip_range_request_id ON ip_range (
+	pool_id, length(ip), request_id
+) WHERE request_id IS NOT NULL AND moved_from IS NULL;
+
+CREATE UNIQUE INDEX ip_range_moved_request_id ON ip_range (
+	pool_id, length(ip), request_id
+) WHERE moved_from IS NOT NULL;
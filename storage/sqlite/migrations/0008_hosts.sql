@@ -0,0 +1,26 @@
+-- ip_host_subnet keeps the allocated ranges from which individual host addresses are allocated. used is a bitmap of
+-- the addresses of the range that are allocated or reserved: bit i, counting from the most significant bit of the
+-- first byte, is set if the i-th address of the range is used. Deleting the range, which deallocating it does,
+-- deletes the subnet and its hosts.
+CREATE TABLE ip_host_subnet (
+	pool_id INTEGER NOT NULL,
+	ip BLOB NOT NULL,
+	prefix_bits INTEGER NOT NULL,
+	gateway BLOB CHECK (gateway IS NULL OR length(gateway) = length(ip)),
+	used BLOB NOT NULL,
+	PRIMARY KEY (pool_id, ip, prefix_bits),
+	FOREIGN KEY (pool_id, ip, prefix_bits) REFERENCES ip_range(pool_id, ip, prefix_bits) ON DELETE CASCADE
+);
+
+-- ip_host keeps the host addresses allocated from the subnets, at most one per request and subnet.
+CREATE TABLE ip_host (
+	pool_id INTEGER NOT NULL,
+	subnet_ip BLOB NOT NULL,
+	subnet_prefix_bits INTEGER NOT NULL,
+	ip BLOB NOT NULL CHECK (length(ip) = length(subnet_ip)),
+	request_id TEXT NOT NULL CHECK (length(request_id) > 0),
+	PRIMARY KEY (pool_id, subnet_ip, subnet_prefix_bits, request_id),
+	UNIQUE (pool_id, subnet_ip, subnet_prefix_bits, ip),
+	FOREIGN KEY (pool_id, subnet_ip, subnet_prefix_bits) REFERENCES ip_host_subnet(pool_id, ip, prefix_bits)
+		ON DELETE CASCADE
+);
@@ -0,0 +1,34 @@
+-- The allocations and deallocations of host addresses are recorded as allocate_host and release_host events, whose ip
+-- is the host address. SQLite cannot change the CHECK constraint of a column, so the table is rebuilt.
+CREATE TABLE ip_range_event_new (
+	event_id INTEGER PRIMARY KEY AUTOINCREMENT,
+	pool_id INTEGER NOT NULL REFERENCES ip_pool(pool_id),
+	event_time INTEGER NOT NULL,
+	event_type TEXT NOT NULL CHECK (
+		event_type IN ('allocate', 'release', 'split', 'merge', 'allocate_host', 'release_host')
+	),
+	ip BLOB NOT NULL CHECK (length(ip) IN (4, 16)),
+	prefix_bits INTEGER NOT NULL CHECK (prefix_bits >= 0 AND prefix_bits <= length(ip) * 8),
+	request_id TEXT CHECK (request_id IS NULL OR length(request_id) > 0),
+	actor TEXT
+);
+
+INSERT INTO ip_range_event_new (event_id,pool_id,event_time,event_type,ip,prefix_bits,request_id,actor)
+SELECT event_id,pool_id,event_time,event_type,ip,prefix_bits,request_id,actor FROM ip_range_event;
+
+-- Keep the IDs of deleted events from being assigned again.
+DELETE FROM sqlite_sequence WHERE name='ip_range_event_new';
+
+INSERT INTO sqlite_sequence (name,seq) SELECT 'ip_range_event_new',seq FROM sqlite_sequence WHERE name='ip_range_event';
+
+DROP TABLE ip_range_event;
+
+ALTER TABLE ip_range_event_new RENAME TO ip_range_event;
+
+CREATE INDEX ip_range_event_ip ON ip_range_event (
+	pool_id, ip, prefix_bits
+);
+
+CREATE INDEX ip_range_event_request_id ON ip_range_event (
+	pool_id, request_id
+) WHERE request_id IS NOT NULL;
@@ -0,0 +1,24 @@
+-- Deleted pools are kept as tombstones, with the time they were deleted in deleted_at, so that their IDs are not
+-- reused and their events and range versions are kept. Only the names of pools that are not deleted must be unique.
+-- SQLite cannot drop the UNIQUE constraint of a column, so the table is rebuilt. The rows are inserted after the old
+-- table is dropped, so that the references of the other tables are satisfied again before the transaction commits.
+PRAGMA defer_foreign_keys = ON;
+
+CREATE TEMPORARY TABLE ip_pool_copy AS SELECT pool_id,pool_name FROM ip_pool;
+
+DROP TABLE ip_pool;
+
+CREATE TABLE ip_pool (
+	pool_id INTEGER PRIMARY KEY CHECK (pool_id > 0),
+	pool_name TEXT NOT NULL CHECK (length(pool_name) > 0),
+	deleted_at INTEGER
+);
+
+INSERT INTO ip_pool (pool_id,pool_name)
+SELECT pool_id,pool_name FROM ip_pool_copy;
+
+DROP TABLE ip_pool_copy;
+
+CREATE UNIQUE INDEX ip_pool_pool_name ON ip_pool (
+	pool_name
+) WHERE deleted_at IS NULL;
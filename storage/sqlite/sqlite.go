@@ -0,0 +1,820 @@
+// Package sqlite implements storage.Storage using SQLite.
+//
+// CIDRs are stored as the packed bytes of the IP address (4 bytes for IPv4, 16 bytes for IPv6)
+// plus the prefix length, so no extensions are needed.
+//
+// SQLite allows only one writer at a time. Open the database with a busy timeout, immediate
+// transactions and foreign keys enabled, for example:
+//
+//	sql.Open("sqlite3", "file:ipam.db?_busy_timeout=5000&_txlock=immediate&_foreign_keys=on")
+package sqlite
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog/log"
+
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+	"github.com/jbrekelmans/go-sql-ip-management/storage/migrate"
+)
+
+// recordColumns are the columns scanned by scanRecord.
+const recordColumns = `ip,prefix_bits,request_id,retired,expires_at,labels,moved_from`
+
+// eventColumns are the columns scanned by ListEvents.
+const eventColumns = `event_id,event_time,event_type,ip,prefix_bits,request_id,actor`
+
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// legacyTablesQuery counts the tables of the schema that ddl_sqlite.sql created before migrations were introduced.
+const legacyTablesQuery = `SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name IN ('ip_pool','ip_range')`
+
+// NewMigrator returns a migrator for the tables and indexes used by SQLiteStorage.
+// SQLite allows one writer at a time, so concurrent migrators are excluded by the database lock
+// taken by each migration's transaction, provided db is opened with _txlock=immediate. Databases whose schema
+// was created by ddl_sqlite.sql are refused, because migrations cannot upgrade them.
+func NewMigrator(db *sql.DB, opts ...migrate.Option) (*migrate.Migrator, error) {
+	fsys, err := fs.Sub(migrationsFS, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := migrate.Load(fsys)
+	if err != nil {
+		return nil, err
+	}
+	opts = append([]migrate.Option{migrate.WithLegacyCheck(legacyTablesQuery)}, opts...)
+	return migrate.New(db, migrations, migrate.LockerFunc(noLock), opts...), nil
+}
+
+func noLock(ctx context.Context, conn *sql.Conn) (unlock func(ctx context.Context) error, err error) {
+	return func(ctx context.Context) error {
+		return nil
+	}, nil
+}
+
+type SQLiteStorage struct {
+	db *sql.DB
+}
+
+var _ storage.Storage = (*SQLiteStorage)(nil)
+var _ storage.RetryClassifier = (*SQLiteStorage)(nil)
+
+func NewSQLiteStorage(db *sql.DB) *SQLiteStorage {
+	return &SQLiteStorage{
+		db: db,
+	}
+}
+
+// BeginTransaction implements storage.Storage.
+// Transactions in SQLite are always serializable, so txOpts.Isolation is ignored.
+func (s *SQLiteStorage) BeginTransaction(ctx context.Context, txOpts *sql.TxOptions) (storage.Transaction, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &txWrapper{
+		now: time.Now().UTC(),
+		tx:  tx,
+	}, nil
+}
+
+// IsRetryable implements storage.RetryClassifier.
+// Returns true if err is a SQLite error caused by concurrent transactions.
+func (s *SQLiteStorage) IsRetryable(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	// See https://www.sqlite.org/rescode.html
+	switch sqliteErr.Code {
+	case sqlite3.ErrBusy, sqlite3.ErrLocked:
+		return true
+	}
+	return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+}
+
+type txWrapper struct {
+	// now is the time of the transaction, which stamps the versions of records written by the transaction.
+	now time.Time
+	tx  *sql.Tx
+}
+
+var _ storage.Transaction = (*txWrapper)(nil)
+
+func (t *txWrapper) Commit() error {
+	return t.tx.Commit()
+}
+
+// CountRecords implements storage.Transaction.
+func (t *txWrapper) CountRecords(ctx context.Context, poolID int) (counts []storage.RecordCount, err error) {
+	rows, err := t.query(ctx, `SELECT length(ip),prefix_bits,request_id IS NOT NULL,retired,count(*)
+FROM ip_range
+WHERE pool_id=?
+GROUP BY 1,2,3,4
+ORDER BY 1,2,3,4`, poolID)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			if err == nil {
+				err = closeErr
+			} else {
+				log.Error().Err(closeErr).Msg("error closing rows")
+			}
+		}
+	}()
+	for rows.Next() {
+		var count storage.RecordCount
+		var ipLength int
+		err = rows.Scan(&ipLength, &count.PrefixBits, &count.Allocated, &count.Retired, &count.Count)
+		if err != nil {
+			return
+		}
+		count.Family = cidr.IPv4
+		if ipLength == net.IPv6len {
+			count.Family = cidr.IPv6
+		}
+		counts = append(counts, count)
+	}
+	err = rows.Err()
+	return
+}
+
+func (t *txWrapper) Delete(ctx context.Context, poolID int, c cidr.CIDR) error {
+	// Delete the hosts explicitly, because the foreign keys only cascade if db is opened with _foreign_keys=on.
+	err := t.execContext(ctx, -1, `DELETE FROM ip_host WHERE pool_id=? AND subnet_ip=? AND subnet_prefix_bits=?`,
+		poolID, []byte(c.IP), c.PrefixBits)
+	if err != nil {
+		return err
+	}
+	err = t.execContext(ctx, -1, `DELETE FROM ip_host_subnet WHERE pool_id=? AND ip=? AND prefix_bits=?`,
+		poolID, []byte(c.IP), c.PrefixBits)
+	if err != nil {
+		return err
+	}
+	err = t.execContext(ctx, 1, `DELETE FROM ip_range WHERE pool_id=? AND ip=? AND prefix_bits=?`,
+		poolID, []byte(c.IP), c.PrefixBits)
+	if err != nil {
+		return err
+	}
+	return t.endVersion(ctx, poolID, c)
+}
+
+func (t *txWrapper) DeleteHost(ctx context.Context, poolID int, subnet cidr.CIDR, requestID string) error {
+	return t.execContext(ctx, 1,
+		`DELETE FROM ip_host WHERE pool_id=? AND subnet_ip=? AND subnet_prefix_bits=? AND request_id=?`,
+		poolID, []byte(subnet.IP), subnet.PrefixBits, requestID)
+}
+
+func (t *txWrapper) DeletePool(ctx context.Context, poolID int) error {
+	if err := t.execContext(ctx, -1, `DELETE FROM ip_host WHERE pool_id=?`, poolID); err != nil {
+		return err
+	}
+	if err := t.execContext(ctx, -1, `DELETE FROM ip_host_subnet WHERE pool_id=?`, poolID); err != nil {
+		return err
+	}
+	if err := t.execContext(ctx, -1, `DELETE FROM ip_range WHERE pool_id=?`, poolID); err != nil {
+		return err
+	}
+	if err := t.execContext(ctx, -1, `UPDATE ip_range_version SET valid_to=? WHERE pool_id=? AND valid_to IS NULL`,
+		t.now.UnixNano(), poolID); err != nil {
+		return err
+	}
+	if err := t.execContext(ctx, -1, `DELETE FROM ip_pool_root WHERE pool_id=?`, poolID); err != nil {
+		return err
+	}
+	return t.execContext(ctx, 1, `UPDATE ip_pool SET deleted_at=? WHERE pool_id=? AND deleted_at IS NULL`,
+		t.now.UnixNano(), poolID)
+}
+
+// endVersion ends the current version of the record identified by poolID and c.
+func (t *txWrapper) endVersion(ctx context.Context, poolID int, c cidr.CIDR) error {
+	return t.execContext(ctx, -1,
+		`UPDATE ip_range_version SET valid_to=? WHERE pool_id=? AND ip=? AND prefix_bits=? AND valid_to IS NULL`,
+		t.now.UnixNano(), poolID, []byte(c.IP), c.PrefixBits)
+}
+
+// execContext executes a statement and checks that it affected expectedRowsAffected rows.
+// If expectedRowsAffected is negative then the number of affected rows is not checked.
+func (t *txWrapper) execContext(ctx context.Context, expectedRowsAffected int, query string, args ...any) error {
+	log.Debug().Str("q", query).Any("qv", args).Msg("executing statement")
+	result, err := t.tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	actualRowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if expectedRowsAffected >= 0 && expectedRowsAffected != int(actualRowsAffected) {
+		return fmt.Errorf(`statement affected unexpected number of rows %d (expected %d)`, actualRowsAffected, expectedRowsAffected)
+	}
+	return nil
+}
+
+func (t *txWrapper) FindAllocated(ctx context.Context, poolID int, requestID string) (records []storage.Record, err error) {
+	if requestID == "" {
+		return nil, fmt.Errorf("requestID must not be empty")
+	}
+	rows, err := t.query(ctx, `SELECT `+recordColumns+` FROM ip_range WHERE pool_id=? AND request_id=? ORDER BY length(ip)`,
+		poolID, requestID)
+	if err != nil {
+		return
+	}
+	return scanRecords(rows, poolID)
+}
+
+// FindExpired implements storage.Transaction.
+// The query is answered using the partial index ip_range_expires_at.
+func (t *txWrapper) FindExpired(ctx context.Context, poolID int, now time.Time, limit int) (records []storage.Record, err error) {
+	rows, err := t.query(ctx, `SELECT `+recordColumns+` FROM ip_range
+WHERE pool_id=? AND request_id IS NOT NULL AND expires_at IS NOT NULL AND expires_at <= ?
+ORDER BY expires_at
+LIMIT ?`, poolID, now.UnixNano(), limit)
+	if err != nil {
+		return
+	}
+	return scanRecords(rows, poolID)
+}
+
+// FindOverlapping implements storage.Transaction.
+// Records contained in c are found using a range scan over the primary key.
+// Records containing c are found by enumerating the supernets of c.
+func (t *txWrapper) FindOverlapping(ctx context.Context, poolID int, c cidr.CIDR) (records []storage.Record, err error) {
+	var queryBuilder bytes.Buffer
+	queryBuilder.WriteString(`SELECT ` + recordColumns + `
+FROM ip_range
+WHERE pool_id=? AND (
+	(length(ip)=? AND ip>=? AND ip<=? AND prefix_bits>=?)`)
+	args := []any{poolID, len(c.IP), []byte(c.IP), []byte(c.Last()), c.PrefixBits}
+	for prefixBits := 0; prefixBits < c.PrefixBits; prefixBits++ {
+		supernet := c.Supernet(prefixBits)
+		queryBuilder.WriteString("\n\tOR (ip=? AND prefix_bits=?)")
+		args = append(args, []byte(supernet.IP), prefixBits)
+	}
+	queryBuilder.WriteString("\n)\nORDER BY length(ip),ip,prefix_bits")
+	rows, err := t.query(ctx, queryBuilder.String(), args...)
+	if err != nil {
+		return
+	}
+	return scanRecords(rows, poolID)
+}
+
+func (t *txWrapper) FindHost(ctx context.Context, poolID int, subnet cidr.CIDR, requestID string) (*storage.Host,
+	error) {
+	row := t.queryRow(ctx,
+		`SELECT ip FROM ip_host WHERE pool_id=? AND subnet_ip=? AND subnet_prefix_bits=? AND request_id=?`,
+		poolID, []byte(subnet.IP), subnet.PrefixBits, requestID)
+	host := &storage.Host{PoolID: poolID, Subnet: subnet, RequestID: requestID}
+	err := row.Scan(ipDest(&host.IP))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return host, nil
+}
+
+// FindSmallestFree implements storage.Transaction.
+// The query is answered using the partial index ip_range_free.
+func (t *txWrapper) FindSmallestFree(ctx context.Context, poolID int, family cidr.Family, prefixBits int) (*storage.Record, error) {
+	row := t.queryRow(ctx,
+		`SELECT ip,prefix_bits
+FROM ip_range
+WHERE pool_id=? AND length(ip)=? AND request_id IS NULL AND retired = 0 AND prefix_bits <= ?
+ORDER BY prefix_bits DESC
+LIMIT 1`, poolID, family.Bits()/8, prefixBits)
+	record := &storage.Record{PoolID: poolID}
+	err := row.Scan(ipDest(&record.C.IP), &record.C.PrefixBits)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return record, nil
+}
+
+func (t *txWrapper) Get(ctx context.Context, poolID int, c cidr.CIDR) (*storage.Record, error) {
+	row := t.queryRow(ctx, `SELECT `+recordColumns+` FROM ip_range WHERE pool_id=? AND ip=? AND prefix_bits=?`,
+		poolID, []byte(c.IP), c.PrefixBits)
+	record, err := scanRecord(row, poolID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return &record, nil
+}
+
+func (t *txWrapper) GetHostSubnet(ctx context.Context, poolID int, c cidr.CIDR) (*storage.HostSubnet, error) {
+	row := t.queryRow(ctx, `SELECT gateway,used FROM ip_host_subnet WHERE pool_id=? AND ip=? AND prefix_bits=?`,
+		poolID, []byte(c.IP), c.PrefixBits)
+	hostSubnet := &storage.HostSubnet{PoolID: poolID, C: c}
+	err := row.Scan(ipDest(&hostSubnet.Gateway), &hostSubnet.Used)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return hostSubnet, nil
+}
+
+func (t *txWrapper) GetPool(ctx context.Context, poolID int) (*storage.Pool, error) {
+	row := t.queryRow(ctx, `SELECT pool_name FROM ip_pool WHERE pool_id=? AND deleted_at IS NULL`, poolID)
+	pool := &storage.Pool{ID: poolID}
+	err := row.Scan(&pool.Name)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return pool, nil
+}
+
+func (t *txWrapper) InsertMany(ctx context.Context, records []storage.Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	var statementBuilder, versionStatementBuilder bytes.Buffer
+	statementBuilder.WriteString(
+		`INSERT INTO ip_range(pool_id,ip,prefix_bits,request_id,retired,expires_at,labels,moved_from) VALUES `)
+	versionStatementBuilder.WriteString(`INSERT INTO ip_range_version(
+	pool_id,ip,prefix_bits,request_id,retired,expires_at,labels,moved_from,valid_from) VALUES `)
+	statementArgs := make([]any, 0, len(records)*8)
+	versionStatementArgs := make([]any, 0, len(records)*9)
+	for i, record := range records {
+		if i > 0 {
+			statementBuilder.WriteByte(',')
+			versionStatementBuilder.WriteByte(',')
+		}
+		statementBuilder.WriteString("(?,?,?,?,?,?,?,?)")
+		versionStatementBuilder.WriteString("(?,?,?,?,?,?,?,?,?)")
+		recordArgs := []any{record.PoolID, []byte(record.C.IP), record.C.PrefixBits, emptyStringToNil(record.RequestID),
+			record.Retired, timeToNanos(record.ExpiresAt), labelsToJSON(record.Labels), movedFromIP(record.MovedFrom)}
+		statementArgs = append(statementArgs, recordArgs...)
+		versionStatementArgs = append(append(versionStatementArgs, recordArgs...), t.now.UnixNano())
+	}
+	if err := t.execContext(ctx, len(records), statementBuilder.String(), statementArgs...); err != nil {
+		return err
+	}
+	return t.execContext(ctx, len(records), versionStatementBuilder.String(), versionStatementArgs...)
+}
+
+func (t *txWrapper) InsertEvents(ctx context.Context, events []storage.Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	var statementBuilder bytes.Buffer
+	statementBuilder.WriteString(`INSERT INTO ip_range_event(pool_id,event_time,event_type,ip,prefix_bits,request_id,actor) VALUES `)
+	statementArgs := make([]any, 0, len(events)*7)
+	for i, event := range events {
+		if i > 0 {
+			statementBuilder.WriteByte(',')
+		}
+		statementBuilder.WriteString("(?,?,?,?,?,?,?)")
+		statementArgs = append(statementArgs, event.PoolID, event.Time.UnixNano(), string(event.Type), []byte(event.C.IP),
+			event.C.PrefixBits, emptyStringToNil(event.RequestID), emptyStringToNil(event.Actor))
+	}
+	return t.execContext(ctx, len(events), statementBuilder.String(), statementArgs...)
+}
+
+func (t *txWrapper) InsertHost(ctx context.Context, host storage.Host) error {
+	return t.execContext(ctx, 1,
+		`INSERT INTO ip_host(pool_id,subnet_ip,subnet_prefix_bits,ip,request_id) VALUES (?,?,?,?,?)`, host.PoolID, []byte(host.Subnet.IP), host.Subnet.PrefixBits, []byte(host.IP), host.RequestID)
+}
+
+func (t *txWrapper) InsertHostSubnet(ctx context.Context, hostSubnet storage.HostSubnet) error {
+	return t.execContext(ctx, 1, `INSERT INTO ip_host_subnet(pool_id,ip,prefix_bits,gateway,used) VALUES (?,?,?,?,?)`,
+		hostSubnet.PoolID, []byte(hostSubnet.C.IP), hostSubnet.C.PrefixBits, ipOrNil(hostSubnet.Gateway),
+		hostSubnet.Used)
+}
+
+func (t *txWrapper) InsertPool(ctx context.Context, pool storage.Pool) error {
+	return t.execContext(ctx, 1, `INSERT INTO ip_pool(pool_id,pool_name) VALUES (?,?)`, pool.ID, pool.Name)
+}
+
+func (t *txWrapper) ListPools(ctx context.Context) (pools []storage.Pool, err error) {
+	rows, err := t.query(ctx, `SELECT pool_id,pool_name FROM ip_pool WHERE deleted_at IS NULL ORDER BY pool_id`)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			if err == nil {
+				err = closeErr
+			} else {
+				log.Error().Err(closeErr).Msg("error closing rows")
+			}
+		}
+	}()
+	for rows.Next() {
+		var pool storage.Pool
+		err = rows.Scan(&pool.ID, &pool.Name)
+		if err != nil {
+			return
+		}
+		pools = append(pools, pool)
+	}
+	err = rows.Err()
+	return
+}
+
+// ListAllocations implements storage.Transaction.
+// Records are ordered by length(ip),ip,prefix_bits, which is the order of storage.CompareAddress.
+func (t *txWrapper) ListAllocations(ctx context.Context, poolID int, filter storage.ListFilter, after *cidr.CIDR,
+	limit int) (records []storage.Record, err error) {
+	var queryBuilder bytes.Buffer
+	queryBuilder.WriteString(`SELECT ` + recordColumns + ` FROM ip_range WHERE pool_id=?`)
+	args := []any{poolID}
+	if after != nil {
+		queryBuilder.WriteString(` AND (length(ip),ip,prefix_bits) > (?,?,?)`)
+		args = append(args, len(after.IP), []byte(after.IP), after.PrefixBits)
+	}
+	if filter.Within != nil {
+		queryBuilder.WriteString(` AND length(ip)=? AND ip>=? AND ip<=? AND prefix_bits>=?`)
+		args = append(args, len(filter.Within.IP), []byte(filter.Within.IP), []byte(filter.Within.Last()),
+			filter.Within.PrefixBits)
+	}
+	if filter.MinPrefixBits > 0 {
+		queryBuilder.WriteString(` AND prefix_bits>=?`)
+		args = append(args, filter.MinPrefixBits)
+	}
+	if filter.MaxPrefixBits > 0 {
+		queryBuilder.WriteString(` AND prefix_bits<=?`)
+		args = append(args, filter.MaxPrefixBits)
+	}
+	if filter.RequestIDPrefix != "" {
+		queryBuilder.WriteString(` AND substr(request_id,1,length(?))=?`)
+		args = append(args, filter.RequestIDPrefix, filter.RequestIDPrefix)
+	}
+	switch filter.State {
+	case storage.StateAllocated:
+		queryBuilder.WriteString(` AND request_id IS NOT NULL`)
+	case storage.StateFree:
+		queryBuilder.WriteString(` AND request_id IS NULL`)
+	}
+	for _, key := range sortedKeys(filter.Labels) {
+		queryBuilder.WriteString(` AND EXISTS (SELECT 1 FROM json_each(labels) WHERE key=? AND value=?)`)
+		args = append(args, key, filter.Labels[key])
+	}
+	queryBuilder.WriteString(` ORDER BY length(ip),ip,prefix_bits`)
+	if limit > 0 {
+		queryBuilder.WriteString(` LIMIT ?`)
+		args = append(args, limit)
+	}
+	rows, err := t.query(ctx, queryBuilder.String(), args...)
+	if err != nil {
+		return
+	}
+	return scanRecords(rows, poolID)
+}
+
+// ListEvents implements storage.Transaction.
+// Events overlapping a CIDR are found like FindOverlapping finds records.
+func (t *txWrapper) ListEvents(ctx context.Context, poolID int, filter storage.EventFilter) (events []storage.Event,
+	err error) {
+	var queryBuilder bytes.Buffer
+	queryBuilder.WriteString(`SELECT ` + eventColumns + ` FROM ip_range_event WHERE pool_id=?`)
+	args := []any{poolID}
+	if c := filter.Overlapping; c != nil {
+		queryBuilder.WriteString(" AND (\n\t(length(ip)=? AND ip>=? AND ip<=? AND prefix_bits>=?)")
+		args = append(args, len(c.IP), []byte(c.IP), []byte(c.Last()), c.PrefixBits)
+		for prefixBits := 0; prefixBits < c.PrefixBits; prefixBits++ {
+			supernet := c.Supernet(prefixBits)
+			queryBuilder.WriteString("\n\tOR (ip=? AND prefix_bits=?)")
+			args = append(args, []byte(supernet.IP), prefixBits)
+		}
+		queryBuilder.WriteString("\n)")
+	}
+	if filter.RequestID != "" {
+		queryBuilder.WriteString(` AND request_id=?`)
+		args = append(args, filter.RequestID)
+	}
+	queryBuilder.WriteString(` ORDER BY event_id`)
+	rows, err := t.query(ctx, queryBuilder.String(), args...)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			if err == nil {
+				err = closeErr
+			} else {
+				log.Error().Err(closeErr).Msg("error closing rows")
+			}
+		}
+	}()
+	for rows.Next() {
+		event := storage.Event{PoolID: poolID}
+		var eventTime int64
+		var eventType string
+		var requestID, actor *string
+		err = rows.Scan(&event.ID, &eventTime, &eventType, ipDest(&event.C.IP), &event.C.PrefixBits, &requestID, &actor)
+		if err != nil {
+			return
+		}
+		event.Time = time.Unix(0, eventTime).UTC()
+		event.Type = storage.EventType(eventType)
+		if requestID != nil {
+			event.RequestID = *requestID
+		}
+		if actor != nil {
+			event.Actor = *actor
+		}
+		events = append(events, event)
+	}
+	err = rows.Err()
+	return
+}
+
+func (t *txWrapper) ListHostSubnets(ctx context.Context, poolID int) (hostSubnets []storage.HostSubnet, err error) {
+	rows, err := t.query(ctx, `SELECT ip,prefix_bits,gateway,used FROM ip_host_subnet WHERE pool_id=?
+ORDER BY length(ip),ip,prefix_bits`, poolID)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			if err == nil {
+				err = closeErr
+			} else {
+				log.Error().Err(closeErr).Msg("error closing rows")
+			}
+		}
+	}()
+	for rows.Next() {
+		hostSubnet := storage.HostSubnet{PoolID: poolID}
+		err = rows.Scan(ipDest(&hostSubnet.C.IP), &hostSubnet.C.PrefixBits, ipDest(&hostSubnet.Gateway), &hostSubnet.Used)
+		if err != nil {
+			return
+		}
+		hostSubnets = append(hostSubnets, hostSubnet)
+	}
+	err = rows.Err()
+	return
+}
+
+func (t *txWrapper) ListHosts(ctx context.Context, poolID int, subnet cidr.CIDR) (hosts []storage.Host, err error) {
+	rows, err := t.query(ctx, `SELECT ip,request_id FROM ip_host
+WHERE pool_id=? AND subnet_ip=? AND subnet_prefix_bits=?
+ORDER BY ip`, poolID, []byte(subnet.IP), subnet.PrefixBits)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			if err == nil {
+				err = closeErr
+			} else {
+				log.Error().Err(closeErr).Msg("error closing rows")
+			}
+		}
+	}()
+	for rows.Next() {
+		host := storage.Host{PoolID: poolID, Subnet: subnet}
+		if err = rows.Scan(ipDest(&host.IP), &host.RequestID); err != nil {
+			return
+		}
+		hosts = append(hosts, host)
+	}
+	err = rows.Err()
+	return
+}
+
+func (t *txWrapper) ListRecords(ctx context.Context, poolID int) (records []storage.Record, err error) {
+	rows, err := t.query(ctx, `SELECT `+recordColumns+` FROM ip_range WHERE pool_id=? ORDER BY length(ip),ip,prefix_bits`,
+		poolID)
+	if err != nil {
+		return
+	}
+	return scanRecords(rows, poolID)
+}
+
+func (t *txWrapper) query(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	log.Debug().Str("q", query).Any("qv", args).Msg("doing query")
+	return t.tx.QueryContext(ctx, query, args...)
+}
+
+func (t *txWrapper) queryRow(ctx context.Context, query string, args ...any) *sql.Row {
+	log.Debug().Str("q", query).Any("qv", args).Msg("doing query")
+	return t.tx.QueryRowContext(ctx, query, args...)
+}
+
+func (t *txWrapper) ListRecordsAt(ctx context.Context, poolID int, at time.Time) (records []storage.Record, err error) {
+	rows, err := t.query(ctx, `SELECT `+recordColumns+` FROM ip_range_version
+WHERE pool_id=? AND valid_from <= ? AND (valid_to IS NULL OR valid_to > ?)
+ORDER BY length(ip),ip,prefix_bits`, poolID, at.UnixNano(), at.UnixNano())
+	if err != nil {
+		return
+	}
+	return scanRecords(rows, poolID)
+}
+
+func (t *txWrapper) ListRoots(ctx context.Context, poolID int) (roots []cidr.CIDR, err error) {
+	rows, err := t.query(ctx, `SELECT ip,prefix_bits FROM ip_pool_root WHERE pool_id=? ORDER BY length(ip),ip,prefix_bits`,
+		poolID)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			if err == nil {
+				err = closeErr
+			} else {
+				log.Error().Err(closeErr).Msg("error closing rows")
+			}
+		}
+	}()
+	for rows.Next() {
+		var root cidr.CIDR
+		if err = rows.Scan(ipDest(&root.IP), &root.PrefixBits); err != nil {
+			return
+		}
+		roots = append(roots, root)
+	}
+	err = rows.Err()
+	return
+}
+
+// MaxPoolID implements storage.Transaction. Deleted pools are kept as tombstones, so their IDs are included.
+func (t *txWrapper) MaxPoolID(ctx context.Context) (maxPoolID int, err error) {
+	err = t.queryRow(ctx, `SELECT COALESCE(MAX(pool_id),0) FROM ip_pool`).Scan(&maxPoolID)
+	return
+}
+
+func (t *txWrapper) Rollback() error {
+	return t.tx.Rollback()
+}
+
+func (t *txWrapper) SetRoots(ctx context.Context, poolID int, roots []cidr.CIDR) error {
+	if err := t.execContext(ctx, -1, `DELETE FROM ip_pool_root WHERE pool_id=?`, poolID); err != nil {
+		return err
+	}
+	if len(roots) == 0 {
+		return nil
+	}
+	var statementBuilder bytes.Buffer
+	statementBuilder.WriteString(`INSERT INTO ip_pool_root(pool_id,ip,prefix_bits) VALUES `)
+	statementArgs := make([]any, 0, len(roots)*3)
+	for i, root := range roots {
+		if i > 0 {
+			statementBuilder.WriteByte(',')
+		}
+		statementBuilder.WriteString("(?,?,?)")
+		statementArgs = append(statementArgs, poolID, []byte(root.IP), root.PrefixBits)
+	}
+	return t.execContext(ctx, len(roots), statementBuilder.String(), statementArgs...)
+}
+
+func (t *txWrapper) Update(ctx context.Context, record storage.Record) error {
+	err := t.execContext(ctx, 1,
+		`UPDATE ip_range SET request_id=?,retired=?,expires_at=?,labels=?,moved_from=?
+WHERE pool_id=? AND ip=? AND prefix_bits=?`,
+		emptyStringToNil(record.RequestID), record.Retired, timeToNanos(record.ExpiresAt), labelsToJSON(record.Labels),
+		movedFromIP(record.MovedFrom), record.PoolID, []byte(record.C.IP), record.C.PrefixBits)
+	if err != nil {
+		return err
+	}
+	if err := t.endVersion(ctx, record.PoolID, record.C); err != nil {
+		return err
+	}
+	return t.execContext(ctx, 1, `INSERT INTO ip_range_version(pool_id,ip,prefix_bits,request_id,retired,expires_at,labels,
+moved_from,valid_from)
+SELECT pool_id,ip,prefix_bits,request_id,retired,expires_at,labels,moved_from,? FROM ip_range
+WHERE pool_id=? AND ip=? AND prefix_bits=?`,
+		t.now.UnixNano(), record.PoolID, []byte(record.C.IP), record.C.PrefixBits)
+}
+
+func (t *txWrapper) UpdateHostSubnet(ctx context.Context, hostSubnet storage.HostSubnet) error {
+	return t.execContext(ctx, 1, `UPDATE ip_host_subnet SET used=? WHERE pool_id=? AND ip=? AND prefix_bits=?`,
+		hostSubnet.Used, hostSubnet.PoolID, []byte(hostSubnet.C.IP), hostSubnet.C.PrefixBits)
+}
+
+func (t *txWrapper) UpdatePool(ctx context.Context, pool storage.Pool) error {
+	return t.execContext(ctx, 1, `UPDATE ip_pool SET pool_name=? WHERE pool_id=? AND deleted_at IS NULL`, pool.Name, pool.ID)
+}
+
+// scanRecord scans a row with columns recordColumns.
+func scanRecord(row interface{ Scan(dest ...any) error }, poolID int) (record storage.Record, err error) {
+	record.PoolID = poolID
+	var requestID *string
+	var expiresAt *int64
+	var labels, movedFrom []byte
+	err = row.Scan(ipDest(&record.C.IP), &record.C.PrefixBits, &requestID, &record.Retired, &expiresAt, &labels,
+		&movedFrom)
+	if err != nil {
+		return
+	}
+	if movedFrom != nil {
+		record.MovedFrom = &cidr.CIDR{IP: movedFrom, PrefixBits: record.C.PrefixBits}
+	}
+	if requestID != nil {
+		record.RequestID = *requestID
+	}
+	if expiresAt != nil {
+		expiresAtTime := time.Unix(0, *expiresAt).UTC()
+		record.ExpiresAt = &expiresAtTime
+	}
+	if labels != nil {
+		err = json.Unmarshal(labels, &record.Labels)
+	}
+	return
+}
+
+// scanRecords scans rows with columns recordColumns, and closes rows.
+func scanRecords(rows *sql.Rows, poolID int) (records []storage.Record, err error) {
+	defer func() {
+		if closeErr := rows.Close(); closeErr != nil {
+			if err == nil {
+				err = closeErr
+			} else {
+				log.Error().Err(closeErr).Msg("error closing rows")
+			}
+		}
+	}()
+	for rows.Next() {
+		var record storage.Record
+		record, err = scanRecord(rows, poolID)
+		if err != nil {
+			return
+		}
+		records = append(records, record)
+	}
+	err = rows.Err()
+	return
+}
+
+func emptyStringToNil(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// timeToNanos converts t to nanoseconds since the Unix epoch, or nil if t is nil.
+func timeToNanos(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.UnixNano()
+}
+
+// movedFromIP returns the IP address of movedFrom, which has the prefix length of the record, or nil if movedFrom is
+// nil.
+func movedFromIP(movedFrom *cidr.CIDR) any {
+	if movedFrom == nil {
+		return nil
+	}
+	return []byte(movedFrom.IP)
+}
+
+// ipOrNil returns the packed bytes of ip, or nil if ip is nil.
+func ipOrNil(ip net.IP) any {
+	if ip == nil {
+		return nil
+	}
+	return []byte(ip)
+}
+
+// labelsToJSON encodes labels as a JSON object, or nil if labels is empty.
+func labelsToJSON(labels map[string]string) any {
+	if len(labels) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(labels)
+	return string(data)
+}
+
+// sortedKeys returns the keys of m in ascending order, so that generated queries are deterministic.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ipDest returns a destination for (*sql.Row).Scan to scan a packed IP address into.
+func ipDest(ip *net.IP) *[]byte {
+	return (*[]byte)(ip)
+}
@@ -0,0 +1,487 @@
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jbrekelmans/go-sql-ip-management/allocator"
+	"github.com/jbrekelmans/go-sql-ip-management/cidr"
+	"github.com/jbrekelmans/go-sql-ip-management/storage"
+	"github.com/jbrekelmans/go-sql-ip-management/storage/migrate"
+	"github.com/jbrekelmans/go-sql-ip-management/storage/sqlite"
+)
+
+func testStorage(t *testing.T, roots ...string) *sqlite.SQLiteStorage {
+	t.Helper()
+	return testStorageWithParams(t, "_busy_timeout=5000&_txlock=immediate&_foreign_keys=on", roots...)
+}
+
+// testStorageWithParams is like testStorage but opens the database with the DSN query parameters params.
+func testStorageWithParams(t *testing.T, params string, roots ...string) *sqlite.SQLiteStorage {
+	t.Helper()
+	ctx := context.Background()
+	dsn := "file:" + filepath.Join(t.TempDir(), "ipam.db") + "?" + params
+	db, err := sql.Open("sqlite3", dsn)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, db.Close())
+	})
+	migrator, err := sqlite.NewMigrator(db, migrate.WithLogger(zerolog.Nop()))
+	require.NoError(t, err)
+	_, err = migrator.Up(ctx)
+	require.NoError(t, err)
+	_, err = db.ExecContext(ctx, `INSERT INTO ip_pool(pool_id,pool_name) VALUES (1,'pool1')`)
+	require.NoError(t, err)
+	s := sqlite.NewSQLiteStorage(db)
+	var records []storage.Record
+	for _, root := range roots {
+		records = append(records, storage.Record{PoolID: 1, C: cidr.MustParseCIDR(root)})
+	}
+	tx, err := s.BeginTransaction(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, tx.InsertMany(ctx, records))
+	require.NoError(t, tx.Commit())
+	return s
+}
+
+func Test_SQLiteStorage(t *testing.T) {
+	ctx := context.Background()
+	t.Run("Transaction", func(t *testing.T) {
+		s := testStorage(t, "10.0.0.0/16", "fd00::/64")
+		tx, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, tx.Rollback())
+		}()
+		pool, err := tx.GetPool(ctx, 1)
+		require.NoError(t, err)
+		assert.Equal(t, &storage.Pool{ID: 1, Name: "pool1"}, pool)
+		record, err := tx.FindSmallestFree(ctx, 1, cidr.IPv4, 24)
+		require.NoError(t, err)
+		assert.Equal(t, &storage.Record{PoolID: 1, C: cidr.MustParseCIDR("10.0.0.0/16")}, record)
+		record, err = tx.FindSmallestFree(ctx, 1, cidr.IPv6, 64)
+		require.NoError(t, err)
+		assert.Equal(t, &storage.Record{PoolID: 1, C: cidr.MustParseCIDR("fd00::/64")}, record)
+		require.NoError(t, tx.Update(ctx, storage.Record{PoolID: 1, C: cidr.MustParseCIDR("fd00::/64"), RequestID: "a"}))
+		records, err := tx.FindAllocated(ctx, 1, "a")
+		require.NoError(t, err)
+		assert.Equal(t, []storage.Record{{PoolID: 1, C: cidr.MustParseCIDR("fd00::/64"), RequestID: "a"}}, records)
+		require.NoError(t, tx.Delete(ctx, 1, cidr.MustParseCIDR("10.0.0.0/16")))
+		record, err = tx.Get(ctx, 1, cidr.MustParseCIDR("10.0.0.0/16"))
+		require.NoError(t, err)
+		assert.Nil(t, record)
+		err = tx.InsertMany(ctx, []storage.Record{{PoolID: 1, C: cidr.MustParseCIDR("fd00::/64")}})
+		assert.True(t, s.IsRetryable(err))
+		require.NoError(t, tx.InsertMany(ctx, []storage.Record{{PoolID: 1, C: cidr.MustParseCIDR("10.0.0.0/16"), Retired: true}}))
+		record, err = tx.FindSmallestFree(ctx, 1, cidr.IPv4, 24)
+		require.NoError(t, err)
+		assert.Nil(t, record)
+		record, err = tx.Get(ctx, 1, cidr.MustParseCIDR("10.0.0.0/16"))
+		require.NoError(t, err)
+		assert.Equal(t, &storage.Record{PoolID: 1, C: cidr.MustParseCIDR("10.0.0.0/16"), Retired: true}, record)
+	})
+	t.Run("FindOverlapping", func(t *testing.T) {
+		s := testStorage(t, "10.0.0.0/17", "10.0.128.0/18", "10.0.192.0/18", "fd00::/64")
+		tx, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, tx.Rollback())
+		}()
+		for _, tc := range []struct {
+			C        string
+			Expected []string
+		}{
+			{C: "10.0.0.0/16", Expected: []string{"10.0.0.0/17", "10.0.128.0/18", "10.0.192.0/18"}},
+			{C: "10.0.128.0/17", Expected: []string{"10.0.128.0/18", "10.0.192.0/18"}},
+			{C: "10.0.4.0/24", Expected: []string{"10.0.0.0/17"}},
+			{C: "10.1.0.0/16", Expected: nil},
+			{C: "::/0", Expected: []string{"fd00::/64"}},
+		} {
+			records, err := tx.FindOverlapping(ctx, 1, cidr.MustParseCIDR(tc.C))
+			require.NoError(t, err)
+			var actual []string
+			for _, record := range records {
+				actual = append(actual, record.C.String())
+			}
+			assert.Equalf(t, tc.Expected, actual, "FindOverlapping(%s)", tc.C)
+		}
+	})
+	t.Run("Allocator", func(t *testing.T) {
+		s := testStorage(t, "10.0.0.0/16")
+		retryPolicy := allocator.DefaultRetryPolicy()
+		retryPolicy.MaxAttempts = 1000
+		a := allocator.New(s, allocator.WithLogger(zerolog.Nop()), allocator.WithRetryPolicy(retryPolicy))
+		const parallelism = 4
+		const allocationsPerWorker = 8
+		var waitGroup sync.WaitGroup
+		var mu sync.Mutex
+		allocated := map[string]string{}
+		for i := 1; i <= parallelism; i++ {
+			workerID := i
+			waitGroup.Add(1)
+			go func() {
+				defer waitGroup.Done()
+				for i := 1; i <= allocationsPerWorker; i++ {
+					requestID := fmt.Sprintf("worker%d_user%d", workerID, i)
+					c, err := a.Allocate(ctx, cidr.IPv4, 24, requestID)
+					if !assert.NoError(t, err) {
+						return
+					}
+					mu.Lock()
+					allocated[c.String()] = requestID
+					mu.Unlock()
+				}
+			}()
+		}
+		waitGroup.Wait()
+		assert.Len(t, allocated, parallelism*allocationsPerWorker)
+		for _, requestID := range allocated {
+			_, err := a.Deallocate(ctx, requestID)
+			require.NoError(t, err)
+		}
+		tx, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, tx.Rollback())
+		}()
+		record, err := tx.Get(ctx, 1, cidr.MustParseCIDR("10.0.0.0/16"))
+		require.NoError(t, err)
+		assert.Equal(t, &storage.Record{PoolID: 1, C: cidr.MustParseCIDR("10.0.0.0/16")}, record)
+	})
+	t.Run("Lease", func(t *testing.T) {
+		s := testStorage(t, "10.0.0.0/24")
+		now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		a := allocator.New(s, allocator.WithLogger(zerolog.Nop()), allocator.WithClock(func() time.Time { return now }))
+		_, err := a.Allocate(ctx, cidr.IPv4, 25, "a", allocator.WithLease(time.Minute))
+		require.NoError(t, err)
+		_, err = a.Allocate(ctx, cidr.IPv4, 25, "b", allocator.WithLease(time.Hour))
+		require.NoError(t, err)
+		records, err := a.Lookup(ctx, "a")
+		require.NoError(t, err)
+		if assert.Len(t, records, 1) && assert.NotNil(t, records[0].ExpiresAt) {
+			assert.Equal(t, now.Add(time.Minute), *records[0].ExpiresAt)
+		}
+		now = now.Add(time.Minute)
+		reaped, err := a.Reap(ctx)
+		require.NoError(t, err)
+		if assert.Len(t, reaped, 1) {
+			assert.Equal(t, "a", reaped[0].RequestID)
+		}
+		_, err = a.Lookup(ctx, "a")
+		assert.ErrorIs(t, err, allocator.ErrNotFound)
+		_, err = a.Lookup(ctx, "b")
+		assert.NoError(t, err)
+	})
+	t.Run("Labels", func(t *testing.T) {
+		s := testStorage(t, "10.0.0.0/24")
+		a := allocator.New(s, allocator.WithLogger(zerolog.Nop()))
+		_, err := a.Allocate(ctx, cidr.IPv4, 25, "a", allocator.WithLabels(map[string]string{"team": "payments", "ticket": "IPAM-1"}))
+		require.NoError(t, err)
+		_, err = a.Allocate(ctx, cidr.IPv4, 25, "b", allocator.WithLabels(map[string]string{"team": "search"}))
+		require.NoError(t, err)
+		records, err := a.FindByLabels(ctx, map[string]string{"team": "payments"})
+		require.NoError(t, err)
+		if assert.Len(t, records, 1) {
+			assert.Equal(t, "a", records[0].RequestID)
+			assert.Equal(t, map[string]string{"team": "payments", "ticket": "IPAM-1"}, records[0].Labels)
+		}
+		records, err = a.FindByLabels(ctx, map[string]string{"team": "payments", "ticket": "IPAM-2"})
+		require.NoError(t, err)
+		assert.Empty(t, records)
+		records, err = a.FindByLabels(ctx, nil)
+		require.NoError(t, err)
+		assert.Len(t, records, 2)
+		require.NoError(t, a.SetLabels(ctx, "a", nil))
+		records, err = a.Lookup(ctx, "a")
+		require.NoError(t, err)
+		assert.Nil(t, records[0].Labels)
+	})
+	t.Run("ListAllocations", func(t *testing.T) {
+		s := testStorage(t, "10.0.0.0/24", "fd00::/48")
+		a := allocator.New(s, allocator.WithLogger(zerolog.Nop()))
+		for _, requestID := range []string{"vpc-a", "vpc-b", "ci-a"} {
+			_, err := a.Allocate(ctx, cidr.IPv4, 26, requestID, allocator.WithLabels(map[string]string{"id": requestID}))
+			require.NoError(t, err)
+		}
+		_, err := a.Allocate(ctx, cidr.IPv6, 64, "vpc-a")
+		require.NoError(t, err)
+		list := func(filter storage.ListFilter, pageSize int) (listed []string) {
+			pageToken := ""
+			for {
+				records, nextPageToken, err := a.ListAllocations(ctx, filter, pageToken, pageSize)
+				require.NoError(t, err)
+				for _, record := range records {
+					listed = append(listed, record.RequestID+" "+record.C.String())
+				}
+				if nextPageToken == "" {
+					return
+				}
+				pageToken = nextPageToken
+			}
+		}
+		assert.Equal(t, []string{"vpc-a 10.0.0.0/26", "vpc-b 10.0.0.64/26", "ci-a 10.0.0.128/26", "vpc-a fd00::/64"},
+			list(storage.ListFilter{State: storage.StateAllocated}, 1))
+		assert.Equal(t, []string{"vpc-a 10.0.0.0/26", "vpc-b 10.0.0.64/26", "vpc-a fd00::/64"},
+			list(storage.ListFilter{RequestIDPrefix: "vpc-"}, 2))
+		within := cidr.MustParseCIDR("10.0.0.128/25")
+		assert.Equal(t, []string{"ci-a 10.0.0.128/26", " 10.0.0.192/26"}, list(storage.ListFilter{Within: &within}, 0))
+		assert.Equal(t, []string{" 10.0.0.192/26", " fd00:0:0:8000::/49"},
+			list(storage.ListFilter{State: storage.StateFree, MaxPrefixBits: 49}, 0))
+		assert.Equal(t, []string{"vpc-b 10.0.0.64/26"}, list(storage.ListFilter{Labels: map[string]string{"id": "vpc-b"}}, 0))
+	})
+	t.Run("PoolStats", func(t *testing.T) {
+		s := testStorage(t, "10.0.0.0/24", "fd00::/64")
+		a := allocator.New(s, allocator.WithLogger(zerolog.Nop()))
+		_, err := a.Allocate(ctx, cidr.IPv4, 26, "a")
+		require.NoError(t, err)
+		tx, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		counts, err := tx.CountRecords(ctx, 1)
+		require.NoError(t, err)
+		require.NoError(t, tx.Rollback())
+		assert.Equal(t, []storage.RecordCount{
+			{Family: cidr.IPv4, PrefixBits: 25, Count: 1},
+			{Family: cidr.IPv4, PrefixBits: 26, Count: 1},
+			{Family: cidr.IPv4, PrefixBits: 26, Allocated: true, Count: 1},
+			{Family: cidr.IPv6, PrefixBits: 64, Count: 1},
+		}, counts)
+		stats, err := allocator.NewPoolManager(s, allocator.WithLogger(zerolog.Nop())).PoolStats(ctx, 1)
+		require.NoError(t, err)
+		assert.Equal(t, "192", stats.IPv4.Free.String())
+		assert.Equal(t, 25, stats.IPv4.LargestFreePrefixBits)
+		assert.Equal(t, "18446744073709551616", stats.IPv6.Total.String())
+	})
+	t.Run("History", func(t *testing.T) {
+		s := testStorage(t, "10.0.0.0/24", "fd00::/64")
+		now := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+		a := allocator.New(s, allocator.WithLogger(zerolog.Nop()), allocator.WithClock(func() time.Time { return now }))
+		actorCtx := allocator.ContextWithActor(ctx, "alice")
+		_, err := a.Allocate(actorCtx, cidr.IPv4, 26, "a")
+		require.NoError(t, err)
+		_, err = a.Allocate(ctx, cidr.IPv6, 64, "a")
+		require.NoError(t, err)
+		_, err = a.Deallocate(ctx, "a")
+		require.NoError(t, err)
+		events, err := a.History(ctx, cidr.MustParseCIDR("10.0.0.64/26"))
+		require.NoError(t, err)
+		var types []storage.EventType
+		for _, event := range events {
+			types = append(types, event.Type)
+		}
+		assert.Equal(t, []storage.EventType{storage.EventSplit, storage.EventMerge}, types)
+		events, err = a.HistoryOfRequest(ctx, "a")
+		require.NoError(t, err)
+		require.Len(t, events, 4)
+		assert.Equal(t, storage.Event{
+			ID:        events[0].ID,
+			PoolID:    1,
+			Time:      now,
+			Type:      storage.EventAllocate,
+			C:         cidr.MustParseCIDR("10.0.0.0/26"),
+			RequestID: "a",
+			Actor:     "alice",
+		}, events[0])
+		assert.Equal(t, cidr.MustParseCIDR("fd00::/64"), events[1].C)
+		assert.Empty(t, events[1].Actor)
+		assert.Equal(t, storage.EventRelease, events[3].Type)
+		m := allocator.NewPoolManager(s, allocator.WithLogger(zerolog.Nop()))
+		require.NoError(t, m.DeletePool(ctx, 1, true))
+
+		// The deleted pool is kept as a tombstone with its history, so its name can be reused but its ID cannot.
+		pool, err := m.CreatePool(ctx, "pool1", cidr.MustParseCIDR("10.0.0.0/24"))
+		require.NoError(t, err)
+		assert.Equal(t, 2, pool.ID)
+		tx, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		events, err = tx.ListEvents(ctx, 1, storage.EventFilter{RequestID: "a"})
+		require.NoError(t, err)
+		assert.Len(t, events, 4)
+		require.NoError(t, tx.Rollback())
+		require.NoError(t, m.DeletePool(ctx, pool.ID, true))
+	})
+	t.Run("Snapshot", func(t *testing.T) {
+		s := testStorage(t, "10.0.0.0/24")
+		m := allocator.NewPoolManager(s, allocator.WithLogger(zerolog.Nop()))
+		a := allocator.New(s, allocator.WithLogger(zerolog.Nop()))
+		before := time.Now()
+		_, err := a.Allocate(ctx, cidr.IPv4, 25, "a")
+		require.NoError(t, err)
+		allocated := time.Now()
+		require.NoError(t, a.SetLabels(ctx, "a", map[string]string{"team": "payments"}))
+		_, err = a.Deallocate(ctx, "a")
+		require.NoError(t, err)
+
+		records, err := m.PoolSnapshotAt(ctx, 1, before)
+		require.NoError(t, err)
+		assert.Equal(t, []storage.Record{{PoolID: 1, C: cidr.MustParseCIDR("10.0.0.0/24")}}, records)
+		records, err = m.PoolSnapshotAt(ctx, 1, allocated)
+		require.NoError(t, err)
+		assert.Equal(t, []storage.Record{
+			{PoolID: 1, C: cidr.MustParseCIDR("10.0.0.0/25"), RequestID: "a"},
+			{PoolID: 1, C: cidr.MustParseCIDR("10.0.0.128/25")},
+		}, records)
+		records, err = m.PoolSnapshotAt(ctx, 1, time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, []storage.Record{{PoolID: 1, C: cidr.MustParseCIDR("10.0.0.0/24")}}, records)
+		require.NoError(t, m.DeletePool(ctx, 1, true))
+	})
+	t.Run("Check", func(t *testing.T) {
+		s := testStorage(t)
+		m := allocator.NewPoolManager(s, allocator.WithLogger(zerolog.Nop()))
+		pool, err := m.CreatePool(ctx, "pool2", cidr.MustParseCIDR("10.0.0.0/24"), cidr.MustParseCIDR("fd00::/64"))
+		require.NoError(t, err)
+		require.NoError(t, m.AddRange(ctx, pool.ID, cidr.MustParseCIDR("10.0.1.0/24")))
+		_, err = m.RetireRange(ctx, pool.ID, cidr.MustParseCIDR("10.0.0.0/25"))
+		require.NoError(t, err)
+		tx, err := s.BeginTransaction(ctx, nil)
+		require.NoError(t, err)
+		roots, err := tx.ListRoots(ctx, pool.ID)
+		require.NoError(t, err)
+		assert.Equal(t, []cidr.CIDR{
+			cidr.MustParseCIDR("10.0.0.128/25"),
+			cidr.MustParseCIDR("10.0.1.0/24"),
+			cidr.MustParseCIDR("fd00::/64"),
+		}, roots)
+		require.NoError(t, tx.Delete(ctx, pool.ID, cidr.MustParseCIDR("fd00::/64")))
+		require.NoError(t, tx.Commit())
+		violations, err := m.Check(ctx, pool.ID)
+		require.NoError(t, err)
+		assert.Equal(t, []allocator.Violation{{Type: allocator.ViolationGap, C: cidr.MustParseCIDR("fd00::/64")}},
+			violations)
+		require.NoError(t, m.DeletePool(ctx, pool.ID, true))
+	})
+	t.Run("Defrag", func(t *testing.T) {
+		s := testStorage(t, "10.0.0.0/24")
+		a := allocator.New(s, allocator.WithLogger(zerolog.Nop()))
+		for _, requestID := range []string{"a", "b", "c", "d"} {
+			_, err := a.Allocate(ctx, cidr.IPv4, 26, requestID, allocator.WithLabels(map[string]string{"team": requestID}))
+			require.NoError(t, err)
+		}
+		for _, requestID := range []string{"b", "d"} {
+			_, err := a.Deallocate(ctx, requestID)
+			require.NoError(t, err)
+		}
+		plan, err := a.PlanDefrag(ctx, cidr.IPv4, 25)
+		require.NoError(t, err)
+		require.Len(t, plan.Moves, 1)
+		applied, err := a.ApplyDefrag(ctx, plan, allocator.WithMigrateFunc(func(ctx context.Context,
+			move allocator.DefragMove) error {
+			records, err := a.Lookup(ctx, move.RequestID)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []storage.Record{
+				{PoolID: 1, C: move.From, RequestID: "a", Labels: map[string]string{"team": "a"}},
+				{PoolID: 1, C: move.To, RequestID: "a", Labels: map[string]string{"team": "a"}, MovedFrom: &move.From},
+			}, records)
+			return nil
+		}))
+		require.NoError(t, err)
+		assert.Equal(t, plan.Moves, applied)
+		records, err := a.Lookup(ctx, "a")
+		require.NoError(t, err)
+		assert.Equal(t, []storage.Record{
+			{PoolID: 1, C: cidr.MustParseCIDR("10.0.0.192/26"), RequestID: "a", Labels: map[string]string{"team": "a"}},
+		}, records)
+		c, err := a.Allocate(ctx, cidr.IPv4, 25, "e")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.0/25", c.String())
+	})
+	t.Run("Hosts", func(t *testing.T) {
+		s := testStorageWithParams(t, "_busy_timeout=5000&_txlock=immediate", "10.0.0.0/24", "fd00::/64")
+		a := allocator.New(s, allocator.WithLogger(zerolog.Nop()))
+		subnet, err := a.Allocate(ctx, cidr.IPv4, 29, "subnet")
+		require.NoError(t, err)
+		require.NoError(t, a.EnableHosts(ctx, subnet))
+		for _, requestID := range []string{"vm1", "vm2", "vm3"} {
+			_, err := a.AllocateHost(ctx, subnet, requestID)
+			require.NoError(t, err)
+		}
+		ip, err := a.DeallocateHost(ctx, subnet, "vm2")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.3", ip.String())
+		ip, err = a.AllocateHost(ctx, subnet, "vm4")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.3", ip.String())
+		ip, err = a.LookupHost(ctx, subnet, "vm1")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.2", ip.String())
+		hosts, err := a.ListHosts(ctx, subnet)
+		require.NoError(t, err)
+		assert.Equal(t, []storage.Host{
+			{PoolID: 1, Subnet: subnet, IP: net.IP{10, 0, 0, 2}, RequestID: "vm1"},
+			{PoolID: 1, Subnet: subnet, IP: net.IP{10, 0, 0, 3}, RequestID: "vm4"},
+			{PoolID: 1, Subnet: subnet, IP: net.IP{10, 0, 0, 4}, RequestID: "vm3"},
+		}, hosts)
+
+		v6, err := a.Allocate(ctx, cidr.IPv6, 120, "v6")
+		require.NoError(t, err)
+		require.NoError(t, a.EnableHosts(ctx, v6, allocator.WithGateway(net.ParseIP("fd00::fe"))))
+		require.NoError(t, a.EnableHosts(ctx, v6, allocator.WithGateway(net.ParseIP("fd00::fe"))))
+		ip, err = a.AllocateHost(ctx, v6, "vm1")
+		require.NoError(t, err)
+		assert.Equal(t, "fd00::1", ip.String())
+		violations, err := allocator.NewPoolManager(s, allocator.WithLogger(zerolog.Nop())).Check(ctx, 1)
+		require.NoError(t, err)
+		assert.Empty(t, violations)
+
+		// Deallocating the subnet deletes its hosts, even though the database is opened without foreign keys.
+		_, err = a.Deallocate(ctx, "subnet")
+		require.NoError(t, err)
+		_, err = a.ListHosts(ctx, subnet)
+		assert.ErrorIs(t, err, allocator.ErrHostsNotEnabled)
+		events, err := a.HistoryOfRequest(ctx, "vm4")
+		require.NoError(t, err)
+		require.Len(t, events, 2)
+		assert.Equal(t, storage.EventReleaseHost, events[1].Type)
+		assert.Equal(t, "10.0.0.3/32", events[1].C.String())
+		subnet, err = a.Allocate(ctx, cidr.IPv4, 29, "subnet")
+		require.NoError(t, err)
+		require.NoError(t, a.EnableHosts(ctx, subnet))
+		ip, err = a.AllocateHost(ctx, subnet, "vm5")
+		require.NoError(t, err)
+		assert.Equal(t, "10.0.0.2", ip.String())
+		require.NoError(t, allocator.NewPoolManager(s, allocator.WithLogger(zerolog.Nop())).DeletePool(ctx, 1, true))
+	})
+	t.Run("Migrate", func(t *testing.T) {
+		dsn := "file:" + filepath.Join(t.TempDir(), "ipam.db") + "?_busy_timeout=5000&_txlock=immediate&_foreign_keys=on"
+		db, err := sql.Open("sqlite3", dsn)
+		require.NoError(t, err)
+		defer func() {
+			assert.NoError(t, db.Close())
+		}()
+		migrator, err := sqlite.NewMigrator(db, migrate.WithLogger(zerolog.Nop()))
+		require.NoError(t, err)
+		const parallelism = 4
+		var waitGroup sync.WaitGroup
+		var mu sync.Mutex
+		var applied []migrate.Migration
+		waitGroup.Add(parallelism)
+		for i := 0; i < parallelism; i++ {
+			go func() {
+				defer waitGroup.Done()
+				appliedNow, err := migrator.Up(ctx)
+				assert.NoError(t, err)
+				mu.Lock()
+				applied = append(applied, appliedNow...)
+				mu.Unlock()
+			}()
+		}
+		waitGroup.Wait()
+		statuses, err := migrator.Status(ctx)
+		require.NoError(t, err)
+		require.NotEmpty(t, statuses)
+		assert.Len(t, applied, len(statuses))
+		for _, status := range statuses {
+			assert.NotNil(t, status.AppliedAt)
+		}
+	})
+}
@@ -1,9 +1,12 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"net"
+	"strings"
+	"time"
 
 	"github.com/jbrekelmans/go-sql-ip-management/cidr"
 )
@@ -20,12 +23,235 @@ type Record struct {
 	RequestID string
 	// C is the CIDR notation for the range of IP addresses.
 	C cidr.CIDR
+	// Retired is true if this range is being removed from the pool.
+	// Retired ranges are never allocated, and become free retired ranges when deallocated.
+	Retired bool
+	// ExpiresAt is the time the lease of this range expires, after which the range may be deallocated.
+	// Nil if this range is free or allocated without a lease.
+	ExpiresAt *time.Time
+	// Labels are key-value metadata of the allocation, such as the owner of the object this range is allocated to.
+	// Nil if this range is free or allocated without labels.
+	Labels map[string]string
+	// MovedFrom is the range of IP addresses of the same size that the allocation is being moved from, which is
+	// allocated to RequestID as well until the move completes (see allocator.Allocator.ApplyDefrag).
+	// Nil if this range is free or not being moved to.
+	MovedFrom *cidr.CIDR
 }
 
 // DeepCopy returns a deep copy of r.
 func (r Record) DeepCopy() Record {
 	deepCopy := r
 	deepCopy.C.IP = append(net.IP(nil), deepCopy.C.IP...)
+	if r.ExpiresAt != nil {
+		expiresAt := *r.ExpiresAt
+		deepCopy.ExpiresAt = &expiresAt
+	}
+	if r.Labels != nil {
+		deepCopy.Labels = make(map[string]string, len(r.Labels))
+		for key, value := range r.Labels {
+			deepCopy.Labels[key] = value
+		}
+	}
+	if r.MovedFrom != nil {
+		movedFrom := *r.MovedFrom
+		movedFrom.IP = append(net.IP(nil), movedFrom.IP...)
+		deepCopy.MovedFrom = &movedFrom
+	}
+	return deepCopy
+}
+
+// HasLabels returns true if r has all labels of selector. Every record has all labels of an empty selector.
+func (r Record) HasLabels(selector map[string]string) bool {
+	for key, value := range selector {
+		if actualValue, ok := r.Labels[key]; !ok || actualValue != value {
+			return false
+		}
+	}
+	return true
+}
+
+// RecordState selects records by whether they are allocated.
+type RecordState int
+
+const (
+	// StateAny selects all records.
+	StateAny RecordState = iota
+	// StateAllocated selects the records that are allocated to an object.
+	StateAllocated
+	// StateFree selects the records that are not allocated to any object, including retired records.
+	StateFree
+)
+
+// RecordCount is the number of records of a pool that have the same address family, prefix length and state.
+type RecordCount struct {
+	Family     cidr.Family
+	PrefixBits int
+	Allocated  bool
+	Retired    bool
+	Count      int
+}
+
+// ListFilter selects records. The zero value selects all records.
+type ListFilter struct {
+	// Within selects the records contained in Within (including Within itself) if not nil.
+	Within *cidr.CIDR
+	// MinPrefixBits selects the records with a prefix length of at least MinPrefixBits.
+	MinPrefixBits int
+	// MaxPrefixBits selects the records with a prefix length of at most MaxPrefixBits, if MaxPrefixBits is positive.
+	MaxPrefixBits int
+	// RequestIDPrefix selects the records whose request ID starts with RequestIDPrefix, if not empty.
+	// Since free records have no request ID, a non-empty RequestIDPrefix only selects allocated records.
+	RequestIDPrefix string
+	State           RecordState
+	// Labels selects the records that have all labels of Labels (see Record.HasLabels).
+	// A non-empty Labels only selects allocated records.
+	Labels map[string]string
+}
+
+// Match returns true if r is selected by f.
+func (f ListFilter) Match(r Record) bool {
+	if f.Within != nil && !f.Within.Contains(r.C) {
+		return false
+	}
+	if r.C.PrefixBits < f.MinPrefixBits || (f.MaxPrefixBits > 0 && r.C.PrefixBits > f.MaxPrefixBits) {
+		return false
+	}
+	if f.RequestIDPrefix != "" && !strings.HasPrefix(r.RequestID, f.RequestIDPrefix) {
+		return false
+	}
+	switch f.State {
+	case StateAllocated:
+		if r.RequestID == "" {
+			return false
+		}
+	case StateFree:
+		if r.RequestID != "" {
+			return false
+		}
+	}
+	return r.HasLabels(f.Labels)
+}
+
+// CompareAddress compares the CIDRs a and b by IP address (IPv4 before IPv6), then by prefix length.
+// Returns a negative number if a < b, zero if a = b, and a positive number otherwise.
+// This is the order in which records are listed.
+func CompareAddress(a, b cidr.CIDR) int {
+	if len(a.IP) != len(b.IP) {
+		return len(a.IP) - len(b.IP)
+	}
+	if d := bytes.Compare(a.IP, b.IP); d != 0 {
+		return d
+	}
+	return a.PrefixBits - b.PrefixBits
+}
+
+// EventType is the type of an Event.
+type EventType string
+
+const (
+	// EventAllocate is the event of allocating a range to an object.
+	EventAllocate EventType = "allocate"
+	// EventRelease is the event of deallocating a range, either explicitly or because its lease expired.
+	EventRelease EventType = "release"
+	// EventSplit is the event of splitting a free range into smaller ranges.
+	EventSplit EventType = "split"
+	// EventMerge is the event of merging free ranges into a larger range.
+	EventMerge EventType = "merge"
+	// EventAllocateHost is the event of allocating a host address of a host subnet to an object.
+	EventAllocateHost EventType = "allocate_host"
+	// EventReleaseHost is the event of deallocating a host address of a host subnet.
+	EventReleaseHost EventType = "release_host"
+	// EventRetire is the event of retiring a range, so that it is not allocated again.
+	EventRetire EventType = "retire"
+	// EventRemove is the event of removing a range from its pool, because the range was retired or because an
+	// allocated range was deleted with its pool.
+	EventRemove EventType = "remove"
+)
+
+// IsWatched returns true if events of type t are sent to watchers (see Watcher), which is true for the events of
+// allocating, deallocating and removing ranges, and of allocating and deallocating host addresses.
+func (t EventType) IsWatched() bool {
+	return t == EventAllocate || t == EventRelease || t == EventRemove || t == EventAllocateHost || t == EventReleaseHost
+}
+
+// Event records a change to the ranges of IP addresses of a pool, for auditing.
+// Events are written in the same transaction as the change.
+type Event struct {
+	// ID is assigned when the event is inserted. Of the events of a pool, events committed later have greater IDs,
+	// so that the ID of the last event seen by a watcher is a position to resume watching from (see Watcher).
+	ID     int64
+	PoolID int
+	Time   time.Time
+	Type   EventType
+	// C is the range that was allocated or released, the range that was split, or the range resulting from a merge.
+	// For host events, C is the host address as a range of one IP address.
+	C cidr.CIDR
+	// RequestID is the request ID the range or host address was allocated to or released from.
+	// Empty for split and merge events.
+	RequestID string
+	// Actor identifies who caused the event, such as a user name. Empty if unknown.
+	Actor string
+}
+
+// EventFilter selects events. The zero value selects all events.
+type EventFilter struct {
+	// Overlapping selects the events whose range has at least one IP address in common with Overlapping, if not nil.
+	Overlapping *cidr.CIDR
+	// RequestID selects the events of RequestID, if not empty.
+	RequestID string
+}
+
+// Match returns true if e is selected by f.
+func (f EventFilter) Match(e Event) bool {
+	if f.Overlapping != nil && !f.Overlapping.Overlaps(e.C) {
+		return false
+	}
+	return f.RequestID == "" || e.RequestID == f.RequestID
+}
+
+// Pool is a named set of ranges of IP addresses to allocate from.
+type Pool struct {
+	ID   int
+	Name string
+}
+
+// HostSubnet is an allocated range of IP addresses from which individual host addresses are allocated.
+type HostSubnet struct {
+	PoolID int
+	// C is the range of IP addresses, which is a record of the pool.
+	C cidr.CIDR
+	// Gateway is the gateway address of the subnet, which is reserved. Nil if the subnet has no gateway.
+	Gateway net.IP
+	// Used is a bitmap of the addresses of C that are allocated or reserved. The i-th address of C is used if bit i is
+	// set, where bit 0 is the most significant bit of the first byte.
+	Used []byte
+}
+
+// DeepCopy returns a deep copy of s.
+func (s HostSubnet) DeepCopy() HostSubnet {
+	deepCopy := s
+	deepCopy.C.IP = append(net.IP(nil), s.C.IP...)
+	deepCopy.Gateway = append(net.IP(nil), s.Gateway...)
+	deepCopy.Used = append([]byte(nil), s.Used...)
+	return deepCopy
+}
+
+// Host is a host address allocated from a HostSubnet.
+type Host struct {
+	PoolID int
+	// Subnet is the range of IP addresses of the HostSubnet.
+	Subnet cidr.CIDR
+	// IP is the host address.
+	IP net.IP
+	// RequestID is a human-readable identifier of the object this address is allocated to.
+	RequestID string
+}
+
+// DeepCopy returns a deep copy of h.
+func (h Host) DeepCopy() Host {
+	deepCopy := h
+	deepCopy.Subnet.IP = append(net.IP(nil), h.Subnet.IP...)
+	deepCopy.IP = append(net.IP(nil), h.IP...)
 	return deepCopy
 }
 
@@ -38,25 +264,65 @@ type Storage interface {
 	BeginTransaction(ctx context.Context, txOpts *sql.TxOptions) (Transaction, error)
 }
 
+// RetryClassifier is optionally implemented by a Storage to declare which of its errors are transient,
+// such as transaction serialization failures caused by concurrent transactions.
+// Operations that fail with such errors may succeed when retried.
+type RetryClassifier interface {
+	// IsRetryable returns true if err is a transient error.
+	IsRetryable(err error) bool
+}
+
+// RetryClassifierFunc is an adapter to allow the use of ordinary functions as RetryClassifier.
+type RetryClassifierFunc func(err error) bool
+
+// IsRetryable calls f(err).
+func (f RetryClassifierFunc) IsRetryable(err error) bool {
+	return f(err)
+}
+
+// Watcher is optionally implemented by a Storage that can notify of committed events, so that watchers do not have
+// to poll.
+type Watcher interface {
+	// Watch calls handle with the watched events (see EventType.IsWatched) of the pool identified by poolID that have
+	// an ID greater than afterID, ordered by ID: first the events that are already committed, and then the events of
+	// transactions as they commit.
+	// Watch blocks until ctx is done or handle returns an error, and returns ctx.Err() or the error of handle.
+	Watch(ctx context.Context, poolID int, afterID int64, handle func(event Event) error) error
+}
+
 type Transaction interface {
 	// Commit the transaction.
 	Commit() error
 
-	// Delete deletes the specified record.
+	// CountRecords counts the records of the pool identified by poolID, grouped by address family, prefix length,
+	// whether they are allocated and whether they are retired. Groups without records are omitted.
+	// The groups are ordered by family (IPv4 first), then by prefix length, then by Allocated and Retired (false first).
+	CountRecords(ctx context.Context, poolID int) ([]RecordCount, error)
+
+	// Delete deletes the specified record, and its host subnet and hosts if any.
 	Delete(ctx context.Context, poolID int, c cidr.CIDR) error
 
-	// FindAllocated finds the record allocated to the object
-	// identified by requestID.
-	// If no such record exists then returns nil.
+	// DeleteHost deletes the host allocated to requestID from the host subnet of the pool identified by poolID
+	// and subnet.
+	DeleteHost(ctx context.Context, poolID int, subnet cidr.CIDR, requestID string) error
+
+	// DeletePool deletes the pool identified by poolID and all its records, roots, host subnets and hosts. The events
+	// and record versions of the pool are kept, and the ID of the pool is never used again (see MaxPoolID).
+	DeletePool(ctx context.Context, poolID int) error
+
+	// FindAllocated finds the records allocated to the object
+	// identified by requestID, ordered by address family (IPv4 first).
+	// If no such records exist then returns nil.
 	// If requestID is empty then returns an error.
-	// Since no two different records can have equal requestID,
-	// there is at most one such record.
-	FindAllocated(ctx context.Context, poolID int, requestID string) (*Record, error)
+	// Since no two different records of the same address family can have equal requestID,
+	// there is at most one such record per address family.
+	FindAllocated(ctx context.Context, poolID int, requestID string) ([]Record, error)
 
 	// FindSmallestFree finds records that:
-	// 1. are not allocated to any object;
-	// 2. have a range of IP addresses of at least a certain size; -and
-	// 3. are the records with the smallest range that satisfy 1 and 2.
+	// 1. are not allocated to any object and are not retired;
+	// 2. have a range of IP addresses of address family family;
+	// 3. have a range of IP addresses of at least a certain size; -and
+	// 4. are the records with the smallest range that satisfy 1, 2 and 3.
 	// If no such records exist then returns nil.
 	// Otherwise, returns an arbitrary such record.
 	//
@@ -69,16 +335,96 @@ type Transaction interface {
 	// which is the binary length of the (longest) common prefix of the range.
 	// This is equivalent to the number to the right of the slash in CIDR
 	// notation. For example, the size of 192.168.128.0/17 has prefixBits = 17.
-	FindSmallestFree(ctx context.Context, poolID, prefixBits int) (*Record, error)
+	FindSmallestFree(ctx context.Context, poolID int, family cidr.Family, prefixBits int) (*Record, error)
+
+	// FindExpired finds at most limit allocated records whose lease expired at or before now,
+	// ordered by the time the lease expired.
+	FindExpired(ctx context.Context, poolID int, now time.Time, limit int) ([]Record, error)
+
+	// FindOverlapping finds the records that have at least one IP address in common with c.
+	// That is, the record that contains c (if any), or the records that are contained in c.
+	// The records are ordered by IP address.
+	FindOverlapping(ctx context.Context, poolID int, c cidr.CIDR) ([]Record, error)
+
+	// FindHost finds the host allocated to requestID from the host subnet of the pool identified by poolID and subnet.
+	// Returns nil if no such host exists.
+	FindHost(ctx context.Context, poolID int, subnet cidr.CIDR, requestID string) (*Host, error)
 
 	Get(ctx context.Context, poolID int, c cidr.CIDR) (*Record, error)
 
+	// GetPool gets the pool identified by poolID.
+	// If no such pool exists, or it was deleted, then returns nil.
+	GetPool(ctx context.Context, poolID int) (*Pool, error)
+
+	// GetHostSubnet gets the host subnet of the pool identified by poolID and c.
+	// Returns nil if no such host subnet exists.
+	GetHostSubnet(ctx context.Context, poolID int, c cidr.CIDR) (*HostSubnet, error)
+
 	// InsertMany inserts multiple records.
 	InsertMany(ctx context.Context, records []Record) error
 
+	// InsertEvents inserts events. The ID of the events is ignored.
+	InsertEvents(ctx context.Context, events []Event) error
+
+	// InsertHost inserts a host. Its host subnet must exist, and no other host of the host subnet may be allocated to
+	// the same request ID or have the same address.
+	InsertHost(ctx context.Context, host Host) error
+
+	// InsertHostSubnet inserts a host subnet. Its range must be a record of the pool. Deleting the record deletes the
+	// host subnet and its hosts.
+	InsertHostSubnet(ctx context.Context, subnet HostSubnet) error
+
+	// InsertPool inserts a pool.
+	InsertPool(ctx context.Context, pool Pool) error
+
+	// ListHostSubnets lists the host subnets of the pool identified by poolID, ordered by address.
+	ListHostSubnets(ctx context.Context, poolID int) ([]HostSubnet, error)
+
+	// ListHosts lists the hosts of the host subnet of the pool identified by poolID and subnet, ordered by address.
+	ListHosts(ctx context.Context, poolID int, subnet cidr.CIDR) ([]Host, error)
+
+	// ListPools lists all pools that are not deleted, ordered by ID.
+	ListPools(ctx context.Context) ([]Pool, error)
+
+	// ListAllocations lists at most limit records of the pool identified by poolID that are selected by filter,
+	// ordered by address (see CompareAddress). If after is not nil then only records ordered after after are listed,
+	// so that the CIDR of the last listed record can be used as a cursor to list the next page.
+	// If limit is not positive then all such records are listed.
+	ListAllocations(ctx context.Context, poolID int, filter ListFilter, after *cidr.CIDR, limit int) ([]Record, error)
+
+	// ListEvents lists the events of the pool identified by poolID that are selected by filter, ordered by ID.
+	ListEvents(ctx context.Context, poolID int, filter EventFilter) ([]Event, error)
+
+	// ListRecords lists all records of the pool identified by poolID.
+	// The records are ordered by IP address, IPv4 before IPv6.
+	ListRecords(ctx context.Context, poolID int) ([]Record, error)
+
+	// ListRecordsAt lists the records of the pool identified by poolID as they were at time at, ordered like ListRecords.
+	//
+	// Every write of a record keeps the previous version of the record, stamped with the time of the transaction that
+	// replaced it. Transactions that overlap in time may therefore be reflected as if they happened in a different order.
+	// Records written before versions were kept are listed as of the time the schema migration added versioning.
+	ListRecordsAt(ctx context.Context, poolID int, at time.Time) ([]Record, error)
+
+	// ListRoots lists the root ranges of the pool identified by poolID (see SetRoots), ordered like ListRecords.
+	ListRoots(ctx context.Context, poolID int) ([]cidr.CIDR, error)
+
+	// MaxPoolID returns the highest ID of all pools, including deleted pools, or 0 if no pool was ever inserted.
+	MaxPoolID(ctx context.Context) (int, error)
+
 	// Rollback the transaction.
 	Rollback() error
 
+	// SetRoots replaces the root ranges of the pool identified by poolID. The roots of a pool are the ranges of IP
+	// addresses that the records of the pool tile. Storages do not check that roots do not overlap.
+	SetRoots(ctx context.Context, poolID int, roots []cidr.CIDR) error
+
 	// Update updates an existing record.
 	Update(ctx context.Context, record Record) error
+
+	// UpdateHostSubnet updates the bitmap of an existing host subnet.
+	UpdateHostSubnet(ctx context.Context, subnet HostSubnet) error
+
+	// UpdatePool updates an existing pool.
+	UpdatePool(ctx context.Context, pool Pool) error
 }